@@ -0,0 +1,627 @@
+// Package backends routes completions between several Ollama servers, such
+// as a desktop GPU reached over a VPN and the laptop's own Ollama, or a few
+// GPU boxes shared by a team. Each backend's round trip time is probed
+// periodically and its time to first token is observed from real
+// completions.
+package backends
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/events"
+)
+
+// ProbeInterval is how often Run measures each backend's round trip time.
+const ProbeInterval = 15 * time.Second
+
+// weight is how much a new sample moves a backend's moving averages.
+const weight = 0.3
+
+// BreakerThreshold is how many completions in a row must fail on a backend
+// before its circuit opens. An open circuit fails completions at once
+// instead of letting each wait for the backend, until a completion let
+// through after the cooldown or a probe succeeds.
+const BreakerThreshold = 3
+
+// BreakerCooldown is how long a circuit stays open at first. The cooldown
+// doubles each time the completion let through fails, up to
+// BreakerMaxCooldown.
+const (
+	BreakerCooldown    = time.Second
+	BreakerMaxCooldown = 30 * time.Second
+)
+
+// StickyTTL is how long completions with the same prompt head keep going
+// to the backend that last served one, and StickySize how many prompt heads
+// are remembered.
+const (
+	StickyTTL  = 5 * time.Minute
+	StickySize = 1000
+)
+
+// Strategy is how a Pool spreads completions over its healthy backends.
+type Strategy string
+
+const (
+	// Latency sends every completion to the fastest backend.
+	Latency Strategy = "latency"
+	// RoundRobin sends completions to each backend in turn.
+	RoundRobin Strategy = "round-robin"
+	// LeastLoaded sends completions to the backend generating the fewest,
+	// the fastest one among equals.
+	LeastLoaded Strategy = "least-loaded"
+)
+
+// Strategies are the valid strategies.
+var Strategies = []Strategy{Latency, RoundRobin, LeastLoaded}
+
+// Backend is one Ollama server.
+type Backend struct {
+	Name string
+	URL  *url.URL
+
+	mu        sync.Mutex
+	rtt       time.Duration
+	ttft      time.Duration
+	healthy   bool
+	err       error
+	lastErr   error
+	lastErrAt time.Time
+	inFlight  int
+	models    []string
+
+	// failures counts the completions failed in a row. The circuit is
+	// open with failures at BreakerThreshold, until openUntil.
+	failures  int
+	openUntil time.Time
+	cooldown  time.Duration
+}
+
+// Stats is a snapshot of a backend's measurements.
+type Stats struct {
+	Name    string        `json:"name"`
+	URL     string        `json:"url"`
+	RTT     time.Duration `json:"rtt"`
+	TTFT    time.Duration `json:"ttft"`
+	Healthy bool          `json:"healthy"`
+	Pinned  bool          `json:"pinned"`
+	Error   string        `json:"error,omitempty"`
+	// LastError is the most recent failure, kept after the backend
+	// recovers.
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitzero"`
+	// InFlight counts the completions the backend is generating.
+	InFlight int `json:"in_flight"`
+	// CircuitOpen is set while completions fail fast instead of being
+	// sent to the backend.
+	CircuitOpen bool `json:"circuit_open"`
+	// Models are the models loaded in the backend's memory at the last
+	// probe.
+	Models []string `json:"models"`
+}
+
+// ObserveTTFT records the time to first token of a completion the backend
+// served.
+func (b *Backend) ObserveTTFT(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ttft = average(b.ttft, d)
+}
+
+// Start counts a completion the backend generates until done is called.
+func (b *Backend) Start() (done func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inFlight++
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.inFlight--
+	}
+}
+
+// Fail marks the backend unhealthy until the next successful probe or
+// completion, and counts the failure towards opening its circuit.
+func (b *Backend) Fail(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.setHealth(err)
+	if b.failures++; b.failures >= BreakerThreshold {
+		b.failures = BreakerThreshold
+		b.cooldown = min(max(b.cooldown*2, BreakerCooldown), BreakerMaxCooldown)
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// Succeed records a completion the backend served, which marks it healthy
+// and closes its circuit.
+func (b *Backend) Succeed() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.setHealth(nil)
+}
+
+// Allow reports whether a completion may be sent to the backend. While the
+// circuit is open it is not. Once the cooldown is over, one completion is
+// let through to find out whether the backend is back, and the others keep
+// failing fast until it ends.
+func (b *Backend) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < BreakerThreshold {
+		return true
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false
+	}
+	b.openUntil = now.Add(b.cooldown)
+	return true
+}
+
+func (b *Backend) observeProbe(rtt time.Duration, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.setHealth(err)
+	if err == nil {
+		b.rtt = average(b.rtt, rtt)
+	}
+}
+
+// setHealth records the outcome of a request to the backend, publishing an
+// event when the backend goes down or comes back. Success closes the
+// circuit. b.mu must be held.
+func (b *Backend) setHealth(err error) {
+	if err == nil {
+		b.failures, b.cooldown, b.openUntil = 0, 0, time.Time{}
+	}
+	switch healthy := err == nil; {
+	case b.healthy && !healthy:
+		events.Publish(events.BackendFailed, events.Fields{"backend": b.Name, "error": err.Error()})
+	case !b.healthy && healthy:
+		events.Publish(events.BackendRecovered, events.Fields{"backend": b.Name})
+	}
+	b.healthy, b.err = err == nil, err
+	if err != nil {
+		b.lastErr, b.lastErrAt = err, time.Now()
+	}
+}
+
+// score orders healthy backends: lower is faster. Time to first token is
+// what users feel, so it wins over round trip time once it is known.
+func (b *Backend) score() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ttft > 0 {
+		return b.ttft, b.healthy
+	}
+	return b.rtt, b.healthy
+}
+
+func (b *Backend) stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := Stats{
+		Name:        b.Name,
+		URL:         b.URL.String(),
+		RTT:         b.rtt,
+		TTFT:        b.ttft,
+		Healthy:     b.healthy,
+		LastErrorAt: b.lastErrAt,
+		InFlight:    b.inFlight,
+		CircuitOpen: b.failures >= BreakerThreshold,
+		Models:      append([]string{}, b.models...),
+	}
+	if b.err != nil {
+		s.Error = b.err.Error()
+	}
+	if b.lastErr != nil {
+		s.LastError = b.lastErr.Error()
+	}
+	return s
+}
+
+func average(avg, sample time.Duration) time.Duration {
+	if avg == 0 {
+		return sample
+	}
+	return time.Duration(weight*float64(sample) + (1-weight)*float64(avg))
+}
+
+// Pool picks the backend for each completion.
+type Pool struct {
+	backends []*Backend
+	http     *http.Client
+	// next is the turn of RoundRobin.
+	next atomic.Uint64
+
+	mu       sync.RWMutex
+	pinned   string
+	strategy Strategy
+
+	stickyMu sync.Mutex
+	// sticky maps prompt heads to the backend that last served them, with
+	// heads in the order they were last served.
+	sticky     map[string]stickyRoute
+	stickyKeys []string
+}
+
+type stickyRoute struct {
+	backend *Backend
+	at      time.Time
+}
+
+// New creates a Pool from backend names and addresses. Addresses take the
+// same form as OLLAMA_HOST: [scheme://]host[:port]. Backends are considered
+// healthy until a probe or completion fails. Changes in health are
+// published as events.
+func New(addresses map[string]string) (*Pool, error) {
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no backends configured")
+	}
+
+	names := make([]string, 0, len(addresses))
+	for name := range addresses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	p := &Pool{http: &http.Client{Timeout: 5 * time.Second}, strategy: Latency, sticky: map[string]stickyRoute{}}
+	for _, name := range names {
+		u, err := ParseAddress(addresses[name])
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %w", name, err)
+		}
+		p.backends = append(p.backends, &Backend{Name: name, URL: u, healthy: true})
+	}
+	return p, nil
+}
+
+// ParseAddress parses an Ollama address of the form [scheme://]host[:port],
+// defaulting to http and port 11434.
+func ParseAddress(address string) (*url.URL, error) {
+	scheme, hostport, ok := strings.Cut(address, "://")
+	if !ok {
+		scheme, hostport = "http", address
+	}
+	if scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q in %q", scheme, address)
+	}
+	hostport = strings.TrimRight(hostport, "/")
+	if hostport == "" {
+		return nil, fmt.Errorf("missing host in %q", address)
+	}
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		hostport = net.JoinHostPort(strings.Trim(hostport, "[]"), "11434")
+	}
+	return &url.URL{Scheme: scheme, Host: hostport}, nil
+}
+
+// Pin sends every completion to the backend called name, whatever its
+// health. An empty name unpins.
+func (p *Pool) Pin(name string) error {
+	if name != "" && p.lookup(name) == nil {
+		return fmt.Errorf("unknown backend %q", name)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pinned = name
+	return nil
+}
+
+// Pinned returns the name of the pinned backend, or "".
+func (p *Pool) Pinned() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.pinned
+}
+
+// SetStrategy changes how completions are spread over the backends. An
+// empty strategy is Latency.
+func (p *Pool) SetStrategy(s Strategy) error {
+	if s == "" {
+		s = Latency
+	}
+	if !slices.Contains(Strategies, s) {
+		return fmt.Errorf("unknown strategy %q", s)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.strategy = s
+	return nil
+}
+
+// Strategy returns how completions are spread over the backends.
+func (p *Pool) Strategy() Strategy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.strategy
+}
+
+// Pick returns the pinned backend, or else a healthy backend chosen by the
+// strategy. When none is healthy the first is returned so the error reaches
+// the client.
+func (p *Pool) Pick() *Backend {
+	if b := p.lookup(p.Pinned()); b != nil {
+		return b
+	}
+	if b := p.pick(nil); b != nil {
+		return b
+	}
+	return p.backends[0]
+}
+
+// Sticky returns the backend that served a completion with the prompt head
+// key in the last StickyTTL, while it is healthy, or nil. Ollama reuses the
+// KV cache of a prompt that starts as the previous one did, and completions
+// typed in the same file have the same head, so sending them to the same
+// backend saves evaluating the prompt again. A pinned backend wins.
+func (p *Pool) Sticky(key string) *Backend {
+	if p.Pinned() != "" {
+		return nil
+	}
+	p.stickyMu.Lock()
+	route, ok := p.sticky[key]
+	p.stickyMu.Unlock()
+	if !ok || time.Since(route.at) > StickyTTL {
+		return nil
+	}
+	if _, healthy := route.backend.score(); !healthy {
+		return nil
+	}
+	return route.backend
+}
+
+// Stick records that b served a completion with the prompt head key.
+func (p *Pool) Stick(key string, b *Backend) {
+	p.stickyMu.Lock()
+	defer p.stickyMu.Unlock()
+	if _, ok := p.sticky[key]; ok {
+		p.stickyKeys = slices.DeleteFunc(p.stickyKeys, func(k string) bool { return k == key })
+	}
+	p.sticky[key] = stickyRoute{backend: b, at: time.Now()}
+	p.stickyKeys = append(p.stickyKeys, key)
+	if len(p.stickyKeys) > StickySize {
+		delete(p.sticky, p.stickyKeys[0])
+		p.stickyKeys = p.stickyKeys[1:]
+	}
+}
+
+// Failover returns a healthy backend other than those tried, for a
+// completion the tried backends failed, or nil when there is none. A pinned
+// backend does not fail over.
+func (p *Pool) Failover(tried ...*Backend) *Backend {
+	if p.Pinned() != "" {
+		return nil
+	}
+	return p.pick(tried)
+}
+
+// CanFailover reports whether Failover would find a backend other than
+// those tried, without taking a turn of RoundRobin.
+func (p *Pool) CanFailover(tried ...*Backend) bool {
+	return p.Pinned() == "" && len(p.candidates(tried)) > 0
+}
+
+// candidate is a healthy backend pick chooses from.
+type candidate struct {
+	backend  *Backend
+	score    time.Duration
+	inFlight int
+}
+
+// pick returns the healthy backend the strategy chooses among those not in
+// skip, or nil.
+func (p *Pool) pick(skip []*Backend) *Backend {
+	candidates := p.candidates(skip)
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch p.Strategy() {
+	case RoundRobin:
+		return candidates[(p.next.Add(1)-1)%uint64(len(candidates))].backend
+	case LeastLoaded:
+		return slices.MinFunc(candidates, func(a, b candidate) int {
+			return cmp.Or(cmp.Compare(a.inFlight, b.inFlight), cmp.Compare(a.score, b.score))
+		}).backend
+	default:
+		return slices.MinFunc(candidates, func(a, b candidate) int { return cmp.Compare(a.score, b.score) }).backend
+	}
+}
+
+// candidates returns the healthy backends not in skip.
+func (p *Pool) candidates(skip []*Backend) []candidate {
+	var candidates []candidate
+	for _, b := range p.backends {
+		if slices.Contains(skip, b) {
+			continue
+		}
+		if score, healthy := b.score(); healthy {
+			b.mu.Lock()
+			inFlight := b.inFlight
+			b.mu.Unlock()
+			candidates = append(candidates, candidate{b, score, inFlight})
+		}
+	}
+	return candidates
+}
+
+// Backends returns the backends of the pool, by name.
+func (p *Pool) Backends() []*Backend {
+	return slices.Clone(p.backends)
+}
+
+// Stats returns the measurements of every backend.
+func (p *Pool) Stats() []Stats {
+	pinned := p.Pinned()
+	stats := make([]Stats, len(p.backends))
+	for i, b := range p.backends {
+		stats[i] = b.stats()
+		stats[i].Pinned = b.Name == pinned
+	}
+	return stats
+}
+
+// Probe measures the round trip time of every backend with Ollama's
+// heartbeat endpoint, and lists the models each one has loaded.
+func (p *Pool) Probe(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, b := range p.backends {
+		wg.Add(1)
+		go func(b *Backend) {
+			defer wg.Done()
+			rtt, err := p.probe(ctx, b)
+			b.observeProbe(rtt, err)
+			if err != nil {
+				return
+			}
+			if models, err := p.loadedModels(ctx, b); err == nil {
+				b.setModels(models)
+			}
+		}(b)
+	}
+	wg.Wait()
+}
+
+func (b *Backend) setModels(models []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.models = models
+}
+
+// loadedModels lists the models in the backend's memory with Ollama's
+// /api/ps. Servers too old to have it report none.
+func (p *Pool) loadedModels(ctx context.Context, b *Backend) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.URL.String()+"/api/ps", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+
+	var running struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&running); err != nil {
+		return nil, err
+	}
+	models := make([]string, 0, len(running.Models))
+	for _, m := range running.Models {
+		models = append(models, m.Name)
+	}
+	return models, nil
+}
+
+func (p *Pool) probe(ctx context.Context, b *Backend) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, b.URL.String()+"/", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return 0, fmt.Errorf("status %s", resp.Status)
+	}
+	return time.Since(start), nil
+}
+
+// Run probes the backends every ProbeInterval, or every BreakerCooldown
+// while a circuit is open. It blocks and is meant to run in its own
+// goroutine.
+func (p *Pool) Run() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), ProbeInterval)
+		p.Probe(ctx)
+		cancel()
+		// Backends with an open circuit are probed every cooldown, so that
+		// completions resume soon after they come back.
+		if p.anyOpen() {
+			time.Sleep(BreakerCooldown)
+		} else {
+			time.Sleep(ProbeInterval)
+		}
+	}
+}
+
+// anyOpen reports whether the circuit of a backend is open.
+func (p *Pool) anyOpen() bool {
+	for _, b := range p.backends {
+		b.mu.Lock()
+		open := b.failures >= BreakerThreshold
+		b.mu.Unlock()
+		if open {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Pool) lookup(name string) *Backend {
+	for _, b := range p.backends {
+		if b.Name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+type backendKey struct{}
+
+// WithBackend returns a context whose Ollama requests Transport sends to b.
+func WithBackend(ctx context.Context, b *Backend) context.Context {
+	return context.WithValue(ctx, backendKey{}, b)
+}
+
+// Transport sends requests made with a WithBackend context to that backend.
+// The Ollama client has a fixed base URL, so this is how a request reaches
+// the backend picked for it.
+type Transport struct {
+	Base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	b, ok := req.Context().Value(backendKey{}).(*Backend)
+	if !ok {
+		return base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = b.URL.Scheme, b.URL.Host
+	req.Host = b.URL.Host
+	return base.RoundTrip(req)
+}
@@ -0,0 +1,292 @@
+package backends_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/backends"
+)
+
+// fakeBackend starts a server that answers after delay and counts the
+// requests it receives.
+func fakeBackend(t *testing.T, delay time.Duration, requests *int) string {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests != nil && r.Method != http.MethodHead {
+			*requests++
+		}
+		time.Sleep(delay)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestParseAddress(t *testing.T) {
+	tests := map[string]string{
+		"gpu.tailnet":           "http://gpu.tailnet:11434",
+		"10.0.0.2:8080":         "http://10.0.0.2:8080",
+		"https://ollama.local/": "https://ollama.local:11434",
+		"[::1]":                 "http://[::1]:11434",
+	}
+	for address, want := range tests {
+		u, err := backends.ParseAddress(address)
+		if err != nil {
+			t.Errorf("expected %q to parse, got %v", address, err)
+			continue
+		}
+		if u.String() != want {
+			t.Errorf("expected %q to parse as %q, got %q", address, want, u.String())
+		}
+	}
+
+	if _, err := backends.ParseAddress("ftp://host"); err == nil {
+		t.Error("expected an unsupported scheme to be rejected")
+	}
+}
+
+func TestPool_PicksLowestLatency(t *testing.T) {
+	pool, err := backends.New(map[string]string{
+		"desktop": fakeBackend(t, 50*time.Millisecond, nil),
+		"laptop":  fakeBackend(t, 0, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool.Probe(context.Background())
+	if got := pool.Pick().Name; got != "laptop" {
+		t.Errorf("expected the backend with the lowest round trip time, got %s", got)
+	}
+
+	// Time to first token is what users feel, so it wins once known.
+	pool.Pick().ObserveTTFT(2 * time.Second)
+	if got := pool.Pick().Name; got != "desktop" {
+		t.Errorf("expected the backend without a slow TTFT, got %s", got)
+	}
+}
+
+func TestPool_SkipsFailedBackends(t *testing.T) {
+	pool, err := backends.New(map[string]string{
+		"a": fakeBackend(t, 0, nil),
+		"b": fakeBackend(t, 0, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := pool.Pick()
+	first.Fail(errors.New("connection refused"))
+	if got := pool.Pick(); got == first {
+		t.Errorf("expected a failed backend to be skipped, got %s", got.Name)
+	}
+
+	pool.Probe(context.Background())
+	for _, s := range pool.Stats() {
+		if !s.Healthy {
+			t.Errorf("expected %s to be healthy after a successful probe", s.Name)
+		}
+	}
+}
+
+func TestPool_Pin(t *testing.T) {
+	pool, err := backends.New(map[string]string{
+		"desktop": fakeBackend(t, 50*time.Millisecond, nil),
+		"laptop":  fakeBackend(t, 0, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Probe(context.Background())
+
+	if err := pool.Pin("desktop"); err != nil {
+		t.Fatal(err)
+	}
+	if got := pool.Pick().Name; got != "desktop" {
+		t.Errorf("expected the pinned backend, got %s", got)
+	}
+	if err := pool.Pin("missing"); err == nil {
+		t.Error("expected pinning an unknown backend to fail")
+	}
+
+	if err := pool.Pin(""); err != nil {
+		t.Fatal(err)
+	}
+	if got := pool.Pick().Name; got != "laptop" {
+		t.Errorf("expected unpinning to restore latency routing, got %s", got)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var requests int
+	pool, err := backends.New(map[string]string{"remote": fakeBackend(t, 0, &requests)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: &backends.Transport{}}
+	ctx := backends.WithBackend(context.Background(), pool.Pick())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://127.0.0.1:1/api/generate", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("expected the request to reach the backend, got %v", err)
+	}
+	resp.Body.Close()
+
+	if requests != 1 {
+		t.Errorf("expected 1 request on the backend, got %d", requests)
+	}
+}
+
+func TestPool_Stats(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/ps" {
+			_, _ = w.Write([]byte(`{"models":[{"name":"qwen2.5-coder:7b"}]}`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	pool, err := backends.New(map[string]string{"gpu": srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := pool.Pick()
+	done := b.Start()
+	b.Fail(errors.New("connection refused"))
+	pool.Probe(context.Background())
+
+	stats := pool.Stats()[0]
+	if stats.InFlight != 1 {
+		t.Errorf("expected 1 completion in flight, got %d", stats.InFlight)
+	}
+	if !stats.Healthy || stats.Error != "" {
+		t.Errorf("expected the backend to recover after a successful probe, got %+v", stats)
+	}
+	if stats.LastError != "connection refused" || stats.LastErrorAt.IsZero() {
+		t.Errorf("expected the last error to be kept after recovering, got %+v", stats)
+	}
+	if len(stats.Models) != 1 || stats.Models[0] != "qwen2.5-coder:7b" {
+		t.Errorf("expected the loaded models, got %q", stats.Models)
+	}
+
+	done()
+	if got := pool.Stats()[0].InFlight; got != 0 {
+		t.Errorf("expected no completion in flight, got %d", got)
+	}
+}
+
+func TestBackend_Breaker(t *testing.T) {
+	pool, err := backends.New(map[string]string{"gpu": fakeBackend(t, 0, nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := pool.Pick()
+
+	for i := 1; i < backends.BreakerThreshold; i++ {
+		b.Fail(errors.New("connection refused"))
+	}
+	if !b.Allow() {
+		t.Fatal("expected the circuit to stay closed below the threshold")
+	}
+	b.Fail(errors.New("connection refused"))
+	if b.Allow() {
+		t.Fatal("expected the circuit to open at the threshold")
+	}
+	if !pool.Stats()[0].CircuitOpen {
+		t.Error("expected the stats to show the open circuit")
+	}
+
+	time.Sleep(backends.BreakerCooldown)
+	if !b.Allow() {
+		t.Fatal("expected one completion to be let through after the cooldown")
+	}
+	if b.Allow() {
+		t.Error("expected the others to keep failing fast")
+	}
+
+	b.Succeed()
+	if !b.Allow() || pool.Stats()[0].CircuitOpen {
+		t.Error("expected a success to close the circuit")
+	}
+}
+
+func TestPool_Strategies(t *testing.T) {
+	pool, err := backends.New(map[string]string{"a": "127.0.0.1:1", "b": "127.0.0.1:2", "c": "127.0.0.1:3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.SetStrategy("random"); err == nil {
+		t.Error("expected an unknown strategy to be refused")
+	}
+
+	if err := pool.SetStrategy(backends.RoundRobin); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for range 4 {
+		names = append(names, pool.Pick().Name)
+	}
+	if got := strings.Join(names, ","); got != "a,b,c,a" {
+		t.Errorf("expected the backends in turn, got %s", got)
+	}
+	if !pool.CanFailover(pool.Pick()) || pool.Pick().Name != "c" {
+		t.Error("expected a failover check not to take a turn")
+	}
+
+	if err := pool.SetStrategy(backends.LeastLoaded); err != nil {
+		t.Fatal(err)
+	}
+	first := pool.Pick()
+	defer first.Start()()
+	second := pool.Pick()
+	defer second.Start()()
+	if first == second {
+		t.Errorf("expected a busy backend to be passed over, got %s twice", first.Name)
+	}
+
+	if picked, got := pool.Pick(), pool.Failover(pool.Pick()); got == nil || got == picked {
+		t.Errorf("expected another backend than %s to fail over to, got %v", picked.Name, got)
+	}
+	if err := pool.Pin("a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := pool.Failover(pool.Pick()); got != nil {
+		t.Errorf("expected a pinned backend not to fail over, got %s", got.Name)
+	}
+}
+
+func TestPool_Sticky(t *testing.T) {
+	pool, err := backends.New(map[string]string{"a": "127.0.0.1:1", "b": "127.0.0.1:2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pool.Sticky("head"); got != nil {
+		t.Errorf("expected no backend for an unknown prompt head, got %s", got.Name)
+	}
+
+	b := pool.Failover(pool.Pick())
+	pool.Stick("head", b)
+	if got := pool.Sticky("head"); got != b {
+		t.Errorf("expected the backend that served the prompt head, got %v", got)
+	}
+
+	b.Fail(errors.New("connection refused"))
+	if got := pool.Sticky("head"); got != nil {
+		t.Errorf("expected an unhealthy backend not to be stuck to, got %s", got.Name)
+	}
+	b.Succeed()
+	if err := pool.Pin("a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := pool.Sticky("head"); got != nil {
+		t.Errorf("expected the pinned backend to win, got %s", got.Name)
+	}
+}
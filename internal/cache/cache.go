@@ -0,0 +1,249 @@
+// Package cache keeps recent completions in memory. Editors resend nearly
+// identical requests as the user types, and a cached completion is served
+// without asking Ollama to redo the same work.
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/storage"
+)
+
+// bucket is the storage bucket of the cached completions.
+const bucket = "completion_cache"
+
+// Hit is a completion served from the cache.
+type Hit struct {
+	Text  string
+	Model string
+	// Extension is set when the request's prefix extends a cached one with
+	// text the cached completion starts with, and Text is the rest of it.
+	Extension bool
+}
+
+// Stats counts the cache's lookups.
+type Stats struct {
+	Entries    int
+	Hits       int
+	Extensions int
+	Misses     int
+}
+
+type entry struct {
+	Scope   string    `json:"scope"`
+	Prefix  string    `json:"prefix"`
+	Suffix  string    `json:"suffix"`
+	Text    string    `json:"text"`
+	Model   string    `json:"model"`
+	Expires time.Time `json:"expires"`
+}
+
+// Cache is a least recently used cache of completions, safe for concurrent
+// use. Completions are looked up by a scope, such as the model, system
+// prompt and options, and the text before and after the cursor. A nil Cache
+// caches nothing.
+type Cache struct {
+	size int
+	ttl  time.Duration
+
+	mu    sync.Mutex
+	lru   *list.List
+	index map[string]*list.Element
+	stats Stats
+	// store, when set, keeps the cached completions across restarts.
+	store storage.Storage
+	// shared is store when other servers use it too. Their completions are
+	// then looked up in it, and completions left out of this cache stay
+	// there until they expire.
+	shared storage.Shared
+}
+
+// New returns a cache of at most size completions, each kept for ttl.
+func New(size int, ttl time.Duration) *Cache {
+	return &Cache{size: size, ttl: ttl, lru: list.New(), index: map[string]*list.Element{}}
+}
+
+func key(scope, prefix, suffix string) string {
+	return scope + "\x00" + prefix + "\x00" + suffix
+}
+
+// storeKey is the storage key of the completion cached under k, hashed to
+// keep long prompts out of the keys.
+func storeKey(k string) string {
+	sum := sha256.Sum256([]byte(k))
+	return hex.EncodeToString(sum[:])
+}
+
+// Store keeps the cached completions in s as well, and loads the ones s
+// kept that have not expired, most recently cached first. Writes to s that
+// fail lose the completions across restarts only. When s is shared, the
+// completions other servers cached are served too.
+func (c *Cache) Store(s storage.Storage) error {
+	if c == nil {
+		return nil
+	}
+	var entries []*entry
+	now := time.Now()
+	err := s.Each(bucket, func(k string, value []byte) error {
+		var e entry
+		if err := json.Unmarshal(value, &e); err != nil || !now.Before(e.Expires) {
+			return s.Delete(bucket, k)
+		}
+		entries = append(entries, &e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(entries, func(a, b *entry) int { return a.Expires.Compare(b.Expires) })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store = s
+	c.shared, _ = s.(storage.Shared)
+	for _, e := range entries {
+		k := key(e.Scope, e.Prefix, e.Suffix)
+		if el, ok := c.index[k]; ok {
+			c.lru.Remove(el)
+		}
+		c.index[k] = c.lru.PushFront(e)
+	}
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+	return nil
+}
+
+// Get returns the completion cached for exactly prefix and suffix. Failing
+// that, it returns the rest of a completion whose prefix the user has since
+// typed further into, as long as what was typed matches the completion.
+func (c *Cache) Get(scope, prefix, suffix string) (Hit, bool) {
+	if c == nil {
+		return Hit{}, false
+	}
+	k := key(scope, prefix, suffix)
+	now := time.Now()
+	c.mu.Lock()
+	if el, ok := c.index[k]; ok {
+		e := el.Value.(*entry)
+		if now.Before(e.Expires) {
+			c.lru.MoveToFront(el)
+			c.stats.Hits++
+			c.mu.Unlock()
+			return Hit{Text: e.Text, Model: e.Model}, true
+		}
+		c.remove(el)
+	}
+	shared := c.shared
+	c.mu.Unlock()
+
+	// The shared storage is asked without holding the lock, which other
+	// lookups would wait for.
+	if e, ok := fetch(shared, k, now); ok {
+		c.mu.Lock()
+		c.add(k, e)
+		c.stats.Hits++
+		c.mu.Unlock()
+		return Hit{Text: e.Text, Model: e.Model}, true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*entry)
+		if e.Scope != scope || e.Suffix != suffix || len(e.Prefix) >= len(prefix) || !now.Before(e.Expires) {
+			continue
+		}
+		typed, ok := strings.CutPrefix(prefix, e.Prefix)
+		if !ok || !strings.HasPrefix(e.Text, typed) || len(e.Text) == len(typed) {
+			continue
+		}
+		c.lru.MoveToFront(el)
+		c.stats.Extensions++
+		return Hit{Text: e.Text[len(typed):], Model: e.Model, Extension: true}, true
+	}
+
+	c.stats.Misses++
+	return Hit{}, false
+}
+
+// Put caches the completion text model generated for prefix and suffix,
+// evicting the least recently used completion when the cache is full.
+func (c *Cache) Put(scope, prefix, suffix, text, model string) {
+	if c == nil || c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := key(scope, prefix, suffix)
+	e := &entry{Scope: scope, Prefix: prefix, Suffix: suffix, Text: text, Model: model, Expires: time.Now().Add(c.ttl)}
+	c.add(k, e)
+	if value, err := json.Marshal(e); err == nil {
+		switch {
+		case c.shared != nil:
+			_ = c.shared.PutExpiring(bucket, storeKey(k), value, c.ttl)
+		case c.store != nil:
+			_ = c.store.Put(bucket, storeKey(k), value)
+		}
+	}
+}
+
+// add caches e under k, replacing what was cached there, and evicts the
+// least recently used completions beyond the size of the cache.
+func (c *Cache) add(k string, e *entry) {
+	if el, ok := c.index[k]; ok {
+		c.remove(el)
+	}
+	c.index[k] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// fetch returns the completion another server cached under k in shared,
+// unless it expired by now.
+func fetch(shared storage.Shared, k string, now time.Time) (*entry, bool) {
+	if shared == nil {
+		return nil, false
+	}
+	value, ok, err := shared.Get(bucket, storeKey(k))
+	if err != nil || !ok {
+		return nil, false
+	}
+	var e entry
+	if err := json.Unmarshal(value, &e); err != nil || key(e.Scope, e.Prefix, e.Suffix) != k || !now.Before(e.Expires) {
+		return nil, false
+	}
+	return &e, true
+}
+
+// Stats returns the number of cached completions and lookups so far.
+func (c *Cache) Stats() Stats {
+	if c == nil {
+		return Stats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+func (c *Cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*entry)
+	k := key(e.Scope, e.Prefix, e.Suffix)
+	delete(c.index, k)
+	if c.store != nil && c.shared == nil {
+		_ = c.store.Delete(bucket, storeKey(k))
+	}
+}
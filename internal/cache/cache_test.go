@@ -0,0 +1,137 @@
+package cache_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/cache"
+	"github.com/josuemontano/ollama-copilot/internal/redistest"
+	"github.com/josuemontano/ollama-copilot/internal/storage"
+)
+
+func TestCache_Get(t *testing.T) {
+	c := cache.New(10, time.Minute)
+	c.Put("scope", "x := ", "\n", "compute(a, b)", "model")
+
+	if hit, ok := c.Get("scope", "x := ", "\n"); !ok || hit.Text != "compute(a, b)" || hit.Model != "model" || hit.Extension {
+		t.Errorf("expected an exact hit, got %+v, %v", hit, ok)
+	}
+	if hit, ok := c.Get("scope", "x := comp", "\n"); !ok || hit.Text != "ute(a, b)" || !hit.Extension {
+		t.Errorf("expected the rest of the completion, got %+v, %v", hit, ok)
+	}
+
+	misses := []struct{ scope, prefix, suffix string }{
+		{"other", "x := ", "\n"},
+		{"scope", "x := ", "\n}"},
+		{"scope", "x := y", "\n"},
+		{"scope", "x := compute(a, b)", "\n"},
+	}
+	for _, m := range misses {
+		if hit, ok := c.Get(m.scope, m.prefix, m.suffix); ok {
+			t.Errorf("expected a miss for %+v, got %+v", m, hit)
+		}
+	}
+
+	if stats := c.Stats(); stats.Entries != 1 || stats.Hits != 1 || stats.Extensions != 1 || stats.Misses != len(misses) {
+		t.Errorf("expected 1 entry, 1 hit, 1 extension and %d misses, got %+v", len(misses), stats)
+	}
+}
+
+func TestCache_Evicts(t *testing.T) {
+	c := cache.New(2, time.Minute)
+	c.Put("s", "a", "", "1", "m")
+	c.Put("s", "b", "", "2", "m")
+	c.Get("s", "a", "")
+	c.Put("s", "c", "", "3", "m")
+
+	if _, ok := c.Get("s", "b", ""); ok {
+		t.Error("expected the least recently used completion to be evicted")
+	}
+	if _, ok := c.Get("s", "a", ""); !ok {
+		t.Error("expected a recently used completion to be kept")
+	}
+}
+
+func TestCache_Expires(t *testing.T) {
+	c := cache.New(2, time.Millisecond)
+	c.Put("s", "a", "", "1", "m")
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := c.Get("s", "a", ""); ok {
+		t.Error("expected an expired completion to be a miss")
+	}
+	if _, ok := c.Get("s", "", ""); ok {
+		t.Error("expected an expired completion not to be extended")
+	}
+}
+
+func TestCache_Store(t *testing.T) {
+	store := storage.NewMemory()
+	c := cache.New(2, time.Minute)
+	if err := c.Store(store); err != nil {
+		t.Fatal(err)
+	}
+	c.Put("s", "a", "", "1", "m")
+	c.Put("s", "b", "", "2", "m")
+	c.Put("s", "c", "", "3", "m")
+
+	// A restarted server gets the completions the first one kept.
+	restarted := cache.New(2, time.Minute)
+	if err := restarted.Store(store); err != nil {
+		t.Fatal(err)
+	}
+	if hit, ok := restarted.Get("s", "c", ""); !ok || hit.Text != "3" {
+		t.Errorf("expected the stored completion, got %+v, %v", hit, ok)
+	}
+	if _, ok := restarted.Get("s", "a", ""); ok {
+		t.Error("expected the evicted completion to be gone from the storage")
+	}
+
+	smaller := cache.New(1, time.Minute)
+	if err := smaller.Store(store); err != nil {
+		t.Fatal(err)
+	}
+	if stats := smaller.Stats(); stats.Entries != 1 {
+		t.Errorf("expected the stored completions cut to the cache size, got %d", stats.Entries)
+	}
+}
+
+func TestCache_Shared(t *testing.T) {
+	srv := redistest.NewServer(t)
+	caches := make([]*cache.Cache, 2)
+	for i := range caches {
+		store, err := storage.OpenRedis(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		caches[i] = cache.New(1, time.Minute)
+		if err := caches[i].Store(store); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	caches[0].Put("s", "a", "", "1", "m")
+	caches[0].Put("s", "b", "", "2", "m")
+	// The first server evicted a, which the second one still gets from
+	// the shared storage.
+	for _, prefix := range []string{"a", "b"} {
+		if hit, ok := caches[1].Get("s", prefix, ""); !ok || hit.Extension {
+			t.Errorf("expected the completion of %s cached by the other server, got %+v, %v", prefix, hit, ok)
+		}
+	}
+	if _, ok := caches[1].Get("s", "c", ""); ok {
+		t.Error("expected a completion no server cached to be a miss")
+	}
+	if stats := caches[1].Stats(); stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("expected 2 hits and a miss, got %+v", stats)
+	}
+}
+
+func TestCache_Nil(t *testing.T) {
+	var c *cache.Cache
+	c.Put("s", "a", "", "1", "m")
+	if _, ok := c.Get("s", "a", ""); ok {
+		t.Error("expected a nil cache to miss")
+	}
+}
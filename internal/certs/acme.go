@@ -0,0 +1,26 @@
+package certs
+
+import (
+	"path/filepath"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACME returns a manager obtaining and renewing certificates for domains
+// from Let's Encrypt, accepting its terms of service. Certificates and the
+// account key are kept in cacheDir, by default in an acme directory next
+// to the local authority.
+func ACME(cacheDir string, domains ...string) (*autocert.Manager, error) {
+	if cacheDir == "" {
+		dir, err := DefaultDir()
+		if err != nil {
+			return nil, err
+		}
+		cacheDir = filepath.Join(dir, "acme")
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+	}, nil
+}
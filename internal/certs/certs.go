@@ -0,0 +1,207 @@
+// Package certs keeps the local certificate authority and the certificate
+// the HTTPS listeners serve when no certificate is configured. Both are
+// generated once and stored, so that clients trusting the authority keep
+// trusting the server across restarts.
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Files in the certificate directory.
+const (
+	CAFile   = "ca.crt"
+	caKey    = "ca.key"
+	leafFile = "server.crt"
+	leafKey  = "server.key"
+)
+
+// Validity of generated certificates. Leaf certificates stay under the 825
+// days macOS and iOS accept for certificates of authorities users add, and
+// are renewed renewBefore they expire.
+const (
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 825 * 24 * time.Hour
+	renewBefore  = 30 * 24 * time.Hour
+)
+
+// DefaultHosts are the names every generated certificate is valid for.
+var DefaultHosts = []string{"localhost", "127.0.0.1", "::1"}
+
+// DefaultDir returns the directory certificates are kept in under the
+// user's config directory.
+func DefaultDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "ollama-copilot", "certs"), nil
+}
+
+// Load returns a certificate for DefaultHosts and hosts signed by the
+// authority in dir, creating the authority on first use. The certificate
+// is reused while it covers every host and is not close to expiring, and
+// generated again otherwise.
+func Load(dir string, hosts ...string) (tls.Certificate, error) {
+	ca, caPriv, err := loadCA(dir)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	hosts = append(slices.Clone(DefaultHosts), hosts...)
+	if cert, err := tls.LoadX509KeyPair(filepath.Join(dir, leafFile), filepath.Join(dir, leafKey)); err == nil && reusable(cert, ca, hosts) {
+		return cert, nil
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template, err := newTemplate(leafValidity)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template.Subject = pkix.Name{CommonName: "ollama-copilot"}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, priv.Public(), caPriv)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("signing the server certificate: %w", err)
+	}
+	if err := write(dir, leafFile, leafKey, der, priv); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der, ca.Raw}, PrivateKey: priv}, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the DER encoded
+// certificate der, in hex, which clients can pin the certificate with.
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// CA returns the PEM encoded certificate of the authority in dir, creating
+// it on first use.
+func CA(dir string) ([]byte, error) {
+	if _, _, err := loadCA(dir); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(dir, CAFile))
+}
+
+// loadCA reads the authority in dir, or generates and stores one when
+// there is none.
+func loadCA(dir string) (*x509.Certificate, crypto.Signer, error) {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, CAFile), filepath.Join(dir, caKey))
+	if err == nil {
+		ca, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing the certificate authority: %w", err)
+		}
+		return ca, pair.PrivateKey.(crypto.Signer), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("loading the certificate authority: %w", err)
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := newTemplate(caValidity)
+	if err != nil {
+		return nil, nil, err
+	}
+	hostname, _ := os.Hostname()
+	template.Subject = pkix.Name{Organization: []string{"ollama-copilot"}, CommonName: "ollama-copilot local CA " + hostname}
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	template.IsCA = true
+	template.MaxPathLenZero = true
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating the certificate authority: %w", err)
+	}
+	if err := write(dir, CAFile, caKey, der, priv); err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	return ca, priv, err
+}
+
+// reusable reports whether cert is signed by ca, valid for every one of
+// hosts and far enough from expiring.
+func reusable(cert tls.Certificate, ca *x509.Certificate, hosts []string) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || leaf.CheckSignatureFrom(ca) != nil {
+		return false
+	}
+	if time.Until(leaf.NotAfter) < renewBefore {
+		return false
+	}
+	for _, h := range hosts {
+		if leaf.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// newTemplate returns a certificate template with a random serial number,
+// valid from now for validity.
+func newTemplate(validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber:          serial,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		BasicConstraintsValid: true,
+	}, nil
+}
+
+// write stores the certificate der and its key in dir, the key only
+// readable by the user.
+func write(dir, certFile, keyFile string, der []byte, priv *ecdsa.PrivateKey) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, keyFile), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, certFile), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}
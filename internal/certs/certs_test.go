@@ -0,0 +1,79 @@
+package certs_test
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/certs"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	cert, err := certs.Load(dir, "desktop.tailnet", "192.168.1.20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM, err := certs.CA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		t.Fatal("expected the certificate authority to be PEM encoded")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"localhost", "127.0.0.1", "::1", "desktop.tailnet", "192.168.1.20"} {
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Errorf("expected the certificate to be trusted for %s, got %v", host, err)
+		}
+	}
+}
+
+func TestLoad_Reuse(t *testing.T) {
+	dir := t.TempDir()
+	first, err := certs.Load(dir, "desktop.tailnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := certs.CA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := certs.Load(dir, "desktop.tailnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.Certificate[0], again.Certificate[0]) {
+		t.Error("expected the stored certificate to be reused")
+	}
+
+	other, err := certs.Load(dir, "laptop.tailnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first.Certificate[0], other.Certificate[0]) {
+		t.Error("expected a new certificate for a host the stored one does not cover")
+	}
+	leaf, _ := x509.ParseCertificate(other.Certificate[0])
+	if err := leaf.VerifyHostname("laptop.tailnet"); err != nil {
+		t.Errorf("expected the new certificate to cover laptop.tailnet, got %v", err)
+	}
+
+	caAgain, err := certs.CA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ca, caAgain) {
+		t.Error("expected the certificate authority to be kept")
+	}
+	if block, _ := pem.Decode(ca); block == nil || block.Type != "CERTIFICATE" {
+		t.Errorf("expected a PEM certificate, got %q", ca)
+	}
+}
@@ -0,0 +1,69 @@
+package certs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Linux trust stores, the directory their anchors are copied to and the
+// command that rebuilds them.
+var linuxStores = []struct {
+	dir    string
+	update []string
+}{
+	{"/usr/local/share/ca-certificates", []string{"update-ca-certificates"}},
+	{"/etc/pki/ca-trust/source/anchors", []string{"update-ca-trust", "extract"}},
+	{"/etc/ca-certificates/trust-source/anchors", []string{"trust", "extract-compat"}},
+}
+
+// Install adds the authority in dir to the system trust store: the login
+// keychain on macOS, the current user's root store on Windows and the
+// distribution's anchors on Linux, which needs root.
+func Install(dir string) error {
+	if _, err := CA(dir); err != nil {
+		return err
+	}
+	ca := filepath.Join(dir, CAFile)
+
+	switch runtime.GOOS {
+	case "darwin":
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		keychain := filepath.Join(home, "Library", "Keychains", "login.keychain-db")
+		return run("security", "add-trusted-cert", "-r", "trustRoot", "-k", keychain, ca)
+	case "windows":
+		return run("certutil", "-user", "-addstore", "Root", ca)
+	case "linux":
+		for _, store := range linuxStores {
+			if _, err := os.Stat(store.dir); err != nil {
+				continue
+			}
+			data, err := os.ReadFile(ca)
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(filepath.Join(store.dir, "ollama-copilot.crt"), data, 0o644); err != nil {
+				return fmt.Errorf("copying the certificate authority to %s: %w", store.dir, err)
+			}
+			return run(store.update[0], store.update[1:]...)
+		}
+		return errors.New("no known trust store found, add " + ca + " to it by hand")
+	default:
+		return fmt.Errorf("installing certificates is not supported on %s, add %s to the trust store by hand", runtime.GOOS, ca)
+	}
+}
+
+func run(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
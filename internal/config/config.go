@@ -0,0 +1,255 @@
+// Package config fills command line flags from a YAML or TOML config file
+// and from environment variables. Values set in the environment win over
+// flags given on the command line, which win over the file.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the environment variable for each flag, e.g.
+// OLLAMA_COPILOT_FALLBACK_AFTER for --fallback-after.
+const EnvPrefix = "OLLAMA_COPILOT_"
+
+// DefaultPaths are the config files tried, in order, when none is given.
+func DefaultPaths() []string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil
+	}
+	dir = filepath.Join(dir, "ollama-copilot")
+	return []string{
+		filepath.Join(dir, "config.yaml"),
+		filepath.Join(dir, "config.yml"),
+		filepath.Join(dir, "config.toml"),
+	}
+}
+
+// Load reads a config file whose keys are flag names. The format is chosen
+// by the file extension. Lists set a repeatable flag once per item and maps
+// set it once per name=value pair. The names of a nested map are joined to
+// the outer name with a dot, so that {chat-control: {temperature: 0.2}}
+// becomes chat-control.temperature=0.2.
+func Load(file string) (map[string][]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+
+	var raw map[string]any
+	switch ext := strings.ToLower(filepath.Ext(file)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("config %s: unsupported format %q, use .yaml or .toml", file, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", file, err)
+	}
+
+	values := make(map[string][]string, len(raw))
+	for name, value := range raw {
+		values[name] = flatten(value)
+	}
+	return values, nil
+}
+
+func flatten(value any) []string {
+	switch v := value.(type) {
+	case []any:
+		var values []string
+		for _, item := range v {
+			values = append(values, flatten(item)...)
+		}
+		return values
+	case map[string]any:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		values := make([]string, 0, len(v))
+		for _, name := range names {
+			inner, ok := v[name].(map[string]any)
+			if !ok {
+				values = append(values, name+"="+fmt.Sprint(v[name]))
+				continue
+			}
+			for _, value := range flatten(inner) {
+				values = append(values, name+"."+value)
+			}
+		}
+		return values
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+// Apply sets every flag in fs that was not given on the command line from
+// values, then every flag with an environment variable from the
+// environment. fs must already be parsed. Repeatable flags take a comma
+// separated list from the environment.
+func Apply(fs *flag.FlagSet, values map[string][]string) error {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	var errs []error
+	for name, vs := range values {
+		f := fs.Lookup(name)
+		if f == nil {
+			errs = append(errs, fmt.Errorf("config: unknown setting %q", name))
+			continue
+		}
+		if explicit[name] {
+			continue
+		}
+		for _, v := range vs {
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Errorf("config: invalid value %q for %s: %w", v, name, err))
+			}
+		}
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(EnvName(f.Name))
+		if !ok {
+			return
+		}
+		vs := []string{v}
+		if isRepeatable(f) {
+			vs = strings.Split(v, ",")
+		}
+		for _, v := range vs {
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Errorf("invalid value %q for %s: %w", v, EnvName(f.Name), err))
+			}
+		}
+	})
+
+	return errors.Join(errs...)
+}
+
+// Reload sets the named flags of fs again from values, as read from the
+// config file after it changed, and the environment. Those given on the
+// command line keep their value; the others are reset to their default
+// first, with their Reset method for repeatable flags, so that a setting
+// removed from the file is undone. The other flags are left alone, but
+// every setting of values must be a flag of fs. The settings are checked on
+// a separate flag set first, so that on error no flag changes.
+func Reload(fs *flag.FlagSet, values map[string][]string, names ...string) error {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	var errs []error
+	for name := range values {
+		if fs.Lookup(name) == nil {
+			errs = append(errs, fmt.Errorf("config: unknown setting %q", name))
+		}
+	}
+
+	checked := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	reloaded := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	reloadedValues := map[string][]string{}
+	for _, name := range names {
+		f := fs.Lookup(name)
+		if f == nil || explicit[name] {
+			continue
+		}
+		value, err := fresh(f)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		checked.Var(value, f.Name, f.Usage)
+		reloaded.Var(f.Value, f.Name, f.Usage)
+		if vs, ok := values[name]; ok {
+			reloadedValues[name] = vs
+		}
+	}
+	_ = checked.Parse(nil)
+	if err := Apply(checked, reloadedValues); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	reloaded.VisitAll(func(f *flag.Flag) {
+		if err := reset(f); err != nil {
+			errs = append(errs, err)
+		}
+	})
+	_ = reloaded.Parse(nil)
+	if err := Apply(reloaded, reloadedValues); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// fresh returns a new value of the type of the value of f, reset to its
+// default, for Reload to check settings on. Only values that are maps or
+// pointers to other than structs can be made this way.
+func fresh(f *flag.Flag) (flag.Value, error) {
+	t := reflect.TypeOf(f.Value)
+	var v reflect.Value
+	switch {
+	case t.Kind() == reflect.Map:
+		v = reflect.MakeMap(t)
+	case t.Kind() == reflect.Pointer && t.Elem().Kind() != reflect.Struct:
+		v = reflect.New(t.Elem())
+	default:
+		return nil, fmt.Errorf("config: %s cannot be reloaded", f.Name)
+	}
+	value := v.Interface().(flag.Value)
+	if err := reset(&flag.Flag{Name: f.Name, Value: value, DefValue: f.DefValue}); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// resetter is implemented by repeatable flag values that can be emptied.
+type resetter interface {
+	Reset()
+}
+
+func reset(f *flag.Flag) error {
+	if r, ok := f.Value.(resetter); ok {
+		r.Reset()
+		return nil
+	}
+	if isRepeatable(f) {
+		return fmt.Errorf("config: %s cannot be reset", f.Name)
+	}
+	if err := f.Value.Set(f.DefValue); err != nil {
+		return fmt.Errorf("config: resetting %s: %w", f.Name, err)
+	}
+	return nil
+}
+
+// EnvName returns the environment variable that sets the flag name.
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// repeatable is implemented by flag values that accumulate repeated uses.
+type repeatable interface {
+	Repeatable() bool
+}
+
+func isRepeatable(f *flag.Flag) bool {
+	r, ok := f.Value.(repeatable)
+	return ok && r.Repeatable()
+}
@@ -0,0 +1,168 @@
+package config_test
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/config"
+)
+
+type listValue []string
+
+func (l *listValue) String() string     { return strings.Join(*l, ",") }
+func (l *listValue) Set(v string) error { *l = append(*l, v); return nil }
+func (l *listValue) Repeatable() bool   { return true }
+func (l *listValue) Reset()             { *l = nil }
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApply_Precedence(t *testing.T) {
+	for _, file := range []struct{ name, content string }{
+		{"config.yaml", "model: file-model\nport: \":9000\"\nfallback-after: 5s\nforward-header: [x-a, x-b]\n"},
+		{"config.toml", "model = \"file-model\"\nport = \":9000\"\nfallback-after = \"5s\"\nforward-header = [\"x-a\", \"x-b\"]\n"},
+	} {
+		t.Run(file.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			model := fs.String("model", "default-model", "")
+			port := fs.String("port", ":11437", "")
+			fallbackAfter := fs.Duration("fallback-after", 3*time.Second, "")
+			var forward listValue
+			fs.Var(&forward, "forward-header", "")
+
+			if err := fs.Parse([]string{"--model", "flag-model", "--port", ":8000"}); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("OLLAMA_COPILOT_PORT", ":7000")
+
+			values, err := config.Load(writeConfig(t, file.name, file.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := config.Apply(fs, values); err != nil {
+				t.Fatal(err)
+			}
+
+			if *model != "flag-model" {
+				t.Errorf("expected the flag to win over the file, got %q", *model)
+			}
+			if *port != ":7000" {
+				t.Errorf("expected the environment to win over the flag, got %q", *port)
+			}
+			if *fallbackAfter != 5*time.Second {
+				t.Errorf("expected the file to set fallback-after, got %v", *fallbackAfter)
+			}
+			if want := (listValue{"x-a", "x-b"}); !reflect.DeepEqual(forward, want) {
+				t.Errorf("expected %v, got %v", want, forward)
+			}
+		})
+	}
+}
+
+func TestApply_Errors(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Int("num-predict", 200, "")
+	_ = fs.Parse(nil)
+
+	values, err := config.Load(writeConfig(t, "config.yaml", "modle: typo\nnum-predict: lots\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = config.Apply(fs, values)
+	if err == nil || !strings.Contains(err.Error(), `"modle"`) || !strings.Contains(err.Error(), "num-predict") {
+		t.Errorf("expected errors for the unknown and invalid settings, got %v", err)
+	}
+
+	if _, err := config.Load(writeConfig(t, "config.json", "{}")); err == nil {
+		t.Error("expected an error for an unsupported format")
+	}
+}
+
+func TestReload(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	model := fs.String("model", "default-model", "")
+	port := fs.String("port", ":11437", "")
+	numPredict := fs.Int("num-predict", 200, "")
+	var forward listValue
+	fs.Var(&forward, "forward-header", "")
+	if err := fs.Parse([]string{"--model", "flag-model"}); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := config.Load(writeConfig(t, "config.yaml", "model: file-model\nport: \":9000\"\nnum-predict: 100\nforward-header: [x-a]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Apply(fs, values); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err = config.Load(writeConfig(t, "config.yaml", "model: other-model\nport: \":8000\"\nnum-predict: 64\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Reload(fs, values, "model", "num-predict", "forward-header"); err != nil {
+		t.Fatal(err)
+	}
+	if *model != "flag-model" {
+		t.Errorf("expected the flag to win over the reloaded file, got %q", *model)
+	}
+	if *numPredict != 64 {
+		t.Errorf("expected the reloaded value, got %d", *numPredict)
+	}
+	if len(forward) != 0 {
+		t.Errorf("expected the setting removed from the file to be reset, got %v", forward)
+	}
+	if *port != ":9000" {
+		t.Errorf("expected a flag that is not reloaded to keep its value, got %q", *port)
+	}
+
+	values, err = config.Load(writeConfig(t, "config.yaml", "model: other-model\nnum-predict: many\nforward-header: [x-b]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Reload(fs, values, "num-predict", "forward-header"); err == nil {
+		t.Error("expected an error for the invalid value")
+	}
+	if *numPredict != 64 || len(forward) != 0 {
+		t.Errorf("expected a failed reload to change no flag, got %d and %v", *numPredict, forward)
+	}
+
+	values, err = config.Load(writeConfig(t, "config.yaml", "modle: typo\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Reload(fs, values, "model"); err == nil || !strings.Contains(err.Error(), `"modle"`) {
+		t.Errorf("expected an error for the unknown setting, got %v", err)
+	}
+}
+
+func TestLoad_NestedMaps(t *testing.T) {
+	for _, file := range []struct{ name, content string }{
+		{"config.yaml", "model-options:\n  chat-control:\n    temperature: 0.2\n    num_predict: 400\n  copilot-codex:\n    num_predict: 60\n"},
+		{"config.toml", "[model-options.chat-control]\ntemperature = 0.2\nnum_predict = 400\n\n[model-options.copilot-codex]\nnum_predict = 60\n"},
+	} {
+		t.Run(file.name, func(t *testing.T) {
+			values, err := config.Load(writeConfig(t, file.name, file.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{"chat-control.num_predict=400", "chat-control.temperature=0.2", "copilot-codex.num_predict=60"}
+			if got := values["model-options"]; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %v, got %v", want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+// Package corpus records the prompts completions were generated from, and
+// the completions, for offline analysis. Texts are stored once each, under
+// the SHA-256 of their content, and a manifest of entries refers to them by
+// that id. Long recording sessions repeat the same system prompts, suffixes
+// and completions over and over, which are then kept only once, and the ids
+// stay the same for every tool that reads the corpus.
+package corpus
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/storage"
+)
+
+// ManifestLog is the storage log entries are appended to, as JSON.
+const ManifestLog = "corpus"
+
+// BlobBucket is the storage bucket texts are kept in, by id.
+const BlobBucket = "corpus_blobs"
+
+// Entry is one recorded completion. Prompt, System and Completion are the
+// ids of the texts, System being empty when there was no system prompt.
+type Entry struct {
+	Time       time.Time      `json:"time"`
+	Id         string         `json:"id"`
+	Model      string         `json:"model"`
+	Language   string         `json:"language,omitempty"`
+	Mode       string         `json:"mode,omitempty"`
+	Template   string         `json:"template,omitempty"`
+	Raw        bool           `json:"raw,omitempty"`
+	Options    map[string]any `json:"options,omitempty"`
+	Prompt     string         `json:"prompt"`
+	System     string         `json:"system,omitempty"`
+	Completion string         `json:"completion"`
+}
+
+// Texts are the contents an Entry refers to.
+type Texts struct {
+	Prompt     string
+	System     string
+	Completion string
+}
+
+// Corpus records entries in a storage. A nil Corpus records nothing.
+type Corpus struct {
+	store storage.Storage
+}
+
+// New returns a Corpus kept in store.
+func New(store storage.Storage) *Corpus {
+	return &Corpus{store: store}
+}
+
+// ID returns the id text is stored under: the hex SHA-256 of its content.
+func ID(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// Record stores the texts not stored yet and appends e, with the ids of
+// texts, to the manifest.
+func (c *Corpus) Record(e Entry, texts Texts) error {
+	if c == nil {
+		return nil
+	}
+	var err error
+	if e.Prompt, err = c.put(texts.Prompt); err != nil {
+		return err
+	}
+	if texts.System != "" {
+		if e.System, err = c.put(texts.System); err != nil {
+			return err
+		}
+	}
+	if e.Completion, err = c.put(texts.Completion); err != nil {
+		return err
+	}
+	record, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return c.store.Append(ManifestLog, record)
+}
+
+// put stores text unless a text with its id already is, and returns the id.
+func (c *Corpus) put(text string) (string, error) {
+	id := ID(text)
+	if _, ok, err := c.store.Get(BlobBucket, id); err != nil || ok {
+		return id, err
+	}
+	return id, c.store.Put(BlobBucket, id, []byte(text))
+}
+
+// Text returns the text stored under id.
+func (c *Corpus) Text(id string) (string, bool, error) {
+	text, ok, err := c.store.Get(BlobBucket, id)
+	return string(text), ok, err
+}
+
+// Entries calls fn with each entry of the manifest, oldest first.
+func (c *Corpus) Entries(fn func(Entry) error) error {
+	return c.store.Scan(ManifestLog, func(record []byte) error {
+		var e Entry
+		if err := json.Unmarshal(record, &e); err != nil {
+			return err
+		}
+		return fn(e)
+	})
+}
@@ -0,0 +1,49 @@
+package corpus_test
+
+import (
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/corpus"
+	"github.com/josuemontano/ollama-copilot/internal/storage"
+)
+
+func TestCorpus_Record(t *testing.T) {
+	store := storage.NewMemory()
+	c := corpus.New(store)
+	system := "You are an expert programming assistant."
+	for _, texts := range []corpus.Texts{
+		{Prompt: "<PRE> x := <SUF>", System: system, Completion: "1"},
+		{Prompt: "<PRE> y := <SUF>", System: system, Completion: "1"},
+		{Prompt: "<PRE> z := <SUF>", Completion: "2"},
+	} {
+		if err := c.Record(corpus.Entry{Id: texts.Prompt, Model: "m"}, texts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var entries []corpus.Entry
+	if err := c.Entries(func(e corpus.Entry) error { entries = append(entries, e); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	if entries[0].System != entries[1].System || entries[0].Completion != entries[1].Completion {
+		t.Errorf("expected equal texts to share an id, got %+v and %+v", entries[0], entries[1])
+	}
+	if entries[2].System != "" {
+		t.Errorf("expected no system prompt id, got %q", entries[2].System)
+	}
+	if text, ok, _ := c.Text(entries[1].Prompt); !ok || text != "<PRE> y := <SUF>" {
+		t.Errorf("expected the prompt to be stored under its id, got %q", text)
+	}
+	if entries[0].System != corpus.ID(system) {
+		t.Errorf("expected ids to be content hashes, got %q", entries[0].System)
+	}
+
+	var blobs int
+	_ = store.Each(corpus.BlobBucket, func(string, []byte) error { blobs++; return nil })
+	if blobs != 6 {
+		t.Errorf("expected 6 distinct texts stored, got %d", blobs)
+	}
+}
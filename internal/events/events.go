@@ -0,0 +1,146 @@
+// Package events is the daemon's event log. Requests, cache hits, backend
+// failures and configuration changes are published as events, and the
+// access log, metrics, webhooks and the admin API subscribe to them instead
+// of each part of the server reporting to each of them.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types published by the server.
+const (
+	RequestStarted       = "request.started"
+	RequestFinished      = "request.finished"
+	CacheHit             = "cache.hit"
+	CompletionSuppressed = "completion.suppressed"
+	BackendFailed        = "backend.failed"
+	BackendRecovered     = "backend.recovered"
+	ConfigReloaded       = "config.reloaded"
+	ModelSwitched        = "model.switched"
+	QuotaNearing         = "quota.nearing"
+	BurstStarted         = "burst.started"
+	BurstEnded           = "burst.ended"
+)
+
+// Fields are the details of an event.
+type Fields map[string]any
+
+// Event is something that happened in the daemon. Seq numbers events in the
+// order they were published, starting at 1.
+type Event struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	Fields Fields    `json:"fields,omitempty"`
+}
+
+// subscriberBuffer is how many events a subscriber may fall behind by
+// before events are dropped for it.
+const subscriberBuffer = 256
+
+type subscriber struct {
+	events chan Event
+	done   chan struct{}
+}
+
+// Bus keeps the most recent events and passes every event to its
+// subscribers. Publishing never blocks: a subscriber that falls behind
+// misses events.
+type Bus struct {
+	mu      sync.Mutex
+	seq     uint64
+	log     []Event
+	next    int
+	subs    map[*subscriber]struct{}
+	dropped uint64
+}
+
+// NewBus returns a bus keeping the last size events.
+func NewBus(size int) *Bus {
+	return &Bus{log: make([]Event, 0, size), subs: map[*subscriber]struct{}{}}
+}
+
+// Publish appends an event of type typ to the log and hands it to the
+// subscribers.
+func (b *Bus) Publish(typ string, fields Fields) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	e := Event{Seq: b.seq, Time: time.Now(), Type: typ, Fields: fields}
+	if len(b.log) < cap(b.log) {
+		b.log = append(b.log, e)
+	} else if cap(b.log) > 0 {
+		b.log[b.next] = e
+		b.next = (b.next + 1) % cap(b.log)
+	}
+
+	for s := range b.subs {
+		select {
+		case s.events <- e:
+		default:
+			b.dropped++
+		}
+	}
+}
+
+// Subscribe calls fn with every event published from now on, one at a time
+// and in order, on a goroutine of its own. The returned function stops the
+// subscription and waits for fn to return.
+func (b *Bus) Subscribe(fn func(Event)) (unsubscribe func()) {
+	s := &subscriber{events: make(chan Event, subscriberBuffer), done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		for e := range s.events {
+			fn(e)
+		}
+	}()
+
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, s)
+			close(s.events)
+			b.mu.Unlock()
+			<-s.done
+		})
+	}
+}
+
+// Since returns the events still in the log that were published after the
+// event numbered seq, oldest first.
+func (b *Bus) Since(seq uint64) []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	events := make([]Event, 0, len(b.log))
+	for i := range b.log {
+		if e := b.log[(b.next+i)%len(b.log)]; e.Seq > seq {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// Dropped returns the number of events subscribers missed because they
+// fell behind.
+func (b *Bus) Dropped() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dropped
+}
+
+// Default is the bus the server publishes to.
+var Default = NewBus(1000)
+
+// Publish publishes an event on Default.
+func Publish(typ string, fields Fields) {
+	Default.Publish(typ, fields)
+}
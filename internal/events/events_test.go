@@ -0,0 +1,95 @@
+package events_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/events"
+	"github.com/josuemontano/ollama-copilot/internal/storage"
+	"go.uber.org/zap"
+)
+
+func TestBus_Since(t *testing.T) {
+	bus := events.NewBus(3)
+	for _, typ := range []string{"a", "b", "c", "d"} {
+		bus.Publish(typ, nil)
+	}
+
+	got := bus.Since(0)
+	if len(got) != 3 || got[0].Type != "b" || got[2].Type != "d" {
+		t.Fatalf("expected the last 3 events oldest first, got %+v", got)
+	}
+	if got := bus.Since(3); len(got) != 1 || got[0].Seq != 4 {
+		t.Errorf("expected only the event after seq 3, got %+v", got)
+	}
+}
+
+func TestBus_Subscribe(t *testing.T) {
+	bus := events.NewBus(10)
+	received := make(chan events.Event, 10)
+	unsubscribe := bus.Subscribe(func(e events.Event) { received <- e })
+
+	bus.Publish(events.CacheHit, events.Fields{"model": "qwen"})
+	bus.Publish(events.ConfigReloaded, nil)
+	unsubscribe()
+	bus.Publish(events.CacheHit, nil)
+
+	if e := <-received; e.Type != events.CacheHit || e.Fields["model"] != "qwen" {
+		t.Errorf("expected the cache hit first, got %+v", e)
+	}
+	if e := <-received; e.Type != events.ConfigReloaded {
+		t.Errorf("expected the config reload second, got %+v", e)
+	}
+	select {
+	case e := <-received:
+		t.Errorf("expected no events after unsubscribing, got %+v", e)
+	default:
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	posted := make(chan events.Event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e events.Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("failed to decode the event: %v", err)
+		}
+		posted <- e
+	}))
+	defer srv.Close()
+
+	bus := events.NewBus(10)
+	defer bus.Subscribe(events.Webhook(srv.URL, zap.NewNop(), events.BackendFailed))()
+	bus.Publish(events.CacheHit, nil)
+	bus.Publish(events.BackendFailed, events.Fields{"backend": "desktop"})
+
+	select {
+	case e := <-posted:
+		if e.Type != events.BackendFailed || e.Fields["backend"] != "desktop" {
+			t.Errorf("expected only the backend failure to be posted, got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the event to be posted")
+	}
+}
+
+func TestRecord(t *testing.T) {
+	store := storage.NewMemory()
+	record := events.Record(store, nil)
+	record(events.Event{Seq: 1, Type: events.CacheHit, Fields: events.Fields{"model": "qwen"}})
+	record(events.Event{Seq: 2, Type: events.ConfigReloaded})
+
+	var recorded []events.Event
+	_ = store.Scan(events.RecordLog, func(record []byte) error {
+		var e events.Event
+		err := json.Unmarshal(record, &e)
+		recorded = append(recorded, e)
+		return err
+	})
+	if len(recorded) != 2 || recorded[0].Fields["model"] != "qwen" || recorded[1].Type != events.ConfigReloaded {
+		t.Errorf("expected both events recorded in order, got %+v", recorded)
+	}
+}
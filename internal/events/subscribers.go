@@ -0,0 +1,95 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/storage"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// RecordLog is the storage log Record appends events to.
+const RecordLog = "events"
+
+// Log returns a subscriber writing events to logger. Request events are
+// logged at debug level, as the access log already covers them, and
+// backend failures as warnings.
+func Log(logger *zap.Logger) func(Event) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return func(e Event) {
+		level := zapcore.InfoLevel
+		switch {
+		case strings.HasPrefix(e.Type, "request."):
+			level = zapcore.DebugLevel
+		case e.Type == BackendFailed:
+			level = zapcore.WarnLevel
+		}
+
+		fields := make([]zap.Field, 0, len(e.Fields)+1)
+		fields = append(fields, zap.Uint64("seq", e.Seq))
+		for k, v := range e.Fields {
+			fields = append(fields, zap.Any(k, v))
+		}
+		logger.Log(level, e.Type, fields...)
+	}
+}
+
+// Webhook returns a subscriber posting each event as JSON to url. Only the
+// given types are posted, or every type when none are given. Failed posts
+// are logged to logger unless it is nil.
+func Webhook(url string, logger *zap.Logger, types ...string) func(Event) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	return func(e Event) {
+		if len(types) > 0 && !slices.Contains(types, e.Type) {
+			return
+		}
+		if err := post(client, url, e); err != nil {
+			logger.Warn("Error posting event to webhook", zap.String("url", url), zap.String("type", e.Type), zap.Error(err))
+		}
+	}
+}
+
+// Record returns a subscriber appending each event as JSON to the RecordLog
+// of store, so that what the daemon did can be looked at later. Failed
+// appends are logged to logger unless it is nil.
+func Record(store storage.Storage, logger *zap.Logger) func(Event) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return func(e Event) {
+		record, err := json.Marshal(e)
+		if err == nil {
+			err = store.Append(RecordLog, record)
+		}
+		if err != nil {
+			logger.Warn("Error recording event", zap.String("type", e.Type), zap.Error(err))
+		}
+	}
+}
+
+func post(client *http.Client, url string, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
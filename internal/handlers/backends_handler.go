@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/josuemontano/ollama-copilot/internal/backends"
+)
+
+// BackendsResponse lists the Ollama backends and their measurements.
+type BackendsResponse struct {
+	Pinned   string            `json:"pinned,omitempty"`
+	Balance  backends.Strategy `json:"balance"`
+	Backends []backends.Stats  `json:"backends"`
+}
+
+// PinRequest pins completions to a backend. An empty Pinned unpins.
+type PinRequest struct {
+	Pinned string `json:"pinned"`
+}
+
+// BackendsHandler reports backend latency with GET and pins a backend with
+// POST.
+type BackendsHandler struct {
+	pool *backends.Pool
+}
+
+// NewBackendsHandler returns a BackendsHandler for pool.
+func NewBackendsHandler(pool *backends.Pool) *BackendsHandler {
+	return &BackendsHandler{pool: pool}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *BackendsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req PinRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := h.pool.Pin(req.Pinned); err != nil {
+			writeValidationError(w, []FieldError{{Field: "pinned", Message: err.Error()}})
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, BackendsResponse{Pinned: h.pool.Pinned(), Balance: h.pool.Strategy(), Backends: h.pool.Stats()})
+}
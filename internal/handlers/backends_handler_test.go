@@ -0,0 +1,156 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/backends"
+	"github.com/josuemontano/ollama-copilot/internal/handlers"
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
+	"github.com/ollama/ollama/api"
+)
+
+func TestCompletionHandler_Backends(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		t.Error("expected the completion to go to the picked backend")
+	})
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeChunks(w, "primary", "ok")
+	}))
+	t.Cleanup(remote.Close)
+
+	transport := http.DefaultClient.Transport
+	http.DefaultClient.Transport = &backends.Transport{Base: transport}
+	t.Cleanup(func() { http.DefaultClient.Transport = transport })
+
+	pool, err := backends.New(map[string]string{"remote": remote.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Backends: pool})
+
+	rr := postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20}`)
+	if responses := streamedResponses(t, rr.Body.String()); len(responses) != 2 || responses[0].Choices[0].Text != "ok" {
+		t.Errorf("expected the remote backend's completion, got %q", rr.Body.String())
+	}
+	if stats := pool.Stats(); stats[0].TTFT == 0 {
+		t.Error("expected the backend's time to first token to be observed")
+	}
+}
+
+func TestCompletionHandler_BackendFailover(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		t.Error("expected the completion to go to a backend of the pool")
+	})
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeChunks(w, "primary", "ok")
+	}))
+	t.Cleanup(up.Close)
+
+	transport := http.DefaultClient.Transport
+	http.DefaultClient.Transport = &backends.Transport{Base: transport}
+	t.Cleanup(func() { http.DefaultClient.Transport = transport })
+
+	// Both backends have the same latency, so the first, which is down, is
+	// picked.
+	pool, err := backends.New(map[string]string{"a": down.URL, "b": up.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := metrics.BackendFailovers.Get("a")
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Backends: pool, RetryBudget: time.Minute})
+
+	start := time.Now()
+	rr := postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20}`)
+	if got := completionText(streamedResponses(t, rr.Body.String())); got != "ok" {
+		t.Errorf("expected the completion of the backend that is up, got %q", rr.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the failover not to wait for retries, took %s", elapsed)
+	}
+	if stats := pool.Stats(); stats[0].Healthy || !stats[1].Healthy {
+		t.Errorf("expected only the backend that is down to be marked unhealthy, got %+v", stats)
+	}
+	if got := metrics.BackendFailovers.Get("a"); got != before+1 {
+		t.Errorf("expected 1 failover to be counted, got %v", got-before)
+	}
+}
+
+func TestCompletionHandler_StickyRouting(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		t.Error("expected the completion to go to a backend of the pool")
+	})
+	served := map[string]int{}
+	backend := func(name string) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			served[name]++
+			writeChunks(w, "primary", "ok")
+		}))
+		t.Cleanup(srv.Close)
+		return srv.URL
+	}
+
+	transport := http.DefaultClient.Transport
+	http.DefaultClient.Transport = &backends.Transport{Base: transport}
+	t.Cleanup(func() { http.DefaultClient.Transport = transport })
+
+	pool, err := backends.New(map[string]string{"a": backend("a"), "b": backend("b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.SetStrategy(backends.RoundRobin); err != nil {
+		t.Fatal(err)
+	}
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Backends: pool, StickyRouting: true})
+
+	for _, prompt := range []string{"x = ", "x = 1", "x = 12"} {
+		postCompletion(t, h, `{"prompt":"`+prompt+`","suffix":"","max_tokens":20}`)
+	}
+	if served["a"] != 3 || served["b"] != 0 {
+		t.Errorf("expected completions typed in the same place to stay on one backend, got %v", served)
+	}
+
+	h = newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Backends: pool})
+	for _, prompt := range []string{"y = ", "y = 1"} {
+		postCompletion(t, h, `{"prompt":"`+prompt+`","suffix":"","max_tokens":20}`)
+	}
+	if served["b"] != 1 {
+		t.Errorf("expected round robin without sticky routing, got %v", served)
+	}
+}
+
+func TestBackendsHandler_Pin(t *testing.T) {
+	pool, err := backends.New(map[string]string{"desktop": "gpu.tailnet", "laptop": "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := handlers.NewBackendsHandler(pool)
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/admin/backends", strings.NewReader(`{"pinned":"desktop"}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	var resp handlers.BackendsResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Pinned != "desktop" || len(resp.Backends) != 2 || !resp.Backends[0].Pinned {
+		t.Errorf("expected desktop to be pinned, got %+v", resp)
+	}
+	if got := pool.Pick().Name; got != "desktop" {
+		t.Errorf("expected completions to go to the pinned backend, got %s", got)
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/admin/backends", strings.NewReader(`{"pinned":"missing"}`)))
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected status code %d for an unknown backend, got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// serveJSON answers a request with stream set to false. The completion is
+// generated as for a stream, and its events are joined into a single
+// CompletionResponse once it is done. A completion that failed is answered
+// with 502 and its error.
+func (ch *CompletionHandler) serveJSON(ctx context.Context, w http.ResponseWriter, settings *completionSettings, info requestInfo, req CompletionRequest, selected *template.Template) error {
+	var events eventBuffer
+	if err := ch.generateCompletion(ctx, &events, settings, info, req, selected); err != nil {
+		return err
+	}
+	resp, err := events.join(info.id)
+	if err != nil {
+		return err
+	}
+	status := http.StatusOK
+	if resp.Error != nil {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, resp)
+	return nil
+}
+
+// eventBuffer is a ResponseWriter keeping the events of a completion
+// instead of sending them.
+type eventBuffer struct {
+	header http.Header
+	buf    bytes.Buffer
+}
+
+func (b *eventBuffer) Header() http.Header {
+	if b.header == nil {
+		b.header = http.Header{}
+	}
+	return b.header
+}
+
+func (b *eventBuffer) Write(p []byte) (int, error) { return b.buf.Write(p) }
+
+func (b *eventBuffer) WriteHeader(int) {}
+
+// join returns the buffered events as one response with a single choice:
+// their texts together, with the finish reason, range, metadata and usage
+// of the last event that has them. A completion that ended without a reason
+// stopped.
+func (b *eventBuffer) join(id string) (CompletionResponse, error) {
+	resp := CompletionResponse{Id: id, Object: "text_completion", Created: time.Now().Unix()}
+	choice := ChoiceResponse{Index: 0}
+	var text strings.Builder
+	for _, event := range strings.Split(b.buf.String(), "\n\n") {
+		data, ok := strings.CutPrefix(strings.TrimSpace(event), "data: ")
+		if !ok {
+			continue
+		}
+		var e CompletionResponse
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return resp, fmt.Errorf("decoding completion event: %w", err)
+		}
+		if e.Model != "" {
+			resp.Model = e.Model
+		}
+		if e.Error != nil {
+			resp.Error = e.Error
+		}
+		if e.Usage != nil {
+			resp.Usage = e.Usage
+		}
+		for _, c := range e.Choices {
+			text.WriteString(c.Text)
+			if c.FinishReason != "" {
+				choice.FinishReason = c.FinishReason
+			}
+			if c.Range != nil {
+				choice.Range = c.Range
+			}
+			if c.Metadata != nil {
+				choice.Metadata = c.Metadata
+			}
+		}
+	}
+	choice.Text = text.String()
+	if choice.FinishReason == "" {
+		choice.FinishReason = "stop"
+	}
+	resp.Choices = []ChoiceResponse{choice}
+	return resp, nil
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+)
+
+// BurstRequest starts burst mode for Minutes, the configured duration when
+// zero. The minutes query parameter may be given instead, for hotkeys that
+// cannot send a body.
+type BurstRequest struct {
+	Minutes int `json:"minutes"`
+}
+
+// BurstResponse describes the burst mode of the user.
+type BurstResponse struct {
+	Active     bool      `json:"active"`
+	Model      string    `json:"model"`
+	NumPredict int       `json:"num_predict"`
+	Until      time.Time `json:"until,omitzero"`
+}
+
+// BurstHandler reports the burst mode of the user with GET, starts or
+// extends it with POST and ends it with DELETE. Users are identified as in
+// completion requests, by the user header or else the client IP.
+type BurstHandler struct {
+	bursts     *Bursts
+	userHeader string
+}
+
+// NewBurstHandler returns a BurstHandler for bursts. userHeader is the
+// request header identifying users, see CompletionConfig.UserHeader.
+func NewBurstHandler(bursts *Bursts, userHeader string) *BurstHandler {
+	return &BurstHandler{bursts: bursts, userHeader: userHeader}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *BurstHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r, h.userHeader)
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req BurstRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if s := r.URL.Query().Get("minutes"); s != "" {
+			minutes, err := strconv.Atoi(s)
+			if err != nil {
+				writeValidationError(w, []FieldError{{Field: "minutes", Message: "must be a number of minutes"}})
+				return
+			}
+			req.Minutes = minutes
+		}
+		if req.Minutes < 0 || time.Duration(req.Minutes)*time.Minute > MaxBurstDuration {
+			writeValidationError(w, []FieldError{{Field: "minutes", Message: fmt.Sprintf("must be between 0 and %d", int(MaxBurstDuration.Minutes()))}})
+			return
+		}
+		h.bursts.Start(user, middleware.ClientID(r), time.Duration(req.Minutes)*time.Minute)
+	case http.MethodDelete:
+		h.bursts.Stop(user)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	until, active := h.bursts.Until(user)
+	writeJSON(w, http.StatusOK, BurstResponse{Active: active, Model: h.bursts.Model, NumPredict: h.bursts.NumPredict, Until: until})
+}
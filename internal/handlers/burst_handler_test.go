@@ -0,0 +1,68 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/handlers"
+	"github.com/ollama/ollama/api"
+)
+
+func TestCompletionHandler_Burst(t *testing.T) {
+	var got api.GenerateRequest
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		got = req
+		writeChunks(w, req.Model, "1")
+	})
+	bursts := handlers.NewBursts("large", 400, 0)
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "small", NumPredict: 100, Bursts: bursts})
+	burst := handlers.NewBurstHandler(bursts, "")
+	body := `{"prompt":"x = ","suffix":"","max_tokens":500}`
+
+	rr := httptest.NewRecorder()
+	burst.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1/burst?minutes=20", nil))
+	var resp handlers.BurstResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Active || resp.Model != "large" || time.Until(resp.Until) < 19*time.Minute {
+		t.Errorf("expected burst mode for 20 minutes, got %+v", resp)
+	}
+
+	postCompletion(t, h, body)
+	if got.Model != "large" || got.Options["num_predict"] != float64(400) {
+		t.Errorf("expected the burst model and num_predict, got %s with %v", got.Model, got.Options["num_predict"])
+	}
+
+	rr = httptest.NewRecorder()
+	burst.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/v1/burst", nil))
+	postCompletion(t, h, body)
+	if got.Model != "small" || got.Options["num_predict"] != float64(100) {
+		t.Errorf("expected the default model and num_predict after burst mode, got %s with %v", got.Model, got.Options["num_predict"])
+	}
+
+	rr = httptest.NewRecorder()
+	burst.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1/burst?minutes=1000", nil))
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected status code %d for a burst too long, got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+}
+
+func TestBursts_Expire(t *testing.T) {
+	bursts := handlers.NewBursts("large", 400, 10*time.Millisecond)
+	bursts.Start("alice", "ip:127.0.0.1", 0)
+	if _, ok := bursts.Until("alice"); !ok {
+		t.Fatal("expected alice to be in burst mode")
+	}
+	if _, ok := bursts.Until("bob"); ok {
+		t.Error("expected burst mode to concern alice only")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := bursts.Until("alice"); ok {
+		t.Error("expected burst mode to end by itself")
+	}
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/events"
+)
+
+// DefaultBurstDuration is how long burst mode lasts unless asked otherwise.
+const DefaultBurstDuration = 10 * time.Minute
+
+// MaxBurstDuration is the longest burst mode may be asked for, so that a
+// forgotten burst does not keep the larger model busy all day.
+const MaxBurstDuration = 2 * time.Hour
+
+// Bursts remembers the users in burst mode, whose completions come from a
+// larger model with more tokens for a while, such as when writing a tricky
+// algorithm. Burst mode ends by itself once its time is up. A nil Bursts
+// has no user in burst mode.
+type Bursts struct {
+	// Model replaces the configured and mapped models in burst mode, and
+	// NumPredict is the least num_predict completions get.
+	Model      string
+	NumPredict int
+	// Duration is how long burst mode lasts unless asked otherwise.
+	Duration time.Duration
+
+	mu     sync.Mutex
+	active map[string]*burst
+}
+
+type burst struct {
+	until time.Time
+	// client identifies the user in events, see middleware.ClientID.
+	client string
+	timer  *time.Timer
+}
+
+// NewBursts returns Bursts answering with model and at least numPredict
+// tokens for d, DefaultBurstDuration when d is not positive.
+func NewBursts(model string, numPredict int, d time.Duration) *Bursts {
+	if d <= 0 {
+		d = DefaultBurstDuration
+	}
+	return &Bursts{Model: model, NumPredict: numPredict, Duration: d, active: map[string]*burst{}}
+}
+
+// Start puts user in burst mode for d, or Duration when d is not positive,
+// and returns when it ends. Starting again extends or shortens a burst
+// already running. client identifies the user in the events published.
+func (b *Bursts) Start(user, client string, d time.Duration) time.Time {
+	if d <= 0 {
+		d = b.Duration
+	}
+	d = min(d, MaxBurstDuration)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if running, ok := b.active[user]; ok {
+		running.timer.Stop()
+	}
+	current := &burst{until: time.Now().Add(d), client: client}
+	current.timer = time.AfterFunc(d, func() { b.end(user, current, "expired") })
+	b.active[user] = current
+	events.Publish(events.BurstStarted, events.Fields{"client": client, "model": b.Model, "until": current.until})
+	return current.until
+}
+
+// Stop ends the burst mode of user, and reports whether it was in burst
+// mode.
+func (b *Bursts) Stop(user string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	running, ok := b.active[user]
+	b.mu.Unlock()
+	if !ok {
+		return false
+	}
+	running.timer.Stop()
+	return b.end(user, running, "stopped")
+}
+
+// Until returns when the burst mode of user ends, and whether it is in
+// burst mode.
+func (b *Bursts) Until(user string) (time.Time, bool) {
+	if b == nil {
+		return time.Time{}, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	running, ok := b.active[user]
+	if !ok {
+		return time.Time{}, false
+	}
+	return running.until, true
+}
+
+// end ends the burst mode of user unless a newer burst replaced the one
+// ending, and reports whether it ended.
+func (b *Bursts) end(user string, ending *burst, reason string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.active[user] != ending {
+		return false
+	}
+	delete(b.active, user)
+	events.Publish(events.BurstEnded, events.Fields{"client": ending.client, "model": b.Model, "reason": reason})
+	return true
+}
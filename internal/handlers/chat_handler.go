@@ -0,0 +1,337 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/josuemontano/ollama-copilot/internal/limiter"
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+	"github.com/ollama/ollama/api"
+	"go.uber.org/zap"
+)
+
+// ChatContent is a message's content, sent either as a string or as an
+// array of typed parts of which only the text parts are kept.
+type ChatContent string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (c *ChatContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = ChatContent(text)
+		return nil
+	}
+
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return fmt.Errorf("message content must be a string or an array of parts: %w", err)
+	}
+	var b strings.Builder
+	for _, part := range parts {
+		if part.Type == "text" {
+			b.WriteString(part.Text)
+		}
+	}
+	*c = ChatContent(b.String())
+	return nil
+}
+
+// ChatMessage is a single message in a chat conversation.
+type ChatMessage struct {
+	Role    string      `json:"role"`
+	Content ChatContent `json:"content"`
+}
+
+// ChatRequest is an OpenAI-style chat completions request.
+type ChatRequest struct {
+	Model       string        `json:"model"`
+	Messages    []ChatMessage `json:"messages"`
+	Stream      bool          `json:"stream"`
+	Temperature *float64      `json:"temperature"`
+	TopP        *float64      `json:"top_p"`
+	MaxTokens   int           `json:"max_tokens"`
+	Stop        StopSequences `json:"stop"`
+}
+
+// ChatDelta is the part of a message added by one streamed chunk.
+type ChatDelta struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+// ChatChoice is a single chat completion choice. Streamed chunks carry a
+// Delta, complete responses a Message.
+type ChatChoice struct {
+	Index        int          `json:"index"`
+	Delta        *ChatDelta   `json:"delta,omitempty"`
+	Message      *ChatMessage `json:"message,omitempty"`
+	FinishReason *string      `json:"finish_reason"`
+}
+
+// TokenUsage counts the tokens of a completion or chat completion, as
+// Ollama reports them.
+type TokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// ChatResponse is a chat completion, or one chunk of a streamed one.
+type ChatResponse struct {
+	Id      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []ChatChoice   `json:"choices"`
+	Usage   *TokenUsage    `json:"usage,omitempty"`
+	Error   *ErrorResponse `json:"error,omitempty"`
+}
+
+// ChatHandler serves OpenAI-style chat completions from Ollama's chat API,
+// as used by the Copilot Chat panels.
+type ChatHandler struct {
+	api        Generator
+	model      string
+	models     ModelMap
+	options    ModelOptions
+	limiter    *limiter.Limiter
+	userHeader string
+	logger     *zap.Logger
+}
+
+// NewChatHandler constructs a new ChatHandler. The model the client asks
+// for names a hosted model, so requests are answered by the Ollama model
+// models maps it to, or by model when it is not mapped, with the options
+// of the requested model. A nil logger discards its logs.
+func NewChatHandler(api Generator, model string, models ModelMap, options ModelOptions, limiter *limiter.Limiter, userHeader string, logger *zap.Logger) *ChatHandler {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return &ChatHandler{api: api, model: model, models: models, options: options, limiter: limiter, userHeader: userHeader, logger: logger}
+}
+
+// ServeHTTP handles a chat completions request.
+func (h *ChatHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logger.Error("Failed to decode chat request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(req.Messages) == 0 {
+		writeValidationError(w, []FieldError{{Field: "messages", Message: "must contain at least one message"}})
+		return
+	}
+	if errs := req.Stop.check("stop"); len(errs) > 0 {
+		writeValidationError(w, errs)
+		return
+	}
+
+	id := "chatcmpl-" + uuid.New().String()
+	middleware.AddLogField(r.Context(), "completion_id", id)
+	middleware.AddLogField(r.Context(), "requested_model", req.Model)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	defer cancel()
+
+	chatReq := h.chatRequest(req)
+	user := requestUser(r, h.userHeader)
+
+	if rejectQueueFull(ctx, w, h.limiter) {
+		return
+	}
+	defer metrics.InFlight.Start(r.URL.Path, chatReq.Model)()
+
+	release, err := acquireSlot(ctx, h.limiter, r.URL.Path)
+	if err != nil {
+		h.writeError(ctx, w, id, chatReq.Model, req.Stream, fmt.Errorf("waiting for a generation slot: %w", err))
+		return
+	}
+	defer release()
+
+	if req.Stream {
+		h.stream(ctx, w, id, user, chatReq)
+		return
+	}
+
+	var content strings.Builder
+	var final api.ChatResponse
+	err = h.api.Chat(ctx, chatReq, func(resp api.ChatResponse) error {
+		content.WriteString(resp.Message.Content)
+		if resp.Done {
+			final = resp
+		}
+		return nil
+	})
+	reportHealth(err)
+	if err != nil {
+		h.logger.Warn("Chat generation failed", zap.Error(err))
+		h.writeError(ctx, w, id, chatReq.Model, false, err)
+		return
+	}
+	recordEvalMetrics(ctx, chatReq.Model, user, final.Metrics)
+
+	reason := finishReason(final.Metrics, numPredictOf(chatReq.Options))
+	writeJSON(w, http.StatusOK, ChatResponse{
+		Id:      id,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   chatReq.Model,
+		Choices: []ChatChoice{{
+			Message:      &ChatMessage{Role: "assistant", Content: ChatContent(content.String())},
+			FinishReason: &reason,
+		}},
+		Usage: tokenUsage(final.Metrics),
+	})
+}
+
+// stream writes the chat completion as SSE deltas ending with a finish
+// reason chunk and the [DONE] terminator.
+func (h *ChatHandler) stream(ctx context.Context, w http.ResponseWriter, id, user string, chatReq *api.ChatRequest) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	chunk := func(delta ChatDelta, finishReason *string) ChatResponse {
+		return ChatResponse{
+			Id:      id,
+			Object:  "chat.completion.chunk",
+			Created: time.Now().Unix(),
+			Model:   chatReq.Model,
+			Choices: []ChatChoice{{Delta: &delta, FinishReason: finishReason}},
+		}
+	}
+
+	h.writeEvent(w, chunk(ChatDelta{Role: "assistant"}, nil))
+	var final api.Metrics
+	err := h.api.Chat(ctx, chatReq, func(resp api.ChatResponse) error {
+		if resp.Message.Content != "" {
+			h.writeEvent(w, chunk(ChatDelta{Content: resp.Message.Content}, nil))
+		}
+		if resp.Done {
+			final = resp.Metrics
+			recordEvalMetrics(ctx, chatReq.Model, user, resp.Metrics)
+		}
+		return nil
+	})
+	reportHealth(err)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		h.logger.Warn("Chat generation failed", zap.Error(err))
+		h.writeError(ctx, w, id, chatReq.Model, true, err)
+		return
+	}
+
+	reason := finishReason(final, numPredictOf(chatReq.Options))
+	last := chunk(ChatDelta{}, &reason)
+	last.Usage = tokenUsage(final)
+	h.writeEvent(w, last)
+	h.done(w)
+}
+
+// chatRequest translates req into an Ollama chat request.
+func (h *ChatHandler) chatRequest(req ChatRequest) *api.ChatRequest {
+	messages := make([]api.Message, len(req.Messages))
+	for i, m := range req.Messages {
+		messages[i] = api.Message{Role: m.Role, Content: string(m.Content)}
+	}
+
+	options := map[string]interface{}{}
+	if req.Temperature != nil {
+		options["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		options["top_p"] = *req.TopP
+	}
+	if req.MaxTokens > 0 {
+		options["num_predict"] = req.MaxTokens
+	}
+	if stop := req.Stop.clean(); len(stop) > 0 {
+		options["stop"] = stop
+	}
+	// The options of the requested model replace the client's, though
+	// num_predict stays within its max_tokens.
+	for name, value := range h.options[req.Model] {
+		options[name] = value
+	}
+	dropDrafts(options, draftsOf(h.api))
+	if n := numPredictOf(options); req.MaxTokens > 0 && n > req.MaxTokens {
+		options["num_predict"] = req.MaxTokens
+	}
+
+	stream := req.Stream
+	return &api.ChatRequest{Model: h.models.Resolve(req.Model, h.model), Messages: messages, Stream: &stream, Options: options}
+}
+
+// writeError records err and reports it to the client, as a final event
+// when streaming and as a 502 otherwise.
+func (h *ChatHandler) writeError(ctx context.Context, w http.ResponseWriter, id, model string, streaming bool, err error) {
+	class := classifyError(err)
+	metrics.OllamaErrors.Inc(class)
+	middleware.AddLogField(ctx, "error", class)
+	middleware.ResponseFailed(ctx)
+
+	if class == errCanceled {
+		return
+	}
+	metrics.RecentErrors.Add(class, model)
+
+	resp := ChatResponse{
+		Id:      id,
+		Object:  "chat.completion.chunk",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []ChatChoice{},
+		Error:   &ErrorResponse{Message: errMessages[class], Type: "backend_error", Code: class},
+	}
+	if !streaming {
+		resp.Object = "chat.completion"
+		writeJSON(w, http.StatusBadGateway, resp)
+		return
+	}
+	h.writeEvent(w, resp)
+	h.done(w)
+}
+
+// writeEvent writes v as a single SSE data event.
+func (h *ChatHandler) writeEvent(w http.ResponseWriter, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		h.logger.Warn("Failed to encode SSE event", zap.Error(err))
+		return
+	}
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+		h.logger.Warn("Failed to write SSE event", zap.Error(err))
+		return
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// done writes the [DONE] terminator OpenAI clients wait for.
+func (h *ChatHandler) done(w http.ResponseWriter) {
+	if _, err := fmt.Fprint(w, "data: [DONE]\n\n"); err != nil {
+		h.logger.Warn("Failed to write SSE terminator", zap.Error(err))
+		return
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
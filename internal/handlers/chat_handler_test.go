@@ -0,0 +1,177 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/handlers"
+	"github.com/ollama/ollama/api"
+	"go.uber.org/zap"
+)
+
+// fakeChat starts a server answering /api/chat with chat and returns a
+// ChatHandler backed by it.
+func fakeChat(t *testing.T, chat func(w http.ResponseWriter, req api.ChatRequest)) *handlers.ChatHandler {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/chat" {
+			t.Errorf("expected a request to /api/chat, got %s", r.URL.Path)
+		}
+		var req api.ChatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode chat request: %v", err)
+			return
+		}
+		chat(w, req)
+	}))
+	t.Cleanup(srv.Close)
+
+	t.Setenv("OLLAMA_HOST", srv.URL)
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handlers.NewChatHandler(client, "chat-model", nil, nil, nil, "", zap.NewNop())
+}
+
+func writeChatChunks(w http.ResponseWriter, model string, chunks ...string) {
+	enc := json.NewEncoder(w)
+	for i, chunk := range chunks {
+		_ = enc.Encode(api.ChatResponse{Model: model, Message: api.Message{Role: "assistant", Content: chunk}, Done: i == len(chunks)-1})
+	}
+}
+
+func TestChatHandler_Stream(t *testing.T) {
+	var got api.ChatRequest
+	h := fakeChat(t, func(w http.ResponseWriter, req api.ChatRequest) {
+		got = req
+		writeChatChunks(w, req.Model, "Hello", " world", "")
+	})
+
+	body := `{"model":"gpt-4o","stream":true,"temperature":0.1,"messages":[
+		{"role":"system","content":"Be brief."},
+		{"role":"user","content":[{"type":"text","text":"Say hi"}]}]}`
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/chat/completions", strings.NewReader(body)))
+
+	if got.Model != "chat-model" {
+		t.Errorf("expected the configured model to answer, got %q", got.Model)
+	}
+	if len(got.Messages) != 2 || got.Messages[1].Content != "Say hi" {
+		t.Errorf("expected the text parts to be forwarded, got %+v", got.Messages)
+	}
+	if got.Options["temperature"] != 0.1 {
+		t.Errorf("expected temperature 0.1, got %v", got.Options["temperature"])
+	}
+
+	events := strings.Split(strings.TrimSpace(rr.Body.String()), "\n\n")
+	if last := events[len(events)-1]; last != "data: [DONE]" {
+		t.Fatalf("expected the stream to end with [DONE], got %q", last)
+	}
+
+	var text strings.Builder
+	var finish string
+	for _, event := range events[:len(events)-1] {
+		var chunk handlers.ChatResponse
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(event, "data: ")), &chunk); err != nil {
+			t.Fatalf("failed to decode chunk %q: %v", event, err)
+		}
+		if chunk.Object != "chat.completion.chunk" {
+			t.Errorf("expected chat.completion.chunk, got %q", chunk.Object)
+		}
+		text.WriteString(chunk.Choices[0].Delta.Content)
+		if fr := chunk.Choices[0].FinishReason; fr != nil {
+			finish = *fr
+		}
+	}
+	if text.String() != "Hello world" {
+		t.Errorf("expected the deltas to add up to %q, got %q", "Hello world", text.String())
+	}
+	if finish != "stop" {
+		t.Errorf("expected finish reason stop, got %q", finish)
+	}
+}
+
+func TestChatHandler_NoStream(t *testing.T) {
+	h := fakeChat(t, func(w http.ResponseWriter, req api.ChatRequest) {
+		_ = json.NewEncoder(w).Encode(api.ChatResponse{
+			Model:   req.Model,
+			Message: api.Message{Role: "assistant", Content: "Hi"},
+			Done:    true,
+			Metrics: api.Metrics{PromptEvalCount: 12, EvalCount: 2},
+		})
+	})
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"hi"}]}`)))
+
+	var resp handlers.ChatResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Object != "chat.completion" || resp.Choices[0].Message == nil || resp.Choices[0].Message.Content != "Hi" {
+		t.Errorf("expected a complete assistant message, got %+v", resp)
+	}
+	if resp.Usage == nil || resp.Usage.TotalTokens != 14 {
+		t.Errorf("expected 14 total tokens, got %+v", resp.Usage)
+	}
+	if fr := resp.Choices[0].FinishReason; fr == nil || *fr != "stop" {
+		t.Errorf("expected finish reason stop, got %v", fr)
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"messages":[{"role":"user","content":"hi"}],"max_tokens":2}`)))
+	resp = handlers.ChatResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if fr := resp.Choices[0].FinishReason; fr == nil || *fr != "length" {
+		t.Errorf("expected finish reason length when max_tokens is reached, got %v", fr)
+	}
+}
+
+func TestChatHandler_Error(t *testing.T) {
+	h := fakeChat(t, func(w http.ResponseWriter, req api.ChatRequest) {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "model 'chat-model' not found, try pulling it first"})
+	})
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/chat/completions", strings.NewReader(`{"stream":true,"messages":[{"role":"user","content":"hi"}]}`)))
+
+	if !strings.Contains(rr.Body.String(), `"code":"model_not_found"`) || !strings.HasSuffix(rr.Body.String(), "data: [DONE]\n\n") {
+		t.Errorf("expected a model_not_found error event followed by [DONE], got %s", rr.Body.String())
+	}
+}
+
+func TestChatHandler_ModelOptions(t *testing.T) {
+	var got api.ChatRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("failed to decode chat request: %v", err)
+		}
+		writeChatChunks(w, got.Model, "ok", "")
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("OLLAMA_HOST", srv.URL)
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := handlers.ModelOptions{"gpt-4o": {"temperature": 0.3, "num_predict": 800}}
+	h := handlers.NewChatHandler(client, "chat-model", nil, options, nil, "", zap.NewNop())
+	body := `{"model":"gpt-4o","temperature":0.1,"max_tokens":500,"messages":[{"role":"user","content":"hi"}]}`
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/chat/completions", strings.NewReader(body)))
+
+	if got.Options["temperature"] != 0.3 {
+		t.Errorf("expected the model's temperature to replace the client's, got %v", got.Options["temperature"])
+	}
+	if got.Options["num_predict"] != float64(500) {
+		t.Errorf("expected num_predict to stay within max_tokens, got %v", got.Options["num_predict"])
+	}
+}
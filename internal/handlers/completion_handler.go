@@ -3,35 +3,134 @@ package handlers
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/josuemontano/ollama-copilot/internal/backends"
+	"github.com/josuemontano/ollama-copilot/internal/cache"
+	"github.com/josuemontano/ollama-copilot/internal/corpus"
+	"github.com/josuemontano/ollama-copilot/internal/events"
+	"github.com/josuemontano/ollama-copilot/internal/health"
+	"github.com/josuemontano/ollama-copilot/internal/lang"
+	"github.com/josuemontano/ollama-copilot/internal/limiter"
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+	"github.com/josuemontano/ollama-copilot/internal/project"
+	"github.com/josuemontano/ollama-copilot/internal/rules"
+	"github.com/josuemontano/ollama-copilot/internal/stream"
+	"github.com/josuemontano/ollama-copilot/internal/templates"
+	"github.com/josuemontano/ollama-copilot/internal/tokenizer"
+	"github.com/josuemontano/ollama-copilot/internal/tracing"
 	"github.com/ollama/ollama/api"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+// PromptTemplateHeader selects one of the named prompt templates for a
+// single request.
+const PromptTemplateHeader = "X-Prompt-Template"
+
+// DebugPromptHeader set to "true" makes the handler return the Ollama
+// request it would send, as a DebugPrompt, instead of generating.
+const DebugPromptHeader = "X-Debug-Prompt"
+
+// SuggestionMetadataHeader set to "true" adds a SuggestionMetadata to the
+// choices of a completion response.
+const SuggestionMetadataHeader = "X-Suggestion-Metadata"
+
+// CompletionIDHeader carries the ID shared by every chunk of a completion,
+// which clients send back with feedback.
+const CompletionIDHeader = "X-Completion-Id"
+
+// DefaultContextLines is how many lines before and after the cursor are put
+// in the prompt when CompletionConfig sets none.
+const DefaultContextLines = 60
+
+// DefaultNumCtx is Ollama's context window for models that set none.
+const DefaultNumCtx = 2048
+
+// DefaultRequestTimeout bounds completion requests unless configured
+// otherwise.
+const DefaultRequestTimeout = time.Minute
+
+// MaxRequestBytes bounds the body of a completion request, as it does that
+// of a request IdempotencyMiddleware reads.
+const MaxRequestBytes = middleware.MaxRequestBytes
+
+// errFirstTokenTimeout is the cause a generation is canceled with when the
+// model produces no token within the first-token timeout.
+var errFirstTokenTimeout = errors.New("no token within the first-token timeout")
+
 // CompletionRequest represents the request sent to the completion handler.
 type CompletionRequest struct {
 	Extra struct {
-		Language          string `json:"language"`
-		NextIndent        int    `json:"next_indent"`
-		PromptTokens      int    `json:"prompt_tokens"`
-		SuffixTokens      int    `json:"suffix_tokens"`
-		TrimByIndentation bool   `json:"trim_by_indentation"`
+		Language     string `json:"language"`
+		PromptTokens int    `json:"prompt_tokens"`
+		SuffixTokens int    `json:"suffix_tokens"`
+		// TrimByIndentation ends the completion before the first line
+		// indented no deeper than NextIndent, the indentation in columns
+		// of the next line with text after the cursor.
+		TrimByIndentation bool `json:"trim_by_indentation"`
+		NextIndent        int  `json:"next_indent"`
+		// URI and Position, sent by clients built on the language server
+		// protocol, are the document being completed and the cursor in
+		// it. The URI takes precedence over a path comment in the prompt.
+		URI      string    `json:"uri"`
+		Position *Position `json:"position"`
+		// Range, sent with Position, is the document text the completion
+		// replaces, such as the rest of the identifier at the cursor. The
+		// choices then say what they replace, see ChoiceResponse.Range.
+		Range *Range `json:"range"`
 	} `json:"extra"`
-	MaxTokens   int      `json:"max_tokens"`
-	N           int      `json:"n"`
-	Prompt      string   `json:"prompt"`
-	Stop        []string `json:"stop"`
-	Stream      bool     `json:"stream"`
-	Suffix      string   `json:"suffix"`
-	Temperature float64  `json:"temperature"`
-	TopP        int      `json:"top_p"`
+	MaxTokens int `json:"max_tokens"`
+	// Model names the Copilot model the client wants, which Models maps to
+	// an Ollama model. When empty, the engine in the request path is used.
+	Model  string        `json:"model"`
+	N      int           `json:"n"`
+	Prompt string        `json:"prompt"`
+	Stop   StopSequences `json:"stop"`
+	// Stream chooses between a stream of events and a single JSON
+	// response, see streaming.
+	Stream      *bool   `json:"stream"`
+	Suffix      string  `json:"suffix"`
+	Temperature float64 `json:"temperature"`
+	TopP        float64 `json:"top_p"`
+}
+
+// streaming reports whether the response is a stream of events. When the
+// request does not say, a single completion is streamed, as Copilot
+// clients expect, and the completions panel answers with one JSON object.
+func (r CompletionRequest) streaming() bool {
+	if r.Stream == nil {
+		return r.N <= 1
+	}
+	return *r.Stream
+}
+
+// path returns the path of the document being completed, from its URI or
+// the path comment of the prompt, or "" when neither names one.
+func (r CompletionRequest) path() string {
+	if path := lang.PathFromURI(r.Extra.URI); path != "" {
+		return path
+	}
+	return lang.PathFromPrompt(r.Prompt)
 }
 
 // ChoiceResponse is a single completion choice.
@@ -39,13 +138,55 @@ type ChoiceResponse struct {
 	Text         string `json:"text"`
 	Index        int    `json:"index"`
 	FinishReason string `json:"finish_reason,omitempty"`
+	// Range is set for requests with extra.range, to the range the choice
+	// replaces. The text of the choice then starts at the start of the
+	// range rather than at the cursor.
+	Range *Range `json:"range,omitempty"`
+	// Metadata is an extension Copilot clients ignore, only sent when the
+	// request asks for it with SuggestionMetadataHeader. A streamed
+	// completion carries it on its last event.
+	Metadata *SuggestionMetadata `json:"ollama_copilot,omitempty"`
+}
+
+// SuggestionMetadata explains how a choice was produced, for plugins that
+// show why a suggestion was made and for evaluating completions offline.
+type SuggestionMetadata struct {
+	// Model is the Ollama model that generated the choice.
+	Model string `json:"model"`
+	// Mode is the completion mode the cursor position resolved to.
+	Mode CompletionMode `json:"mode,omitempty"`
+	// Cache is "hit" or "extension" when the choice was served from the
+	// completion cache.
+	Cache string `json:"cache,omitempty"`
+	// Filters are the stream stages that cut or rewrote the generation.
+	Filters []string `json:"filters,omitempty"`
+	// Score is the share of the completions panel's generations that
+	// produced the choice.
+	Score float64 `json:"score,omitempty"`
+	// GenerationMs is how long generating the choice took.
+	GenerationMs int64 `json:"generation_ms"`
 }
 
 // CompletionResponse is the full response returned to the client.
 type CompletionResponse struct {
-	Id      string           `json:"id"`
+	// Id is the same on every event of a completion.
+	Id string `json:"id"`
+	// Object is always "text_completion", as in the Codex schema.
+	Object  string           `json:"object"`
 	Created int64            `json:"created"`
+	Model   string           `json:"model"`
 	Choices []ChoiceResponse `json:"choices"`
+	// Usage is set on the last event of a completion Ollama generated to
+	// the end.
+	Usage *TokenUsage    `json:"usage,omitempty"`
+	Error *ErrorResponse `json:"error,omitempty"`
+}
+
+// ErrorResponse describes why a completion stream ended early.
+type ErrorResponse struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    string `json:"code"`
 }
 
 // Prompt represents a FIM prompt with prefix/suffix.
@@ -63,170 +204,1468 @@ func (p Prompt) Generate(tmpl *template.Template) (string, error) {
 	return buf.String(), nil
 }
 
-// CompletionHandler streams completions from Ollama.
+// CompletionConfig holds the generation settings shared by all completion requests.
+type CompletionConfig struct {
+	// Model is the primary Ollama model used for completions.
+	Model string
+	// Models routes requested Copilot model names to other Ollama models.
+	Models ModelMap
+	// ModelOptions are the Ollama options of requested Copilot model
+	// names, such as a smaller num_predict for copilot-codex.
+	ModelOptions ModelOptions
+	// FallbackModel, when set, answers requests the primary model fails or
+	// does not start answering within FallbackAfter.
+	FallbackModel string
+	FallbackAfter time.Duration
+	// PromptTemplate renders the FIM prompt from a Prompt.
+	PromptTemplate *template.Template
+	// SystemTemplate, when set, renders the system prompt from a systemData
+	// in place of the built-in ones.
+	SystemTemplate *template.Template
+	// NoSystem sends completions without a system prompt, for models that
+	// do worse with one.
+	NoSystem bool
+	// Raw sends the rendered prompt to the model verbatim, bypassing the
+	// model's own template. Raw prompts have no system prompt.
+	Raw bool
+	// Stop are stop tokens added to every request, such as the special
+	// tokens of the model's FIM format.
+	Stop       []string
+	NumPredict int
+	// FunctionNumPredict is the num_predict of ModeFunction completions,
+	// which write whole function bodies. It only applies when larger than
+	// NumPredict, and the request's max_tokens still bounds it.
+	FunctionNumPredict int
+	// PrefixLines and SuffixLines are how many lines before and after the
+	// cursor are put in the prompt, DefaultContextLines when zero. Path
+	// rules with MaxLines override both, and the prompt_tokens and
+	// suffix_tokens budgets of a request cut them further.
+	PrefixLines int
+	SuffixLines int
+	// NumCtx is the model's context window in tokens, sent to Ollama as
+	// num_ctx. Prompts are cut to fit it with room for NumPredict tokens.
+	// Zero leaves both to Ollama.
+	NumCtx int
+	// Limiter, when set, bounds the number of concurrent generations.
+	Limiter *limiter.Limiter
+	// DefaultLanguage is used when the client reports no language and none
+	// can be inferred from the prompt.
+	DefaultLanguage string
+	// Rules override the model, template and context size per file path.
+	Rules *rules.Set
+	// LanguageParams override generation settings per language.
+	LanguageParams lang.Table
+	// Templates are the named prompt templates selectable with
+	// PromptTemplateHeader.
+	Templates *templates.Set
+	// UserHeader names the request header that identifies the user in
+	// the usage export. Without it, or when the header is missing, the
+	// client's IP address is used.
+	UserHeader string
+	// Project, when set, provides a project summary that is prepended to
+	// the system prompt.
+	Project *project.Summarizer
+	// Tokenizer counts prompt tokens, defaulting to tokenizer.Default.
+	Tokenizer tokenizer.Tokenizer
+	// Backends, when set, picks the Ollama server for each completion
+	// instead of the client's.
+	Backends *backends.Pool
+	// Cache, when set, serves repeated requests without generating.
+	Cache *cache.Cache
+	// Mode cuts completions to the cursor line or block. The zero value
+	// streams everything, like ModeFull.
+	Mode CompletionMode
+	// CancelSuperseded cancels a running generation when the same client
+	// asks for a completion at the same document position again.
+	CancelSuperseded bool
+	// CommentLanguage, when set, is the natural language, such as Spanish,
+	// the system prompt asks the model to write comments and docs in.
+	CommentLanguage string
+	// ResumeWindow, when set, lets a client whose connection dropped resume
+	// a streamed completion with LastEventIDHeader for that long, and keeps
+	// the completion generating for that long without a client.
+	ResumeWindow time.Duration
+	// RequestTimeout bounds each completion request, DefaultRequestTimeout
+	// when zero.
+	RequestTimeout time.Duration
+	// FirstTokenTimeout, when set, gives up on a generation that produces
+	// no token for that long and answers the request empty.
+	FirstTokenTimeout time.Duration
+	// RetryBudget is how long generations failing with transient errors,
+	// such as Ollama restarting, are retried for before the error is
+	// returned. Zero disables retries.
+	RetryBudget time.Duration
+	// PostProcess is the chain completions stream through, before Mode
+	// cuts them. Nil is the chain of DefaultPostProcess.
+	PostProcess []PostProcessor
+	// Rejections, when set, keeps suggestions the user rejected from being
+	// shown again at the same position of the same session. It is shared
+	// with the FeedbackHandler the rejections are reported to.
+	Rejections *Rejections
+	// Corpus, when set, records the prompt and text of every completion
+	// generated.
+	Corpus *corpus.Corpus
+	// Bursts, when set, are the users whose completions come from a larger
+	// model for a while, see BurstHandler.
+	Bursts *Bursts
+	// StickyRouting sends completions whose prompts start the same way to
+	// the backend that served the last one, see backends.Pool.Sticky.
+	StickyRouting bool
+}
+
+// CompletionHandler streams completions from Ollama. It is shared by every
+// completion route and request. Requests read an immutable snapshot of its
+// settings when they start, so Configure never affects a request in flight.
 type CompletionHandler struct {
-	api        *api.Client
-	model      string
-	promptTmpl *template.Template
-	systemTmpl *template.Template
-	numPredict int
-	logger     *zap.Logger
-}
-
-// NewCompletionHandler constructs a new CompletionHandler.
-func NewCompletionHandler(api *api.Client, model string, promptTmpl *template.Template, numPredict int, logger *zap.Logger) *CompletionHandler {
-	systemTmpl := template.Must(template.New("system").Parse(
-		`You are an expert programming assistant for {{.Language}}. 
+	api      Generator
+	settings atomic.Pointer[completionSettings]
+	running  superseder
+	replays  replays
+	logger   *zap.Logger
+	// fallingBack is set while the fallback model answers in place of the
+	// primary, so that the switches each way are published once.
+	fallingBack atomic.Bool
+	// reconfiguring serializes Reconfigure, so that no change is lost.
+	reconfiguring sync.Mutex
+}
+
+// completionSettings is a snapshot of a CompletionConfig. It is never
+// modified once stored.
+type completionSettings struct {
+	// config is what the settings were built from, for Config.
+	config        CompletionConfig
+	model         string
+	models        ModelMap
+	modelOptions  ModelOptions
+	fallbackModel string
+	fallbackAfter time.Duration
+	promptTmpl    *template.Template
+	systemTmpl    *template.Template
+	noSystem      bool
+	raw           bool
+	stop          []string
+	numPredict    int
+	fnNumPredict  int
+	prefixLines   int
+	suffixLines   int
+	numCtx        int
+	limiter       *limiter.Limiter
+	defaultLang   string
+	rules         *rules.Set
+	langParams    lang.Table
+	templates     *templates.Set
+	project       *project.Summarizer
+	userHeader    string
+	tokenizer     tokenizer.Tokenizer
+	mode          CompletionMode
+	backends      *backends.Pool
+	cache         *cache.Cache
+	supersede     bool
+	commentLang   string
+	resumeWindow  time.Duration
+	timeout       time.Duration
+	firstToken    time.Duration
+	retryBudget   time.Duration
+	postProcess   []PostProcessor
+	rejections    *Rejections
+	corpus        *corpus.Corpus
+	bursts        *Bursts
+	sticky        bool
+	windows       *windowCache
+	// infill is set when the generator is an Infiller, and completions
+	// are not templated.
+	infill bool
+	// drafts are the DraftOptions the generator takes.
+	drafts []string
+	// minNumPredict is the least num_predict of completions in burst
+	// mode, whatever the language params say.
+	minNumPredict int
+	// bursting is set in burst mode, where the burst model replaces the
+	// models of the language params.
+	bursting bool
+}
+
+var systemTmpl = template.Must(template.New("system").Parse(
+	`You are an expert programming assistant for {{.Language}}. 
 Your task is to perform Fill-in-the-Middle (FIM) code completion. Complete only the code that fits between the given prefix and suffix. 
 You may generate code, comments, type annotations, and meta comments in the middle section. 
-Do not add explanations, comments, or markdown. Do not change code outside the specified boundaries.`))
+Do not add explanations, comments, or markdown. Do not change code outside the specified boundaries.{{if .CommentLanguage}} 
+Write any comments and documentation in {{.CommentLanguage}}, whatever language the surrounding code uses.{{end}}`))
+
+// functionSystemTmpl replaces systemTmpl when the cursor is in the empty
+// body of a function, which ModeFunction completes as a whole.
+var functionSystemTmpl = template.Must(template.New("system").Parse(
+	`You are an expert programming assistant for {{.Language}}. 
+Your task is to perform Fill-in-the-Middle (FIM) code completion. The prefix ends inside the empty body of a function. 
+Write the complete body of that function, implementing what its name, signature and doc comment describe, and stop at the end of the function. 
+Do not add explanations or markdown. Do not change code outside the specified boundaries.{{if .CommentLanguage}} 
+Write any comments and documentation in {{.CommentLanguage}}, whatever language the surrounding code uses.{{end}}`))
+
+// testSystemTmpl replaces systemTmpl in test files.
+var testSystemTmpl = template.Must(template.New("system").Parse(
+	`You are an expert programming assistant for {{.Language}}, writing tests. 
+Your task is to perform Fill-in-the-Middle (FIM) code completion in a test file. Complete only the code that fits between the given prefix and suffix. 
+Follow the test framework, helpers and naming already used in the file. Prefer concrete inputs and precise assertions on the expected results, and complete one test case at a time. 
+Do not add explanations, comments, or markdown. Do not change code outside the specified boundaries.{{if .CommentLanguage}} 
+Write any comments and documentation in {{.CommentLanguage}}, whatever language the surrounding code uses.{{end}}`))
+
+// systemData is rendered by the system prompt templates.
+type systemData struct {
+	Language        string
+	CommentLanguage string
+	// Mode is the completion mode, and Test is set in test files, for
+	// templates that adapt to them as the built-in ones do.
+	Mode CompletionMode
+	Test bool
+}
+
+// NewCompletionHandler constructs a new CompletionHandler. A nil logger
+// discards its logs.
+func NewCompletionHandler(api Generator, config CompletionConfig, logger *zap.Logger) *CompletionHandler {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	ch := &CompletionHandler{api: api, logger: logger}
+	ch.Configure(config)
+	return ch
+}
+
+// Configure replaces the handler's settings. Requests already in flight
+// finish with the settings they started with. The Stop and Models of config
+// are copied; the rules, tables, templates and summarizer it points to must
+// not be modified afterwards.
+func (ch *CompletionHandler) Configure(config CompletionConfig) {
+	tok := config.Tokenizer
+	if tok == nil {
+		tok = tokenizer.Default
+	}
 
-	return &CompletionHandler{
-		api:        api,
-		model:      model,
-		promptTmpl: promptTmpl,
-		systemTmpl: systemTmpl,
-		numPredict: numPredict,
-		logger:     logger,
+	previous := ch.settings.Swap(&completionSettings{
+		config:        config,
+		model:         config.Model,
+		models:        maps.Clone(config.Models),
+		modelOptions:  maps.Clone(config.ModelOptions),
+		fallbackModel: config.FallbackModel,
+		fallbackAfter: config.FallbackAfter,
+		promptTmpl:    config.PromptTemplate,
+		systemTmpl:    config.SystemTemplate,
+		noSystem:      config.NoSystem,
+		raw:           config.Raw,
+		stop:          slices.Clone(config.Stop),
+		numPredict:    config.NumPredict,
+		fnNumPredict:  config.FunctionNumPredict,
+		prefixLines:   orDefault(config.PrefixLines, DefaultContextLines),
+		suffixLines:   orDefault(config.SuffixLines, DefaultContextLines),
+		numCtx:        config.NumCtx,
+		limiter:       config.Limiter,
+		defaultLang:   config.DefaultLanguage,
+		rules:         config.Rules,
+		langParams:    config.LanguageParams,
+		templates:     config.Templates,
+		project:       config.Project,
+		userHeader:    config.UserHeader,
+		tokenizer:     tok,
+		windows:       newWindowCache(tok, config.NumCtx > 0),
+		infill:        infills(ch.api),
+		drafts:        draftsOf(ch.api),
+		mode:          config.Mode,
+		backends:      config.Backends,
+		cache:         config.Cache,
+		supersede:     config.CancelSuperseded,
+		commentLang:   config.CommentLanguage,
+		resumeWindow:  config.ResumeWindow,
+		timeout:       orDefault(config.RequestTimeout, DefaultRequestTimeout),
+		firstToken:    config.FirstTokenTimeout,
+		retryBudget:   config.RetryBudget,
+		postProcess:   orDefaultChain(config.PostProcess),
+		rejections:    config.Rejections,
+		corpus:        config.Corpus,
+		bursts:        config.Bursts,
+		sticky:        config.StickyRouting,
+	})
+	if previous != nil {
+		events.Publish(events.ConfigReloaded, events.Fields{"handler": "completions", "model": config.Model})
 	}
 }
 
+// Config returns the configuration of the handler's current settings. Its
+// Stop, Models and ModelOptions are copies.
+func (ch *CompletionHandler) Config() CompletionConfig {
+	config := ch.settings.Load().config
+	config.Stop = slices.Clone(config.Stop)
+	config.Models = maps.Clone(config.Models)
+	config.ModelOptions = maps.Clone(config.ModelOptions)
+	return config
+}
+
+// Reconfigure changes the current configuration with change and applies
+// it, as Configure does, then returns it. Concurrent calls are applied one
+// after the other, each to the configuration the last one left.
+func (ch *CompletionHandler) Reconfigure(change func(config *CompletionConfig)) CompletionConfig {
+	ch.reconfiguring.Lock()
+	defer ch.reconfiguring.Unlock()
+
+	config := ch.Config()
+	change(&config)
+	ch.Configure(config)
+	return ch.Config()
+}
+
 // ServeHTTP handles completion requests.
 func (ch *CompletionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	settings := ch.settings.Load()
+	if last := r.Header.Get(LastEventIDHeader); last != "" && settings.resumeWindow > 0 && ch.resume(w, r, last) {
+		return
+	}
+	user := requestUser(r, settings.userHeader)
+	if _, ok := settings.bursts.Until(user); ok {
+		settings = settings.burst()
+		middleware.AddLogField(r.Context(), "burst", true)
+	}
 
-	var req CompletionRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		ch.logger.Error("Failed to decode request", zap.Error(err))
-		w.WriteHeader(http.StatusBadRequest)
+	_, span := tracing.Tracer().Start(r.Context(), "decode request")
+	req, ok := ch.decodeRequest(w, r)
+	span.End()
+	if !ok {
+		return
+	}
+
+	if req.Extra.Language == "" {
+		req.Extra.Language = lang.FromPath(req.path())
+	}
+	if req.Extra.Language == "" {
+		req.Extra.Language = lang.Infer(req.Prompt, settings.defaultLang)
+	}
+	if req.Model == "" {
+		req.Model = engineFromPath(r.URL.Path)
+	}
+	middleware.AddLogField(r.Context(), "requested_model", req.Model)
+	req, replace, _ := req.cutRange()
+
+	var selected *template.Template
+	if name := r.Header.Get(PromptTemplateHeader); name != "" {
+		tmpl, ok := settings.templates.Lookup(name)
+		if !ok {
+			ch.logger.Warn("Unknown prompt template requested", zap.String("template", name))
+			http.Error(w, fmt.Sprintf("unknown prompt template %q", name), http.StatusBadRequest)
+			return
+		}
+		selected = tmpl
+		w.Header().Set(PromptTemplateHeader, name)
+	}
+
+	if r.Header.Get(DebugPromptHeader) == "true" {
+		ch.writeDebugPrompt(w, settings, req, selected)
+		return
+	}
+
+	id := uuid.New().String()
+	middleware.AddLogField(r.Context(), "completion_id", id)
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String(tracing.IDAttribute, id))
+
+	ch.logger.Debug("Incoming completion request", zap.String("id", id), zap.Any("request", req))
+	w.Header().Set(CompletionIDHeader, id)
+	if states := health.States(health.Default.Conditions()); states != "" {
+		w.Header().Set(health.Header, states)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), settings.timeout)
+	defer cancel()
+
+	info := requestInfo{
+		id:       id,
+		path:     r.URL.Path,
+		user:     user,
+		session:  r.Header.Get(SessionHeader),
+		metadata: r.Header.Get(SuggestionMetadataHeader) == "true",
+		replace:  replace,
+	}
+	if rejectQueueFull(ctx, w, settings.limiter) {
+		return
+	}
+	if req.N > 1 {
+		if err := ch.servePanel(ctx, w, settings, info, req, selected); err != nil {
+			ch.logger.Error("Panel completion generation failed", zap.Error(err))
+			http.Error(w, "generating completions", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !req.streaming() {
+		if err := ch.serveJSON(ctx, w, settings, info, req, selected); err != nil {
+			ch.logger.Error("Completion generation failed", zap.Error(err))
+			http.Error(w, "generating completion", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if settings.resumeWindow > 0 {
+		ch.serveResumable(w, r, settings, info, req, selected)
 		return
 	}
 
-	ch.logger.Debug("Incoming completion request", zap.Any("request", req))
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.WriteHeader(http.StatusOK)
+	if err := ch.generateCompletion(ctx, w, settings, info, req, selected); err != nil {
+		ch.logger.Error("Completion generation failed", zap.Error(err))
+	}
+}
 
-	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
-	defer cancel()
+// decodeRequest reads and validates a completion request. It answers the
+// request itself and returns false when the request is malformed or
+// invalid.
+func (ch *CompletionHandler) decodeRequest(w http.ResponseWriter, r *http.Request) (CompletionRequest, bool) {
+	var req CompletionRequest
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxRequestBytes))
+	if err != nil {
+		ch.logger.Error("Failed to read request", zap.Error(err))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		return req, false
+	}
 
-	if err := ch.generateCompletion(ctx, w, req); err != nil {
-		ch.logger.Error("Completion generation failed", zap.Error(err))
+	if err := json.Unmarshal(body, &req); err != nil {
+		ch.logger.Error("Failed to decode request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return req, false
+	}
+
+	if unknown := unknownFields(body); len(unknown) > 0 {
+		ch.logger.Info("Completion request has unknown fields", zap.Strings("fields", unknown))
+		for _, field := range unknown {
+			metrics.UnknownFields.Inc(unknownFieldLabel(field))
+		}
 	}
+
+	if errs := req.Validate(); len(errs) > 0 {
+		ch.logger.Warn("Invalid completion request", zap.Any("errors", errs))
+		writeValidationError(w, errs)
+		return req, false
+	}
+	return req, true
 }
 
-// generateCompletion streams a code completion from Ollama.
-func (ch *CompletionHandler) generateCompletion(ctx context.Context, w http.ResponseWriter, req CompletionRequest) error {
-	startTime := time.Now()
+// DebugPrompt describes the Ollama request a completion would make.
+type DebugPrompt struct {
+	Model    string                 `json:"model,omitempty"`
+	Template string                 `json:"template,omitempty"`
+	Prompt   string                 `json:"prompt,omitempty"`
+	System   string                 `json:"system,omitempty"`
+	Raw      bool                   `json:"raw,omitempty"`
+	Options  map[string]interface{} `json:"options,omitempty"`
+	// Suffix is the text after the cursor, which a generator filling in
+	// the middle natively takes apart from the prompt.
+	Suffix string `json:"suffix,omitempty"`
+	// PromptTokens is the length of System, Prompt and Suffix together, as
+	// counted by the model family's tokenizer.
+	PromptTokens int `json:"prompt_tokens"`
+	// Mode is the completion mode the cursor position resolved to.
+	Mode CompletionMode `json:"mode,omitempty"`
+	// Skipped is set when the request would be answered empty without
+	// calling Ollama, to the path rule or heuristic responsible.
+	Skipped string `json:"skipped,omitempty"`
+}
 
-	prefix, suffix := getLinesAroundCursor(req.Prompt, req.Suffix, 60, 60)
-	prompt, err := Prompt{Prefix: prefix, Suffix: suffix}.Generate(ch.promptTmpl)
+func (ch *CompletionHandler) writeDebugPrompt(w http.ResponseWriter, settings *completionSettings, req CompletionRequest, selected *template.Template) {
+	plan, err := settings.plan(req, selected)
 	if err != nil {
-		return err
+		ch.logger.Error("Failed to build the debug prompt", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	systemBuf := bytes.Buffer{}
-	if err := ch.systemTmpl.Execute(&systemBuf, struct{ Language string }{Language: req.Extra.Language}); err != nil {
-		return fmt.Errorf("executing system template: %w", err)
-	}
-
-	numPredict := minInt(req.MaxTokens, ch.numPredict)
-	stopTokens := ensureImEndStop(req.Stop)
-	genReq := api.GenerateRequest{
-		Model:  ch.model,
-		Prompt: prompt,
-		System: systemBuf.String(),
-		Options: map[string]interface{}{
-			"temperature": req.Temperature,
-			"top_p":       req.TopP,
-			"stop":        stopTokens,
-			"num_predict": numPredict,
-		},
+	var suffix string
+	if plan.infill != nil {
+		suffix = plan.infill.suffix
 	}
+	writeJSON(w, http.StatusOK, DebugPrompt{
+		Model:        plan.req.Model,
+		Template:     plan.template,
+		Prompt:       plan.req.Prompt,
+		Suffix:       suffix,
+		System:       plan.req.System,
+		Raw:          plan.req.Raw,
+		Options:      plan.req.Options,
+		PromptTokens: tokenizer.Count(settings.tokenizer, plan.req.System+plan.req.Prompt+suffix),
+		Mode:         plan.mode,
+		Skipped:      plan.skip,
+	})
+}
 
-	done := make(chan struct{})
-	var genErr error
-	var totalChunks []string
-	var prevSkipped bool
-
-	// Always return nil error so the stream ends gracefully
-	_ = ch.api.Generate(ctx, &genReq, func(resp api.GenerateResponse) error {
-		chunk, skip := cleanChunk(resp.Response, prevSkipped, req.Extra.Language)
-		if skip {
-			prevSkipped = true
-			return nil
+// requestInfo identifies a completion request.
+type requestInfo struct {
+	// id is shared by every event of the completion.
+	id   string
+	path string
+	user string
+	// session is the client's SessionHeader, which may be empty.
+	session string
+	// metadata is set when the client asked for SuggestionMetadata.
+	metadata bool
+	// replace is set when the request asked to replace a range.
+	replace *replacement
+}
+
+// completionPlan is what the handler sends Ollama for a request.
+type completionPlan struct {
+	// skip, when set, is why the request is answered with an empty
+	// completion: "path_rule" or the suppression heuristic that applied.
+	skip     string
+	template string
+	// mode is ModeLine, ModeBlock or ModeFull. Block completions end
+	// before the first line indented less than indent.
+	mode   CompletionMode
+	indent int
+	// reindent, when set, is the indentation completions are rewritten to.
+	reindent *stream.IndentStyle
+	req      api.GenerateRequest
+	// infill is the text around the cursor when the generator fills in
+	// the middle natively. req.Prompt is then the prefix alone.
+	infill *infillText
+}
+
+// burst returns the settings of completions in burst mode: the burst model
+// in place of the configured, mapped and language ones, and at least the
+// burst num_predict. A larger model is slower, so the latency budget is lifted,
+// but the fallback still answers when it fails.
+func (s *completionSettings) burst() *completionSettings {
+	burst := *s
+	burst.model, burst.models = s.bursts.Model, nil
+	burst.minNumPredict = s.bursts.NumPredict
+	burst.bursting = true
+	burst.fallbackAfter = 0
+	return &burst
+}
+
+// plan applies path rules, suppression heuristics and language params to
+// req and renders the prompt. The model of a path rule takes precedence
+// over that of the language, which takes precedence over the mapped one. A
+// non-nil selected template takes precedence over the configured and path
+// rule ones.
+func (s *completionSettings) plan(req CompletionRequest, selected *template.Template) (completionPlan, error) {
+	model, promptTmpl := s.models.Resolve(req.Model, s.model), s.promptTmpl
+	if params, ok := s.langParams.Lookup(req.Extra.Language); ok && params.Model != "" && !s.bursting {
+		model = params.Model
+	}
+	before, after := s.prefixLines, s.suffixLines
+	if override, ok := s.rules.Match(req.path()); ok {
+		if override.Block {
+			return completionPlan{skip: "path_rule"}, nil
+		}
+		if override.Model != "" {
+			model = override.Model
+		}
+		if override.Template != nil {
+			promptTmpl = override.Template
 		}
-		prevSkipped = false
+		if override.MaxLines > 0 {
+			before, after = override.MaxLines, override.MaxLines
+		}
+	}
+	if selected != nil {
+		promptTmpl = selected
+	}
 
-		ch.logger.Debug("Chunk generated", zap.Any("chunk", resp))
-		totalChunks = append(totalChunks, chunk)
+	heuristics := lang.DefaultSuppress
+	if params, ok := s.langParams.Lookup(req.Extra.Language); ok && params.Suppress != nil {
+		heuristics = params.Suppress
+	}
+	if reason := lang.Suppress(req.Prompt, req.Suffix, req.path(), req.Extra.Language, heuristics); reason != "" {
+		return completionPlan{skip: reason}, nil
+	}
 
-		response := CompletionResponse{
-			Id:      uuid.New().String(),
-			Created: time.Now().Unix(),
-			Choices: []ChoiceResponse{{Text: chunk, Index: 0}},
+	// The options of the requested model replace the server's and the
+	// client's; those of the language still apply on top of them.
+	modelOptions := s.modelOptions[req.Model]
+	numPredict := minInt(req.MaxTokens, s.numPredict)
+	if n, ok := modelOptions["num_predict"].(int); ok {
+		numPredict = minInt(req.MaxTokens, n)
+	}
+	// The client's sequences come first, then the server's, each once.
+	stopTokens := appendMissing(ensureImEndStop(req.Stop.clean()), s.stop...)
+	temperature := req.Temperature
+	if t, ok := modelOptions["temperature"].(float64); ok {
+		temperature = t
+	}
+	mode := s.mode.resolve(req.Prompt, req.Suffix)
+	params, hasParams := s.langParams.Lookup(req.Extra.Language)
+	testFile := lang.IsTest(req.path(), req.Extra.Language, params.TestPatterns)
+	if testFile {
+		testStop := params.TestStop
+		if testStop == nil {
+			testStop = lang.TestStop(req.Extra.Language)
 		}
+		stopTokens = appendMissing(stopTokens, testStop...)
+	}
+	if hasParams {
+		if params.NumPredict > 0 {
+			numPredict = minInt(req.MaxTokens, params.NumPredict)
+		}
+		if params.Temperature != nil {
+			temperature = *params.Temperature
+		}
+		if params.SingleLine {
+			mode = ModeLine
+		}
+	}
+	if s.minNumPredict > 0 {
+		numPredict = max(numPredict, minInt(req.MaxTokens, s.minNumPredict))
+	}
+	languageStop := lang.DefaultStop(req.Extra.Language)
+	if params.Stop != nil {
+		languageStop = params.Stop
+	}
+	stopTokens = appendMissing(stopTokens, languageStop...)
+	indent := blockIndent(req.Prompt)
+	system := systemTmpl
+	if testFile {
+		system = testSystemTmpl
+	}
+	switch mode {
+	case ModeLine:
+		stopTokens = appendMissing(stopTokens, "\n")
+	case ModeFunction:
+		if bodyIndent, ok := emptyFunctionBody(req.Prompt, req.Suffix); ok {
+			indent = bodyIndent
+		}
+		numPredict = max(numPredict, minInt(req.MaxTokens, s.fnNumPredict))
+		system = functionSystemTmpl
+	}
 
-		if _, err := fmt.Fprintf(w, "data: "); err != nil {
-			ch.logger.Warn("Failed to write SSE prefix", zap.Error(err))
-			return nil
+	if s.systemTmpl != nil {
+		system = s.systemTmpl
+	}
+
+	// Ollama places the system prompt with the model's template, which raw
+	// and natively filled prompts go without.
+	systemBuf := bytes.Buffer{}
+	if !s.noSystem && !s.raw && !s.infill {
+		if summary := s.project.Summary(); summary != "" {
+			fmt.Fprintf(&systemBuf, "Project context:\n%s\n\n", summary)
 		}
-		if err := json.NewEncoder(w).Encode(response); err != nil {
-			ch.logger.Warn("Failed to write SSE response", zap.Error(err))
-			return nil
+		if err := system.Execute(&systemBuf, systemData{Language: req.Extra.Language, CommentLanguage: s.commentLang, Mode: mode, Test: testFile}); err != nil {
+			return completionPlan{}, fmt.Errorf("executing system template: %w", err)
 		}
-		if _, err := fmt.Fprintf(w, "\n\n"); err != nil {
-			ch.logger.Warn("Failed to write SSE suffix", zap.Error(err))
-			return nil
+	}
+
+	prefixWindow, suffixWindow := s.windows.prefix(req.path(), req.Prompt, before), s.windows.suffix(req.path(), req.Suffix, after)
+	prefix, suffix, err := s.fit(promptTmpl, systemBuf.String(), numPredict, prefixWindow, suffixWindow)
+	if err != nil {
+		return completionPlan{}, err
+	}
+	if req.Extra.PromptTokens > 0 {
+		prefix = tokenizer.Tail(s.tokenizer, prefix, req.Extra.PromptTokens)
+	}
+	if req.Extra.SuffixTokens > 0 {
+		suffix = tokenizer.Head(s.tokenizer, suffix, req.Extra.SuffixTokens)
+	}
+	var infill *infillText
+	templateName, prompt := promptTmpl.Name(), prefix
+	if s.infill {
+		infill, templateName = &infillText{prefix: prefix, suffix: suffix}, "infill"
+	} else if prompt, err = (Prompt{Prefix: prefix, Suffix: suffix}).Generate(promptTmpl); err != nil {
+		return completionPlan{}, err
+	}
+
+	options := map[string]interface{}{
+		"temperature": temperature,
+		"top_p":       req.TopP,
+		"stop":        stopTokens,
+		"num_predict": numPredict,
+	}
+	if s.numCtx > 0 {
+		options["num_ctx"] = s.numCtx
+	}
+	for name, value := range modelOptions {
+		if name != "num_predict" && name != "temperature" {
+			options[name] = value
 		}
+	}
+	dropDrafts(options, s.drafts)
 
-		if resp.Done {
-			close(done)
+	return completionPlan{
+		template: templateName,
+		mode:     mode,
+		indent:   indent,
+		reindent: indentStyle(req, params.Indent),
+		req: api.GenerateRequest{
+			Model:   model,
+			Prompt:  prompt,
+			System:  systemBuf.String(),
+			Raw:     s.raw,
+			Options: options,
+		},
+		infill: infill,
+	}, nil
+}
+
+// maxLineBytes is the longest line put in completion prompts; longer ones
+// are cut by clipLongLines.
+const maxLineBytes = 1000
+
+// suffixShare is the largest part of the context window, in percent, the
+// suffix may take when the prompt has to be cut.
+const suffixShare = 25
+
+// fit cuts the prefix and suffix windows at their far ends so that the
+// prompt rendered from them, the system prompt and numPredict generated
+// tokens fit in the context window. Lines far from the cursor matter least,
+// and a few long lines of minified or generated code would otherwise
+// overflow it. Windows that fit are not tokenized again.
+func (s *completionSettings) fit(tmpl *template.Template, system string, numPredict int, prefix, suffix window) (string, string, error) {
+	if s.numCtx <= 0 {
+		return prefix.text, suffix.text, nil
+	}
+	overhead, err := Prompt{}.Generate(tmpl)
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, w := range []*window{&prefix, &suffix} {
+		if w.tokens < 0 {
+			w.tokens = tokenizer.Count(s.tokenizer, w.text)
 		}
+	}
+	room := max(s.numCtx-numPredict-tokenizer.Count(s.tokenizer, system)-tokenizer.Count(s.tokenizer, overhead), 0)
+	suffixRoom := min(suffix.tokens, room*suffixShare/100)
+	prefixText, suffixText := prefix.text, suffix.text
+	if prefix.tokens > room-suffixRoom {
+		prefixText = tokenizer.Tail(s.tokenizer, prefixText, room-suffixRoom)
+	}
+	if suffix.tokens > suffixRoom {
+		suffixText = tokenizer.Head(s.tokenizer, suffixText, suffixRoom)
+	}
+	return prefixText, suffixText, nil
+}
 
+// generateCompletion streams a code completion from Ollama.
+func (ch *CompletionHandler) generateCompletion(ctx context.Context, w http.ResponseWriter, settings *completionSettings, info requestInfo, req CompletionRequest, selected *template.Template) error {
+	plan, err := settings.tracedPlan(ctx, req, selected)
+	if err != nil {
+		return err
+	}
+	switch plan.skip {
+	case "":
+	case "path_rule":
+		events.Publish(events.CompletionSuppressed, events.Fields{"reason": plan.skip, "path": req.path()})
+		return nil
+	default:
+		events.Publish(events.CompletionSuppressed, events.Fields{"reason": plan.skip})
+		metrics.Suppressed.Inc(plan.skip)
+		middleware.AddLogField(ctx, "suppressed", plan.skip)
 		return nil
+	}
+	genReq, model := plan.req, plan.req.Model
+	ctx = withInfill(ctx, plan.infill)
+
+	// Where the user rejected suggestions, the model samples more freely,
+	// and suggestions it writes again, cached ones included, are dropped.
+	position := positionKey(info.user+"\x00"+info.session, req)
+	rejected := settings.rejections.Rejected(position)
+	var stages []stream.Stage
+	if len(rejected) > 0 {
+		middleware.AddLogField(ctx, "rejected", len(rejected))
+		genReq.Options = resampled(genReq.Options)
+		stages = append(settings.stages(req, plan), stream.Stage{Name: "rejected", Filter: stream.Except(rejected)})
+	} else {
+		stages = settings.stages(req, plan)
+	}
+
+	scope := cacheScope(plan)
+	if hit, ok := settings.cache.Get(scope, req.Prompt, req.Suffix); ok && !slices.Contains(rejected, hit.Text) {
+		ch.writeCached(ctx, w, info, plan.mode, hit)
+		settings.rejections.Shown(info.id, position, hit.Text)
+		return nil
+	} else if settings.cache != nil {
+		metrics.CacheLookups.Inc("miss")
+	}
+
+	if settings.supersede {
+		var done func()
+		ctx, done = ch.running.start(ctx, positionKey(info.user, req))
+		defer done()
+	}
+
+	defer metrics.InFlight.Start(info.path, model)()
+
+	release, err := acquireSlot(ctx, settings.limiter, info.path)
+	if err != nil {
+		ch.writeError(ctx, w, info.id, model, fmt.Errorf("waiting for a generation slot: %w", err))
+		return nil
+	}
+	defer release()
+
+	var backend *backends.Backend
+	endBackend := func() {}
+	defer func() { endBackend() }()
+	var sticky string
+	if settings.backends != nil {
+		if settings.sticky {
+			sticky = stickyKey(req.path(), genReq)
+			if backend = settings.backends.Sticky(sticky); backend != nil {
+				metrics.StickyRoutes.Inc("hit")
+				middleware.AddLogField(ctx, "sticky", true)
+			} else {
+				metrics.StickyRoutes.Inc("miss")
+			}
+		}
+		if backend == nil {
+			backend = settings.backends.Pick()
+		}
+		// A backend whose circuit is open answers empty at once, instead
+		// of every keystroke waiting for it to fail.
+		if !backend.Allow() {
+			events.Publish(events.CompletionSuppressed, events.Fields{"reason": "circuit_open", "backend": backend.Name})
+			metrics.Suppressed.Inc("circuit_open")
+			middleware.AddLogField(ctx, "suppressed", "circuit_open")
+			return nil
+		}
+		endBackend = backend.Start()
+	}
+
+	// The model changes when the request moves to the fallback.
+	var streamModel string
+	var completion strings.Builder
+	out := stream.New(w, func(text string) ([]byte, error) {
+		choice := info.replace.apply(ChoiceResponse{Text: text, Index: 0}, completion.Len() == 0)
+		completion.WriteString(text)
+		return encodeEvent(CompletionResponse{
+			Id:      info.id,
+			Object:  "text_completion",
+			Created: time.Now().Unix(),
+			Model:   streamModel,
+			Choices: []ChoiceResponse{choice},
+		})
+	}, stages...)
+
+	genStart := time.Now()
+	firstToken, recorded := true, false
+	// final holds the metrics of the done response, once there is one.
+	var final *api.Metrics
+
+	genCtx, genSpan := tracing.Tracer().Start(ctx, "ollama generate", trace.WithAttributes(attribute.String("model", model)))
+	genCtx = httptrace.WithClientTrace(genCtx, &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) { genSpan.AddEvent("connected") },
 	})
+	var first *firstResponse
+	if settings.firstToken > 0 {
+		var cancelGen context.CancelCauseFunc
+		genCtx, cancelGen = context.WithCancelCause(genCtx)
+		defer cancelGen(nil)
+		first = awaitFirstResponse(settings.firstToken, func() { cancelGen(errFirstTokenTimeout) })
+		defer first.stop()
+	}
+	var writeSpan trace.Span
+	defer func() {
+		if writeSpan != nil {
+			writeSpan.SetAttributes(attribute.Int("events", out.Events()), attribute.Int64("filter_us", out.FilterTime().Microseconds()))
+			writeSpan.End()
+		}
+	}()
 
-	// Wait for either context timeout or done signal
-	select {
-	case <-ctx.Done():
-		genErr = ctx.Err()
-	case <-done:
+	onResponse := func(model string, resp api.GenerateResponse) error {
+		if firstToken {
+			// A response arriving as the first-token timeout passes is
+			// dropped, rather than streamed from a canceled generation.
+			if !first.arrived() {
+				return context.Cause(genCtx)
+			}
+			firstToken = false
+			genSpan.AddEvent("first token")
+			_, writeSpan = tracing.Tracer().Start(ctx, "stream write")
+			metrics.TTFTSeconds.Observe(model, time.Since(genStart).Seconds())
+			if settings.limiter != nil {
+				settings.limiter.Observe(time.Since(genStart))
+			}
+			if backend != nil {
+				backend.ObserveTTFT(time.Since(genStart))
+			}
+		}
+		streamModel = model
+
+		if resp.Done {
+			final = &resp.Metrics
+			recordEvalMetrics(ctx, model, info.user, resp.Metrics)
+		}
+
+		ch.logger.Debug("Chunk generated", zap.Any("chunk", resp))
+		err := out.Write(resp.Response)
+		if !recorded && out.Events() > 0 {
+			recorded = true
+			metrics.RecentCompletions.Add(info.id, model)
+		}
+		if err != nil && !errors.Is(err, stream.ErrStopped) {
+			return fmt.Errorf("%w: %w", errClientGone, err)
+		}
+		return err
+	}
+	// A completion that fails on an unreachable backend before producing
+	// anything moves to the next healthy one. Retrying the same backend is
+	// left for when there is no other.
+	var genErr error
+	var tried []string
+	for {
+		backendCtx, budget := genCtx, settings.retryBudget
+		if backend != nil {
+			backendCtx = backends.WithBackend(genCtx, backend)
+			if settings.backends.CanFailover(backend) {
+				budget = 0
+			}
+		}
+		genErr = ch.generate(backendCtx, settings, budget, &genReq, onResponse)
+		if backend == nil || !firstToken || !transient(genErr) {
+			break
+		}
+		next := settings.backends.Failover(backend)
+		if next == nil || !next.Allow() {
+			break
+		}
+		backend.Fail(genErr)
+		metrics.BackendFailovers.Inc(backend.Name)
+		tried = append(tried, backend.Name)
+		endBackend()
+		backend, endBackend = next, next.Start()
+	}
+	if backend != nil {
+		middleware.AddLogField(ctx, "backend", backend.Name)
+	}
+	if len(tried) > 0 {
+		middleware.AddLogField(ctx, "failover", tried)
+	}
+	// A filter that ends the stream ends the completion.
+	stopped := errors.Is(genErr, stream.ErrStopped)
+	if stopped {
 		genErr = nil
 	}
+	if genErr == nil {
+		genErr = ctx.Err()
+	}
+	endSpan(genSpan, streamModel, genErr)
 
-	// If there was an error, send a final "empty" chunk with durations
+	// Nothing is left to write to a client that went away, and the backend
+	// did nothing wrong.
+	if errors.Is(genErr, errClientGone) {
+		ch.logger.Debug("Client went away during the completion", zap.Error(genErr))
+		middleware.AddLogField(ctx, "client_gone", true)
+		return nil
+	}
+	if first.abandoned() {
+		events.Publish(events.CompletionSuppressed, events.Fields{"reason": "first_token_timeout"})
+		metrics.Suppressed.Inc("first_token_timeout")
+		middleware.AddLogField(ctx, "suppressed", "first_token_timeout")
+		return nil
+	}
 	if genErr != nil {
-		endTime := time.Now()
-		finalChunk := map[string]interface{}{
-			"chunk": map[string]interface{}{
-				"model":                ch.model,
-				"created_at":           endTime.Format(time.RFC3339Nano),
-				"response":             "",
-				"done":                 true,
-				"context":              []interface{}{},
-				"total_duration":       endTime.Sub(startTime).Nanoseconds(),
-				"load_duration":        0,
-				"prompt_eval_count":    0,
-				"prompt_eval_duration": 0,
-				"eval_count":           0,
-				"eval_duration":        0,
-			},
-		}
 		ch.logger.Warn("Generator ended with error", zap.Error(genErr))
+		if backend != nil && transient(genErr) {
+			backend.Fail(genErr)
+		}
+		ch.writeError(ctx, w, info.id, model, genErr)
+		return nil
+	}
+	if !firstToken {
+		metrics.GenerationSeconds.Observe(streamModel, time.Since(genStart).Seconds())
+	}
+	if backend != nil {
+		backend.Succeed()
+		if settings.sticky {
+			settings.backends.Stick(sticky, backend)
+		}
+	}
+	if err := out.Close(); err != nil {
+		ch.logger.Warn("Failed to write SSE response", zap.Error(err))
+	}
+	// Completions sampled around a rejection are not what the request
+	// would get otherwise, and are not cached.
+	if len(rejected) == 0 {
+		settings.cache.Put(scope, req.Prompt, req.Suffix, completion.String(), streamModel)
+	}
+	settings.rejections.Shown(info.id, position, completion.String())
+
+	// The last event says why the completion ended and, unless a filter
+	// cut the generation short, how many tokens it took.
+	choice := info.replace.apply(ChoiceResponse{Text: "", Index: 0, FinishReason: "stop"}, false)
+	resp := CompletionResponse{
+		Id:      info.id,
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   streamModel,
+	}
+	if final != nil {
+		if !stopped {
+			choice.FinishReason = finishReason(*final, numPredictOf(genReq.Options))
+		}
+		resp.Usage = tokenUsage(*final)
+	}
+	if info.metadata {
+		choice.Metadata = &SuggestionMetadata{
+			Model:        streamModel,
+			Mode:         plan.mode,
+			Filters:      out.Applied(),
+			GenerationMs: time.Since(genStart).Milliseconds(),
+		}
+	}
+	resp.Choices = []ChoiceResponse{choice}
+	ch.writeEvent(w, resp)
+
+	err = settings.corpus.Record(corpus.Entry{
+		Time:     time.Now(),
+		Id:       info.id,
+		Model:    streamModel,
+		Language: req.Extra.Language,
+		Mode:     string(plan.mode),
+		Template: plan.template,
+		Raw:      genReq.Raw,
+		Options:  genReq.Options,
+	}, corpus.Texts{Prompt: genReq.Prompt, System: genReq.System, Completion: completion.String()})
+	if err != nil {
+		ch.logger.Warn("Error recording the completion", zap.Error(err))
+	}
+	return nil
+}
+
+// stickyHeadBytes is how much of the start of a prompt is the same for
+// completions sticky routing sends to one backend.
+const stickyHeadBytes = 1024
+
+// stickyKey returns the key of sticky routing for a completion of path with
+// the Ollama request req: the model, the system prompt and the document,
+// hashed. Without a path, the lines of the prompt's first kilobyte before
+// the cursor stand for the document.
+func stickyKey(path string, req api.GenerateRequest) string {
+	head := path
+	if head == "" {
+		head = req.Prompt[:min(len(req.Prompt), stickyHeadBytes)]
+		head = head[:strings.LastIndexByte(head, '\n')+1]
+	}
+	sum := sha256.Sum256([]byte(req.Model + "\x00" + req.System + "\x00" + head))
+	return hex.EncodeToString(sum[:])
+}
+
+// tracedPlan is plan inside a "build prompt" span.
+func (s *completionSettings) tracedPlan(ctx context.Context, req CompletionRequest, selected *template.Template) (completionPlan, error) {
+	_, span := tracing.Tracer().Start(ctx, "build prompt")
+	defer span.End()
+
+	plan, err := s.plan(req, selected)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "building the prompt")
+		return plan, err
+	}
+	span.SetAttributes(attribute.String("model", plan.req.Model), attribute.String("mode", string(plan.mode)), attribute.String("skipped", plan.skip))
+	return plan, nil
+}
+
+// endSpan ends a generation span, recording the model that answered and
+// the error the generation ended with, if any.
+func endSpan(span trace.Span, model string, err error) {
+	if model != "" {
+		span.SetAttributes(attribute.String("model", model))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, classifyError(err))
+	}
+	span.End()
+}
 
-		fmt.Fprintf(w, "data: ")
-		_ = json.NewEncoder(w).Encode(finalChunk)
-		fmt.Fprintf(w, "\n\n")
+// cacheScope returns the part of the cache key that is not the prompt: a
+// completion is only reused by requests for the same model, system prompt,
+// template and options.
+func cacheScope(plan completionPlan) string {
+	options, _ := json.Marshal(plan.req.Options)
+	return strings.Join([]string{plan.req.Model, plan.req.System, plan.template, string(options)}, "\x00")
+}
+
+// resampled returns a copy of options with the temperature raised to at
+// least ResampleTemperature.
+func resampled(options map[string]any) map[string]any {
+	options = maps.Clone(options)
+	if options == nil {
+		options = map[string]any{}
+	}
+	if t, _ := options["temperature"].(float64); t < ResampleTemperature {
+		options["temperature"] = ResampleTemperature
+	}
+	return options
+}
+
+// writeCached streams a completion served from the cache as one event.
+func (ch *CompletionHandler) writeCached(ctx context.Context, w http.ResponseWriter, info requestInfo, mode CompletionMode, hit cache.Hit) {
+	result := "hit"
+	if hit.Extension {
+		result = "extension"
+	}
+	middleware.AddLogField(ctx, "cache", result)
+	metrics.CacheLookups.Inc(result)
+	events.Publish(events.CacheHit, events.Fields{"id": info.id, "model": hit.Model, "result": result})
+	metrics.RecentCompletions.Add(info.id, hit.Model)
 
+	if hit.Text == "" {
+		return
+	}
+	choice := info.replace.apply(ChoiceResponse{Text: hit.Text, Index: 0, FinishReason: "stop"}, true)
+	if info.metadata {
+		choice.Metadata = &SuggestionMetadata{Model: hit.Model, Mode: mode, Cache: result}
 	}
+	ch.writeEvent(w, CompletionResponse{
+		Id:      info.id,
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   hit.Model,
+		Choices: []ChoiceResponse{choice},
+	})
+}
 
+// stages returns the filters a completion for req streams through, in
+// order: the post-processing chain, then the cut of the completion mode.
+func (s *completionSettings) stages(req CompletionRequest, plan completionPlan) []stream.Stage {
+	var stages []stream.Stage
+	for _, p := range s.postProcess {
+		if stage, ok := p.stage(req, plan); ok {
+			stages = append(stages, stage)
+		}
+	}
+	// Clients asking to trim by indentation send the indentation of the
+	// next line after the cursor. Lines indented no deeper than it are past
+	// the block the completion is in.
+	if req.Extra.TrimByIndentation {
+		stages = append(stages, stream.Stage{Name: "trim_by_indentation", Filter: stream.Block(req.Extra.NextIndent + 1)})
+	}
+	switch plan.mode {
+	case ModeLine:
+		stages = append(stages, stream.Stage{Name: "single_line", Filter: stream.SingleLine()})
+	case ModeBlock, ModeFunction:
+		stages = append(stages, stream.Stage{Name: "block", Filter: stream.Block(plan.indent)})
+	}
+	return stages
+}
+
+// indentStyle returns the indentation completions for req are rewritten
+// to: the one setting names, else the one the file uses, else the
+// language's. It returns nil for "keep" and when nothing tells.
+func indentStyle(req CompletionRequest, setting string) *stream.IndentStyle {
+	if setting == "keep" {
+		return nil
+	}
+	if style, err := stream.ParseIndent(setting); err == nil {
+		return &style
+	}
+	if style, ok := stream.DetectIndent(req.Prompt + "\n" + req.Suffix); ok {
+		return &style
+	}
+	if style, err := stream.ParseIndent(lang.DefaultIndent(req.Extra.Language)); err == nil {
+		return &style
+	}
 	return nil
 }
 
+// writeEvent writes v as a single SSE data event.
+func (ch *CompletionHandler) writeEvent(w http.ResponseWriter, v any) {
+	event, err := encodeEvent(v)
+	if err != nil {
+		ch.logger.Warn("Failed to encode SSE response", zap.Error(err))
+		return
+	}
+	if _, err := w.Write(event); err != nil {
+		ch.logger.Warn("Failed to write SSE response", zap.Error(err))
+	}
+}
+
+// encodeEvent encodes v as an SSE data event.
+func encodeEvent(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("data: ")
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\n\n")
+	return buf.Bytes(), nil
+}
+
+// writeError records err in metrics and the access log and ends the stream
+// with an event carrying its sanitized class and an "error" finish reason.
+// Nothing is written if the client has already gone away or the generation
+// was superseded by a newer one.
+func (ch *CompletionHandler) writeError(ctx context.Context, w http.ResponseWriter, id, model string, err error) {
+	if superseded(ctx) {
+		metrics.Superseded.Inc(model)
+		middleware.AddLogField(ctx, "superseded", true)
+		middleware.ResponseFailed(ctx)
+		return
+	}
+	class := classifyError(err)
+	metrics.OllamaErrors.Inc(class)
+	middleware.AddLogField(ctx, "error", class)
+	middleware.ResponseFailed(ctx)
+
+	if class == errCanceled {
+		return
+	}
+	metrics.RecentErrors.Add(class, model)
+
+	ch.writeEvent(w, CompletionResponse{
+		Id:      id,
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []ChoiceResponse{{Text: "", Index: 0, FinishReason: "error"}},
+		Error:   &ErrorResponse{Message: errMessages[class], Type: "backend_error", Code: class},
+	})
+}
+
+// recordEvalMetrics adds the evaluation statistics Ollama reports with the
+// final response to the metrics, the usage ledger and the access log.
+func recordEvalMetrics(ctx context.Context, model, user string, m api.Metrics) {
+	metrics.PromptEvalTokens.Add(model, float64(m.PromptEvalCount))
+	metrics.PromptEvalSeconds.Add(model, m.PromptEvalDuration.Seconds())
+	metrics.EvalTokens.Add(model, float64(m.EvalCount))
+	metrics.EvalSeconds.Add(model, m.EvalDuration.Seconds())
+	if m.EvalDuration > 0 {
+		metrics.TokensPerSecond.Observe(model, float64(m.EvalCount)/m.EvalDuration.Seconds())
+	}
+
+	gpuTime := m.PromptEvalDuration + m.EvalDuration
+	metrics.Usage.Record(user, model, m.PromptEvalCount, m.EvalCount, gpuTime)
+
+	middleware.AddLogField(ctx, "model", model)
+	middleware.AddLogField(ctx, "prompt_eval_count", m.PromptEvalCount)
+	middleware.AddLogField(ctx, "prompt_eval_duration", m.PromptEvalDuration)
+	middleware.AddLogField(ctx, "eval_count", m.EvalCount)
+	middleware.AddLogField(ctx, "eval_duration", m.EvalDuration)
+	middleware.AddLogField(ctx, "gpu_time", gpuTime)
+	middleware.AddLogField(ctx, "user", user)
+}
+
+// tokenUsage returns the token counts Ollama reported in m.
+func tokenUsage(m api.Metrics) *TokenUsage {
+	return &TokenUsage{
+		PromptTokens:     m.PromptEvalCount,
+		CompletionTokens: m.EvalCount,
+		TotalTokens:      m.PromptEvalCount + m.EvalCount,
+	}
+}
+
+// finishReason returns "length" when a generation ended because it reached
+// numPredict tokens, and "stop" when the model ended it.
+func finishReason(m api.Metrics, numPredict int) string {
+	if numPredict > 0 && m.EvalCount >= numPredict {
+		return "length"
+	}
+	return "stop"
+}
+
+// numPredictOf returns the num_predict set in the options of an Ollama
+// request, or 0 when there is none.
+func numPredictOf(options map[string]interface{}) int {
+	n, _ := options["num_predict"].(int)
+	return n
+}
+
+// requestUser identifies who made r for the usage export: the value of
+// header when it is set, and the client IP otherwise.
+func requestUser(r *http.Request, header string) string {
+	if header != "" {
+		if user := r.Header.Get(header); user != "" {
+			return user
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// generate runs the request against the primary model and, when a fallback
+// model is configured, retries on it if the primary fails or produces no
+// output within the latency budget. fn receives the name of the model that
+// produced each response. Once the primary has streamed anything the request
+// is never moved to the fallback, so clients do not receive mixed output.
+// Transient errors before anything was streamed are retried within the
+// retry budget. The wait for the first response and whether Ollama answered
+// are reported to health.Default.
+func (ch *CompletionHandler) generate(ctx context.Context, settings *completionSettings, retryBudget time.Duration, req *api.GenerateRequest, fn func(string, api.GenerateResponse) error) error {
+	loaded := health.Wait(req.Model)
+	err := retry(ctx, retryBudget, func() (bool, error) {
+		produced := false
+		err := ch.generateWithFallback(ctx, settings, req, func(model string, resp api.GenerateResponse) error {
+			produced = true
+			loaded()
+			return fn(model, resp)
+		})
+		return produced, err
+	})
+	loaded()
+	reportHealth(err)
+	return err
+}
+
+// retryDelay is the wait before the first retry of a transient error. Each
+// retry waits twice as long as the one before.
+const retryDelay = 100 * time.Millisecond
+
+// retry calls attempt until it succeeds, produces output, fails with an
+// error that is not transient, or the wait before the next call would end
+// past budget from the first one.
+func retry(ctx context.Context, budget time.Duration, attempt func() (produced bool, err error)) error {
+	deadline := time.Now().Add(budget)
+	delay := retryDelay
+	for retries := 0; ; retries++ {
+		produced, err := attempt()
+		if err == nil || produced || !transient(err) || time.Now().Add(delay).After(deadline) {
+			if retries > 0 {
+				middleware.AddLogField(ctx, "retries", retries)
+			}
+			return err
+		}
+		metrics.OllamaRetries.Inc(classifyError(err))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// generateWithFallback is generate without the health tracking.
+func (ch *CompletionHandler) generateWithFallback(ctx context.Context, settings *completionSettings, req *api.GenerateRequest, fn func(string, api.GenerateResponse) error) error {
+	if settings.fallbackModel == "" || settings.fallbackModel == req.Model {
+		return ch.complete(ctx, req, func(resp api.GenerateResponse) error {
+			return fn(req.Model, resp)
+		})
+	}
+
+	primaryCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	primary := awaitFirstResponse(settings.fallbackAfter, cancel)
+	err := ch.complete(primaryCtx, req, func(resp api.GenerateResponse) error {
+		if !primary.arrived() {
+			return context.Canceled
+		}
+		return fn(req.Model, resp)
+	})
+	primary.stop()
+
+	if primary.streaming() && ch.fallingBack.CompareAndSwap(true, false) {
+		events.Publish(events.ModelSwitched, events.Fields{"from": settings.fallbackModel, "to": req.Model, "reason": "recovered"})
+	}
+	if primary.streaming() || ctx.Err() != nil {
+		return err
+	}
+	if err == nil {
+		return nil
+	}
+
+	reason := "error"
+	if primary.abandoned() {
+		reason = "latency_budget"
+		ch.logger.Warn("Primary model exceeded latency budget, using fallback",
+			zap.String("model", req.Model), zap.String("fallback", settings.fallbackModel), zap.Duration("budget", settings.fallbackAfter))
+	} else {
+		ch.logger.Warn("Primary model failed, using fallback",
+			zap.String("model", req.Model), zap.String("fallback", settings.fallbackModel), zap.Error(err))
+	}
+	if ch.fallingBack.CompareAndSwap(false, true) {
+		events.Publish(events.ModelSwitched, events.Fields{"from": req.Model, "to": settings.fallbackModel, "reason": reason})
+	}
+
+	fallbackReq := *req
+	fallbackReq.Model = settings.fallbackModel
+	return ch.complete(ctx, &fallbackReq, func(resp api.GenerateResponse) error {
+		return fn(fallbackReq.Model, resp)
+	})
+}
+
+// complete generates req, filling in between the text ctx carries when the
+// generator fills in the middle natively.
+func (ch *CompletionHandler) complete(ctx context.Context, req *api.GenerateRequest, fn api.GenerateResponseFunc) error {
+	if text, ok := ctx.Value(infillKey{}).(*infillText); ok {
+		if infiller, ok := ch.api.(Infiller); ok {
+			return infiller.Infill(ctx, req, text.prefix, text.suffix, fn)
+		}
+	}
+	return ch.api.Generate(ctx, req, fn)
+}
+
+// infills reports whether api fills in the middle natively.
+func infills(api Generator) bool {
+	_, ok := api.(Infiller)
+	return ok
+}
+
+// firstResponse settles the race between a generation's first response and
+// a deadline for it. Whichever comes first wins for good, so a generation
+// is never abandoned once it streamed, nor streamed once it was abandoned.
+// A nil firstResponse has no deadline.
+type firstResponse struct {
+	state atomic.Int32
+	timer *time.Timer
+}
+
+// States of a firstResponse.
+const (
+	awaiting int32 = iota
+	streaming
+	abandoned
+)
+
+// awaitFirstResponse calls abandon, from a goroutine of its own, once d
+// passes without a response having arrived.
+func awaitFirstResponse(d time.Duration, abandon func()) *firstResponse {
+	f := &firstResponse{}
+	f.timer = time.AfterFunc(d, func() {
+		if f.state.CompareAndSwap(awaiting, abandoned) {
+			abandon()
+		}
+	})
+	return f
+}
+
+// arrived records a response and reports whether it may be streamed, which
+// it may unless the deadline passed first.
+func (f *firstResponse) arrived() bool {
+	if f == nil {
+		return true
+	}
+	if f.state.CompareAndSwap(awaiting, streaming) {
+		f.timer.Stop()
+		return true
+	}
+	return f.state.Load() == streaming
+}
+
+// streaming reports whether a response arrived in time.
+func (f *firstResponse) streaming() bool {
+	return f != nil && f.state.Load() == streaming
+}
+
+// abandoned reports whether the deadline passed first.
+func (f *firstResponse) abandoned() bool {
+	return f != nil && f.state.Load() == abandoned
+}
+
+// stop stops the deadline's timer.
+func (f *firstResponse) stop() {
+	if f != nil {
+		f.timer.Stop()
+	}
+}
+
 // getLinesAroundCursor returns up to `before` lines from the end of prefix
 // and up to `after` lines from the start of suffix.
 func getLinesAroundCursor(prefixText, suffixText string, before, after int) (string, string) {
@@ -247,6 +1686,39 @@ func getLinesAroundCursor(prefixText, suffixText string, before, after int) (str
 	return prefix, suffix
 }
 
+// clipLongLines cuts the lines of prefix and suffix longer than
+// maxLineBytes, such as embedded data or a minified line among code, which
+// would take most of the context window and say little. The cursor line
+// keeps the text nearest the cursor, the others their start.
+func clipLongLines(prefix, suffix string) (string, string) {
+	prefixLines := strings.Split(prefix, "\n")
+	for i, line := range prefixLines {
+		if len(line) <= maxLineBytes {
+			continue
+		}
+		if i == len(prefixLines)-1 {
+			prefixLines[i] = strings.ToValidUTF8(line[len(line)-maxLineBytes:], "")
+		} else {
+			prefixLines[i] = strings.ToValidUTF8(line[:maxLineBytes], "")
+		}
+	}
+	suffixLines := strings.Split(suffix, "\n")
+	for i, line := range suffixLines {
+		if len(line) > maxLineBytes {
+			suffixLines[i] = strings.ToValidUTF8(line[:maxLineBytes], "")
+		}
+	}
+	return strings.Join(prefixLines, "\n"), strings.Join(suffixLines, "\n")
+}
+
+// orDefault returns n, or def when n is not positive.
+func orDefault[T int | time.Duration](n, def T) T {
+	if n > 0 {
+		return n
+	}
+	return def
+}
+
 func minInt(a, b int) int {
 	if a < b {
 		return a
@@ -263,21 +1735,13 @@ func ensureImEndStop(stop []string) []string {
 	return append(stop, "<|im_end|>")
 }
 
-// cleanChunk processes a code chunk to remove unwanted markers and adjust newlines.
-// Returns the cleaned chunk and a bool indicating if it should be skipped.
-func cleanChunk(chunk string, prevSkipped bool, language string) (string, bool) {
-	trimmed := strings.TrimSpace(chunk)
-	if trimmed == "```" || trimmed == language {
-		return "", true // skip this chunk
-	}
-
-	// Remove any "\n```" sequences inside the chunk
-	chunk = strings.ReplaceAll(chunk, "\n```", "")
-
-	// Remove leading newline if previous chunk was skipped
-	if prevSkipped && strings.HasPrefix(chunk, "\n") {
-		chunk = strings.TrimPrefix(chunk, "\n")
+// appendMissing appends the tokens not already in stop, leaving out empty
+// ones.
+func appendMissing(stop []string, tokens ...string) []string {
+	for _, tok := range tokens {
+		if tok != "" && !slices.Contains(stop, tok) {
+			stop = append(stop, tok)
+		}
 	}
-
-	return chunk, false
+	return stop
 }
@@ -0,0 +1,1903 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/backends"
+	"github.com/josuemontano/ollama-copilot/internal/cache"
+	"github.com/josuemontano/ollama-copilot/internal/corpus"
+	"github.com/josuemontano/ollama-copilot/internal/events"
+	"github.com/josuemontano/ollama-copilot/internal/handlers"
+	"github.com/josuemontano/ollama-copilot/internal/health"
+	"github.com/josuemontano/ollama-copilot/internal/lang"
+	"github.com/josuemontano/ollama-copilot/internal/limiter"
+	"github.com/josuemontano/ollama-copilot/internal/llamacpp"
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
+	"github.com/josuemontano/ollama-copilot/internal/project"
+	"github.com/josuemontano/ollama-copilot/internal/rules"
+	"github.com/josuemontano/ollama-copilot/internal/storage"
+	"github.com/josuemontano/ollama-copilot/internal/templates"
+	"github.com/josuemontano/ollama-copilot/internal/tokenizer"
+	"github.com/ollama/ollama/api"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+)
+
+// fakeOllama starts a server answering /api/generate with generate and points
+// the Ollama client at it.
+func fakeOllama(t testing.TB, generate func(w http.ResponseWriter, req api.GenerateRequest)) *api.Client {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req api.GenerateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode generate request: %v", err)
+			return
+		}
+		generate(w, req)
+	}))
+	t.Cleanup(srv.Close)
+
+	t.Setenv("OLLAMA_HOST", srv.URL)
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func writeChunks(w http.ResponseWriter, model string, chunks ...string) {
+	enc := json.NewEncoder(w)
+	for i, chunk := range chunks {
+		_ = enc.Encode(api.GenerateResponse{Model: model, Response: chunk, Done: i == len(chunks)-1})
+	}
+}
+
+func newCompletionHandler(client *api.Client, config handlers.CompletionConfig) *handlers.CompletionHandler {
+	config.PromptTemplate = template.Must(template.New("prompt").Parse("{{.Prefix}}<FILL>{{.Suffix}}"))
+	if config.NumPredict == 0 {
+		config.NumPredict = 50
+	}
+	return handlers.NewCompletionHandler(client, config, zap.NewNop())
+}
+
+func postCompletion(t *testing.T, h http.Handler, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+// streamedResponses decodes every SSE data event in body.
+func streamedResponses(t *testing.T, body string) []handlers.CompletionResponse {
+	t.Helper()
+
+	var responses []handlers.CompletionResponse
+	for _, event := range strings.Split(body, "\n\n") {
+		data, ok := strings.CutPrefix(strings.TrimSpace(event), "data: ")
+		if !ok {
+			continue
+		}
+		var resp handlers.CompletionResponse
+		if err := json.Unmarshal([]byte(data), &resp); err != nil {
+			t.Fatalf("failed to decode event %q: %v", data, err)
+		}
+		responses = append(responses, resp)
+	}
+	return responses
+}
+
+// completionText joins the text of the first choice of responses.
+func completionText(responses []handlers.CompletionResponse) string {
+	var text strings.Builder
+	for _, resp := range responses {
+		text.WriteString(resp.Choices[0].Text)
+	}
+	return text.String()
+}
+
+func TestCompletionHandler_FallbackOnError(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		if req.Model == "primary" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"model 'primary' not found"}`))
+			return
+		}
+		writeChunks(w, req.Model, "return", " nil")
+	})
+
+	h := newCompletionHandler(client, handlers.CompletionConfig{
+		Model:         "primary",
+		FallbackModel: "standby",
+		FallbackAfter: time.Second,
+	})
+	rr := postCompletion(t, h, `{"prompt":"func f() error {\n\t","suffix":"\n}","max_tokens":20}`)
+
+	responses := streamedResponses(t, rr.Body.String())
+	if len(responses) != 3 {
+		t.Fatalf("expected 2 chunks and a final event, got %d: %s", len(responses), rr.Body.String())
+	}
+	for _, resp := range responses {
+		if resp.Model != "standby" {
+			t.Errorf("expected response from standby, got %q", resp.Model)
+		}
+	}
+}
+
+func TestCompletionHandler_ModelSwitched(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		if req.Model == "primary" && failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"error":"loading model"}`))
+			return
+		}
+		writeChunks(w, req.Model, "nil")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", FallbackModel: "standby", FallbackAfter: time.Second})
+
+	last := events.Default.Since(0)
+	var seq uint64
+	if len(last) > 0 {
+		seq = last[len(last)-1].Seq
+	}
+	switches := func() []events.Event {
+		var got []events.Event
+		for _, e := range events.Default.Since(seq) {
+			if e.Type == events.ModelSwitched {
+				got = append(got, e)
+			}
+		}
+		return got
+	}
+
+	postCompletion(t, h, `{"prompt":"return ","suffix":"","max_tokens":20}`)
+	postCompletion(t, h, `{"prompt":"return ","suffix":"","max_tokens":20}`)
+	if got := switches(); len(got) != 1 || got[0].Fields["to"] != "standby" || got[0].Fields["reason"] != "error" {
+		t.Fatalf("expected one switch to the fallback, got %+v", got)
+	}
+	failing.Store(false)
+	postCompletion(t, h, `{"prompt":"return ","suffix":"","max_tokens":20}`)
+	if got := switches(); len(got) != 2 || got[1].Fields["to"] != "primary" || got[1].Fields["reason"] != "recovered" {
+		t.Errorf("expected a switch back to the primary, got %+v", got)
+	}
+}
+
+func TestCompletionHandler_FallbackOnLatencyBudget(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		if req.Model == "primary" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		writeChunks(w, req.Model, "x := 1")
+	})
+
+	h := newCompletionHandler(client, handlers.CompletionConfig{
+		Model:         "primary",
+		FallbackModel: "standby",
+		FallbackAfter: 50 * time.Millisecond,
+	})
+	rr := postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20}`)
+
+	responses := streamedResponses(t, rr.Body.String())
+	if len(responses) != 2 || responses[0].Model != "standby" {
+		t.Fatalf("expected a single chunk from standby, got %s", rr.Body.String())
+	}
+}
+
+func TestCompletionHandler_FirstTokenTimeout(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		if req.Model == "slow" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		writeChunks(w, req.Model, "x := 1")
+	})
+
+	before := metrics.Suppressed.Get("first_token_timeout")
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "slow", FirstTokenTimeout: 50 * time.Millisecond})
+	start := time.Now()
+	rr := postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20}`)
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("expected the request to give up early, took %v", elapsed)
+	}
+	if rr.Code != http.StatusOK || rr.Body.String() != "" {
+		t.Errorf("expected an empty answer, got %d %q", rr.Code, rr.Body.String())
+	}
+	if got := metrics.Suppressed.Get("first_token_timeout"); got != before+1 {
+		t.Errorf("expected the timeout to be counted, got %v", got-before)
+	}
+
+	h = newCompletionHandler(client, handlers.CompletionConfig{Model: "fast", FirstTokenTimeout: 50 * time.Millisecond})
+	rr = postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20}`)
+	if text := completionText(streamedResponses(t, rr.Body.String())); text != "x := 1" {
+		t.Errorf("expected a model answering in time to be streamed, got %q", text)
+	}
+}
+
+func TestCompletionHandler_FirstTokenAtTimeout(t *testing.T) {
+	var n atomic.Int64
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		// The first token arrives around the timeout, before or after it.
+		time.Sleep(time.Duration(n.Add(1)%5) * time.Millisecond)
+		writeChunks(w, req.Model, "x := 1")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", FirstTokenTimeout: 2 * time.Millisecond})
+
+	for range 20 {
+		rr := postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20}`)
+		if body := rr.Body.String(); body != "" {
+			if text := completionText(streamedResponses(t, body)); text != "x := 1" {
+				t.Fatalf("expected either nothing or the whole completion, got %q", body)
+			}
+		}
+	}
+}
+
+// brokenWriter fails every write after the first.
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (w *brokenWriter) Write(p []byte) (int, error) {
+	if w.writes++; w.writes > 1 {
+		return 0, fmt.Errorf("write tcp 127.0.0.1:11437: connection reset by peer")
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestCompletionHandler_ClientGone(t *testing.T) {
+	stopped := make(chan int, 1)
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		enc := json.NewEncoder(w)
+		for i := range 200 {
+			if err := enc.Encode(api.GenerateResponse{Model: req.Model, Response: " x"}); err != nil {
+				stopped <- i
+				return
+			}
+			w.(http.Flusher).Flush()
+			time.Sleep(5 * time.Millisecond)
+		}
+		stopped <- 200
+	})
+	pool, err := backends.New(map[string]string{"local": os.Getenv("OLLAMA_HOST")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Backends: pool})
+
+	w := &brokenWriter{ResponseRecorder: httptest.NewRecorder()}
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", strings.NewReader(`{"prompt":"x = ","suffix":"","max_tokens":20}`)))
+	if got := <-stopped; got == 200 {
+		t.Error("expected the generation to stop once the client could not be written to")
+	}
+	if strings.Contains(w.Body.String(), `"error"`) {
+		t.Errorf("expected no error to be written to the client, got %q", w.Body.String())
+	}
+	for _, s := range pool.Stats() {
+		if !s.Healthy {
+			t.Errorf("expected a client going away not to fail backend %s", s.Name)
+		}
+	}
+}
+
+func TestCompletionHandler_RequestTimeout(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		time.Sleep(500 * time.Millisecond)
+		writeChunks(w, req.Model, "x := 1")
+	})
+
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", RequestTimeout: 50 * time.Millisecond})
+	rr := postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20}`)
+	responses := streamedResponses(t, rr.Body.String())
+	if len(responses) != 1 || responses[0].Error == nil || responses[0].Error.Code != "timeout" {
+		t.Errorf("expected a timeout error event, got %s", rr.Body.String())
+	}
+}
+
+func TestCompletionHandler_NoFallbackWhenPrimaryAnswers(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		writeChunks(w, req.Model, "a", "b")
+	})
+
+	h := newCompletionHandler(client, handlers.CompletionConfig{
+		Model:         "primary",
+		FallbackModel: "standby",
+		FallbackAfter: time.Second,
+	})
+	rr := postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20}`)
+
+	for _, resp := range streamedResponses(t, rr.Body.String()) {
+		if resp.Model != "primary" {
+			t.Errorf("expected response from primary, got %q", resp.Model)
+		}
+	}
+}
+
+func TestCompletionHandler_PathRules(t *testing.T) {
+	var models []string
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		models = append(models, req.Model)
+		writeChunks(w, req.Model, "ok")
+	})
+
+	set, err := rules.New([]rules.Rule{
+		{Match: "*.lock", Block: true},
+		{Match: "*.sql", Model: "sql-model"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Rules: set})
+
+	rr := postCompletion(t, h, `{"prompt":"# Path: go.sum.lock\n","suffix":"","max_tokens":20}`)
+	if body := rr.Body.String(); body != "" {
+		t.Errorf("expected an empty stream for a blocked path, got %q", body)
+	}
+
+	postCompletion(t, h, `{"prompt":"-- Path: db/schema.sql\nSELECT ","suffix":"","max_tokens":20}`)
+	if len(models) != 1 || models[0] != "sql-model" {
+		t.Errorf("expected a single generation on sql-model, got %v", models)
+	}
+
+	// The document URI of LSP clients takes precedence over a path comment.
+	rr = postCompletion(t, h, `{"prompt":"# Path: notes.txt\n","suffix":"","max_tokens":20,"extra":{"uri":"file:///repo/go.sum.lock","position":{"line":1,"character":0}}}`)
+	if body := rr.Body.String(); body != "" {
+		t.Errorf("expected an empty stream for a blocked document URI, got %q", body)
+	}
+	postCompletion(t, h, `{"prompt":"SELECT ","suffix":"","max_tokens":20,"extra":{"uri":"file:///repo/db/schema.sql"}}`)
+	if len(models) != 2 || models[1] != "sql-model" {
+		t.Errorf("expected the document URI to route to sql-model, got %v", models)
+	}
+}
+
+func TestCompletionHandler_ModelMap(t *testing.T) {
+	var models []string
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		models = append(models, req.Model)
+		writeChunks(w, req.Model, "ok")
+	})
+
+	h := newCompletionHandler(client, handlers.CompletionConfig{
+		Model:  "primary",
+		Models: handlers.ModelMap{"copilot-codex": "codex-model", "gpt-4o-copilot": "large-model"},
+	})
+
+	postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20}`)
+	postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20,"model":"gpt-4o-copilot"}`)
+	postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20,"model":"unmapped"}`)
+
+	if want := []string{"codex-model", "large-model", "primary"}; !reflect.DeepEqual(models, want) {
+		t.Errorf("expected generations on %v, got %v", want, models)
+	}
+}
+
+func TestCompletionHandler_ModelOptions(t *testing.T) {
+	var options []map[string]interface{}
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		options = append(options, req.Options)
+		writeChunks(w, req.Model, "ok")
+	})
+
+	modelOptions, err := handlers.ParseModelOptions(map[string]string{
+		"copilot-codex.num_predict":  "60",
+		"copilot-codex.top_k":        "20",
+		"gpt-4o-copilot.temperature": "0.2",
+		"gpt-4o-copilot.num_predict": "500",
+		"gpt-4.1.frequency_penalty":  "0.5",
+		"gpt-4.1.draft_model":        "qwen2.5-coder:0.5b",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newCompletionHandler(client, handlers.CompletionConfig{
+		Model:        "primary",
+		NumPredict:   200,
+		ModelOptions: modelOptions,
+	})
+
+	postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":100,"temperature":0.1}`)
+	postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":100,"temperature":0.1,"model":"gpt-4o-copilot"}`)
+	postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":100,"temperature":0.1,"model":"gpt-4.1"}`)
+
+	if len(options) != 3 {
+		t.Fatalf("expected 3 generations, got %d", len(options))
+	}
+	if o := options[0]; o["num_predict"] != float64(60) || o["top_k"] != float64(20) || o["temperature"] != 0.1 {
+		t.Errorf("expected the options of the copilot-codex engine, got %v", o)
+	}
+	if o := options[1]; o["num_predict"] != float64(100) || o["temperature"] != 0.2 {
+		t.Errorf("expected the temperature of gpt-4o-copilot within max_tokens, got %v", o)
+	}
+	if o := options[2]; o["frequency_penalty"] != 0.5 || o["num_predict"] != float64(100) {
+		t.Errorf("expected the options of a model name with dots, got %v", o)
+	}
+	if _, ok := options[2]["draft_model"]; ok {
+		t.Errorf("expected the draft model to be left out for Ollama, got %v", options[2])
+	}
+
+	for _, bad := range []map[string]string{
+		{"num_predict": "60"},
+		{"chat-control.num_ctx": "8192"},
+		{"chat-control.num_predict": "many"},
+		{"chat-control.temperature": "warm"},
+		{"chat-control.draft_model": ""},
+	} {
+		if _, err := handlers.ParseModelOptions(bad); err == nil {
+			t.Errorf("expected an error for %v", bad)
+		}
+	}
+}
+
+func TestCompletionHandler_LanguageParams(t *testing.T) {
+	var options map[string]interface{}
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		options = req.Options
+		writeChunks(w, req.Model, "key: value")
+	})
+
+	temperature := 0.7
+	h := newCompletionHandler(client, handlers.CompletionConfig{
+		Model:      "primary",
+		NumPredict: 200,
+		LanguageParams: lang.Table{
+			"yaml": {NumPredict: 32, Temperature: &temperature, Stop: []string{"---"}, SingleLine: true},
+		},
+	})
+	postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":100,"temperature":0.1,"extra":{"language":"yaml"}}`)
+
+	if options["num_predict"] != float64(32) {
+		t.Errorf("expected num_predict 32, got %v", options["num_predict"])
+	}
+	if options["temperature"] != 0.7 {
+		t.Errorf("expected temperature 0.7, got %v", options["temperature"])
+	}
+	expected := []interface{}{"<|im_end|>", "---", "\n"}
+	if !reflect.DeepEqual(options["stop"], expected) {
+		t.Errorf("expected stop sequences %q, got %q", expected, options["stop"])
+	}
+}
+
+func TestCompletionHandler_LanguageModel(t *testing.T) {
+	var models []string
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		models = append(models, req.Model)
+		writeChunks(w, req.Model, "ok")
+	})
+
+	h := newCompletionHandler(client, handlers.CompletionConfig{
+		Model:  "primary",
+		Models: handlers.ModelMap{"copilot-codex": "codex-model"},
+		LanguageParams: lang.Table{
+			"python": {Model: "qwen2.5-coder"},
+			"sql":    {Model: "duckdb-nsql", NumPredict: 64},
+		},
+	})
+
+	postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20,"extra":{"language":"python"}}`)
+	postCompletion(t, h, `{"prompt":"SELECT ","suffix":"","max_tokens":20,"extra":{"language":"sql"}}`)
+	postCompletion(t, h, `{"prompt":"x := ","suffix":"","max_tokens":20,"extra":{"language":"go"}}`)
+
+	if want := []string{"qwen2.5-coder", "duckdb-nsql", "codex-model"}; !reflect.DeepEqual(models, want) {
+		t.Errorf("expected generations on %v, got %v", want, models)
+	}
+}
+
+func TestCompletionHandler_LanguageStops(t *testing.T) {
+	var stop []interface{}
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		stop, _ = req.Options["stop"].([]interface{})
+		writeChunks(w, req.Model, "return 42")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{
+		Model:          "primary",
+		LanguageParams: lang.Table{"go": {Stop: []string{}}},
+	})
+
+	postCompletion(t, h, `{"prompt":"def f():\n    ","suffix":"","max_tokens":20,"stop":["\n#"],"extra":{"language":"python"}}`)
+	for _, want := range []string{"\n#", "\n\n\n", "\ndef "} {
+		if !slices.Contains(stop, interface{}(want)) {
+			t.Errorf("expected the stop sequences of python and the client, missing %q in %q", want, stop)
+		}
+	}
+
+	// An empty list in the language params disables the defaults.
+	postCompletion(t, h, `{"prompt":"func f() int {\n\t","suffix":"","max_tokens":20,"extra":{"language":"go"}}`)
+	if slices.Contains(stop, interface{}("\nfunc ")) {
+		t.Errorf("expected the go defaults to be disabled, got %q", stop)
+	}
+}
+
+func TestCompletionHandler_TestFiles(t *testing.T) {
+	var system string
+	var options map[string]interface{}
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		system, options = req.System, req.Options
+		writeChunks(w, req.Model, "if got != 42 {")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{
+		Model: "primary",
+		LanguageParams: lang.Table{
+			"python": {TestPatterns: []string{}},
+		},
+	})
+
+	postCompletion(t, h, `{"prompt":"// Path: calc/calc_test.go\n\tgot := Add(40, 2)\n\t","suffix":"","max_tokens":20}`)
+	if !strings.Contains(system, "writing tests") {
+		t.Errorf("expected the testing system prompt in a test file, got %q", system)
+	}
+	if stop, _ := options["stop"].([]interface{}); !slices.Contains(stop, interface{}("\nfunc Test")) {
+		t.Errorf("expected completions to stop before the next test, got %q", options["stop"])
+	}
+
+	postCompletion(t, h, `{"prompt":"// Path: calc/calc.go\n\treturn ","suffix":"","max_tokens":20}`)
+	if strings.Contains(system, "writing tests") {
+		t.Errorf("expected the default system prompt outside test files, got %q", system)
+	}
+
+	// An empty list of test patterns turns test files off for a language.
+	postCompletion(t, h, `{"prompt":"# Path: tests/test_calc.py\nassert ","suffix":"","max_tokens":20}`)
+	if strings.Contains(system, "writing tests") {
+		t.Errorf("expected test files to be disabled for python, got %q", system)
+	}
+}
+
+func TestCompletionHandler_CommentLanguage(t *testing.T) {
+	var system string
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		system = req.System
+		writeChunks(w, req.Model, "// Devuelve la suma")
+	})
+
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary"})
+	postCompletion(t, h, `{"prompt":"// Path: calc/calc.go\nfunc Add(a, b int) int {\n\t","suffix":"","max_tokens":20}`)
+	if strings.Contains(system, "comments and documentation in") {
+		t.Errorf("expected no comment language by default, got %q", system)
+	}
+
+	h = newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", CommentLanguage: "Spanish"})
+	postCompletion(t, h, `{"prompt":"// Path: calc/calc.go\nfunc Add(a, b int) int {\n\t","suffix":"","max_tokens":20}`)
+	if !strings.Contains(system, "Write any comments and documentation in Spanish") {
+		t.Errorf("expected the system prompt to ask for Spanish comments, got %q", system)
+	}
+	postCompletion(t, h, `{"prompt":"// Path: calc/calc_test.go\n\tgot := Add(40, 2)\n\t","suffix":"","max_tokens":20}`)
+	if !strings.Contains(system, "writing tests") || !strings.Contains(system, "in Spanish") {
+		t.Errorf("expected the testing system prompt to ask for Spanish comments, got %q", system)
+	}
+}
+
+func TestCompletionHandler_SystemPrompt(t *testing.T) {
+	var got api.GenerateRequest
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		got = req
+		writeChunks(w, req.Model, "a + b")
+	})
+	body := `{"prompt":"// Path: calc/calc_test.go\nfunc Add(a, b int) int {\n\treturn ","suffix":"","max_tokens":20}`
+
+	tmpl := template.Must(template.New("system").Parse("Complete {{.Language}}{{if .Test}} tests{{end}}."))
+	postCompletion(t, newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", SystemTemplate: tmpl}), body)
+	if got.System != "Complete go tests." || got.Raw {
+		t.Errorf("expected the system template to be rendered, got %q (raw %v)", got.System, got.Raw)
+	}
+
+	postCompletion(t, newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", NoSystem: true}), body)
+	if got.System != "" || got.Raw {
+		t.Errorf("expected no system prompt, got %q (raw %v)", got.System, got.Raw)
+	}
+
+	postCompletion(t, newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", SystemTemplate: tmpl, Raw: true}), body)
+	if got.System != "" || !got.Raw {
+		t.Errorf("expected a raw prompt without a system prompt, got %q (raw %v)", got.System, got.Raw)
+	}
+}
+
+func TestCompletionHandler_RecordsCorpus(t *testing.T) {
+	var prompt string
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		prompt = req.Prompt
+		writeChunks(w, req.Model, "a", " + b")
+	})
+	c := corpus.New(storage.NewMemory())
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Corpus: c})
+	rr := postCompletion(t, h, `{"prompt":"// Path: calc/calc.go\nfunc Add(a, b int) int {\n\treturn ","suffix":"\n}","max_tokens":20}`)
+
+	var entries []corpus.Entry
+	_ = c.Entries(func(e corpus.Entry) error { entries = append(entries, e); return nil })
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 recorded completion, got %d", len(entries))
+	}
+	e := entries[0]
+	if e.Id != rr.Header().Get(handlers.CompletionIDHeader) || e.Model != "primary" || e.Language != "go" {
+		t.Errorf("expected the completion to be described, got %+v", e)
+	}
+	if text, _, _ := c.Text(e.Prompt); text != prompt {
+		t.Errorf("expected the prompt sent to Ollama, got %q", text)
+	}
+	if text, _, _ := c.Text(e.Completion); text != "a + b" {
+		t.Errorf("expected the completion text, got %q", text)
+	}
+	if e.System == "" {
+		t.Error("expected the system prompt to be recorded")
+	}
+}
+
+func TestCompletionHandler_ClipsLongLines(t *testing.T) {
+	var prompt string
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		prompt = req.Prompt
+		writeChunks(w, req.Model, "ok")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", LanguageParams: lang.Table{"*": {Suppress: []string{}}}})
+
+	data := strings.Repeat("0123456789", 500)
+	postCompletion(t, h, `{"prompt":"const table = \"`+data+`\"\nconst x = ","suffix":"\n","max_tokens":20}`)
+	if !strings.Contains(prompt, "const x = ") {
+		t.Errorf("expected the cursor line to be kept, got %q", prompt)
+	}
+	if strings.Contains(prompt, data) {
+		t.Errorf("expected the long line to be cut, got %d bytes of prompt", len(prompt))
+	}
+}
+
+func TestCompletionHandler_QueueWait(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		writeChunks(w, req.Model, "42")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Limiter: limiter.New(1, 1, 0, nil)})
+
+	before := metrics.QueueWaitSeconds.Count("/v1/engines/copilot-codex/completions")
+	postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20}`)
+	if got := metrics.QueueWaitSeconds.Count("/v1/engines/copilot-codex/completions"); got != before+1 {
+		t.Errorf("expected the wait for a slot to be timed once, got %d", got-before)
+	}
+}
+
+func TestCompletionHandler_QueueFull(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		t.Error("expected a request turned away not to reach Ollama")
+	})
+	l := limiter.New(1, 1, 0, nil)
+	l.SetMaxQueue(1)
+	if err := l.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = l.Acquire(ctx) }()
+	for l.Queued() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Limiter: l})
+
+	rr := postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20}`)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429 with a full queue, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got == "" {
+		t.Error("expected a Retry-After header")
+	}
+}
+
+func TestCompletionHandler_PromptTemplateHeader(t *testing.T) {
+	var prompt string
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		prompt = req.Prompt
+		writeChunks(w, req.Model, "ok")
+	})
+
+	set, err := templates.New(map[string]string{"alt": "<PRE>{{.Prefix}}<SUF>{{.Suffix}}<MID>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Templates: set})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", strings.NewReader(`{"prompt":"a","suffix":"b","max_tokens":20}`))
+	req.Header.Set(handlers.PromptTemplateHeader, "alt")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if prompt != "<PRE>a<SUF>b<MID>" {
+		t.Errorf("expected the alt template to be rendered, got %q", prompt)
+	}
+	if got := rr.Header().Get(handlers.PromptTemplateHeader); got != "alt" {
+		t.Errorf("expected the selected template to be echoed, got %q", got)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", strings.NewReader(`{"prompt":"a","suffix":"b"}`))
+	req.Header.Set(handlers.PromptTemplateHeader, "missing")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected status code %d for an unknown template, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestCompletionHandler_ErrorEvent(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"error":"out of memory"}`))
+	})
+
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary"})
+	rr := postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20}`)
+
+	responses := streamedResponses(t, rr.Body.String())
+	if len(responses) != 1 {
+		t.Fatalf("expected a single error event, got %s", rr.Body.String())
+	}
+	resp := responses[0]
+	if resp.Error == nil || resp.Error.Code != "out_of_memory" {
+		t.Errorf("expected an out_of_memory error in the event, got %+v", resp.Error)
+	}
+	if len(resp.Choices) != 1 || resp.Choices[0].FinishReason != "error" {
+		t.Errorf("expected finish_reason error, got %+v", resp.Choices)
+	}
+}
+
+func TestCompletionHandler_ErrorClasses(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		message string
+		code    string
+	}{
+		{"model not found", http.StatusNotFound, "model 'primary' not found, try pulling it first", "model_not_found"},
+		{"out of memory", http.StatusInternalServerError, "model requires more system memory (12 GiB) than is available", "out_of_memory"},
+		{"unknown", http.StatusInternalServerError, "llama runner process has terminated", "backend_error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+				w.WriteHeader(tt.status)
+				_ = json.NewEncoder(w).Encode(map[string]string{"error": tt.message})
+			})
+
+			before := metrics.OllamaErrors.Get(tt.code)
+			h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary"})
+			rr := postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20}`)
+
+			responses := streamedResponses(t, rr.Body.String())
+			if len(responses) != 1 || responses[0].Error == nil || responses[0].Error.Code != tt.code {
+				t.Fatalf("expected a %s error event, got %s", tt.code, rr.Body.String())
+			}
+			if strings.Contains(rr.Body.String(), tt.message) {
+				t.Errorf("expected the raw backend message to stay out of the stream, got %s", rr.Body.String())
+			}
+			if got := metrics.OllamaErrors.Get(tt.code); got != before+1 {
+				t.Errorf("expected the %s counter to be incremented, got %v", tt.code, got-before)
+			}
+		})
+	}
+}
+
+func TestCompletionHandler_ConnectionRefused(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	t.Setenv("OLLAMA_HOST", srv.URL)
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary"})
+	rr := postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20}`)
+
+	responses := streamedResponses(t, rr.Body.String())
+	if len(responses) != 1 || responses[0].Error == nil || responses[0].Error.Code != "connection_refused" {
+		t.Fatalf("expected a connection_refused error event, got %s", rr.Body.String())
+	}
+}
+
+func TestCompletionHandler_RetriesTransientErrors(t *testing.T) {
+	var calls int
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		if calls++; calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "server busy, please try again. maximum pending requests exceeded"})
+			return
+		}
+		writeChunks(w, req.Model, "1")
+	})
+
+	before := metrics.OllamaRetries.Get("backend_error")
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", RetryBudget: time.Second})
+	rr := postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20}`)
+
+	if got := completionText(streamedResponses(t, rr.Body.String())); got != "1" || calls != 2 {
+		t.Errorf("expected the completion after one retry, got %q after %d calls", got, calls)
+	}
+	if got := metrics.OllamaRetries.Get("backend_error"); got != before+1 {
+		t.Errorf("expected 1 retry to be counted, got %v", got-before)
+	}
+
+	calls = 0
+	h = newCompletionHandler(client, handlers.CompletionConfig{Model: "primary"})
+	rr = postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20}`)
+	if responses := streamedResponses(t, rr.Body.String()); len(responses) != 1 || responses[0].Error == nil || calls != 1 {
+		t.Errorf("expected no retry without a budget, got %s after %d calls", rr.Body.String(), calls)
+	}
+}
+
+func TestCompletionHandler_DegradedHeader(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	t.Setenv("OLLAMA_HOST", srv.URL)
+	down, err := api.ClientFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"prompt":"x = ","suffix":"","max_tokens":20}`
+	postCompletion(t, newCompletionHandler(down, handlers.CompletionConfig{Model: "primary"}), body)
+
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		writeChunks(w, req.Model, "1")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary"})
+	if got := postCompletion(t, h, body).Header().Get(health.Header); got != health.BackendDown {
+		t.Errorf("expected the request after a refused connection to report %s, got %q", health.BackendDown, got)
+	}
+	if got := postCompletion(t, h, body).Header().Get(health.Header); got != "" {
+		t.Errorf("expected a successful generation to clear the state, got %q", got)
+	}
+}
+
+func TestCompletionHandler_ResumeUnknown(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		writeChunks(w, req.Model, "1")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", ResumeWindow: time.Minute})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", strings.NewReader(`{"prompt":"x = ","suffix":"","max_tokens":20}`))
+	req.Header.Set(handlers.LastEventIDHeader, "expired/3")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	id := rr.Header().Get(handlers.CompletionIDHeader)
+	if id == "" || id == "expired" {
+		t.Fatalf("expected an unknown completion to be served as a new one, got ID %q", id)
+	}
+	if want := "id: " + id + "/1\ndata: "; !strings.HasPrefix(rr.Body.String(), want) {
+		t.Errorf("expected the events to be numbered from 1, got %q", rr.Body.String())
+	}
+}
+
+func TestCompletionHandler_EvalMetrics(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		_ = json.NewEncoder(w).Encode(api.GenerateResponse{
+			Model:    req.Model,
+			Response: "x",
+			Done:     true,
+			Metrics: api.Metrics{
+				PromptEvalCount:    120,
+				PromptEvalDuration: 300 * time.Millisecond,
+				EvalCount:          8,
+				EvalDuration:       200 * time.Millisecond,
+			},
+		})
+	})
+
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "eval-model"})
+	postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20}`)
+
+	if got := metrics.PromptEvalTokens.Get("eval-model"); got != 120 {
+		t.Errorf("expected 120 prompt tokens, got %v", got)
+	}
+	if got := metrics.EvalTokens.Get("eval-model"); got != 8 {
+		t.Errorf("expected 8 generated tokens, got %v", got)
+	}
+	if got := metrics.EvalSeconds.Get("eval-model"); got != 0.2 {
+		t.Errorf("expected 0.2s of generation, got %v", got)
+	}
+}
+
+func TestCompletionHandler_Validation(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		t.Error("expected an invalid request not to reach Ollama")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary"})
+
+	rr := postCompletion(t, h, `{"prompt":"","suffix":"","max_tokens":20,"temperature":3,"top_p":1.5}`)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected status code %d, got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+
+	var body handlers.ValidationError
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode validation error: %v", err)
+	}
+	var fields []string
+	for _, f := range body.Error.Fields {
+		fields = append(fields, f.Field)
+	}
+	if want := []string{"prompt", "temperature", "top_p"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("expected errors for %v, got %v", want, fields)
+	}
+
+	rr = postCompletion(t, h, `{"prompt":"x","suffix":"","extra":{"position":{"line":-1,"character":2}}}`)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected a negative position line to be rejected, got status code %d", rr.Code)
+	}
+
+	for _, extra := range []string{
+		`{"range":{"start":{"line":0,"character":0},"end":{"line":0,"character":1}}}`,
+		`{"position":{"line":0,"character":1},"range":{"start":{"line":0,"character":2},"end":{"line":0,"character":3}}}`,
+		`{"position":{"line":5,"character":1},"range":{"start":{"line":2,"character":0},"end":{"line":5,"character":1}}}`,
+	} {
+		rr = postCompletion(t, h, `{"prompt":"x","suffix":"","extra":`+extra+`}`)
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected range %s to be rejected, got status code %d", extra, rr.Code)
+		}
+	}
+}
+
+func TestCompletionHandler_StopSequences(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Stop: []string{"<EOT>", "", "\n\n"}})
+
+	debugStop := func(stop string) any {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", strings.NewReader(`{"prompt":"x = ","suffix":"","stop":`+stop+`}`))
+		req.Header.Set(handlers.DebugPromptHeader, "true")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		var debug handlers.DebugPrompt
+		if err := json.NewDecoder(rr.Body).Decode(&debug); err != nil {
+			t.Fatalf("failed to decode debug prompt: %v", err)
+		}
+		return debug.Options["stop"]
+	}
+
+	got := debugStop(`["\n\n", "", "<EOT>", "\n\n", "// end"]`)
+	if want := []any{"\n\n", "<EOT>", "// end", "<|im_end|>"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the client's sequences once each, then the server's, got %q", got)
+	}
+	if got := debugStop(`"// end"`); !slices.Contains(got.([]any), "// end") {
+		t.Errorf("expected a single stop sequence to be accepted as a string, got %q", got)
+	}
+
+	long, _ := json.Marshal([]string{strings.Repeat("x", 129)})
+	many, _ := json.Marshal(slices.Repeat([]string{"a"}, 17))
+	for _, stop := range []string{string(long), string(many)} {
+		if rr := postCompletion(t, h, `{"prompt":"x = ","suffix":"","stop":`+stop+`}`); rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected stop %.40s to be rejected, got status code %d", stop, rr.Code)
+		}
+	}
+	if rr := postCompletion(t, h, `{"prompt":"x = ","suffix":"","stop":3}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected a stop that is not a string to be rejected, got status code %d", rr.Code)
+	}
+}
+
+func TestCompletionHandler_UnknownFields(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		writeChunks(w, req.Model, "x")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary"})
+
+	before, nwo := metrics.UnknownFields.Get("other"), metrics.UnknownFields.Get("nwo")
+	rr := postCompletion(t, h, `{"prompt":"a","suffix":"","top_p":0.95,"nwo":"owner/repo","extra":{"language":"go","cursor_offset":3}}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected unknown fields to be tolerated, got status code %d", rr.Code)
+	}
+	if got := metrics.UnknownFields.Get("other"); got != before+1 {
+		t.Errorf("expected the nested unknown field to be counted as other, got %v", got-before)
+	}
+	if got := metrics.UnknownFields.Get("nwo"); got != nwo+1 {
+		t.Errorf("expected the unsupported field to be counted by name, got %v", got-nwo)
+	}
+	if got := metrics.UnknownFields.Get("extra.cursor_offset"); got != 0 {
+		t.Errorf("expected no label for a field clients are not known to send, got %v", got)
+	}
+}
+
+func TestCompletionHandler_RequestTooLarge(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		t.Error("expected no generation for a request that is too large")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary"})
+
+	rr := postCompletion(t, h, `{"prompt":"`+strings.Repeat("a", handlers.MaxRequestBytes)+`","suffix":""}`)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status code %d, got %d", http.StatusRequestEntityTooLarge, rr.Code)
+	}
+}
+
+func TestCompletionHandler_ProjectSummary(t *testing.T) {
+	var system string
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		if strings.HasPrefix(req.Prompt, "Summarize") {
+			writeChunks(w, req.Model, "A Go CLI.")
+			return
+		}
+		system = req.System
+		writeChunks(w, req.Model, "x")
+	})
+
+	summarizer := project.NewSummarizer(client, "primary", t.TempDir(), 50, tokenizer.Default, zap.NewNop())
+	if err := summarizer.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Project: summarizer})
+	postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20}`)
+
+	if !strings.HasPrefix(system, "Project context:\nA Go CLI.\n\n") {
+		t.Errorf("expected the project summary to lead the system prompt, got %q", system)
+	}
+}
+
+func TestCompletionHandler_Suppress(t *testing.T) {
+	var calls int
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		calls++
+		writeChunks(w, req.Model, "x")
+	})
+
+	h := newCompletionHandler(client, handlers.CompletionConfig{
+		Model:          "primary",
+		LanguageParams: lang.Table{"python": {Suppress: []string{}}},
+	})
+
+	rr := postCompletion(t, h, `{"prompt":"# Path: Cargo.lock\n","suffix":"","extra":{"language":"toml"}}`)
+	if rr.Code != http.StatusOK || rr.Body.Len() != 0 || calls != 0 {
+		t.Errorf("expected an empty completion without calling Ollama, got %d %q after %d calls", rr.Code, rr.Body.String(), calls)
+	}
+
+	postCompletion(t, h, `{"prompt":"# a comment ","suffix":"","extra":{"language":"python"}}`)
+	if calls != 1 {
+		t.Errorf("expected suppression to be disabled for python, got %d calls", calls)
+	}
+}
+
+func TestCompletionHandler_DebugPrompt(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		t.Error("expected a dry run not to call Ollama")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Stop: []string{"<EOT>"}})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", strings.NewReader(`{"prompt":"a = ","suffix":"\nb","max_tokens":20,"stop":["\n\n"]}`))
+	req.Header.Set(handlers.DebugPromptHeader, "true")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	var debug handlers.DebugPrompt
+	if err := json.NewDecoder(rr.Body).Decode(&debug); err != nil {
+		t.Fatalf("failed to decode debug prompt: %v", err)
+	}
+	if debug.Model != "primary" || debug.Template != "prompt" {
+		t.Errorf("expected the primary model and default template, got %q and %q", debug.Model, debug.Template)
+	}
+	if debug.Prompt != "a = <FILL>\nb" {
+		t.Errorf("expected the rendered prompt, got %q", debug.Prompt)
+	}
+	if want := []interface{}{"\n\n", "<|im_end|>", "<EOT>"}; !reflect.DeepEqual(debug.Options["stop"], want) {
+		t.Errorf("expected stop tokens %q, got %q", want, debug.Options["stop"])
+	}
+	if want := tokenizer.Count(tokenizer.Default, debug.System+debug.Prompt); debug.PromptTokens != want {
+		t.Errorf("expected %d prompt tokens, got %d", want, debug.PromptTokens)
+	}
+}
+
+func TestCompletionHandler_ConcurrentConfigure(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		writeChunks(w, req.Model, "a", "b", "c")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "first"})
+
+	var wg sync.WaitGroup
+	bodies := make(chan string, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			bodies <- postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20}`).Body.String()
+		}()
+		go func(i int) {
+			defer wg.Done()
+			model := "first"
+			if i%2 == 1 {
+				model = "second"
+			}
+			h.Configure(handlers.CompletionConfig{
+				Model:          model,
+				PromptTemplate: template.Must(template.New("prompt").Parse("{{.Prefix}}<FILL>{{.Suffix}}")),
+				NumPredict:     50,
+			})
+		}(i)
+	}
+	wg.Wait()
+	close(bodies)
+
+	for body := range bodies {
+		responses := streamedResponses(t, body)
+		if len(responses) != 4 {
+			t.Errorf("expected 4 events, got %d", len(responses))
+			continue
+		}
+		for _, resp := range responses {
+			if resp.Model != responses[0].Model {
+				t.Errorf("expected every event from %s, got one from %s", responses[0].Model, resp.Model)
+			}
+		}
+	}
+}
+
+func TestCompletionHandler_ConfigureKeepsRequestsInFlight(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		close(started)
+		<-release
+		writeChunks(w, req.Model, "ok")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "old", FallbackModel: "fallback", FallbackAfter: time.Minute})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20}`)
+	}()
+
+	<-started
+	stop := []string{"<EOT>"}
+	h.Configure(handlers.CompletionConfig{
+		Model:          "new",
+		PromptTemplate: template.Must(template.New("prompt").Parse("{{.Prefix}}<FILL>{{.Suffix}}")),
+		Stop:           stop,
+		NumPredict:     50,
+	})
+	stop[0] = "changed"
+	close(release)
+
+	responses := streamedResponses(t, (<-done).Body.String())
+	if len(responses) != 2 || responses[0].Model != "old" {
+		t.Fatalf("expected the request in flight to finish on the old model, got %+v", responses)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", strings.NewReader(`{"prompt":"x = ","suffix":"","max_tokens":20}`))
+	req.Header.Set(handlers.DebugPromptHeader, "true")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	var debug handlers.DebugPrompt
+	if err := json.NewDecoder(rr.Body).Decode(&debug); err != nil {
+		t.Fatalf("failed to decode debug prompt: %v", err)
+	}
+	if want := []interface{}{"<|im_end|>", "<EOT>"}; debug.Model != "new" || !reflect.DeepEqual(debug.Options["stop"], want) {
+		t.Errorf("expected the new model with stop tokens %q, got %s with %q", want, debug.Model, debug.Options["stop"])
+	}
+}
+
+func BenchmarkCompletionHandler(b *testing.B) {
+	client := fakeOllama(b, func(w http.ResponseWriter, req api.GenerateRequest) {
+		writeChunks(w, req.Model, "a", "b", "c")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Stop: []string{"<EOT>"}})
+	body := `{"prompt":"// Path: main.go\npackage main\n\nfunc main() {\n\t","suffix":"\n}\n","max_tokens":20}`
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req := httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", strings.NewReader(body))
+			h.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	})
+}
+
+func TestCompletionHandler_Modes(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		writeChunks(w, req.Model, "first()\n", "\tsecond()\n}\n", "\nfunc next() {}")
+	})
+
+	tests := []struct {
+		name   string
+		mode   handlers.CompletionMode
+		prompt string
+		suffix string
+		want   string
+	}{
+		{"line in the middle of a line", handlers.ModeAuto, "func main() {\n\tx := ", ")\n}", "first()"},
+		{"block after an opener", handlers.ModeAuto, "func main() {", "\n}", "first()\n\tsecond()"},
+		{"block on a blank line", handlers.ModeAuto, "func main() {\n\t", "\n}", "first()\n\tsecond()"},
+		{"forced line", handlers.ModeLine, "func main() {", "\n}", "first()"},
+		{"function in an empty body", handlers.ModeAuto, "func main() {\n\t", "\n}\n", "first()\n\tsecond()"},
+		{"full", handlers.ModeFull, "func main() {", "", "first()\n\tsecond()\n}\n\nfunc next() {}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Mode: tt.mode})
+			body, _ := json.Marshal(map[string]any{"prompt": tt.prompt, "suffix": tt.suffix, "max_tokens": 20})
+			rr := postCompletion(t, h, string(body))
+
+			var got strings.Builder
+			for _, resp := range streamedResponses(t, rr.Body.String()) {
+				got.WriteString(resp.Choices[0].Text)
+			}
+			if got.String() != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got.String())
+			}
+		})
+	}
+}
+
+func TestCompletionHandler_FunctionMode(t *testing.T) {
+	var generated api.GenerateRequest
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		generated = req
+		writeChunks(w, req.Model, "return a + b\n", "}\n\nfunc sub(a, b int) int {}")
+	})
+
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Mode: handlers.ModeAuto, NumPredict: 20, FunctionNumPredict: 300})
+
+	tests := []struct {
+		name       string
+		prompt     string
+		suffix     string
+		numPredict float64
+		function   bool
+	}{
+		{"empty go body", "// add returns the sum of a and b.\nfunc add(a, b int) int {\n\t", "\n}\n", 300, true},
+		{"empty python body", "def add(a, b):\n    ", "\n\ndef sub(a, b):\n    return a - b\n", 300, true},
+		{"method signature", "class Calc {\n  public int add(int a, int b) {", "\n  }\n}", 300, true},
+		{"body with code", "func add(a, b int) int {\n\t", "\n\treturn a + b\n}\n", 20, false},
+		{"control statement", "func add(a, b int) int {\n\tif a > b {", "\n\t}\n}\n", 20, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(map[string]any{"prompt": tt.prompt, "suffix": tt.suffix, "max_tokens": 500})
+			rr := postCompletion(t, h, string(body))
+
+			if generated.Options["num_predict"] != tt.numPredict {
+				t.Errorf("expected num_predict %v, got %v", tt.numPredict, generated.Options["num_predict"])
+			}
+			if got := strings.Contains(generated.System, "complete body of that function"); got != tt.function {
+				t.Errorf("expected the function system prompt %v, got %v", tt.function, got)
+			}
+			if !tt.function {
+				return
+			}
+			var got strings.Builder
+			for _, resp := range streamedResponses(t, rr.Body.String()) {
+				got.WriteString(resp.Choices[0].Text)
+			}
+			if want := "return a + b"; got.String() != want {
+				t.Errorf("expected %q, got %q", want, got.String())
+			}
+		})
+	}
+
+	// The request's max_tokens still bounds the function budget.
+	postCompletion(t, h, `{"prompt":"func add(a, b int) int {\n\t","suffix":"\n}\n","max_tokens":100}`)
+	if generated.Options["num_predict"] != float64(100) {
+		t.Errorf("expected num_predict 100, got %v", generated.Options["num_predict"])
+	}
+}
+
+func TestCompletionHandler_SuffixOverlap(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		writeChunks(w, req.Model, "\n\tfmt.Println(x)", "\n\treturn x\n}")
+	})
+
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Mode: handlers.ModeFull})
+	body := `{"prompt": "func f(x int) int {", "suffix": "\n\treturn x\n}", "max_tokens": 20}`
+	rr := postCompletion(t, h, body)
+
+	responses := streamedResponses(t, rr.Body.String())
+	var got strings.Builder
+	for _, resp := range responses {
+		got.WriteString(resp.Choices[0].Text)
+	}
+	if want := "\n\tfmt.Println(x)"; got.String() != want {
+		t.Errorf("expected %q, got %q", want, got.String())
+	}
+	if last := responses[len(responses)-1]; last.Choices[0].FinishReason != "stop" {
+		t.Errorf("expected the stream to end with finish reason stop, got %q", last.Choices[0].FinishReason)
+	}
+}
+
+func TestCompletionHandler_TrimByIndentation(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		writeChunks(w, req.Model, "a()\n\t\tb()\n", "\n\t}\n\tc()")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Mode: handlers.ModeFull})
+
+	body := `{"prompt":"func f() {\n\tif x {\n\t\t","suffix":"\n\treturn\n}","max_tokens":20,"extra":{"trim_by_indentation":true,"next_indent":4}}`
+	responses := streamedResponses(t, postCompletion(t, h, body).Body.String())
+	if got := completionText(responses); got != "a()\n\t\tb()" {
+		t.Errorf("expected the completion to end with the block, got %q", got)
+	}
+	if last := responses[len(responses)-1]; last.Choices[0].FinishReason != "stop" {
+		t.Errorf("expected finish reason stop, got %q", last.Choices[0].FinishReason)
+	}
+
+	body = `{"prompt":"func f() {\n\tif x {\n\t\t","suffix":"\n\treturn\n}","max_tokens":20,"extra":{"next_indent":4}}`
+	if got := completionText(streamedResponses(t, postCompletion(t, h, body).Body.String())); got != "a()\n\t\tb()\n\n\t}\n\tc()" {
+		t.Errorf("expected the completion untrimmed without trim_by_indentation, got %q", got)
+	}
+}
+
+func TestCompletionHandler_ReplaceRange(t *testing.T) {
+	var prompt string
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		prompt = req.Prompt
+		writeChunks(w, req.Model, "nt", "ln")
+	})
+
+	// The cursor is after fmt.Pri, and the range covers the whole of Print.
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Mode: handlers.ModeFull})
+	body := `{"prompt": "func main() {\n\tfmt.Pri", "suffix": "nt(x)\n}", "max_tokens": 20,
+		"extra": {"position": {"line": 1, "character": 8}, "range": {"start": {"line": 1, "character": 5}, "end": {"line": 1, "character": 10}}}}`
+	rr := postCompletion(t, h, body)
+
+	if strings.Contains(prompt, "nt(x)") || !strings.Contains(prompt, "(x)\n}") {
+		t.Errorf("expected the replaced text to be cut from the suffix, got %q", prompt)
+	}
+	responses := streamedResponses(t, rr.Body.String())
+	var got strings.Builder
+	for _, resp := range responses {
+		choice := resp.Choices[0]
+		got.WriteString(choice.Text)
+		want := handlers.Range{Start: handlers.Position{Line: 1, Character: 5}, End: handlers.Position{Line: 1, Character: 10}}
+		if choice.Range == nil || *choice.Range != want {
+			t.Errorf("expected every choice to replace %v, got %v", want, choice.Range)
+		}
+	}
+	if want := "Println"; got.String() != want {
+		t.Errorf("expected %q, got %q", want, got.String())
+	}
+}
+
+func TestCompletionHandler_Reindent(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		writeChunks(w, req.Model, "if err != nil {\n        return err\n    }")
+	})
+	body := `{"prompt":"// Path: main.go\nfunc f() error {\n\terr := g()\n\t","suffix":"\n}","max_tokens":20}`
+
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Mode: handlers.ModeFull})
+	responses := streamedResponses(t, postCompletion(t, h, body).Body.String())
+	if got := responses[0].Choices[0].Text; got != "if err != nil {\n\t\treturn err\n\t}" {
+		t.Errorf("expected the completion indented with tabs like the file, got %q", got)
+	}
+
+	h = newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Mode: handlers.ModeFull, LanguageParams: lang.Table{"go": {Indent: "keep"}}})
+	responses = streamedResponses(t, postCompletion(t, h, body).Body.String())
+	if got := responses[0].Choices[0].Text; got != "if err != nil {\n        return err\n    }" {
+		t.Errorf("expected the model's indentation to be kept, got %q", got)
+	}
+}
+
+func TestCompletionHandler_PostProcess(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		writeChunks(w, req.Model, "``", "`python\n", "\n\n    python", "_path = 1\n    b = 2\n", "    c = 3\n``", "`\n")
+	})
+	body := `{"prompt":"def f():","suffix":"","max_tokens":20,"extra":{"language":"python"}}`
+
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Mode: handlers.ModeFull})
+	if got := completionText(streamedResponses(t, postCompletion(t, h, body).Body.String())); got != "\n\n    python_path = 1\n    b = 2\n    c = 3" {
+		t.Errorf("expected the fences to be dropped and the code kept, got %q", got)
+	}
+
+	chain, err := handlers.ParsePostProcess("fences,trim_blank,max_lines=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Mode: handlers.ModeFull, PostProcess: chain})
+	if got := completionText(streamedResponses(t, postCompletion(t, h, body).Body.String())); got != "\n    python_path = 1\n    b = 2" {
+		t.Errorf("expected the blank line trimmed and three lines kept, got %q", got)
+	}
+}
+
+func TestParsePostProcess(t *testing.T) {
+	chain, err := handlers.ParsePostProcess("fences, max_lines=5")
+	if want := []handlers.PostProcessor{{Name: "fences"}, {Name: "max_lines", Lines: 5}}; err != nil || !reflect.DeepEqual(chain, want) {
+		t.Errorf("expected %+v, got %+v (%v)", want, chain, err)
+	}
+	if chain, err := handlers.ParsePostProcess("none"); err != nil || len(chain) != 0 {
+		t.Errorf("expected an empty chain, got %+v (%v)", chain, err)
+	}
+	for _, s := range []string{"", "fences,strip", "max_lines", "max_lines=0", "fences=1"} {
+		if _, err := handlers.ParsePostProcess(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestCompletionHandler_FinishReason(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		enc := json.NewEncoder(w)
+		_ = enc.Encode(api.GenerateResponse{Model: req.Model, Response: "compute()"})
+		evals := 3
+		if strings.Contains(req.Prompt, "long") {
+			evals = int(req.Options["num_predict"].(float64))
+		}
+		_ = enc.Encode(api.GenerateResponse{Model: req.Model, Done: true, Metrics: api.Metrics{PromptEvalCount: 12, EvalCount: evals}})
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Mode: handlers.ModeFull})
+
+	tests := []struct {
+		prompt string
+		reason string
+		total  int
+	}{
+		{prompt: "x := ", reason: "stop", total: 15},
+		{prompt: "long := ", reason: "length", total: 32},
+	}
+	for _, tt := range tests {
+		rr := postCompletion(t, h, `{"prompt":"`+tt.prompt+`","suffix":"","max_tokens":20}`)
+		responses := streamedResponses(t, rr.Body.String())
+		last := responses[len(responses)-1]
+		if last.Choices[0].FinishReason != tt.reason {
+			t.Errorf("expected finish reason %s for %q, got %q", tt.reason, tt.prompt, last.Choices[0].FinishReason)
+		}
+		if last.Usage == nil || last.Usage.PromptTokens != 12 || last.Usage.TotalTokens != tt.total {
+			t.Errorf("expected %d total tokens on the last event, got %+v", tt.total, last.Usage)
+		}
+	}
+}
+
+func TestCompletionHandler_ContextLines(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {})
+	prompt := "l1\nl2\nl3\nl4\nx = "
+	suffix := "\ns1\ns2\ns3"
+
+	tests := []struct {
+		name   string
+		config handlers.CompletionConfig
+		extra  string
+		want   string
+	}{
+		{"configured lines", handlers.CompletionConfig{PrefixLines: 2, SuffixLines: 3}, `{}`, "l4\nx = <FILL>\ns1\ns2"},
+		{"default lines", handlers.CompletionConfig{}, `{}`, prompt + "<FILL>" + suffix},
+		{"token budgets", handlers.CompletionConfig{Tokenizer: tokenizer.Estimate{CharsPerToken: 1}}, `{"prompt_tokens": 5, "suffix_tokens": 3}`, "\nx = <FILL>\ns1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.Model = "primary"
+			h := newCompletionHandler(client, tt.config)
+
+			body := fmt.Sprintf(`{"prompt": %q, "suffix": %q, "max_tokens": 20, "extra": %s}`, prompt, suffix, tt.extra)
+			req := httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", strings.NewReader(body))
+			req.Header.Set(handlers.DebugPromptHeader, "true")
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			var debug handlers.DebugPrompt
+			if err := json.NewDecoder(rr.Body).Decode(&debug); err != nil {
+				t.Fatalf("failed to decode debug prompt: %v", err)
+			}
+			if debug.Prompt != tt.want {
+				t.Errorf("expected prompt %q, got %q", tt.want, debug.Prompt)
+			}
+		})
+	}
+}
+
+func TestCompletionHandler_ContextWindow(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {})
+	tok := tokenizer.Estimate{CharsPerToken: 1}
+	body := `{"prompt": "l1\nl2\nl3\nl4\nx = ", "suffix": "\ns1\ns2\ns3", "max_tokens": 20}`
+
+	debugPrompt := func(numCtx int) handlers.DebugPrompt {
+		t.Helper()
+		h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Tokenizer: tok, NumCtx: numCtx})
+		req := httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", strings.NewReader(body))
+		req.Header.Set(handlers.DebugPromptHeader, "true")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		var debug handlers.DebugPrompt
+		if err := json.NewDecoder(rr.Body).Decode(&debug); err != nil {
+			t.Fatalf("failed to decode debug prompt: %v", err)
+		}
+		return debug
+	}
+
+	// Room for 8 prompt tokens beside the system prompt, the template and
+	// the 20 tokens to predict. The suffix gets a quarter of it.
+	system := tokenizer.Count(tok, debugPrompt(0).System)
+	debug := debugPrompt(system + len("<FILL>") + 20 + 8)
+	if want := "4\nx = <FILL>\ns"; debug.Prompt != want {
+		t.Errorf("expected prompt %q, got %q", want, debug.Prompt)
+	}
+	if debug.Options["num_ctx"] != float64(system+len("<FILL>")+28) {
+		t.Errorf("expected num_ctx to be sent to Ollama, got %v", debug.Options["num_ctx"])
+	}
+}
+
+func TestCompletionHandler_Infill(t *testing.T) {
+	var body map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/infill" {
+			t.Errorf("expected completions to be filled in natively, got %s", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode infill request: %v", err)
+		}
+		fmt.Fprint(w, "data: {\"content\":\"return 42\",\"stop\":false}\n\ndata: {\"content\":\"\",\"stop\":true}\n\n")
+	}))
+	defer srv.Close()
+	client, err := llamacpp.New(srv.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := handlers.NewCompletionHandler(client, handlers.CompletionConfig{
+		Model:          "qwen2.5-coder:7b",
+		PromptTemplate: template.Must(template.New("prompt").Parse("<|fim_prefix|>{{.Prefix}}<|fim_suffix|>{{.Suffix}}<|fim_middle|>")),
+		NumPredict:     50,
+		ModelOptions:   handlers.ModelOptions{"copilot-codex": {"draft_max": 16, "draft_model": "small"}},
+	}, zap.NewNop())
+
+	const request = `{"prompt":"func answer() int {\n\t","suffix":"\n}","max_tokens":20}`
+	rr := postCompletion(t, h, request)
+	if text := completionText(streamedResponses(t, rr.Body.String())); text != "return 42" {
+		t.Errorf("expected the filled in completion, got %q", rr.Body.String())
+	}
+	if body["input_prefix"] != "func answer() int {\n\t" || body["input_suffix"] != "\n}" || body["n_predict"] != float64(20) {
+		t.Errorf("expected the untemplated prefix and suffix, got %v", body)
+	}
+	if _, ok := body["draft_model"]; ok || body["speculative.n_max"] != float64(16) {
+		t.Errorf("expected only the draft options llama.cpp takes, got %v", body)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", strings.NewReader(request))
+	req.Header.Set(handlers.DebugPromptHeader, "true")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	var debug handlers.DebugPrompt
+	if err := json.NewDecoder(rr.Body).Decode(&debug); err != nil {
+		t.Fatalf("failed to decode debug prompt: %v", err)
+	}
+	if debug.Template != "infill" || debug.Prompt != "func answer() int {\n\t" || debug.Suffix != "\n}" || debug.System != "" {
+		t.Errorf("expected the prefix and suffix apart without a system prompt, got %+v", debug)
+	}
+}
+
+// countingTokenizer counts the texts it split.
+type countingTokenizer struct {
+	tokenizer.Estimate
+	mu    sync.Mutex
+	split map[string]int
+}
+
+func (c *countingTokenizer) Split(text string) []string {
+	c.mu.Lock()
+	c.split[text]++
+	c.mu.Unlock()
+	return c.Estimate.Split(text)
+}
+
+func TestCompletionHandler_PromptWindows(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {})
+	tok := &countingTokenizer{Estimate: tokenizer.Estimate{CharsPerToken: 1}, split: map[string]int{}}
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Tokenizer: tok, NumCtx: 4096, PrefixLines: 2, SuffixLines: 2})
+
+	debugPrompt := func(prompt, suffix string) string {
+		t.Helper()
+		body, _ := json.Marshal(map[string]any{"prompt": prompt, "suffix": suffix, "max_tokens": 20, "extra": map[string]any{"uri": "file:///src/main.go"}})
+		req := httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", strings.NewReader(string(body)))
+		req.Header.Set(handlers.DebugPromptHeader, "true")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		var debug handlers.DebugPrompt
+		if err := json.NewDecoder(rr.Body).Decode(&debug); err != nil {
+			t.Fatalf("failed to decode debug prompt: %v", err)
+		}
+		return debug.Prompt
+	}
+
+	hits := metrics.PromptWindows.Get("hit")
+	suffix := "\n\ts1\n\ts2\n}"
+	for i, prompt := range []string{"l1\nl2\n\tx", "l1\nl2\n\tx ", "l1\nl2\n\tx :"} {
+		want := prompt[len("l1\n"):] + "<FILL>\n\ts1"
+		if got := debugPrompt(prompt, suffix); got != want {
+			t.Errorf("expected prompt %d to be %q, got %q", i, want, got)
+		}
+	}
+	if got := metrics.PromptWindows.Get("hit") - hits; got != 2 {
+		t.Errorf("expected the suffix to be reused while typing in the line, got %v hits", got)
+	}
+	if n := tok.split["\n\ts1"]; n != 1 {
+		t.Errorf("expected the suffix window to be tokenized once, got %d", n)
+	}
+
+	debugPrompt("l1\nl2\n\tx :", suffix)
+	if got := metrics.PromptWindows.Get("hit") - hits; got != 4 {
+		t.Errorf("expected a repeated request to reuse both windows, got %v hits", got)
+	}
+	if got := debugPrompt("l1\nl2\n\tx :", "\n}"); got != "l2\n\tx :<FILL>\n}" {
+		t.Errorf("expected a changed suffix to be cut again, got %q", got)
+	}
+}
+
+func TestCompletionHandler_Cache(t *testing.T) {
+	var generations atomic.Int32
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		generations.Add(1)
+		writeChunks(w, req.Model, "compute(", "a, b)")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Cache: cache.New(10, time.Minute)})
+
+	complete := func(prompt string) string {
+		t.Helper()
+		body, _ := json.Marshal(map[string]any{"prompt": prompt, "suffix": "\n", "max_tokens": 20})
+		var got strings.Builder
+		for _, resp := range streamedResponses(t, postCompletion(t, h, string(body)).Body.String()) {
+			got.WriteString(resp.Choices[0].Text)
+		}
+		return got.String()
+	}
+
+	if got := complete("x := "); got != "compute(a, b)" {
+		t.Errorf("expected the generated completion, got %q", got)
+	}
+	if got := complete("x := "); got != "compute(a, b)" {
+		t.Errorf("expected the cached completion, got %q", got)
+	}
+	if got := complete("x := comp"); got != "ute(a, b)" {
+		t.Errorf("expected the rest of the cached completion, got %q", got)
+	}
+	if n := generations.Load(); n != 1 {
+		t.Errorf("expected 1 generation, got %d", n)
+	}
+}
+
+func TestCompletionHandler_CancelSuperseded(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		if strings.HasSuffix(req.Prompt, "x := <FILL>") {
+			close(started)
+			<-release
+			return
+		}
+		writeChunks(w, req.Model, "ompute()")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", CancelSuperseded: true})
+
+	first := make(chan *httptest.ResponseRecorder)
+	go func() {
+		first <- postCompletion(t, h, `{"prompt":"// Path: main.go\nx := ","suffix":"","max_tokens":20}`)
+	}()
+	<-started
+
+	rr := postCompletion(t, h, `{"prompt":"// Path: main.go\nx := c","suffix":"","max_tokens":20}`)
+	if responses := streamedResponses(t, rr.Body.String()); len(responses) != 2 || responses[0].Choices[0].Text != "ompute()" {
+		t.Errorf("expected the newer request to be answered, got %+v", responses)
+	}
+
+	select {
+	case rr := <-first:
+		if responses := streamedResponses(t, rr.Body.String()); len(responses) != 0 {
+			t.Errorf("expected the superseded request to end without events, got %+v", responses)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the superseded request to be canceled")
+	}
+}
+
+func TestCompletionHandler_NilLogger(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		writeChunks(w, req.Model, "return", " nil")
+	})
+	h := handlers.NewCompletionHandler(client, handlers.CompletionConfig{
+		Model:          "primary",
+		PromptTemplate: template.Must(template.New("prompt").Parse("{{.Prefix}}<FILL>{{.Suffix}}")),
+		NumPredict:     50,
+	}, nil)
+
+	responses := streamedResponses(t, postCompletion(t, h, `{"prompt":"func f() error {\n\t","suffix":"\n}","max_tokens":20}`).Body.String())
+	if len(responses) == 0 {
+		t.Fatal("expected the completion to be streamed")
+	}
+}
+
+func TestCompletionHandler_SuggestionMetadata(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		writeChunks(w, req.Model, "compute(a, b)", "\nreturn x")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Mode: handlers.ModeLine, Cache: cache.New(10, time.Minute)})
+
+	post := func(body string, metadata bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", strings.NewReader(body))
+		if metadata {
+			req.Header.Set(handlers.SuggestionMetadataHeader, "true")
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	body := `{"prompt":"x := ","suffix":"","max_tokens":20}`
+
+	for _, resp := range streamedResponses(t, post(body, false).Body.String()) {
+		if resp.Choices[0].Metadata != nil {
+			t.Errorf("expected no metadata without %s, got %+v", handlers.SuggestionMetadataHeader, resp.Choices[0].Metadata)
+		}
+	}
+
+	responses := streamedResponses(t, post(`{"prompt":"y := ","suffix":"","max_tokens":20}`, true).Body.String())
+	last := responses[len(responses)-1].Choices[0]
+	if last.Metadata == nil {
+		t.Fatal("expected metadata on the last event")
+	}
+	if m := last.Metadata; m.Model != "primary" || m.Mode != handlers.ModeLine || m.Cache != "" || !reflect.DeepEqual(m.Filters, []string{"single_line"}) {
+		t.Errorf("expected a line completion by primary cut by single_line, got %+v", m)
+	}
+
+	responses = streamedResponses(t, post(body, true).Body.String())
+	if m := responses[0].Choices[0].Metadata; m == nil || m.Cache != "hit" || m.Model != "primary" {
+		t.Errorf("expected metadata of a cache hit by primary, got %+v", m)
+	}
+
+	rr := post(`{"prompt":"z := ","suffix":"","max_tokens":20,"n":2}`, true)
+	var panel handlers.CompletionResponse
+	if err := json.NewDecoder(rr.Body).Decode(&panel); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(panel.Choices) != 1 {
+		t.Fatalf("expected the agreeing generations to be merged, got %+v", panel.Choices)
+	}
+	if m := panel.Choices[0].Metadata; m == nil || m.Score != 1 || m.Mode != handlers.ModeLine {
+		t.Errorf("expected a line choice with score 1, got %+v", m)
+	}
+}
+
+func TestCompletionHandler_NoStream(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		if strings.Contains(req.Prompt, "fail") {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"error":"out of memory"}`))
+			return
+		}
+		writeChunks(w, req.Model, "compute", "(a, b)")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Mode: handlers.ModeFull})
+
+	rr := postCompletion(t, h, `{"prompt":"x := ","suffix":"","max_tokens":20,"stream":false}`)
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected a JSON response, got %q", ct)
+	}
+	var resp handlers.CompletionResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.Choices) != 1 || resp.Choices[0].Text != "compute(a, b)" || resp.Choices[0].FinishReason != "stop" {
+		t.Errorf("expected one stopped choice with the whole completion, got %+v", resp.Choices)
+	}
+	if resp.Model != "primary" || resp.Object != "text_completion" || resp.Id != rr.Header().Get(handlers.CompletionIDHeader) {
+		t.Errorf("expected the model, object and completion ID to be set, got %+v", resp)
+	}
+
+	rr = postCompletion(t, h, `{"prompt":"fail := ","suffix":"","max_tokens":20,"stream":false}`)
+	if rr.Code != http.StatusBadGateway {
+		t.Errorf("expected status code %d for a failed completion, got %d", http.StatusBadGateway, rr.Code)
+	}
+	resp = handlers.CompletionResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil || resp.Error == nil {
+		t.Errorf("expected the response to describe the error, got %+v (%v)", resp, err)
+	}
+}
+
+func TestCompletionHandler_Panel(t *testing.T) {
+	var mu sync.Mutex
+	temperatures := map[float64]bool{}
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		mu.Lock()
+		temperatures[req.Options["temperature"].(float64)] = true
+		mu.Unlock()
+
+		// Seeds 1 and 3 agree, seed 4 answers nothing.
+		switch req.Options["seed"].(float64) {
+		case 1, 3:
+			writeChunks(w, req.Model, "a + b")
+		case 2:
+			writeChunks(w, req.Model, "a - b")
+		default:
+			writeChunks(w, req.Model, "")
+		}
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Mode: handlers.ModeFull})
+
+	rr := postCompletion(t, h, `{"prompt":"func add(a, b int) int {\n\treturn ","suffix":"\n}","max_tokens":20,"n":4}`)
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected a JSON response, got %q", ct)
+	}
+	var resp handlers.CompletionResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	var got []string
+	for i, choice := range resp.Choices {
+		if choice.Index != i {
+			t.Errorf("expected choice %d to have index %d, got %d", i, i, choice.Index)
+		}
+		got = append(got, choice.Text)
+	}
+	if want := []string{"a + b", "a - b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected choices %q, got %q", want, got)
+	}
+	if resp.Model != "primary" {
+		t.Errorf("expected model primary, got %q", resp.Model)
+	}
+	if len(temperatures) != 4 {
+		t.Errorf("expected 4 different temperatures, got %v", temperatures)
+	}
+}
+
+func TestCompletionHandler_PanelStream(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		if req.Options["seed"].(float64) == 3 {
+			http.Error(w, `{"error":"model crashed"}`, http.StatusInternalServerError)
+			return
+		}
+		writeChunks(w, req.Model, fmt.Sprintf("v%v", req.Options["seed"]), "!")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Mode: handlers.ModeFull})
+
+	rr := postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20,"n":3,"stream":true}`)
+	if ct := rr.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %q", ct)
+	}
+	texts := map[int]string{}
+	finish := map[int]string{}
+	responses := streamedResponses(t, rr.Body.String())
+	for _, resp := range responses {
+		if len(resp.Choices) != 1 {
+			t.Fatalf("expected one choice per event, got %+v", resp)
+		}
+		choice := resp.Choices[0]
+		texts[choice.Index] += choice.Text
+		if choice.FinishReason != "" {
+			finish[choice.Index] = choice.FinishReason
+		}
+	}
+	if want := map[int]string{0: "v1!", 1: "v2!", 2: ""}; !reflect.DeepEqual(texts, want) {
+		t.Errorf("expected choices %q, got %q", want, texts)
+	}
+	if want := map[int]string{0: "stop", 1: "stop", 2: "error"}; !reflect.DeepEqual(finish, want) {
+		t.Errorf("expected finish reasons %v, got %v", want, finish)
+	}
+	if last := responses[len(responses)-1]; last.Choices[0].Index != 2 {
+		t.Errorf("expected the stream to end with the finish of the last choice, got %+v", last)
+	}
+}
+
+func TestCompletionHandler_Spans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		writeChunks(w, req.Model, "return", " nil")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Mode: handlers.ModeFull})
+	postCompletion(t, h, `{"prompt":"func f() error {\n\t","suffix":"\n}","max_tokens":20}`)
+
+	var names []string
+	for _, span := range exporter.GetSpans() {
+		names = append(names, span.Name)
+	}
+	slices.Sort(names)
+	if want := []string{"build prompt", "decode request", "ollama generate", "stream write"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("expected spans %q, got %q", want, names)
+	}
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// deniedTTL is how long a failed entitlement check is remembered, kept short
+// so users who just got a license are not locked out for long.
+const deniedTTL = time.Minute
+
+// EntitlementChecker asks GitHub whether the user behind an Authorization
+// header has a Copilot license, caching the answer.
+type EntitlementChecker struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]entitlement
+}
+
+type entitlement struct {
+	status  int
+	expires time.Time
+}
+
+// NewEntitlementChecker returns a checker that validates against the Copilot
+// token endpoint at url and caches granted entitlements for ttl.
+func NewEntitlementChecker(url string, ttl time.Duration) *EntitlementChecker {
+	return &EntitlementChecker{
+		url:    url,
+		ttl:    ttl,
+		client: &http.Client{Timeout: 10 * time.Second},
+		cache:  map[[sha256.Size]byte]entitlement{},
+	}
+}
+
+// Check returns the HTTP status GitHub answered for authorization:
+// http.StatusOK when the user is entitled. An error means GitHub could not
+// be asked and nothing was cached.
+func (c *EntitlementChecker) Check(ctx context.Context, authorization string) (int, error) {
+	// Only a hash of the credential is kept in memory.
+	key := sha256.Sum256([]byte(authorization))
+
+	c.mu.Lock()
+	cached, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.status, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("checking entitlement: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return 0, fmt.Errorf("checking entitlement: GitHub answered %s", resp.Status)
+	}
+
+	status := resp.StatusCode
+	ttl := c.ttl
+	if status != http.StatusOK {
+		ttl = min(ttl, deniedTTL)
+	}
+
+	c.mu.Lock()
+	c.cache[key] = entitlement{status: status, expires: time.Now().Add(ttl)}
+	c.mu.Unlock()
+
+	return status, nil
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/health"
+	"github.com/josuemontano/ollama-copilot/internal/limiter"
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+	"github.com/josuemontano/ollama-copilot/internal/stream"
+	"github.com/ollama/ollama/api"
+)
+
+// Error classes reported to clients, metrics and the access log. They never
+// include backend addresses or raw Ollama messages.
+const (
+	errModelNotFound     = "model_not_found"
+	errOutOfMemory       = "out_of_memory"
+	errConnectionRefused = "connection_refused"
+	errTimeout           = "timeout"
+	errCanceled          = "canceled"
+	errQueueFull         = "queue_full"
+	errBackend           = "backend_error"
+)
+
+var errMessages = map[string]string{
+	errModelNotFound:     "the configured model is not available in Ollama",
+	errOutOfMemory:       "Ollama ran out of memory loading or running the model",
+	errConnectionRefused: "Ollama is not reachable",
+	errTimeout:           "generation timed out",
+	errCanceled:          "generation was canceled",
+	errQueueFull:         "too many requests are waiting for Ollama, retry shortly",
+	errBackend:           "Ollama failed to generate a completion",
+}
+
+// errClientGone ends a generation whose stream could not be written to the
+// client, there being no one to stream the rest to.
+var errClientGone = errors.New("writing to the client")
+
+// queueRetryAfter is the Retry-After of requests turned away because the
+// generation queue is full.
+const queueRetryAfter = time.Second
+
+// rejectQueueFull answers 429 and returns true when l has no room left in
+// its queue. Handlers check it before committing to a response, so that a
+// client can back off instead of waiting for a slot.
+func rejectQueueFull(ctx context.Context, w http.ResponseWriter, l *limiter.Limiter) bool {
+	if l == nil || !l.QueueFull() {
+		return false
+	}
+	metrics.Throttled.Inc("queue_full")
+	middleware.AddLogField(ctx, "throttled", "queue_full")
+	middleware.TooManyRequests(w, queueRetryAfter, errMessages[errQueueFull])
+	return true
+}
+
+// reportHealth records in health.Default whether Ollama answered a
+// generation that ended with err. Errors other than a refused connection
+// say nothing about whether Ollama is up.
+func reportHealth(err error) {
+	switch {
+	case err == nil, errors.Is(err, stream.ErrStopped):
+		health.Recover(health.BackendDown)
+	case classifyError(err) == errConnectionRefused:
+		health.Fail(health.BackendDown, errMessages[errConnectionRefused])
+	}
+}
+
+// classifyError maps an error returned while generating to one of the error
+// classes above.
+func classifyError(err error) string {
+	var statusErr api.StatusError
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, limiter.ErrQueueFull):
+		return errQueueFull
+	case errors.Is(err, context.Canceled), errors.Is(err, errClientGone):
+		return errCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return errTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errConnectionRefused
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound:
+		return errModelNotFound
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return errTimeout
+	}
+
+	// Errors reported in the stream body arrive as plain strings.
+	message := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(message, "connection refused"), strings.Contains(message, "no such host"):
+		return errConnectionRefused
+	case strings.Contains(message, "model") && strings.Contains(message, "not found"):
+		return errModelNotFound
+	case strings.Contains(message, "out of memory"), strings.Contains(message, "more system memory"), strings.Contains(message, "insufficient memory"):
+		return errOutOfMemory
+	}
+
+	return errBackend
+}
+
+// transient reports whether err is likely to go away if the request is
+// retried shortly: Ollama restarting, busy or still loading the model.
+// Missing models, running out of memory and timeouts would fail again.
+func transient(err error) bool {
+	var statusErr api.StatusError
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded), errors.Is(err, errClientGone):
+		return false
+	case classifyError(err) == errConnectionRefused:
+		return true
+	case errors.Is(err, syscall.ECONNRESET):
+		return true
+	case errors.As(err, &statusErr):
+		switch statusErr.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, s := range []string{"server busy", "try again", "loading model", "llama runner", "connection reset"} {
+		if strings.Contains(message, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/josuemontano/ollama-copilot/internal/events"
+)
+
+// EventsResponse lists recent events. Clients poll with since set to the
+// Seq of the last event they saw.
+type EventsResponse struct {
+	Events []events.Event `json:"events"`
+	// Dropped counts the events subscribers missed by falling behind.
+	Dropped uint64 `json:"dropped"`
+}
+
+// EventsHandler serves the daemon's recent events from a bus.
+type EventsHandler struct {
+	bus *events.Bus
+}
+
+// NewEventsHandler returns an EventsHandler for bus.
+func NewEventsHandler(bus *events.Bus) *EventsHandler {
+	return &EventsHandler{bus: bus}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *EventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var since uint64
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			writeValidationError(w, []FieldError{{Field: "since", Message: "must be an event sequence number"}})
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, EventsResponse{Events: h.bus.Since(since), Dropped: h.bus.Dropped()})
+}
@@ -0,0 +1,34 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/events"
+	"github.com/josuemontano/ollama-copilot/internal/handlers"
+)
+
+func TestEventsHandler(t *testing.T) {
+	bus := events.NewBus(10)
+	bus.Publish(events.BackendFailed, events.Fields{"backend": "desktop"})
+	bus.Publish(events.BackendRecovered, events.Fields{"backend": "desktop"})
+	h := handlers.NewEventsHandler(bus)
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/admin/events?since=1", nil))
+	var resp handlers.EventsResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.Events) != 1 || resp.Events[0].Type != events.BackendRecovered {
+		t.Errorf("expected only the events after seq 1, got %+v", resp.Events)
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/admin/events?since=last", nil))
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected status %d for an invalid since, got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+}
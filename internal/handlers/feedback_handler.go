@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+	"github.com/josuemontano/ollama-copilot/internal/storage"
+)
+
+// FeedbackLog is the storage log each feedback is appended to, as a
+// FeedbackRecord.
+const FeedbackLog = "feedback"
+
+// FeedbackRequest reports whether the user kept a completion. Id is the
+// value of CompletionIDHeader, which is also the id of every chunk.
+//
+// A request with Diagnostics instead reports what the language server said
+// about a completion once inserted. It follows the acceptance, which is not
+// counted again.
+type FeedbackRequest struct {
+	Id          string       `json:"id"`
+	Accepted    bool         `json:"accepted"`
+	Diagnostics *Diagnostics `json:"diagnostics,omitempty"`
+}
+
+// Diagnostics counts the language server diagnostics an accepted completion
+// introduced in the lines it was inserted in.
+type Diagnostics struct {
+	Errors   int `json:"errors"`
+	Warnings int `json:"warnings"`
+}
+
+// FeedbackRecord is a feedback kept in FeedbackLog.
+type FeedbackRecord struct {
+	Time        time.Time    `json:"time"`
+	Id          string       `json:"id"`
+	Model       string       `json:"model"`
+	Accepted    bool         `json:"accepted"`
+	Diagnostics *Diagnostics `json:"diagnostics,omitempty"`
+}
+
+// FeedbackHandler records acceptance of recent completions.
+type FeedbackHandler struct {
+	store      storage.Storage
+	rejections *Rejections
+}
+
+// NewFeedbackHandler returns a FeedbackHandler appending the feedback to
+// store and reporting rejections to rejections, either of which may be nil.
+func NewFeedbackHandler(store storage.Storage, rejections *Rejections) *FeedbackHandler {
+	return &FeedbackHandler{store: store, rejections: rejections}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *FeedbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req FeedbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if req.Id == "" {
+		writeValidationError(w, []FieldError{{Field: "id", Message: "must not be empty"}})
+		return
+	}
+	if d := req.Diagnostics; d != nil && (d.Errors < 0 || d.Warnings < 0) {
+		writeValidationError(w, []FieldError{{Field: "diagnostics", Message: "counts must not be negative"}})
+		return
+	}
+
+	middleware.AddLogField(r.Context(), "completion_id", req.Id)
+	if req.Diagnostics != nil {
+		// Only accepted completions are inserted and diagnosed.
+		req.Accepted = true
+		middleware.AddLogField(r.Context(), "diagnostic_errors", req.Diagnostics.Errors)
+	} else {
+		middleware.AddLogField(r.Context(), "accepted", req.Accepted)
+	}
+
+	model, ok := metrics.RecentCompletions.Model(req.Id)
+	if !ok {
+		http.Error(w, "unknown completion id", http.StatusNotFound)
+		return
+	}
+	middleware.AddLogField(r.Context(), "model", model)
+
+	switch {
+	case req.Diagnostics != nil:
+		metrics.CompletionsDiagnosed.Inc(model)
+		if req.Diagnostics.Errors > 0 {
+			metrics.CompletionsBroken.Inc(model)
+		}
+	case req.Accepted:
+		metrics.CompletionsAccepted.Inc(model)
+	default:
+		metrics.CompletionsRejected.Inc(model)
+		h.rejections.Reject(req.Id)
+	}
+	if h.store != nil {
+		record, _ := json.Marshal(FeedbackRecord{Time: time.Now(), Id: req.Id, Model: model, Accepted: req.Accepted, Diagnostics: req.Diagnostics})
+		if err := h.store.Append(FeedbackLog, record); err != nil {
+			middleware.AddLogField(r.Context(), "storage_error", err.Error())
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
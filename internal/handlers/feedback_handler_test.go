@@ -0,0 +1,153 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/cache"
+	"github.com/josuemontano/ollama-copilot/internal/handlers"
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
+	"github.com/josuemontano/ollama-copilot/internal/storage"
+	"github.com/ollama/ollama/api"
+)
+
+func TestCompletionHandler_CompletionID(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		writeChunks(w, req.Model, "a", "b", "c")
+	})
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "feedback-model"})
+
+	rr := postCompletion(t, h, `{"prompt":"x = ","suffix":""}`)
+	id := rr.Header().Get(handlers.CompletionIDHeader)
+	if id == "" {
+		t.Fatal("expected a completion id header")
+	}
+	for _, resp := range streamedResponses(t, rr.Body.String()) {
+		if resp.Id != id {
+			t.Errorf("expected every chunk to carry id %q, got %q", id, resp.Id)
+		}
+	}
+
+	store := storage.NewMemory()
+	feedback := handlers.NewFeedbackHandler(store, nil)
+	before := metrics.CompletionsAccepted.Get("feedback-model")
+	w := httptest.NewRecorder()
+	feedback.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/completions/feedback", strings.NewReader(`{"id":"`+id+`","accepted":true}`)))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected status code %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if got := metrics.CompletionsAccepted.Get("feedback-model"); got != before+1 {
+		t.Errorf("expected the acceptance to be counted for the serving model, got %v", got-before)
+	}
+	var records []handlers.FeedbackRecord
+	_ = store.Scan(handlers.FeedbackLog, func(record []byte) error {
+		var r handlers.FeedbackRecord
+		records = append(records, r)
+		return json.Unmarshal(record, &records[len(records)-1])
+	})
+	if len(records) != 1 || records[0].Id != id || records[0].Model != "feedback-model" || !records[0].Accepted {
+		t.Errorf("expected the feedback to be stored, got %+v", records)
+	}
+}
+
+func TestFeedbackHandler_Diagnostics(t *testing.T) {
+	metrics.RecentCompletions.Add("diagnosed", "diagnostics-model")
+	store := storage.NewMemory()
+	feedback := handlers.NewFeedbackHandler(store, nil)
+	post := func(body string) int {
+		w := httptest.NewRecorder()
+		feedback.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/completions/feedback", strings.NewReader(body)))
+		return w.Code
+	}
+
+	accepted := metrics.CompletionsAccepted.Get("diagnostics-model")
+	if code := post(`{"id":"diagnosed","accepted":true}`); code != http.StatusNoContent {
+		t.Fatalf("expected status code %d, got %d", http.StatusNoContent, code)
+	}
+	if code := post(`{"id":"diagnosed","diagnostics":{"errors":2,"warnings":1}}`); code != http.StatusNoContent {
+		t.Fatalf("expected status code %d, got %d", http.StatusNoContent, code)
+	}
+	if got := metrics.CompletionsAccepted.Get("diagnostics-model"); got != accepted+1 {
+		t.Errorf("expected the acceptance to be counted once, got %v", got-accepted)
+	}
+	if metrics.CompletionsDiagnosed.Get("diagnostics-model") != 1 || metrics.CompletionsBroken.Get("diagnostics-model") != 1 {
+		t.Errorf("expected one diagnosed completion with errors, got %v diagnosed and %v broken",
+			metrics.CompletionsDiagnosed.Get("diagnostics-model"), metrics.CompletionsBroken.Get("diagnostics-model"))
+	}
+
+	var records []handlers.FeedbackRecord
+	_ = store.Scan(handlers.FeedbackLog, func(record []byte) error {
+		var r handlers.FeedbackRecord
+		records = append(records, r)
+		return json.Unmarshal(record, &records[len(records)-1])
+	})
+	if len(records) != 2 || records[1].Diagnostics == nil || records[1].Diagnostics.Errors != 2 || !records[1].Accepted {
+		t.Errorf("expected the diagnostics to be stored with the feedback, got %+v", records)
+	}
+
+	if code := post(`{"id":"diagnosed","diagnostics":{"errors":-1}}`); code != http.StatusUnprocessableEntity {
+		t.Errorf("expected status code %d for negative counts, got %d", http.StatusUnprocessableEntity, code)
+	}
+}
+
+func TestFeedbackHandler_UnknownID(t *testing.T) {
+	w := httptest.NewRecorder()
+	handlers.NewFeedbackHandler(nil, nil).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/completions/feedback", strings.NewReader(`{"id":"nope","accepted":false}`)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status code %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestCompletionHandler_SuppressRejected(t *testing.T) {
+	var mu sync.Mutex
+	var temperatures []float64
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		mu.Lock()
+		temperature, _ := req.Options["temperature"].(float64)
+		temperatures = append(temperatures, temperature)
+		calls := len(temperatures)
+		mu.Unlock()
+		if calls < 3 {
+			writeChunks(w, req.Model, "ompute", "()")
+		} else {
+			writeChunks(w, req.Model, "ount()")
+		}
+	})
+	rejections := handlers.NewRejections(0)
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", Cache: cache.New(10, time.Minute), Rejections: rejections})
+	feedback := handlers.NewFeedbackHandler(nil, rejections)
+	body := `{"prompt":"// Path: main.go\nx := c","suffix":"","max_tokens":20}`
+
+	rr := postCompletion(t, h, body)
+	if text := completionText(streamedResponses(t, rr.Body.String())); text != "ompute()" {
+		t.Fatalf("expected the first suggestion, got %q", text)
+	}
+	w := httptest.NewRecorder()
+	feedback.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/completions/feedback", strings.NewReader(`{"id":"`+rr.Header().Get(handlers.CompletionIDHeader)+`","accepted":false}`)))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status code %d, got %d", http.StatusNoContent, w.Code)
+	}
+
+	// The cached suggestion was rejected, and the model writing it again
+	// is dropped.
+	if text := completionText(streamedResponses(t, postCompletion(t, h, body).Body.String())); text != "" {
+		t.Errorf("expected the rejected suggestion to be suppressed, got %q", text)
+	}
+	if text := completionText(streamedResponses(t, postCompletion(t, h, body).Body.String())); text != "ount()" {
+		t.Errorf("expected a different suggestion to be shown, got %q", text)
+	}
+	if text := completionText(streamedResponses(t, postCompletion(t, h, `{"prompt":"// Path: other.go\nx := c","suffix":"","max_tokens":20}`).Body.String())); text != "ount()" {
+		t.Errorf("expected other positions to be unaffected, got %q", text)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(temperatures) != 4 || temperatures[1] < handlers.ResampleTemperature || temperatures[2] < handlers.ResampleTemperature || temperatures[3] >= handlers.ResampleTemperature {
+		t.Errorf("expected the rejected position to be resampled, got temperatures %v", temperatures)
+	}
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"context"
+
+	"github.com/ollama/ollama/api"
+)
+
+// Generator generates completions and chats in the Ollama API's types.
+// Ollama's *api.Client is one, and *openai.Client one for servers speaking
+// the OpenAI API.
+type Generator interface {
+	Generate(ctx context.Context, req *api.GenerateRequest, fn api.GenerateResponseFunc) error
+	Chat(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error
+}
+
+// Drafter is a Generator whose server speculates with a draft model, such
+// as *llamacpp.Client. DraftOptions names the DraftOptions it takes.
+type Drafter interface {
+	Generator
+	DraftOptions() []string
+}
+
+// Infiller is a Generator that fills in the middle natively, such as
+// *llamacpp.Client. Completions with one are not templated: the text
+// before and after the cursor is passed apart, for the server to place
+// with the FIM tokens of its model.
+type Infiller interface {
+	Generator
+	Infill(ctx context.Context, req *api.GenerateRequest, prefix, suffix string, fn api.GenerateResponseFunc) error
+}
+
+// infillKey is the context key of the text an Infiller fills in between.
+type infillKey struct{}
+
+// infillText is the text around the cursor of a completion.
+type infillText struct {
+	prefix, suffix string
+}
+
+// withInfill returns ctx carrying the text the completion of ctx fills in
+// between, when it is filled in natively.
+func withInfill(ctx context.Context, text *infillText) context.Context {
+	if text == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, infillKey{}, text)
+}
@@ -1,25 +1,284 @@
 package handlers
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"mime"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/backends"
+	"github.com/josuemontano/ollama-copilot/internal/health"
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+	"github.com/ollama/ollama/api"
+)
+
+type HealthHandler struct {
+	tracker   *health.Tracker
+	quota     *middleware.RateLimiter
+	readiness *Readiness
+}
+
+// HealthResponse is the JSON answer of /health. Status is "ok", "degraded"
+// when Conditions says what keeps completions from working or a backend of
+// the Components is down, or "unavailable" when no backend can generate.
+type HealthResponse struct {
+	Status     string             `json:"status"`
+	Conditions []health.Condition `json:"conditions"`
+	Components []ComponentHealth  `json:"components,omitempty"`
+}
+
+// Statuses of a ComponentHealth.
+const (
+	ComponentOK   = "ok"
+	ComponentDown = "down"
 )
 
-type HealthHandler struct{}
+// ComponentHealth is the result of a readiness check of something
+// completions depend on.
+type ComponentHealth struct {
+	Name string `json:"name"`
+	// Backend is the name of the backend the component belongs to, when
+	// the server has a pool of them.
+	Backend string  `json:"backend,omitempty"`
+	Status  string  `json:"status"`
+	Detail  string  `json:"detail,omitempty"`
+	Latency float64 `json:"latency_ms"`
+}
+
+// DefaultReadinessTimeout bounds the readiness checks of a request to
+// /health.
+const DefaultReadinessTimeout = 10 * time.Second
+
+// GenerationCheckTTL is how long the result of a generation check is
+// reused, so that requests to /health?generate=true, which need no key, do
+// not each start a generation.
+const GenerationCheckTTL = 5 * time.Second
+
+// Readiness checks that completions can be generated: that Ollama answers,
+// that it has the model and, when asked to, that the model generates.
+type Readiness struct {
+	Client *api.Client
+	// Pool has the backends to check, each through backends.WithBackend.
+	// When nil, the Ollama of Client is checked.
+	Pool *backends.Pool
+	// Model returns the model completions are generated with, which may
+	// change at runtime.
+	Model func() string
+	// Timeout bounds the checks, DefaultReadinessTimeout when zero.
+	Timeout time.Duration
+
+	mu             sync.Mutex
+	generation     ComponentHealth
+	generatedModel string
+	generated      time.Time
+}
+
+// Check checks the "ollama" and "model" components of every backend and,
+// with generate, the "generation" of a token by the model on the backend
+// completions would be sent to. The checks of a backend stop at the first
+// that is down, as the next ones depend on it. It reports whether
+// completions can be generated: whether a backend passed its checks, and
+// the generation when it was checked.
+func (rd *Readiness) Check(ctx context.Context, generate bool) ([]ComponentHealth, bool) {
+	ctx, cancel := context.WithTimeout(ctx, orDefault(rd.Timeout, DefaultReadinessTimeout))
+	defer cancel()
 
-func NewHealthHandler() *HealthHandler {
-	return &HealthHandler{}
+	targets := []*backends.Backend{nil}
+	if rd.Pool != nil {
+		targets = rd.Pool.Backends()
+	}
+	model := rd.Model()
+	checked := make([][]ComponentHealth, len(targets))
+	ready := make([]bool, len(targets))
+	var wg sync.WaitGroup
+	for i, b := range targets {
+		wg.Go(func() {
+			checked[i], ready[i] = rd.checkBackend(ctx, b, model)
+		})
+	}
+	wg.Wait()
+	components := slices.Concat(checked...)
+
+	// Completions go to the backend the pool picks, or to another one when
+	// it is down.
+	var picked *backends.Backend
+	if rd.Pool != nil {
+		picked = rd.Pool.Pick()
+	}
+	target := -1
+	for i, b := range targets {
+		if ready[i] && (target < 0 || b == picked) {
+			target = i
+		}
+	}
+	if target < 0 || !generate {
+		return components, target >= 0
+	}
+	generation := rd.checkGeneration(ctx, targets[target], model)
+	return append(components, generation), generation.Status == ComponentOK
+}
+
+// checkBackend checks the "ollama" and "model" components of b, or of the
+// Ollama of the client when b is nil, and reports whether both are up.
+func (rd *Readiness) checkBackend(ctx context.Context, b *backends.Backend, model string) ([]ComponentHealth, bool) {
+	if b != nil {
+		ctx = backends.WithBackend(ctx, b)
+	}
+	var components []ComponentHealth
+	check := func(name string, fn func() error) bool {
+		c := measure(name, b, fn)
+		components = append(components, c)
+		return c.Status == ComponentOK
+	}
+
+	var list *api.ListResponse
+	ok := check("ollama", func() (err error) {
+		list, err = rd.Client.List(ctx)
+		return err
+	}) && check("model", func() error {
+		if !hasModel(list.Models, model) {
+			return fmt.Errorf("%s is not pulled", model)
+		}
+		return nil
+	})
+	return components, ok
 }
 
+// checkGeneration has model generate a token on b, unless a check of the
+// same generation ended less than GenerationCheckTTL ago. Concurrent calls
+// wait for the running check rather than starting their own.
+func (rd *Readiness) checkGeneration(ctx context.Context, b *backends.Backend, model string) ComponentHealth {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if last := rd.generation; last.Backend == backendName(b) && rd.generatedModel == model && time.Since(rd.generated) < GenerationCheckTTL {
+		return last
+	}
+
+	if b != nil {
+		ctx = backends.WithBackend(ctx, b)
+	}
+	rd.generation = measure("generation", b, func() error {
+		stream := false
+		req := &api.GenerateRequest{Model: model, Prompt: "1", Raw: true, Stream: &stream, Options: map[string]any{"num_predict": 1}}
+		return rd.Client.Generate(ctx, req, func(api.GenerateResponse) error { return nil })
+	})
+	rd.generatedModel, rd.generated = model, time.Now()
+	return rd.generation
+}
+
+// measure runs the check fn of the component name of b and returns its
+// result.
+func measure(name string, b *backends.Backend, fn func() error) ComponentHealth {
+	start := time.Now()
+	err := fn()
+	c := ComponentHealth{Name: name, Backend: backendName(b), Status: ComponentOK, Latency: millis(time.Since(start))}
+	if err != nil {
+		c.Status, c.Detail = ComponentDown, err.Error()
+	}
+	return c
+}
+
+// backendName returns the name of b, or "" when b is nil.
+func backendName(b *backends.Backend) string {
+	if b == nil {
+		return ""
+	}
+	return b.Name
+}
+
+// hasModel reports whether models has model, which Ollama tags latest when
+// it names no tag.
+func hasModel(models []api.ModelResponse, model string) bool {
+	for _, m := range models {
+		if m.Name == model || m.Name == model+":latest" {
+			return true
+		}
+	}
+	return false
+}
+
+// NewHealthHandler returns a handler reporting the conditions of tracker,
+// and whether the client is out of the rate of quota, which may be nil.
+// With readiness, requests also check that completions can be generated.
+func NewHealthHandler(tracker *health.Tracker, quota *middleware.RateLimiter, readiness *Readiness) *HealthHandler {
+	return &HealthHandler{tracker: tracker, quota: quota, readiness: readiness}
+}
+
+// ServeHTTP answers 503 when no backend passes the readiness checks, which
+// ?generate=true adds a generation to, and 200 otherwise, even if degraded.
 func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	_, err := w.Write([]byte("Ollama copilot is running"))
+	var components []ComponentHealth
+	status := http.StatusOK
+	if h.readiness != nil {
+		generate, _ := strconv.ParseBool(r.URL.Query().Get("generate"))
+		var ready bool
+		components, ready = h.readiness.Check(r.Context(), generate)
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	down := slices.ContainsFunc(components, func(c ComponentHealth) bool { return c.Status != ComponentOK })
+
+	conditions := h.tracker.Conditions()
+	if wait, ok := h.quota.Exhausted(r); ok {
+		conditions = append(conditions, health.Condition{State: health.OverQuota, Detail: "retry in " + wait.Round(time.Second).String(), Since: time.Now()})
+	}
+	if states := health.States(conditions); states != "" {
+		w.Header().Set(health.Header, states)
+	}
+
+	if acceptsJSON(r) {
+		resp := HealthResponse{Status: "ok", Conditions: conditions, Components: components}
+		switch {
+		case status != http.StatusOK:
+			resp.Status = "unavailable"
+		case len(conditions) > 0 || down:
+			resp.Status = "degraded"
+		}
+		writeJSON(w, status, resp)
+		return
+	}
+
+	body := "Ollama copilot is running"
+	for _, c := range conditions {
+		body += "\ndegraded: " + c.State
+		if c.Detail != "" {
+			body += " (" + c.Detail + ")"
+		}
+	}
+	for _, c := range components {
+		if c.Status != ComponentOK {
+			name := c.Name
+			if c.Backend != "" {
+				name += " of " + c.Backend
+			}
+			body += "\nunavailable: " + name + " (" + c.Detail + ")"
+		}
+	}
+	w.WriteHeader(status)
+	_, err := w.Write([]byte(body))
 	if err != nil {
 		log.Printf("error writing response: %s", err.Error())
 	}
 }
+
+// acceptsJSON reports whether the Accept header of r names JSON.
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept)); err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
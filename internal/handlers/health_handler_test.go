@@ -1,15 +1,22 @@
 package handlers_test
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/josuemontano/ollama-copilot/internal/backends"
 	"github.com/josuemontano/ollama-copilot/internal/handlers"
+	"github.com/josuemontano/ollama-copilot/internal/health"
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+	"github.com/josuemontano/ollama-copilot/internal/ollamatest"
+	"github.com/ollama/ollama/api"
 )
 
 func TestHealthHandler(t *testing.T) {
-	h := handlers.NewHealthHandler()
+	h := handlers.NewHealthHandler(health.NewTracker(health.LoadingAfter), nil, nil)
 	req, err := http.NewRequest("GET", "/health", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -30,3 +37,174 @@ func TestHealthHandler(t *testing.T) {
 			rr.Body.String(), expected)
 	}
 }
+
+func TestHealthHandler_Degraded(t *testing.T) {
+	tracker := health.NewTracker(health.LoadingAfter)
+	tracker.Fail(health.BackendDown, "Ollama is not reachable")
+	quota := middleware.NewRateLimiter(0.5, 1)
+	middleware.RateLimitMiddleware(quota, http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	h := handlers.NewHealthHandler(tracker, quota, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status %d while degraded, got %d", http.StatusOK, rr.Code)
+	}
+	if got := rr.Header().Get(health.Header); got != "backend_down, over_quota" {
+		t.Errorf("expected the degraded states in the header, got %q", got)
+	}
+	var resp handlers.HealthResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "degraded" || len(resp.Conditions) != 2 || resp.Conditions[0].Detail != "Ollama is not reachable" {
+		t.Errorf("expected both conditions in the response, got %+v", resp)
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if want := "Ollama copilot is running\ndegraded: backend_down (Ollama is not reachable)\ndegraded: over_quota"; !strings.HasPrefix(rr.Body.String(), want) {
+		t.Errorf("expected the conditions as lines of text, got %q", rr.Body.String())
+	}
+
+	tracker.Recover(health.BackendDown)
+	req = httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.RemoteAddr = "192.0.2.9:1234"
+	req.Header.Set("Accept", "application/json")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	resp = handlers.HealthResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "ok" || len(resp.Conditions) != 0 || rr.Header().Get(health.Header) != "" {
+		t.Errorf("expected another client to see nothing degraded, got %+v", resp)
+	}
+}
+
+func TestHealthHandler_Readiness(t *testing.T) {
+	ollama := ollamatest.NewServer(t)
+	model := "qwen2.5-coder:7b"
+	h := handlers.NewHealthHandler(health.NewTracker(health.LoadingAfter), nil, &handlers.Readiness{
+		Client: ollama.Client(),
+		Model:  func() string { return model },
+	})
+	check := func(target string) (int, handlers.HealthResponse) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Accept", "application/json")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		var resp handlers.HealthResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return rr.Code, resp
+	}
+
+	code, resp := check("/health")
+	if code != http.StatusServiceUnavailable || resp.Status != "unavailable" {
+		t.Errorf("expected status code %d without the model, got %d with %+v", http.StatusServiceUnavailable, code, resp)
+	}
+	if len(resp.Components) != 2 || resp.Components[0].Status != handlers.ComponentOK || resp.Components[1].Detail != "qwen2.5-coder:7b is not pulled" {
+		t.Errorf("expected Ollama up and the model down, got %+v", resp.Components)
+	}
+
+	ollama.SetModels("qwen2.5-coder:7b")
+	if code, resp := check("/health"); code != http.StatusOK || resp.Status != "ok" || len(resp.Components) != 2 {
+		t.Errorf("expected status code %d with the model pulled, got %d with %+v", http.StatusOK, code, resp)
+	}
+	if len(ollama.Generates()) != 0 {
+		t.Error("expected no generation unless asked for")
+	}
+
+	code, resp = check("/health?generate=true")
+	if code != http.StatusOK || len(resp.Components) != 3 || resp.Components[2].Name != "generation" {
+		t.Errorf("expected a generation to be checked, got %d with %+v", code, resp.Components)
+	}
+	if generates := ollama.Generates(); len(generates) != 1 || generates[0].Options["num_predict"] != float64(1) {
+		t.Errorf("expected a generation of one token, got %+v", generates)
+	}
+
+	ollama.OnGenerate(func(api.GenerateRequest) ollamatest.Reply {
+		return ollamatest.Failure(http.StatusInternalServerError, "runner crashed")
+	})
+	if code, _ := check("/health?generate=true"); code != http.StatusOK || len(ollama.Generates()) != 1 {
+		t.Errorf("expected the generation check to be reused for %s, got %d after %d generations", handlers.GenerationCheckTTL, code, len(ollama.Generates()))
+	}
+	h = handlers.NewHealthHandler(health.NewTracker(health.LoadingAfter), nil, &handlers.Readiness{
+		Client: ollama.Client(),
+		Model:  func() string { return model },
+	})
+	if code, resp := check("/health?generate=true"); code != http.StatusServiceUnavailable || resp.Components[2].Status != handlers.ComponentDown {
+		t.Errorf("expected a failed generation to make the server unavailable, got %d with %+v", code, resp.Components)
+	}
+
+	model = "codellama"
+	ollama.SetModels("codellama:latest")
+	if code, _ := check("/health"); code != http.StatusOK {
+		t.Errorf("expected a model without a tag to match its latest tag, got %d", code)
+	}
+
+	t.Setenv("OLLAMA_HOST", "http://127.0.0.1:1")
+	unreachable, err := api.ClientFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := handlers.NewHealthHandler(health.NewTracker(health.LoadingAfter), nil, &handlers.Readiness{
+		Client: unreachable,
+		Model:  func() string { return model },
+	})
+	rr := httptest.NewRecorder()
+	down.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), "\nunavailable: ollama (") {
+		t.Errorf("expected Ollama to be reported down, got %d: %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestHealthHandler_ReadinessBackends(t *testing.T) {
+	up := ollamatest.NewServer(t)
+	up.SetModels("qwen2.5-coder:7b")
+	transport := http.DefaultClient.Transport
+	http.DefaultClient.Transport = &backends.Transport{Base: transport}
+	t.Cleanup(func() { http.DefaultClient.Transport = transport })
+
+	check := func(addresses map[string]string) (int, handlers.HealthResponse) {
+		t.Helper()
+		pool, err := backends.New(addresses)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := handlers.NewHealthHandler(health.NewTracker(health.LoadingAfter), nil, &handlers.Readiness{
+			Client: up.Client(),
+			Pool:   pool,
+			Model:  func() string { return "qwen2.5-coder:7b" },
+		})
+		req := httptest.NewRequest(http.MethodGet, "/health?generate=true", nil)
+		req.Header.Set("Accept", "application/json")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		var resp handlers.HealthResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return rr.Code, resp
+	}
+
+	code, resp := check(map[string]string{"a": "127.0.0.1:1", "b": up.URL})
+	if code != http.StatusOK || resp.Status != "degraded" {
+		t.Errorf("expected status code %d with a backend down, got %d with %+v", http.StatusOK, code, resp)
+	}
+	if len(resp.Components) != 4 || resp.Components[0].Backend != "a" || resp.Components[0].Status != handlers.ComponentDown {
+		t.Errorf("expected backend a to be down, got %+v", resp.Components)
+	}
+	if last := resp.Components[len(resp.Components)-1]; last.Name != "generation" || last.Backend != "b" || last.Status != handlers.ComponentOK {
+		t.Errorf("expected the generation to be checked on backend b, got %+v", last)
+	}
+
+	if code, resp := check(map[string]string{"a": "127.0.0.1:1"}); code != http.StatusServiceUnavailable || resp.Status != "unavailable" {
+		t.Errorf("expected status code %d with every backend down, got %d with %+v", http.StatusServiceUnavailable, code, resp)
+	}
+}
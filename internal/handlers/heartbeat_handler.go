@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/josuemontano/ollama-copilot/internal/lang"
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+	"github.com/josuemontano/ollama-copilot/internal/presence"
+	"go.uber.org/zap"
+)
+
+// Heartbeat events editor plugins send.
+const (
+	// HeartbeatFocus is sent when an editor window or another file gains
+	// focus.
+	HeartbeatFocus = "focus"
+	// HeartbeatTyping is sent while the user edits.
+	HeartbeatTyping = "typing"
+)
+
+// HeartbeatRequest tells the server that someone is working in an editor.
+type HeartbeatRequest struct {
+	Event string `json:"event"`
+	// File is the path of the active file, when the plugin knows it.
+	File string `json:"file,omitempty"`
+	// Prompt and Suffix are the text of the active file before and after
+	// the cursor, as in a CompletionRequest. On focus of another file they
+	// prime the model with the file.
+	Prompt   string `json:"prompt,omitempty"`
+	Suffix   string `json:"suffix,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+// HeartbeatHandler records the heartbeats of editor plugins in a tracker
+// and primes the model with the file that gained focus.
+type HeartbeatHandler struct {
+	tracker     *presence.Tracker
+	completions *CompletionHandler
+	logger      *zap.Logger
+}
+
+// NewHeartbeatHandler returns a HeartbeatHandler recording heartbeats in
+// tracker. completions primes the model and may be nil.
+func NewHeartbeatHandler(tracker *presence.Tracker, completions *CompletionHandler, logger *zap.Logger) *HeartbeatHandler {
+	return &HeartbeatHandler{tracker: tracker, completions: completions, logger: logger}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *HeartbeatHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req HeartbeatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if req.Event != HeartbeatFocus && req.Event != HeartbeatTyping {
+		writeValidationError(w, []FieldError{{Field: "event", Message: fmt.Sprintf("must be %q or %q", HeartbeatFocus, HeartbeatTyping)}})
+		return
+	}
+	middleware.AddLogField(r.Context(), "event", req.Event)
+
+	changed := h.tracker.Beat(req.File)
+	if changed && req.Event == HeartbeatFocus && (req.Prompt != "" || req.Suffix != "") && h.completions != nil {
+		prime := CompletionRequest{Prompt: req.Prompt, Suffix: req.Suffix}
+		prime.Extra.Language = req.Language
+		user := requestUser(r, h.completions.settings.Load().userHeader)
+		// The request returns at once, while priming takes as long as
+		// the prompt evaluation.
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			if err := h.completions.Prime(ctx, prime, user); err != nil {
+				h.logger.Warn("Error priming the model", zap.String("file", req.File), zap.Error(err))
+				return
+			}
+			h.logger.Debug("Model primed", zap.String("file", req.File))
+		}()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PrimePath is the path completions priming the model are counted under in
+// metrics.
+const PrimePath = "/v1/heartbeat"
+
+// Prime runs req through the completion pipeline with a single token to
+// predict and throws the result away. Ollama then has the prompt of the
+// file evaluated, and reuses it for a completion whose prompt starts the
+// same way.
+func (ch *CompletionHandler) Prime(ctx context.Context, req CompletionRequest, user string) error {
+	settings := ch.settings.Load()
+	req.MaxTokens, req.N, req.Stream = 1, 0, nil
+	if errs := req.Validate(); len(errs) > 0 {
+		return fmt.Errorf("invalid request: %s %s", errs[0].Field, errs[0].Message)
+	}
+	if req.Extra.Language == "" {
+		req.Extra.Language = lang.Infer(req.Prompt, settings.defaultLang)
+	}
+
+	info := requestInfo{id: uuid.New().String(), path: PrimePath, user: user}
+	return ch.generateCompletion(ctx, discardResponse{header: http.Header{}}, settings, info, req, nil)
+}
+
+// discardResponse is a ResponseWriter throwing away what is written to it.
+type discardResponse struct {
+	header http.Header
+}
+
+func (d discardResponse) Header() http.Header         { return d.header }
+func (d discardResponse) Write(p []byte) (int, error) { return len(p), nil }
+func (d discardResponse) WriteHeader(int)             {}
@@ -0,0 +1,67 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/handlers"
+	"github.com/josuemontano/ollama-copilot/internal/presence"
+	"github.com/ollama/ollama/api"
+	"go.uber.org/zap"
+)
+
+func postHeartbeat(t *testing.T, h http.Handler, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/heartbeat", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestHeartbeatHandler(t *testing.T) {
+	primed := make(chan api.GenerateRequest, 4)
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		primed <- req
+		writeChunks(w, req.Model, "x")
+	})
+	tracker := presence.NewTracker()
+	h := handlers.NewHeartbeatHandler(tracker, newCompletionHandler(client, handlers.CompletionConfig{Model: "coder"}), zap.NewNop())
+
+	if rr := postHeartbeat(t, h, `{"event":"scroll"}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected an unknown event to be rejected, got %d", rr.Code)
+	}
+	if !tracker.LastBeat().IsZero() {
+		t.Error("expected a rejected heartbeat not to count")
+	}
+
+	rr := postHeartbeat(t, h, `{"event":"focus","file":"main.go","prompt":"package main\n\nfunc ","suffix":"\n"}`)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rr.Code)
+	}
+	if time.Since(tracker.LastBeat()) > time.Second {
+		t.Errorf("expected the heartbeat to be recorded, got %v", tracker.LastBeat())
+	}
+	select {
+	case req := <-primed:
+		if !strings.HasPrefix(req.Prompt, "package main") {
+			t.Errorf("expected the model to be primed with the file, got %q", req.Prompt)
+		}
+		if got := req.Options["num_predict"]; got != float64(1) {
+			t.Errorf("expected priming to predict a single token, got %v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the focused file to prime the model")
+	}
+
+	postHeartbeat(t, h, `{"event":"typing","file":"main.go","prompt":"package main\n\nfunc m","suffix":"\n"}`)
+	postHeartbeat(t, h, `{"event":"focus","file":"main.go","prompt":"package main\n\nfunc ","suffix":"\n"}`)
+	select {
+	case req := <-primed:
+		t.Errorf("expected the file to be primed once, got %q", req.Prompt)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
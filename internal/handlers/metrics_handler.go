@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
+)
+
+// MetricsHandler serves the metrics in the Prometheus text format.
+type MetricsHandler struct{}
+
+// NewMetricsHandler returns a MetricsHandler.
+func NewMetricsHandler() *MetricsHandler {
+	return &MetricsHandler{}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := metrics.WriteText(w); err != nil {
+		log.Printf("error writing metrics: %s", err.Error())
+	}
+}
@@ -0,0 +1,48 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/handlers"
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	metrics.CacheLookups.Inc("miss")
+	metrics.TTFTSeconds.Observe("metrics-model", 0.3)
+	metrics.TTFTSeconds.Observe("metrics-model", 2)
+
+	h := handlers.NewMetricsHandler()
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	body := rr.Body.String()
+	for _, want := range []string{
+		"# TYPE completion_cache_lookups_total counter\n",
+		`completion_cache_lookups_total{result="miss"} `,
+		"# TYPE completion_ttft_seconds histogram\n",
+		`completion_ttft_seconds_bucket{model="metrics-model",le="0.25"} 0` + "\n",
+		`completion_ttft_seconds_bucket{model="metrics-model",le="0.5"} 1` + "\n",
+		`completion_ttft_seconds_bucket{model="metrics-model",le="+Inf"} 2` + "\n",
+		`completion_ttft_seconds_sum{model="metrics-model"} 2.3` + "\n",
+		`completion_ttft_seconds_count{model="metrics-model"} 2` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected the metrics to contain %q, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsHandler_MethodNotAllowed(t *testing.T) {
+	rr := httptest.NewRecorder()
+	handlers.NewMetricsHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status code %d, got %d", http.StatusMethodNotAllowed, rr.Code)
+	}
+}
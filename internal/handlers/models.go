@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ModelMap routes the model names Copilot asks for, such as copilot-codex
+// or gpt-4o-copilot, to Ollama models.
+type ModelMap map[string]string
+
+// Resolve returns the Ollama model mapped to requested, or fallback when
+// requested is empty or not mapped.
+func (m ModelMap) Resolve(requested, fallback string) string {
+	if model, ok := m[requested]; ok && requested != "" {
+		return model
+	}
+	return fallback
+}
+
+// ModelOptions are the Ollama options sent with requests for the model
+// names Copilot asks for, by name. They replace the server's and the
+// client's settings, so that each editor feature can be tuned for its own
+// model. The values are ints or float64s, as Ollama decodes them.
+type ModelOptions map[string]map[string]interface{}
+
+// intOptions, floatOptions and stringOptions are the sampling and
+// DraftOptions ModelOptions may set. Options of the runner, such as
+// num_ctx, would reload the model for every other request and are left to
+// the server's flags.
+var (
+	intOptions    = []string{"num_predict", "seed", "top_k", "repeat_last_n", "mirostat", "draft_max", "draft_min"}
+	floatOptions  = []string{"temperature", "top_p", "typical_p", "repeat_penalty", "presence_penalty", "frequency_penalty", "mirostat_tau", "mirostat_eta", "draft_p_min"}
+	stringOptions = []string{"draft_model"}
+)
+
+// DraftOptions are the ModelOptions of speculative decoding with a draft
+// model. Ollama has none, so they are only sent to a Drafter that takes
+// them.
+var DraftOptions = []string{"draft_model", "draft_max", "draft_min", "draft_p_min"}
+
+// draftsOf returns the DraftOptions api takes.
+func draftsOf(api Generator) []string {
+	if d, ok := api.(Drafter); ok {
+		return d.DraftOptions()
+	}
+	return nil
+}
+
+// dropDrafts deletes the DraftOptions not in taken from options.
+func dropDrafts(options map[string]interface{}, taken []string) {
+	for _, name := range DraftOptions {
+		if !slices.Contains(taken, name) {
+			delete(options, name)
+		}
+	}
+}
+
+// ParseModelOptions parses options given as name.option=value pairs, such
+// as chat-control.temperature=0.2, keyed by the part before the =. Names
+// may contain dots, the option is after the last one.
+func ParseModelOptions(values map[string]string) (ModelOptions, error) {
+	options := ModelOptions{}
+	for key, value := range values {
+		i := strings.LastIndex(key, ".")
+		if i <= 0 {
+			return nil, fmt.Errorf("model option %q must be given as name.option", key)
+		}
+		name, option := key[:i], key[i+1:]
+		var v interface{}
+		switch {
+		case slices.Contains(intOptions, option):
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("model option %s needs a whole number, got %q", key, value)
+			}
+			v = n
+		case slices.Contains(floatOptions, option):
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("model option %s needs a number, got %q", key, value)
+			}
+			v = f
+		case slices.Contains(stringOptions, option):
+			if value == "" {
+				return nil, fmt.Errorf("model option %s needs a value", key)
+			}
+			v = value
+		default:
+			return nil, fmt.Errorf("unknown model option %q, expected one of %s", option, strings.Join(slices.Concat(intOptions, floatOptions, stringOptions), ", "))
+		}
+		if options[name] == nil {
+			options[name] = map[string]interface{}{}
+		}
+		options[name][option] = v
+	}
+	return options, nil
+}
+
+// engineFromPath returns the engine named in a /v1/engines/{engine}/...
+// path, or "" for other paths.
+func engineFromPath(path string) string {
+	rest, ok := strings.CutPrefix(path, "/v1/engines/")
+	if !ok {
+		return ""
+	}
+	engine, _, _ := strings.Cut(rest, "/")
+	return engine
+}
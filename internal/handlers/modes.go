@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/josuemontano/ollama-copilot/internal/stream"
+)
+
+// CompletionMode controls how much of a generation reaches the client.
+type CompletionMode string
+
+const (
+	// ModeAuto picks ModeLine, ModeBlock or ModeFunction from the cursor
+	// position.
+	ModeAuto CompletionMode = "auto"
+	// ModeLine completes the rest of the cursor line only.
+	ModeLine CompletionMode = "line"
+	// ModeBlock completes until the block the cursor is in ends.
+	ModeBlock CompletionMode = "block"
+	// ModeFunction completes the whole body of a function, with a larger
+	// budget and a system prompt asking for a complete implementation.
+	ModeFunction CompletionMode = "function"
+	// ModeFull streams everything the model generates.
+	ModeFull CompletionMode = "full"
+)
+
+// ParseCompletionMode returns the mode named s.
+func ParseCompletionMode(s string) (CompletionMode, error) {
+	switch mode := CompletionMode(s); mode {
+	case ModeAuto, ModeLine, ModeBlock, ModeFunction, ModeFull:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown completion mode %q, expected auto, line, block, function or full", s)
+	}
+}
+
+// blockOpeners end lines after which a new block starts, in most languages.
+const blockOpeners = "{[(:"
+
+// resolve replaces ModeAuto with the mode the cursor position suggests. In
+// the middle of a line only the line is completed. In the empty body of a
+// function the whole function is. On a blank line, or at the end of a line
+// that opens a block, a block is completed. At the end of any other line
+// only the line is. An unset mode is ModeFull.
+func (m CompletionMode) resolve(prompt, suffix string) CompletionMode {
+	if m == "" {
+		return ModeFull
+	}
+	if m != ModeAuto {
+		return m
+	}
+
+	rest, _, _ := strings.Cut(suffix, "\n")
+	if strings.TrimSpace(rest) != "" {
+		return ModeLine
+	}
+	if _, ok := emptyFunctionBody(prompt, suffix); ok {
+		return ModeFunction
+	}
+
+	line := strings.TrimSpace(cursorLine(prompt))
+	if line == "" || strings.ContainsAny(line[len(line)-1:], blockOpeners) {
+		return ModeBlock
+	}
+	return ModeLine
+}
+
+// blockIndent is the least indentation of the lines a block completion at
+// the end of prompt may write: deeper than the cursor line when it opens a
+// block, and at least as deep otherwise.
+func blockIndent(prompt string) int {
+	line := cursorLine(prompt)
+	indent := stream.Indent(line)
+	if trimmed := strings.TrimSpace(line); trimmed != "" && strings.ContainsAny(trimmed[len(trimmed)-1:], blockOpeners) {
+		indent++
+	}
+	return indent
+}
+
+// functionHeader matches the signature line of a function or method: a
+// declaration keyword such as func, def or fn after any modifiers, an arrow
+// function, or a name and parameter list that no control statement starts
+// with. Only lines opening a block with { or : are checked against it.
+var (
+	functionHeader   = regexp.MustCompile(`^(?:[\w.]+\s+)*(?:func|def|fn|function|fun|sub|proc)\b|=>\s*\{$|^[\w.<>\[\],*&:\s]*\w\s*\([^;]*\)[^;=]*\{$`)
+	controlStatement = regexp.MustCompile(`^(?:\}\s*)?(?:if|else|for|foreach|while|do|switch|case|catch|try|with|match|select|loop|return)\b`)
+)
+
+// emptyFunctionBody reports whether the cursor is in the body of a function
+// that has nothing in it yet: the cursor line, or the last line with text
+// before a blank cursor line, is a function signature opening a block, and
+// the next line after the cursor with text, if any, is indented no deeper
+// than the signature, such as its closing brace. It returns the indentation
+// of the body's lines, one column deeper than the signature.
+func emptyFunctionBody(prompt, suffix string) (int, bool) {
+	if rest, _, _ := strings.Cut(suffix, "\n"); strings.TrimSpace(rest) != "" {
+		return 0, false
+	}
+
+	lines := strings.Split(prompt, "\n")
+	header := lines[len(lines)-1]
+	if strings.TrimSpace(header) == "" {
+		header = ""
+		for i := len(lines) - 2; i >= 0; i-- {
+			if strings.TrimSpace(lines[i]) != "" {
+				header = lines[i]
+				break
+			}
+		}
+	}
+	signature := strings.TrimSpace(header)
+	if !strings.HasSuffix(signature, "{") && !strings.HasSuffix(signature, ":") {
+		return 0, false
+	}
+	if controlStatement.MatchString(signature) || !functionHeader.MatchString(signature) {
+		return 0, false
+	}
+
+	indent := stream.Indent(header)
+	_, after, _ := strings.Cut(suffix, "\n")
+	for _, line := range strings.Split(after, "\n") {
+		if strings.TrimSpace(line) != "" {
+			if stream.Indent(line) > indent {
+				return 0, false
+			}
+			break
+		}
+	}
+	return indent + 1, true
+}
+
+// cursorLine returns the part of the cursor line before the cursor.
+func cursorLine(prompt string) string {
+	return prompt[strings.LastIndexByte(prompt, '\n')+1:]
+}
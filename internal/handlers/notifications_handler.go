@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/events"
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+)
+
+// NotificationTypes are the events editor plugins may subscribe to, which
+// are worth telling users about. Requests and cache hits stay on the admin
+// API, as they concern every client.
+var NotificationTypes = []string{
+	events.BackendFailed,
+	events.BackendRecovered,
+	events.ModelSwitched,
+	events.QuotaNearing,
+	events.BurstStarted,
+	events.BurstEnded,
+	events.ConfigReloaded,
+}
+
+// notificationKeepAlive is how often an idle stream gets a comment, so that
+// proxies do not close it.
+const notificationKeepAlive = 30 * time.Second
+
+// NotificationsHandler streams the events of NotificationTypes from a bus as
+// server-sent events, for editor plugins to show to users. Each event has
+// its Seq as id, so a client reconnecting with Last-Event-ID gets the ones
+// it missed. Events about one client, such as quota warnings, only go to
+// that client, and backend errors are left out.
+type NotificationsHandler struct {
+	bus *events.Bus
+}
+
+// NewNotificationsHandler returns a NotificationsHandler for bus.
+func NewNotificationsHandler(bus *events.Bus) *NotificationsHandler {
+	return &NotificationsHandler{bus: bus}
+}
+
+// ServeHTTP implements http.Handler. The types query parameter narrows the
+// stream to a comma-separated list of NotificationTypes.
+func (h *NotificationsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	types := NotificationTypes
+	if s := r.URL.Query().Get("types"); s != "" {
+		types = strings.Split(s, ",")
+		for _, typ := range types {
+			if !slices.Contains(NotificationTypes, typ) {
+				writeValidationError(w, []FieldError{{Field: "types", Message: fmt.Sprintf("unknown notification type %q", typ)}})
+				return
+			}
+		}
+	}
+	var last uint64
+	lastID := r.Header.Get(LastEventIDHeader)
+	if lastID != "" {
+		var err error
+		if last, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+			writeValidationError(w, []FieldError{{Field: LastEventIDHeader, Message: "must be an event sequence number"}})
+			return
+		}
+	}
+	client := middleware.ClientID(r)
+
+	// Subscribing before replaying the log misses nothing in between; the
+	// events seen twice are skipped by their Seq.
+	live := make(chan events.Event, 16)
+	unsubscribe := h.bus.Subscribe(func(e events.Event) {
+		select {
+		case live <- e:
+		case <-r.Context().Done():
+		}
+	})
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	flush()
+
+	send := func(e events.Event) bool {
+		if e.Seq <= last || !slices.Contains(types, e.Type) {
+			return true
+		}
+		if id, ok := e.Fields["client"]; ok && id != client {
+			return true
+		}
+		last = e.Seq
+		event, err := encodeNotification(e)
+		if err != nil {
+			return true
+		}
+		if _, err := w.Write(event); err != nil {
+			return false
+		}
+		flush()
+		return true
+	}
+	if lastID != "" {
+		for _, e := range h.bus.Since(last) {
+			if !send(e) {
+				return
+			}
+		}
+	}
+
+	keepAlive := time.NewTicker(notificationKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-live:
+			if !send(e) {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return
+			}
+			flush()
+		}
+	}
+}
+
+// encodeNotification encodes e as an SSE event named by its type, without
+// the fields meant for the server's operators only.
+func encodeNotification(e events.Event) ([]byte, error) {
+	e.Fields = maps.Clone(e.Fields)
+	delete(e.Fields, "error")
+	delete(e.Fields, "client")
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return fmt.Appendf(nil, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data), nil
+}
@@ -0,0 +1,104 @@
+package handlers_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/events"
+	"github.com/josuemontano/ollama-copilot/internal/handlers"
+)
+
+// readNotifications reads n events from an SSE stream.
+func readNotifications(t *testing.T, r *bufio.Reader, n int) []events.Event {
+	t.Helper()
+	var got []events.Event
+	for len(got) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("expected %d events, got %d (%v)", n, len(got), err)
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var e events.Event
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, e)
+		}
+	}
+	return got
+}
+
+func TestNotificationsHandler(t *testing.T) {
+	bus := events.NewBus(10)
+	srv := httptest.NewServer(handlers.NewNotificationsHandler(bus))
+	defer srv.Close()
+
+	bus.Publish(events.BackendFailed, events.Fields{"backend": "gpu", "error": "dial tcp 10.0.0.5:11434: connection refused"})
+	bus.Publish(events.RequestStarted, events.Fields{"path": "/v1/engines/copilot-codex/completions"})
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set(handlers.LastEventIDHeader, "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("expected an event stream, got %q", got)
+	}
+	body := bufio.NewReader(resp.Body)
+
+	replayed := readNotifications(t, body, 1)
+	if replayed[0].Type != events.BackendFailed || replayed[0].Fields["backend"] != "gpu" {
+		t.Errorf("expected the missed backend failure, got %+v", replayed[0])
+	}
+	if _, ok := replayed[0].Fields["error"]; ok {
+		t.Errorf("expected the backend error to be left out, got %+v", replayed[0].Fields)
+	}
+
+	// The handler subscribes before answering, so events published now
+	// reach the stream.
+	bus.Publish(events.QuotaNearing, events.Fields{"client": "ip:10.9.9.9", "remaining": 1})
+	bus.Publish(events.QuotaNearing, events.Fields{"client": "ip:127.0.0.1", "remaining": 1})
+	bus.Publish(events.ModelSwitched, events.Fields{"from": "big", "to": "small", "reason": "latency_budget"})
+
+	live := readNotifications(t, body, 2)
+	if live[0].Seq != 4 || live[0].Type != events.QuotaNearing || live[1].Seq != 5 || live[1].Type != events.ModelSwitched {
+		t.Errorf("expected only this client's quota warning and the model switch, got %+v", live)
+	}
+	if _, ok := live[0].Fields["client"]; ok {
+		t.Errorf("expected the client to be left out, got %+v", live[0].Fields)
+	}
+}
+
+func TestNotificationsHandler_Types(t *testing.T) {
+	bus := events.NewBus(10)
+	h := handlers.NewNotificationsHandler(bus)
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v1/events?types=request.started", nil))
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected status code %d for a type that is not a notification, got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	bus.Publish(events.BackendFailed, events.Fields{"backend": "gpu"})
+	bus.Publish(events.BackendRecovered, events.Fields{"backend": "gpu"})
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"?types="+events.BackendRecovered, nil)
+	req.Header.Set(handlers.LastEventIDHeader, "0")
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := readNotifications(t, bufio.NewReader(resp.Body), 1); got[0].Type != events.BackendRecovered {
+		t.Errorf("expected only the requested type, got %+v", got)
+	}
+}
@@ -0,0 +1,378 @@
+package handlers
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/events"
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+	"github.com/josuemontano/ollama-copilot/internal/stream"
+	"github.com/josuemontano/ollama-copilot/internal/tracing"
+	"github.com/ollama/ollama/api"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Sampling of the alternatives generated for the completions panel: the
+// first uses the request's temperature, raised to panelMinTemperature so
+// that the alternatives differ at all, and each next one panelTemperatureStep
+// more, up to panelMaxTemperature.
+const (
+	panelMinTemperature  = 0.2
+	panelTemperatureStep = 0.1
+	panelMaxTemperature  = 1.0
+)
+
+// panelCandidate is one generated alternative.
+type panelCandidate struct {
+	text    string
+	model   string
+	filters []string
+	elapsed time.Duration
+	// finish is the finish reason of the candidate's choice, and metrics
+	// the counts Ollama reported, nil when a filter cut it short.
+	finish  string
+	metrics *api.Metrics
+	err     error
+}
+
+// servePanel answers a request for several alternative completions, as the
+// Copilot completions panel and ghost-text cycling send. The alternatives
+// are generated in parallel with different temperatures and seeds. The
+// response is a single JSON CompletionResponse once all are done, ranked by
+// how many generations agreed on them. When the client asked for a stream,
+// the alternatives are streamed as they are generated instead, each in the
+// choices of its own index.
+func (ch *CompletionHandler) servePanel(ctx context.Context, w http.ResponseWriter, settings *completionSettings, info requestInfo, req CompletionRequest, selected *template.Template) error {
+	plan, err := settings.tracedPlan(ctx, req, selected)
+	if err != nil {
+		return err
+	}
+	middleware.AddLogField(ctx, "panel", req.N)
+
+	var live *panelStream
+	if req.streaming() {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		live = &panelStream{w: w, info: info}
+	}
+
+	var candidates []panelCandidate
+	switch plan.skip {
+	case "":
+		defer metrics.InFlight.Start(info.path, plan.req.Model)()
+		candidates = ch.generateCandidates(ctx, settings, info, req, plan, live)
+	case "path_rule":
+		events.Publish(events.CompletionSuppressed, events.Fields{"reason": plan.skip, "path": req.path()})
+	default:
+		events.Publish(events.CompletionSuppressed, events.Fields{"reason": plan.skip})
+		metrics.Suppressed.Inc(plan.skip)
+		middleware.AddLogField(ctx, "suppressed", plan.skip)
+	}
+	if live != nil {
+		ch.finishPanelStream(ctx, w, info, plan, candidates)
+		return nil
+	}
+
+	choices, model, genErr := rankCandidates(candidates, req.N)
+	for i := range choices {
+		choices[i] = info.replace.apply(choices[i], true)
+		if info.metadata {
+			choices[i].Metadata.Mode = plan.mode
+		} else {
+			choices[i].Metadata = nil
+		}
+	}
+	if len(choices) == 0 && genErr != nil {
+		ch.writePanelError(ctx, w, info.id, plan.req.Model, genErr)
+		return nil
+	}
+	if model != "" {
+		metrics.RecentCompletions.Add(info.id, model)
+	}
+	writeJSON(w, http.StatusOK, CompletionResponse{Id: info.id, Object: "text_completion", Created: time.Now().Unix(), Model: model, Choices: choices, Usage: panelUsage(candidates)})
+	return nil
+}
+
+// panelStream writes the chunks of a streamed panel's alternatives as they
+// are generated. The alternatives write from goroutines of their own, so
+// every event is written and flushed under a lock.
+type panelStream struct {
+	w    http.ResponseWriter
+	info requestInfo
+	mu   sync.Mutex
+}
+
+func (s *panelStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, err := s.w.Write(p)
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// encoder returns the encoder of the chunks of the i-th alternative. model
+// points to the model generating it, and first reports whether the chunk is
+// the start of the alternative.
+func (s *panelStream) encoder(i int, model *string, first func() bool) stream.Encoder {
+	return func(text string) ([]byte, error) {
+		return encodeEvent(CompletionResponse{
+			Id:      s.info.id,
+			Object:  "text_completion",
+			Created: time.Now().Unix(),
+			Model:   *model,
+			Choices: []ChoiceResponse{s.info.replace.apply(ChoiceResponse{Text: text, Index: i}, first())},
+		})
+	}
+}
+
+// finishPanelStream ends a streamed panel with one event per alternative,
+// in index order, saying why it ended. Alternatives that failed end with
+// finish reason "error", and the last event carries the usage of all. When
+// every alternative failed, the stream ends with the error instead.
+func (ch *CompletionHandler) finishPanelStream(ctx context.Context, w http.ResponseWriter, info requestInfo, plan completionPlan, candidates []panelCandidate) {
+	var model string
+	var genErr error
+	for _, c := range candidates {
+		if c.err != nil {
+			genErr = cmp.Or(genErr, c.err)
+		} else {
+			model = cmp.Or(model, c.model)
+		}
+	}
+	if model == "" && genErr != nil {
+		ch.writeError(ctx, w, info.id, plan.req.Model, genErr)
+		return
+	}
+	if model != "" {
+		metrics.RecentCompletions.Add(info.id, model)
+	}
+
+	usage := panelUsage(candidates)
+	for i, c := range candidates {
+		choice := info.replace.apply(ChoiceResponse{Text: "", Index: i, FinishReason: c.finish}, false)
+		if c.err != nil {
+			choice.FinishReason = "error"
+		} else if info.metadata {
+			choice.Metadata = &SuggestionMetadata{
+				Model:        c.model,
+				Mode:         plan.mode,
+				Filters:      c.filters,
+				GenerationMs: c.elapsed.Milliseconds(),
+			}
+		}
+		resp := CompletionResponse{Id: info.id, Object: "text_completion", Created: time.Now().Unix(), Model: cmp.Or(c.model, model), Choices: []ChoiceResponse{choice}}
+		// Only the last event carries the usage, so that it is counted once.
+		if i == len(candidates)-1 {
+			resp.Usage = usage
+		}
+		ch.writeEvent(w, resp)
+	}
+}
+
+// generateCandidates generates n alternatives for plan in parallel, each
+// cut by the request's stream stages. Each generation takes a limiter slot
+// of its own, so a low limit runs them in turns. With live set, the
+// alternatives are streamed to it as they are generated.
+func (ch *CompletionHandler) generateCandidates(ctx context.Context, settings *completionSettings, info requestInfo, req CompletionRequest, plan completionPlan, live *panelStream) []panelCandidate {
+	temperature, _ := plan.req.Options["temperature"].(float64)
+
+	candidates := make([]panelCandidate, req.N)
+	var wg sync.WaitGroup
+	for i := range candidates {
+		genReq := plan.req
+		genReq.Options = maps.Clone(plan.req.Options)
+		genReq.Options["temperature"] = panelTemperature(temperature, i)
+		genReq.Options["seed"] = i + 1
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			candidates[i] = ch.generateCandidate(ctx, settings, info, req, plan, &genReq, i, live)
+		}()
+	}
+	wg.Wait()
+	return candidates
+}
+
+func (ch *CompletionHandler) generateCandidate(ctx context.Context, settings *completionSettings, info requestInfo, req CompletionRequest, plan completionPlan, genReq *api.GenerateRequest, i int, live *panelStream) panelCandidate {
+	release, err := acquireSlot(ctx, settings.limiter, info.path)
+	if err != nil {
+		return panelCandidate{err: fmt.Errorf("waiting for a generation slot: %w", err)}
+	}
+	defer release()
+
+	var text strings.Builder
+	var model string
+	var w io.Writer = io.Discard
+	encode := func(string) ([]byte, error) { return nil, nil }
+	if live != nil {
+		w, encode = live, live.encoder(i, &model, func() bool { return text.Len() == 0 })
+	}
+	out := stream.New(w, func(chunk string) ([]byte, error) {
+		event, err := encode(chunk)
+		text.WriteString(chunk)
+		return event, err
+	}, settings.stages(req, plan)...)
+
+	genCtx, span := tracing.Tracer().Start(withInfill(ctx, plan.infill), "ollama generate", trace.WithAttributes(
+		attribute.String("model", genReq.Model),
+		attribute.Int("seed", genReq.Options["seed"].(int)),
+	))
+
+	start := time.Now()
+	var final *api.Metrics
+	err = ch.generate(genCtx, settings, settings.retryBudget, genReq, func(m string, resp api.GenerateResponse) error {
+		model = m
+		if resp.Done {
+			final = &resp.Metrics
+			recordEvalMetrics(ctx, m, info.user, resp.Metrics)
+		}
+		err := out.Write(resp.Response)
+		if err != nil && !errors.Is(err, stream.ErrStopped) {
+			return fmt.Errorf("%w: %w", errClientGone, err)
+		}
+		return err
+	})
+	finish := "stop"
+	if errors.Is(err, stream.ErrStopped) {
+		err = nil
+	} else if final != nil {
+		finish = finishReason(*final, numPredictOf(genReq.Options))
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	endSpan(span, model, err)
+	if err != nil {
+		return panelCandidate{err: err}
+	}
+	_ = out.Close()
+	return panelCandidate{text: text.String(), model: model, filters: out.Applied(), elapsed: time.Since(start), finish: finish, metrics: final}
+}
+
+// panelUsage adds up the tokens of the candidates Ollama generated to the
+// end, or returns nil when there are none.
+func panelUsage(candidates []panelCandidate) *TokenUsage {
+	var usage *TokenUsage
+	for _, c := range candidates {
+		if c.metrics == nil {
+			continue
+		}
+		if usage == nil {
+			usage = &TokenUsage{}
+		}
+		u := tokenUsage(*c.metrics)
+		usage.PromptTokens += u.PromptTokens
+		usage.CompletionTokens += u.CompletionTokens
+		usage.TotalTokens += u.TotalTokens
+	}
+	return usage
+}
+
+// panelTemperature returns the temperature of the i-th alternative.
+func panelTemperature(base float64, i int) float64 {
+	t := max(base, panelMinTemperature) + float64(i)*panelTemperatureStep
+	return min(t, max(panelMaxTemperature, base))
+}
+
+// rankCandidates merges alternatives that differ only in trailing
+// whitespace and drops empty ones, then orders them by how many
+// generations produced them, earlier, cooler ones first on ties. It
+// returns at most n choices, each with the metadata of its first
+// generation and its share of the votes as score, the model of the first
+// and the first error of the candidates that failed.
+func rankCandidates(candidates []panelCandidate, n int) ([]ChoiceResponse, string, error) {
+	type ranked struct {
+		panelCandidate
+		votes int
+		first int
+	}
+
+	var firstErr error
+	var alternatives []*ranked
+	byText := map[string]*ranked{}
+	for i, c := range candidates {
+		if c.err != nil {
+			if firstErr == nil {
+				firstErr = c.err
+			}
+			continue
+		}
+		key := strings.TrimRight(c.text, " \t\n")
+		if key == "" {
+			continue
+		}
+		if r, ok := byText[key]; ok {
+			r.votes++
+			continue
+		}
+		r := &ranked{panelCandidate: c, votes: 1, first: i}
+		byText[key] = r
+		alternatives = append(alternatives, r)
+	}
+
+	slices.SortStableFunc(alternatives, func(a, b *ranked) int {
+		if a.votes != b.votes {
+			return b.votes - a.votes
+		}
+		return a.first - b.first
+	})
+	if len(alternatives) > n {
+		alternatives = alternatives[:n]
+	}
+
+	choices := make([]ChoiceResponse, 0, len(alternatives))
+	for i, r := range alternatives {
+		choices = append(choices, ChoiceResponse{
+			Text:         r.text,
+			Index:        i,
+			FinishReason: r.finish,
+			Metadata: &SuggestionMetadata{
+				Model:        r.model,
+				Filters:      r.filters,
+				Score:        float64(r.votes) / float64(len(candidates)),
+				GenerationMs: r.elapsed.Milliseconds(),
+			},
+		})
+	}
+	if len(alternatives) == 0 {
+		return choices, "", firstErr
+	}
+	return choices, alternatives[0].model, firstErr
+}
+
+// writePanelError answers with 502 when every alternative failed, like
+// writeError does for a single completion.
+func (ch *CompletionHandler) writePanelError(ctx context.Context, w http.ResponseWriter, id, model string, err error) {
+	class := classifyError(err)
+	metrics.OllamaErrors.Inc(class)
+	middleware.AddLogField(ctx, "error", class)
+	middleware.ResponseFailed(ctx)
+	if class == errCanceled {
+		return
+	}
+	metrics.RecentErrors.Add(class, model)
+	writeJSON(w, http.StatusBadGateway, CompletionResponse{
+		Id:      id,
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []ChoiceResponse{},
+		Error:   &ErrorResponse{Message: errMessages[class], Type: "backend_error", Code: class},
+	})
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/josuemontano/ollama-copilot/internal/stream"
+)
+
+// Post-processors completions can stream through, in the order
+// ParsePostProcess is given them.
+const (
+	// ProcessFences drops markdown code fences and their language tags.
+	ProcessFences = "fences"
+	// ProcessIndent rewrites indentation to the file's style.
+	ProcessIndent = "indent"
+	// ProcessTrimBlank drops blank lines at the start and end.
+	ProcessTrimBlank = "trim_blank"
+	// ProcessSuffixOverlap ends completions that repeat the suffix.
+	ProcessSuffixOverlap = "suffix_overlap"
+	// ProcessMaxLines ends completions after a number of lines, given as
+	// max_lines=N.
+	ProcessMaxLines = "max_lines"
+)
+
+// DefaultPostProcess is the post-processing chain of completions that
+// configure none.
+const DefaultPostProcess = "fences,indent,suffix_overlap"
+
+// PostProcessor is one step of the chain completions stream through before
+// the completion mode cuts them.
+type PostProcessor struct {
+	Name string
+	// Lines is the limit of ProcessMaxLines.
+	Lines int
+}
+
+// ParsePostProcess parses a comma-separated post-processing chain, such as
+// "fences,trim_blank,max_lines=20". "none" is the empty chain.
+func ParsePostProcess(s string) ([]PostProcessor, error) {
+	chain := []PostProcessor{}
+	if strings.TrimSpace(s) == "none" {
+		return chain, nil
+	}
+	for _, field := range strings.Split(s, ",") {
+		name, value, hasValue := strings.Cut(strings.TrimSpace(field), "=")
+		p := PostProcessor{Name: name}
+		switch name {
+		case ProcessFences, ProcessIndent, ProcessTrimBlank, ProcessSuffixOverlap:
+			if hasValue {
+				return nil, fmt.Errorf("post-processor %s takes no value", name)
+			}
+		case ProcessMaxLines:
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("post-processor max_lines needs a number of lines, as in max_lines=20")
+			}
+			p.Lines = n
+		default:
+			return nil, fmt.Errorf("unknown post-processor %q, expected fences, indent, trim_blank, suffix_overlap or max_lines=N", name)
+		}
+		chain = append(chain, p)
+	}
+	return chain, nil
+}
+
+// defaultChain is DefaultPostProcess parsed.
+var defaultChain, _ = ParsePostProcess(DefaultPostProcess)
+
+// orDefaultChain returns a copy of chain, or defaultChain when chain is nil.
+func orDefaultChain(chain []PostProcessor) []PostProcessor {
+	if chain == nil {
+		return defaultChain
+	}
+	return slices.Clone(chain)
+}
+
+// stage returns the stream stage of p for req, and false when p does not
+// apply to it.
+func (p PostProcessor) stage(req CompletionRequest, plan completionPlan) (stream.Stage, bool) {
+	switch p.Name {
+	case ProcessFences:
+		return stream.Stage{Name: p.Name, Filter: stream.Fences(req.Extra.Language)}, true
+	case ProcessIndent:
+		if plan.reindent == nil {
+			return stream.Stage{}, false
+		}
+		lineStart := strings.TrimLeft(cursorLine(req.Prompt), " \t") == ""
+		return stream.Stage{Name: p.Name, Filter: stream.Reindent(*plan.reindent, lineStart)}, true
+	case ProcessTrimBlank:
+		return stream.Stage{Name: p.Name, Filter: stream.TrimBlank()}, true
+	case ProcessSuffixOverlap:
+		return stream.Stage{Name: p.Name, Filter: stream.SuffixOverlap(cursorLine(req.Prompt), req.Suffix)}, true
+	case ProcessMaxLines:
+		return stream.Stage{Name: p.Name, Filter: stream.MaxLines(p.Lines)}, true
+	}
+	return stream.Stage{}, false
+}
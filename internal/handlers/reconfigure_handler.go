@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"text/template"
+
+	"github.com/josuemontano/ollama-copilot/internal/templates"
+)
+
+// ModelRequest switches completions to Model. When Family is set, the
+// prompt template and stop tokens of its preset replace the current ones,
+// for a model of another family than the last.
+type ModelRequest struct {
+	Model  string `json:"model"`
+	Family string `json:"family,omitempty"`
+}
+
+// ModelResponse describes the models completions are generated with.
+type ModelResponse struct {
+	Model         string   `json:"model"`
+	FallbackModel string   `json:"fallback_model,omitempty"`
+	Models        ModelMap `json:"models,omitempty"`
+}
+
+// ModelHandler reports the completion model with GET and switches it with
+// POST, without restarting the server.
+type ModelHandler struct {
+	completions *CompletionHandler
+}
+
+// NewModelHandler returns a ModelHandler reconfiguring completions.
+func NewModelHandler(completions *CompletionHandler) *ModelHandler {
+	return &ModelHandler{completions: completions}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *ModelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	config := h.completions.Config()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req ModelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.Model == "" {
+			writeValidationError(w, []FieldError{{Field: "model", Message: "must not be empty"}})
+			return
+		}
+		var preset *templates.Preset
+		if req.Family != "" {
+			p, _, err := templates.LookupPreset(req.Family, req.Model)
+			if err != nil {
+				writeValidationError(w, []FieldError{{Field: "family", Message: err.Error()}})
+				return
+			}
+			preset = &p
+		}
+		config = h.completions.Reconfigure(func(config *CompletionConfig) {
+			config.Model = req.Model
+			if preset != nil {
+				config.PromptTemplate = template.Must(template.New("prompt").Parse(preset.Template))
+				config.Stop = slices.Clone(preset.Stop)
+			}
+		})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ModelResponse{Model: config.Model, FallbackModel: config.FallbackModel, Models: config.Models})
+}
+
+// TemplateRequest replaces the FIM prompt template of completions.
+type TemplateRequest struct {
+	Template string `json:"template"`
+}
+
+// TemplateResponse holds the FIM prompt template of completions, and the
+// problems templates.Lint finds in it against the model's preset.
+type TemplateResponse struct {
+	Template string   `json:"template"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+// TemplateHandler reports the prompt template with GET and replaces it
+// with POST, without restarting the server. A template that parses is
+// applied even with problems, as at startup.
+type TemplateHandler struct {
+	completions *CompletionHandler
+}
+
+// NewTemplateHandler returns a TemplateHandler reconfiguring completions.
+func NewTemplateHandler(completions *CompletionHandler) *TemplateHandler {
+	return &TemplateHandler{completions: completions}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *TemplateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	config := h.completions.Config()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req TemplateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.Template == "" {
+			writeValidationError(w, []FieldError{{Field: "template", Message: "must not be empty"}})
+			return
+		}
+		tmpl, err := template.New("prompt").Parse(req.Template)
+		if err != nil {
+			writeValidationError(w, []FieldError{{Field: "template", Message: err.Error()}})
+			return
+		}
+		config = h.completions.Reconfigure(func(config *CompletionConfig) {
+			config.PromptTemplate = tmpl
+		})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var resp TemplateResponse
+	if tmpl := config.PromptTemplate; tmpl != nil && tmpl.Tree != nil {
+		preset, _, _ := templates.LookupPreset("", config.Model)
+		resp = TemplateResponse{Template: tmpl.Root.String(), Problems: templates.Lint(tmpl, preset)}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// CompletionOptions are the generation options of completions. In a POST,
+// the fields left out keep their value, and ModelOptions, when given,
+// replace all of the current ones.
+type CompletionOptions struct {
+	NumPredict         *int         `json:"num_predict,omitempty"`
+	FunctionNumPredict *int         `json:"function_num_predict,omitempty"`
+	NumCtx             *int         `json:"num_ctx,omitempty"`
+	Stop               []string     `json:"stop"`
+	ModelOptions       ModelOptions `json:"model_options"`
+}
+
+// OptionsHandler reports the generation options of completions with GET
+// and changes them with POST, without restarting the server.
+type OptionsHandler struct {
+	completions *CompletionHandler
+}
+
+// NewOptionsHandler returns an OptionsHandler reconfiguring completions.
+func NewOptionsHandler(completions *CompletionHandler) *OptionsHandler {
+	return &OptionsHandler{completions: completions}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *OptionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	config := h.completions.Config()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req CompletionOptions
+		decoder := json.NewDecoder(r.Body)
+		// Numbers are kept as written, so that ParseModelOptions tells
+		// whole numbers from others.
+		decoder.UseNumber()
+		if err := decoder.Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var errs []FieldError
+		check := func(n *int, field string) {
+			if n != nil && *n < 0 {
+				errs = append(errs, FieldError{Field: field, Message: "must not be negative"})
+			}
+		}
+		check(req.NumPredict, "num_predict")
+		check(req.FunctionNumPredict, "function_num_predict")
+		check(req.NumCtx, "num_ctx")
+		errs = append(errs, StopSequences(req.Stop).check("stop")...)
+		var modelOptions ModelOptions
+		if req.ModelOptions != nil {
+			values := map[string]string{}
+			for name, options := range req.ModelOptions {
+				for option, value := range options {
+					values[name+"."+option] = fmt.Sprint(value)
+				}
+			}
+			var err error
+			if modelOptions, err = ParseModelOptions(values); err != nil {
+				errs = append(errs, FieldError{Field: "model_options", Message: err.Error()})
+			}
+		}
+		if len(errs) > 0 {
+			writeValidationError(w, errs)
+			return
+		}
+		config = h.completions.Reconfigure(func(config *CompletionConfig) {
+			if req.NumPredict != nil {
+				config.NumPredict = *req.NumPredict
+			}
+			if req.FunctionNumPredict != nil {
+				config.FunctionNumPredict = *req.FunctionNumPredict
+			}
+			if req.NumCtx != nil {
+				config.NumCtx = *req.NumCtx
+			}
+			if req.Stop != nil {
+				config.Stop = StopSequences(req.Stop).clean()
+			}
+			if modelOptions != nil {
+				config.ModelOptions = modelOptions
+			}
+		})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Empty lists and maps are reported as such rather than as null.
+	resp := CompletionOptions{
+		NumPredict:         &config.NumPredict,
+		FunctionNumPredict: &config.FunctionNumPredict,
+		NumCtx:             &config.NumCtx,
+		Stop:               append([]string{}, config.Stop...),
+		ModelOptions:       config.ModelOptions,
+	}
+	if resp.ModelOptions == nil {
+		resp.ModelOptions = ModelOptions{}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
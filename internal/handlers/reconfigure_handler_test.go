@@ -0,0 +1,124 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/handlers"
+	"github.com/ollama/ollama/api"
+)
+
+func serveAdmin(h http.Handler, method, body string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(method, "/admin", strings.NewReader(body)))
+	return rr
+}
+
+func TestModelHandler(t *testing.T) {
+	var got api.GenerateRequest
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		got = req
+		writeChunks(w, req.Model, "ok")
+	})
+	completions := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary"})
+	h := handlers.NewModelHandler(completions)
+
+	rr := serveAdmin(h, http.MethodPost, `{"model":"codestral:22b","family":"codestral"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	var resp handlers.ModelResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Model != "codestral:22b" {
+		t.Errorf("expected the new model, got %+v", resp)
+	}
+
+	postCompletion(t, completions, `{"prompt":"x = ","suffix":"\n","max_tokens":20}`)
+	if got.Model != "codestral:22b" || !strings.HasPrefix(got.Prompt, "[SUFFIX]") {
+		t.Errorf("expected the completion to use the new model and its preset, got %s with %q", got.Model, got.Prompt)
+	}
+
+	if rr := serveAdmin(h, http.MethodPost, `{"model":""}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected status code %d for an empty model, got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+	if rr := serveAdmin(h, http.MethodPost, `{"model":"m","family":"unknown"}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected status code %d for an unknown family, got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+	if got := completions.Config().Model; got != "codestral:22b" {
+		t.Errorf("expected rejected changes to keep the model, got %s", got)
+	}
+}
+
+func TestTemplateHandler(t *testing.T) {
+	var prompt string
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		prompt = req.Prompt
+		writeChunks(w, req.Model, "ok")
+	})
+	completions := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary"})
+	h := handlers.NewTemplateHandler(completions)
+
+	rr := serveAdmin(h, http.MethodGet, "")
+	var resp handlers.TemplateResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Template != "{{.Prefix}}<FILL>{{.Suffix}}" {
+		t.Errorf("expected the current template, got %q", resp.Template)
+	}
+
+	rr = serveAdmin(h, http.MethodPost, `{"template":"<PRE>{{.Prefix}}<SUF>{{.Suffix}}<MID>"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	postCompletion(t, completions, `{"prompt":"x = ","suffix":"\n","max_tokens":20}`)
+	if !strings.HasPrefix(prompt, "<PRE>") || !strings.HasSuffix(prompt, "<MID>") {
+		t.Errorf("expected the prompt to use the new template, got %q", prompt)
+	}
+
+	if rr := serveAdmin(h, http.MethodPost, `{"template":"{{.Prefix"}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected status code %d for a template that does not parse, got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+}
+
+func TestOptionsHandler(t *testing.T) {
+	var options map[string]interface{}
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		options = req.Options
+		writeChunks(w, req.Model, "ok")
+	})
+	completions := newCompletionHandler(client, handlers.CompletionConfig{Model: "primary", NumPredict: 200, Stop: []string{"<EOT>"}})
+	h := handlers.NewOptionsHandler(completions)
+
+	rr := serveAdmin(h, http.MethodPost, `{"num_predict":64,"model_options":{"copilot-codex":{"top_k":20,"temperature":0.1}}}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+	var resp handlers.CompletionOptions
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if *resp.NumPredict != 64 || !reflect.DeepEqual(resp.Stop, []string{"<EOT>"}) {
+		t.Errorf("expected num_predict to change and the stop tokens to stay, got %+v", resp)
+	}
+
+	postCompletion(t, completions, `{"prompt":"x = ","suffix":"","max_tokens":100}`)
+	if options["num_predict"] != float64(64) || options["top_k"] != float64(20) || options["temperature"] != 0.1 {
+		t.Errorf("expected the new options in the completion, got %v", options)
+	}
+
+	rr = serveAdmin(h, http.MethodPost, `{"num_ctx":-1,"model_options":{"copilot-codex":{"num_ctx":4096}}}`)
+	var validation handlers.ValidationError
+	if err := json.NewDecoder(rr.Body).Decode(&validation); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusUnprocessableEntity || len(validation.Error.Fields) != 2 {
+		t.Errorf("expected both fields to be rejected, got %d with %+v", rr.Code, validation.Error.Fields)
+	}
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"slices"
+	"sync"
+)
+
+// SessionHeader is the header Copilot clients identify their editor session
+// with. Rejected suggestions are remembered per session.
+const SessionHeader = "VScode-SessionId"
+
+// DefaultRejectionsSize is how many completions and positions a Rejections
+// remembers unless told otherwise.
+const DefaultRejectionsSize = 1000
+
+// RejectedPerPosition is how many rejected suggestions are remembered for
+// each document position.
+const RejectedPerPosition = 4
+
+// ResampleTemperature is the lowest temperature a completion is generated
+// with at a position where the user rejected a suggestion, so that the
+// model does not write the same one again.
+const ResampleTemperature = 0.8
+
+// Rejections remembers the suggestions shown to each session and those the
+// user rejected, by document position, so that a rejected suggestion is not
+// shown again at the same place. A nil Rejections remembers nothing.
+type Rejections struct {
+	size int
+
+	mu sync.Mutex
+	// shown are the recent completions by id, with ids in the order shown.
+	shown    map[string]shownSuggestion
+	shownIDs []string
+	// rejected are the rejected texts by position, with positions in the
+	// order of their last rejection.
+	rejected  map[string][]string
+	positions []string
+}
+
+type shownSuggestion struct {
+	position string
+	text     string
+}
+
+// NewRejections returns a Rejections remembering the last size completions
+// shown and the rejections of the last size positions, DefaultRejectionsSize
+// when size is not positive.
+func NewRejections(size int) *Rejections {
+	if size <= 0 {
+		size = DefaultRejectionsSize
+	}
+	return &Rejections{size: size, shown: map[string]shownSuggestion{}, rejected: map[string][]string{}}
+}
+
+// Shown records that the completion id showed text at position, a key of
+// positionKey. Empty completions and unknown positions are not recorded.
+func (r *Rejections) Shown(id, position, text string) {
+	if r == nil || position == "" || text == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.shown[id]; !ok {
+		r.shownIDs = append(r.shownIDs, id)
+	}
+	r.shown[id] = shownSuggestion{position: position, text: text}
+	if len(r.shownIDs) > r.size {
+		delete(r.shown, r.shownIDs[0])
+		r.shownIDs = r.shownIDs[1:]
+	}
+}
+
+// Reject records that the user rejected the completion id, and reports
+// whether it was one Shown recorded.
+func (r *Rejections) Reject(id string) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.shown[id]
+	if !ok {
+		return false
+	}
+	texts := r.rejected[s.position]
+	if !slices.Contains(texts, s.text) {
+		texts = append(texts, s.text)
+		if len(texts) > RejectedPerPosition {
+			texts = texts[1:]
+		}
+	}
+	r.rejected[s.position] = texts
+	r.positions = append(slices.DeleteFunc(r.positions, func(p string) bool { return p == s.position }), s.position)
+	if len(r.positions) > r.size {
+		delete(r.rejected, r.positions[0])
+		r.positions = r.positions[1:]
+	}
+	return true
+}
+
+// Rejected returns the suggestions rejected at position, oldest first.
+func (r *Rejections) Rejected(position string) []string {
+	if r == nil || position == "" {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.rejected[position])
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"strings"
+	"unicode/utf16"
+)
+
+// replacement is the document text a completion replaces, from a request
+// with extra.range.
+type replacement struct {
+	// head is the replaced text before the cursor, the end of the prompt.
+	head string
+	rng  Range
+}
+
+// apply makes choice replace the range. The first choice of a completion
+// is prefixed with the replaced text before the cursor, so that the text
+// of the completion starts at the start of the range. A nil replacement
+// returns choice unchanged.
+func (p *replacement) apply(choice ChoiceResponse, first bool) ChoiceResponse {
+	if p == nil {
+		return choice
+	}
+	if first {
+		choice.Text = p.head + choice.Text
+	}
+	choice.Range = &p.rng
+	return choice
+}
+
+// cutRange returns the replacement of the request's extra.range and the
+// request without the replaced text after the cursor, which the completion
+// overwrites. The model still sees the replaced text before the cursor, so
+// that it completes the identifier being typed. It returns a nil
+// replacement for requests without a range, and false when the range does
+// not lie within the prompt and suffix.
+func (r CompletionRequest) cutRange() (CompletionRequest, *replacement, bool) {
+	rng, pos := r.Extra.Range, r.Extra.Position
+	if rng == nil || pos == nil {
+		return r, nil, true
+	}
+
+	// The prompt ends at the cursor, so the cursor line is its last line
+	// and the range starts up lines above it.
+	lines := strings.Split(r.Prompt, "\n")
+	up := pos.Line - rng.Start.Line
+	if up >= len(lines) {
+		return r, nil, false
+	}
+	var head string
+	if up == 0 {
+		line := lines[len(lines)-1]
+		n := pos.Character - rng.Start.Character
+		if n > utf16Len(line) {
+			return r, nil, false
+		}
+		head = line[utf16Offset(line, utf16Len(line)-n):]
+	} else {
+		first := len(lines) - 1 - up
+		head = strings.Join(lines[first:], "\n")[utf16Offset(lines[first], rng.Start.Character):]
+	}
+
+	// The suffix starts at the cursor, so the range ends down lines below
+	// it, counted from the cursor on the cursor line.
+	lines = strings.Split(r.Suffix, "\n")
+	down := rng.End.Line - pos.Line
+	if down >= len(lines) {
+		return r, nil, false
+	}
+	character := rng.End.Character
+	if down == 0 {
+		character -= pos.Character
+	}
+	end := utf16Offset(lines[down], character)
+	for _, line := range lines[:down] {
+		end += len(line) + 1
+	}
+
+	r.Suffix = r.Suffix[end:]
+	return r, &replacement{head: head, rng: *rng}, true
+}
+
+// utf16Len is the length of s in UTF-16 code units, the unit of LSP
+// character offsets.
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// utf16Offset returns the byte offset in s of the UTF-16 code unit offset
+// units, clamped to the length of s like LSP clamps positions past the end
+// of a line.
+func utf16Offset(s string, units int) int {
+	for i, r := range s {
+		if units <= 0 {
+			return i
+		}
+		units -= utf16.RuneLen(r)
+	}
+	return len(s)
+}
+
+// positionBefore reports whether a comes before b in a document.
+func positionBefore(a, b Position) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Character < b.Character
+}
@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+	"go.uber.org/zap"
+)
+
+// LastEventIDHeader is the header an SSE client reconnects with, naming the
+// last event it received.
+const LastEventIDHeader = "Last-Event-ID"
+
+// serveResumable streams a completion that survives the client's connection
+// dropping. The completion is generated into a replay instead of the
+// response, away from the request's context, and the request tails the
+// replay. A client that reconnects within the resume window with
+// LastEventIDHeader gets the events it missed and the rest, as resume
+// does. A completion no client tails for the window is canceled.
+func (ch *CompletionHandler) serveResumable(w http.ResponseWriter, r *http.Request, settings *completionSettings, info requestInfo, req CompletionRequest, selected *template.Template) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), settings.timeout)
+	p := ch.replays.add(info.id, settings.resumeWindow, cancel)
+	go func() {
+		defer cancel()
+		if err := ch.generateCompletion(ctx, p, settings, info, req, selected); err != nil {
+			ch.logger.Error("Completion generation failed", zap.Error(err))
+		}
+		p.finish()
+		ch.replays.expire(info.id, settings.resumeWindow)
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	p.tail(r.Context(), w, info.id, 0)
+}
+
+// resume answers a request reconnecting with lastEventID to a completion
+// that is still running or ended within the resume window, with the events
+// after that one. It returns false, answering nothing, when there is no
+// such completion, so that the request is served as a new one.
+func (ch *CompletionHandler) resume(w http.ResponseWriter, r *http.Request, lastEventID string) bool {
+	id, n, ok := parseEventID(lastEventID)
+	if !ok {
+		return false
+	}
+	p := ch.replays.get(id)
+	if p == nil || n > p.len() {
+		return false
+	}
+	middleware.AddLogField(r.Context(), "completion_id", id)
+	middleware.AddLogField(r.Context(), "resumed_after", n)
+
+	w.Header().Set(CompletionIDHeader, id)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	p.tail(r.Context(), w, id, n)
+	return true
+}
+
+// eventID is the SSE id of the n-th event of the completion id, counting
+// from 1.
+func eventID(id string, n int) string {
+	return id + "/" + strconv.Itoa(n)
+}
+
+// parseEventID splits an SSE id made by eventID.
+func parseEventID(s string) (string, int, bool) {
+	id, num, ok := strings.Cut(s, "/")
+	n, err := strconv.Atoi(num)
+	if !ok || id == "" || err != nil || n < 0 {
+		return "", 0, false
+	}
+	return id, n, true
+}
+
+// replays keeps the completions that can be resumed, by completion ID. The
+// zero value is ready to use.
+type replays struct {
+	mu      sync.Mutex
+	replays map[string]*replay
+}
+
+// add registers the replay of the completion id. cancel cancels its
+// generation once no client has tailed it for window.
+func (s *replays) add(id string, window time.Duration, cancel context.CancelFunc) *replay {
+	p := &replay{window: window, cancel: cancel, changed: make(chan struct{})}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.replays == nil {
+		s.replays = map[string]*replay{}
+	}
+	s.replays[id] = p
+	return p
+}
+
+func (s *replays) get(id string) *replay {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.replays[id]
+}
+
+// expire forgets the completion id after window.
+func (s *replays) expire(id string, window time.Duration) {
+	time.AfterFunc(window, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.replays, id)
+	})
+}
+
+// replay is the ResponseWriter a resumable completion is generated into.
+// Each Write is one event, which it keeps for the clients tailing it.
+type replay struct {
+	window time.Duration
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	header  http.Header
+	events  [][]byte
+	done    bool
+	clients int
+	// changed is closed and replaced when an event is added or the
+	// completion is done.
+	changed chan struct{}
+	// abandoned cancels the generation when no client tails it.
+	abandoned *time.Timer
+}
+
+func (p *replay) Header() http.Header {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.header == nil {
+		p.header = http.Header{}
+	}
+	return p.header
+}
+
+func (p *replay) Write(event []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, append([]byte(nil), event...))
+	p.notify()
+	return len(event), nil
+}
+
+func (p *replay) WriteHeader(int) {}
+
+// finish marks the completion done.
+func (p *replay) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done = true
+	if p.abandoned != nil {
+		p.abandoned.Stop()
+	}
+	p.notify()
+}
+
+func (p *replay) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *replay) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.events)
+}
+
+// tail writes the events after the first from to w as they are generated,
+// each with the SSE id eventID gives it, until the completion is done, the
+// client goes away or ctx is done.
+func (p *replay) tail(ctx context.Context, w http.ResponseWriter, id string, from int) {
+	p.attach()
+	defer p.detach()
+
+	// The headers go out at once, so that the client learns the completion
+	// ID before the first event.
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	for n := from; ; {
+		p.mu.Lock()
+		events, done, changed := p.events[n:], p.done, p.changed
+		p.mu.Unlock()
+
+		for _, event := range events {
+			n++
+			if _, err := fmt.Fprintf(w, "id: %s\n%s", eventID(id, n), event); err != nil {
+				return
+			}
+		}
+		if flusher != nil && len(events) > 0 {
+			flusher.Flush()
+		}
+		if done {
+			return
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *replay) attach() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clients++
+	if p.abandoned != nil {
+		p.abandoned.Stop()
+	}
+}
+
+func (p *replay) detach() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clients--
+	if p.clients == 0 && !p.done {
+		p.abandoned = time.AfterFunc(p.window, p.cancel)
+	}
+}
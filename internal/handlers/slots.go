@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/limiter"
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+	"github.com/josuemontano/ollama-copilot/internal/tracing"
+)
+
+// acquireSlot waits for a generation slot of l for a request to endpoint,
+// recording the wait, and returns the release of the slot. A nil l has none.
+func acquireSlot(ctx context.Context, l *limiter.Limiter, endpoint string) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	start := time.Now()
+	_, span := tracing.Tracer().Start(ctx, "wait for slot")
+	err = l.Acquire(ctx)
+	span.End()
+	wait := time.Since(start)
+	metrics.QueueWaitSeconds.Observe(endpoint, wait.Seconds())
+	middleware.AddLogField(ctx, "queue_wait", wait)
+	if err != nil {
+		return nil, err
+	}
+	return l.Release, nil
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/cache"
+	"github.com/josuemontano/ollama-copilot/internal/limiter"
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
+)
+
+// StatsResponse is a snapshot of what the server is doing.
+type StatsResponse struct {
+	InFlight     []InFlightStats `json:"in_flight"`
+	Concurrency  *Concurrency    `json:"concurrency,omitempty"`
+	Models       []ModelStats    `json:"models"`
+	Cache        *CacheStats     `json:"cache,omitempty"`
+	RecentErrors []ErrorStats    `json:"recent_errors"`
+}
+
+// InFlightStats is a completion currently being generated.
+type InFlightStats struct {
+	Path    string        `json:"path"`
+	Model   string        `json:"model"`
+	Elapsed time.Duration `json:"elapsed"`
+}
+
+// Concurrency describes the generation limiter.
+type Concurrency struct {
+	Limit  int `json:"limit"`
+	Active int `json:"active"`
+	Queued int `json:"queued"`
+}
+
+// ModelStats summarizes the work Ollama did for one model.
+type ModelStats struct {
+	Model            string  `json:"model"`
+	PromptTokens     float64 `json:"prompt_tokens"`
+	GeneratedTokens  float64 `json:"generated_tokens"`
+	PromptTokensPerS float64 `json:"prompt_tokens_per_second"`
+	TokensPerS       float64 `json:"tokens_per_second"`
+}
+
+// CacheStats describes the completion cache. Hits include the extensions,
+// completions served from one whose prefix the user typed into.
+type CacheStats struct {
+	Entries    int     `json:"entries"`
+	Hits       float64 `json:"hits"`
+	Extensions float64 `json:"extensions"`
+	Misses     float64 `json:"misses"`
+	HitRate    float64 `json:"hit_rate"`
+}
+
+// ErrorStats is a recent failed generation.
+type ErrorStats struct {
+	Time  time.Time `json:"time"`
+	Class string    `json:"class"`
+	Model string    `json:"model"`
+}
+
+// StatsHandler serves a StatsResponse.
+type StatsHandler struct {
+	limiter *limiter.Limiter
+	cache   *cache.Cache
+}
+
+// NewStatsHandler returns a StatsHandler. limiter and cache may be nil.
+func NewStatsHandler(limiter *limiter.Limiter, cache *cache.Cache) *StatsHandler {
+	return &StatsHandler{limiter: limiter, cache: cache}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *StatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(h.Stats()); err != nil {
+		log.Printf("error encoding: %s", err.Error())
+	}
+}
+
+// Stats returns the current snapshot.
+func (h *StatsHandler) Stats() StatsResponse {
+	stats := StatsResponse{
+		InFlight:     []InFlightStats{},
+		Models:       []ModelStats{},
+		RecentErrors: []ErrorStats{},
+	}
+
+	now := time.Now()
+	for _, r := range metrics.InFlight.Active() {
+		stats.InFlight = append(stats.InFlight, InFlightStats{Path: r.Path, Model: r.Model, Elapsed: now.Sub(r.Started)})
+	}
+
+	if h.limiter != nil {
+		stats.Concurrency = &Concurrency{Limit: h.limiter.Limit(), Active: h.limiter.InFlight(), Queued: h.limiter.Queued()}
+	}
+
+	if h.cache != nil {
+		c := h.cache.Stats()
+		stats.Cache = &CacheStats{
+			Entries:    c.Entries,
+			Hits:       float64(c.Hits + c.Extensions),
+			Extensions: float64(c.Extensions),
+			Misses:     float64(c.Misses),
+		}
+		if lookups := stats.Cache.Hits + stats.Cache.Misses; lookups > 0 {
+			stats.Cache.HitRate = stats.Cache.Hits / lookups
+		}
+	}
+
+	for _, model := range metrics.EvalTokens.Values() {
+		m := ModelStats{
+			Model:           model,
+			PromptTokens:    metrics.PromptEvalTokens.Get(model),
+			GeneratedTokens: metrics.EvalTokens.Get(model),
+		}
+		if seconds := metrics.PromptEvalSeconds.Get(model); seconds > 0 {
+			m.PromptTokensPerS = m.PromptTokens / seconds
+		}
+		if seconds := metrics.EvalSeconds.Get(model); seconds > 0 {
+			m.TokensPerS = m.GeneratedTokens / seconds
+		}
+		stats.Models = append(stats.Models, m)
+	}
+
+	for _, e := range metrics.RecentErrors.Recent() {
+		stats.RecentErrors = append(stats.RecentErrors, ErrorStats{Time: e.Time, Class: e.Class, Model: e.Model})
+	}
+
+	return stats
+}
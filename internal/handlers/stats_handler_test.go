@@ -0,0 +1,42 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/handlers"
+	"github.com/josuemontano/ollama-copilot/internal/limiter"
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
+	"go.uber.org/zap"
+)
+
+func TestStatsHandler_ServeHTTP(t *testing.T) {
+	done := metrics.InFlight.Start("/v1/engines/copilot-codex/completions", "stats-model")
+	defer done()
+
+	handler := handlers.NewStatsHandler(limiter.New(1, 4, 0, zap.NewNop()), nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/stats", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var stats handlers.StatsResponse
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	found := false
+	for _, r := range stats.InFlight {
+		found = found || r.Model == "stats-model"
+	}
+	if !found {
+		t.Errorf("expected the in-flight request to be listed, got %+v", stats.InFlight)
+	}
+	if stats.Concurrency == nil || stats.Concurrency.Limit != 4 {
+		t.Errorf("expected the concurrency limit to be reported, got %+v", stats.Concurrency)
+	}
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Limits of the stop sequences a client may send. Copilot clients send a
+// handful of short ones; longer lists are malformed or abuse.
+const (
+	maxStopSequences = 16
+	maxStopBytes     = 128
+)
+
+// StopSequences are the stop sequences of a request, sent either as a
+// string or as an array of strings.
+type StopSequences []string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *StopSequences) UnmarshalJSON(data []byte) error {
+	var stop string
+	if err := json.Unmarshal(data, &stop); err == nil {
+		*s = StopSequences{stop}
+		return nil
+	}
+
+	var stops []string
+	if err := json.Unmarshal(data, &stops); err != nil {
+		return fmt.Errorf("stop must be a string or an array of strings: %w", err)
+	}
+	*s = stops
+	return nil
+}
+
+// check returns the errors of the field s was sent in, when it has more
+// sequences than maxStopSequences or one longer than maxStopBytes.
+func (s StopSequences) check(field string) []FieldError {
+	var errs []FieldError
+	if len(s) > maxStopSequences {
+		errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf("must have at most %d sequences", maxStopSequences)})
+	}
+	for i, stop := range s {
+		if len(stop) > maxStopBytes {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("%s[%d]", field, i), Message: fmt.Sprintf("must be at most %d bytes", maxStopBytes)})
+		}
+	}
+	return errs
+}
+
+// clean returns the sequences without the empty ones, which would end
+// every generation at once, and without repeats, in the order sent. It
+// returns a new slice, which the server's sequences can be appended to.
+func (s StopSequences) clean() []string {
+	return appendMissing(nil, s...)
+}
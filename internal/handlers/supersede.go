@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// errSuperseded is the cause a completion is canceled with when the same
+// client asks again for the same position while it is still running.
+var errSuperseded = errors.New("superseded by a newer completion request")
+
+// superseder tracks the running completion of each client and document
+// position, so that rapid typing leaves only the newest one on Ollama. The
+// zero value is ready to use.
+type superseder struct {
+	mu      sync.Mutex
+	running map[string]*context.CancelCauseFunc
+}
+
+// positionKey identifies where a completion was asked for: the client, the
+// document and the cursor line, as sent in the request's position or
+// counted in the prompt. It is "" when the document is unknown.
+func positionKey(user string, req CompletionRequest) string {
+	path := req.path()
+	if path == "" {
+		return ""
+	}
+	line := strings.Count(req.Prompt, "\n")
+	if req.Extra.Position != nil {
+		line = req.Extra.Position.Line
+	}
+	return user + "\x00" + path + "\x00" + strconv.Itoa(line)
+}
+
+// start cancels the completion running for key, if any, and registers the
+// one for ctx in its place. The returned context is canceled with
+// errSuperseded when a newer completion for key starts; done must be called
+// when the completion ends.
+func (s *superseder) start(ctx context.Context, key string) (_ context.Context, done func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	if key == "" {
+		return ctx, func() { cancel(nil) }
+	}
+
+	s.mu.Lock()
+	if s.running == nil {
+		s.running = map[string]*context.CancelCauseFunc{}
+	}
+	if previous, ok := s.running[key]; ok {
+		(*previous)(errSuperseded)
+	}
+	s.running[key] = &cancel
+	s.mu.Unlock()
+
+	return ctx, func() {
+		s.mu.Lock()
+		if s.running[key] == &cancel {
+			delete(s.running, key)
+		}
+		s.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// superseded reports whether ctx was canceled for a newer completion.
+func superseded(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errSuperseded)
+}
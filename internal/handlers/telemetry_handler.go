@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+)
+
+// TelemetryHandler accepts and discards client telemetry, so clients whose
+// token points telemetry at this proxy do not log delivery errors.
+type TelemetryHandler struct{}
+
+// NewTelemetryHandler returns a new TelemetryHandler.
+func NewTelemetryHandler() *TelemetryHandler {
+	return &TelemetryHandler{}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *TelemetryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, _ = io.Copy(io.Discard, r.Body)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,41 +1,97 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"sync"
 	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+	"go.uber.org/zap"
 )
 
+// maxRefreshIn caps how long clients wait before refreshing a token,
+// matching what GitHub hands out.
+const maxRefreshIn = 25 * time.Minute
+
 // TokenResponse is the response returned by the TokenHandler.
 type TokenResponse struct {
-	AnnotationEnabled                  bool     `json:"annotation_enabled"`
-	ChatEnabled                        bool     `json:"chat_enabled"`
-	CodeQuoteEnabled                   bool     `json:"code_quote_enabled"`
-	CopilotIdeAgentChatGpt4SmallPrompt bool     `json:"copilot_ide_agent_chat_gpt4_small_prompt"`
-	CopilotIgnoreEnabled               bool     `json:"copilotignore_enabled"`
-	ExpiresAt                          int64    `json:"expires_at"`
-	IndividualChatEnabled              bool     `json:"individual_chat_enabled"`
-	NesEnabled                         bool     `json:"nes_enabled"`
-	OrganizationList                   []string `json:"organization_list"`
-	Prompt8k                           bool     `json:"prompt_8k"`
-	PublicSuggestions                  string   `json:"public_suggestions"`
-	RefreshIn                          int64    `json:"refresh_in"`
-	Sku                                string   `json:"sku"`
-	SnippyLoadTestEnabled              bool     `json:"snippy_load_test_enabled"`
-	Telemetry                          string   `json:"telemetry"`
-	Token                              string   `json:"token"`
-	TrackingId                         string   `json:"tracking_id"`
-	VscElectronFetcher                 bool     `json:"vsc_electron_fetcher"`
+	AnnotationEnabled                  bool            `json:"annotation_enabled"`
+	ChatEnabled                        bool            `json:"chat_enabled"`
+	ChatJetbrainsEnabled               bool            `json:"chat_jetbrains_enabled"`
+	CodeQuoteEnabled                   bool            `json:"code_quote_enabled"`
+	CodeReviewEnabled                  bool            `json:"code_review_enabled"`
+	CopilotIdeAgentChatGpt4SmallPrompt bool            `json:"copilot_ide_agent_chat_gpt4_small_prompt"`
+	CopilotIgnoreEnabled               bool            `json:"copilotignore_enabled"`
+	Endpoints                          *TokenEndpoints `json:"endpoints,omitempty"`
+	ExpiresAt                          int64           `json:"expires_at"`
+	Individual                         bool            `json:"individual"`
+	IndividualChatEnabled              bool            `json:"individual_chat_enabled"`
+	LimitedUserQuotas                  *int            `json:"limited_user_quotas"`
+	LimitedUserResetDate               *string         `json:"limited_user_reset_date"`
+	NesEnabled                         bool            `json:"nes_enabled"`
+	OrganizationList                   []string        `json:"organization_list"`
+	Prompt8k                           bool            `json:"prompt_8k"`
+	PublicSuggestions                  string          `json:"public_suggestions"`
+	RefreshIn                          int64           `json:"refresh_in"`
+	Sku                                string          `json:"sku"`
+	SnippyLoadTestEnabled              bool            `json:"snippy_load_test_enabled"`
+	Telemetry                          string          `json:"telemetry"`
+	Token                              string          `json:"token"`
+	TrackingId                         string          `json:"tracking_id"`
+	VscElectronFetcher                 bool            `json:"vsc_electron_fetcher"`
+	Xcode                              bool            `json:"xcode"`
+	XcodeChat                          bool            `json:"xcode_chat"`
+}
+
+// TokenEndpoints tells clients where to send each kind of request. Clients
+// that honor it talk to this proxy directly instead of through DNS or HTTP
+// proxy tricks.
+type TokenEndpoints struct {
+	Api           string `json:"api"`
+	OriginTracker string `json:"origin-tracker"`
+	Proxy         string `json:"proxy"`
+	Telemetry     string `json:"telemetry"`
+}
+
+// NewTokenEndpoints returns endpoints that all point at baseURL.
+func NewTokenEndpoints(baseURL string) *TokenEndpoints {
+	return &TokenEndpoints{
+		Api:           baseURL,
+		OriginTracker: baseURL,
+		Proxy:         baseURL,
+		Telemetry:     baseURL,
+	}
 }
 
-// TokenHandler is an http.Handler that returns a token.
+// TokenHandler is an http.Handler that issues tokens. The same token is
+// returned until it is due for refresh, after which a new one is issued, so
+// clients see the same lifecycle as with GitHub.
 type TokenHandler struct {
+	ttl          time.Duration
+	endpoints    *TokenEndpoints
+	entitlements *EntitlementChecker
+	trackingId   string
+	logger       *zap.Logger
+
+	mu      sync.Mutex
+	current TokenResponse
+	renewAt time.Time
 }
 
-// NewTokenHandler returns a new TokenHandler.
-func NewTokenHandler() *TokenHandler {
-	return &TokenHandler{}
+// NewTokenHandler returns a new TokenHandler issuing tokens valid for ttl.
+// When endpoints is not nil it is advertised in every token. When
+// entitlements is not nil, tokens are only issued to users GitHub reports as
+// having a Copilot license. A nil logger discards its logs.
+func NewTokenHandler(ttl time.Duration, endpoints *TokenEndpoints, entitlements *EntitlementChecker, logger *zap.Logger) *TokenHandler {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return &TokenHandler{ttl: ttl, endpoints: endpoints, entitlements: entitlements, trackingId: randomHex(16), logger: logger}
 }
 
 // ServeHTTP implements http.Handler.
@@ -45,7 +101,27 @@ func (t *TokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token := Token()
+	if t.entitlements != nil {
+		authorization := r.Header.Get("Authorization")
+		if authorization == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		status, err := t.entitlements.Check(r.Context(), authorization)
+		if err != nil {
+			t.logger.Warn("Failed to check the Copilot entitlement", zap.String("client", middleware.ClientID(r)), zap.Error(err))
+			middleware.AddLogField(r.Context(), "entitlement_error", err.Error())
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+	}
+
+	token := t.Token()
 
 	w.Header().Set("content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -55,25 +131,60 @@ func (t *TokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func Token() TokenResponse {
+// Token returns the current token, issuing a new one once the previous one
+// is due for refresh.
+func (t *TokenHandler) Token() TokenResponse {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(t.renewAt) {
+		return t.current
+	}
+
+	refreshIn := min(maxRefreshIn, t.ttl*3/4)
+	t.current = NewToken(now, t.ttl, refreshIn, t.trackingId)
+	t.current.Endpoints = t.endpoints
+	t.renewAt = now.Add(refreshIn)
+	return t.current
+}
+
+// NewToken builds a token issued at now that expires after ttl and asks the
+// client to refresh it after refreshIn.
+func NewToken(now time.Time, ttl, refreshIn time.Duration, trackingId string) TokenResponse {
+	expiresAt := now.Add(ttl).Unix()
+
 	return TokenResponse{
 		AnnotationEnabled:                  false,
 		ChatEnabled:                        false,
+		ChatJetbrainsEnabled:               false,
 		CodeQuoteEnabled:                   true,
+		CodeReviewEnabled:                  false,
 		CopilotIdeAgentChatGpt4SmallPrompt: false,
 		CopilotIgnoreEnabled:               false,
-		ExpiresAt:                          time.Now().Unix() + 7200,
+		ExpiresAt:                          expiresAt,
+		Individual:                         true,
 		IndividualChatEnabled:              false,
+		LimitedUserQuotas:                  nil,
+		LimitedUserResetDate:               nil,
 		NesEnabled:                         true,
 		OrganizationList:                   []string{},
 		Prompt8k:                           true,
-		PublicSuggestions:                  "public_suggestions",
-		RefreshIn:                          1500,
-		Sku:                                "sku",
+		PublicSuggestions:                  "disabled",
+		RefreshIn:                          int64(refreshIn.Seconds()),
+		Sku:                                "free_limited_copilot",
 		SnippyLoadTestEnabled:              true,
 		Telemetry:                          "disabled",
-		Token:                              "tid=aaaaaaaaaaaaaaaaaaaaaa",
-		TrackingId:                         "aaaaaaaaaaaaaaaaaaaaaa",
+		Token:                              fmt.Sprintf("tid=%s;exp=%d;sku=free_limited_copilot;8kp=1", randomHex(16), expiresAt),
+		TrackingId:                         trackingId,
 		VscElectronFetcher:                 true,
+		Xcode:                              false,
+		XcodeChat:                          false,
 	}
 }
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
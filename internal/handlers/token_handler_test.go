@@ -5,13 +5,18 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/josuemontano/ollama-copilot/internal/handlers"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 )
 
-func TestTokenHandler_ServeHTTP(t *testing.T) {
-	handler := handlers.NewTokenHandler()
+func getToken(t *testing.T, handler http.Handler) handlers.TokenResponse {
+	t.Helper()
 
 	req := httptest.NewRequest(http.MethodGet, "/copilot_internal/v2/token", nil)
 	w := httptest.NewRecorder()
@@ -26,10 +31,120 @@ func TestTokenHandler_ServeHTTP(t *testing.T) {
 	if err := json.NewDecoder(w.Body).Decode(&token); err != nil {
 		t.Fatalf("failed to decode response: %v", err)
 	}
+	return token
+}
 
-	expected := handlers.Token()
+func TestTokenHandler_ServeHTTP(t *testing.T) {
+	handler := handlers.NewTokenHandler(2*time.Hour, nil, nil, zap.NewNop())
+
+	token := getToken(t, handler)
+	expected := handler.Token()
 
 	if !reflect.DeepEqual(token, expected) {
 		t.Errorf("expected response to be %v, got %v", expected, token)
 	}
 }
+
+func TestTokenHandler_Lifecycle(t *testing.T) {
+	handler := handlers.NewTokenHandler(30*time.Minute, nil, nil, zap.NewNop())
+	token := getToken(t, handler)
+
+	if ttl := token.ExpiresAt - time.Now().Unix(); ttl < 1790 || ttl > 1800 {
+		t.Errorf("expected the token to expire in 30 minutes, got %ds", ttl)
+	}
+	if token.RefreshIn != 1350 {
+		t.Errorf("expected refresh_in to be 1350, got %d", token.RefreshIn)
+	}
+	if !strings.Contains(token.Token, ";exp=") {
+		t.Errorf("expected the token to embed its expiry, got %q", token.Token)
+	}
+	if again := getToken(t, handler); again.Token != token.Token {
+		t.Errorf("expected the same token before it is due for refresh")
+	}
+}
+
+func TestTokenHandler_RenewsNearExpiry(t *testing.T) {
+	handler := handlers.NewTokenHandler(40*time.Millisecond, nil, nil, zap.NewNop())
+	first := getToken(t, handler)
+
+	time.Sleep(50 * time.Millisecond)
+	second := getToken(t, handler)
+
+	if first.Token == second.Token {
+		t.Error("expected a new token once the previous one was due for refresh")
+	}
+	if first.TrackingId != second.TrackingId {
+		t.Error("expected the tracking id to be stable across tokens")
+	}
+}
+
+func TestTokenHandler_Endpoints(t *testing.T) {
+	handler := handlers.NewTokenHandler(time.Hour, handlers.NewTokenEndpoints("https://localhost:11436"), nil, zap.NewNop())
+	token := getToken(t, handler)
+
+	if token.Endpoints == nil {
+		t.Fatal("expected the token to advertise endpoints")
+	}
+	if token.Endpoints.Proxy != "https://localhost:11436" || token.Endpoints.Telemetry != "https://localhost:11436" {
+		t.Errorf("expected endpoints to point at this server, got %+v", token.Endpoints)
+	}
+}
+
+func TestTokenHandler_Entitlement(t *testing.T) {
+	calls := 0
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("Authorization") != "token licensed" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer github.Close()
+
+	handler := handlers.NewTokenHandler(time.Hour, nil, handlers.NewEntitlementChecker(github.URL, time.Hour), zap.NewNop())
+	request := func(authorization string) int {
+		req := httptest.NewRequest(http.MethodGet, "/copilot_internal/v2/token", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := request(""); code != http.StatusUnauthorized {
+		t.Errorf("expected status code %d without credentials, got %d", http.StatusUnauthorized, code)
+	}
+	if code := request("token unlicensed"); code != http.StatusForbidden {
+		t.Errorf("expected status code %d for an unlicensed user, got %d", http.StatusForbidden, code)
+	}
+	for i := 0; i < 3; i++ {
+		if code := request("token licensed"); code != http.StatusOK {
+			t.Errorf("expected status code %d for a licensed user, got %d", http.StatusOK, code)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected entitlement checks to be cached, got %d calls to GitHub", calls)
+	}
+}
+
+func TestTokenHandler_EntitlementError(t *testing.T) {
+	github := httptest.NewServer(http.NotFoundHandler())
+	github.Close()
+
+	core, logs := observer.New(zapcore.WarnLevel)
+	handler := handlers.NewTokenHandler(time.Hour, nil, handlers.NewEntitlementChecker(github.URL, time.Hour), zap.New(core))
+	req := httptest.NewRequest(http.MethodGet, "/copilot_internal/v2/token", nil)
+	req.Header.Set("Authorization", "token licensed")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected status code %d when GitHub cannot be reached, got %d", http.StatusBadGateway, w.Code)
+	}
+	entries := logs.FilterMessage("Failed to check the Copilot entitlement").All()
+	if len(entries) != 1 || entries[0].ContextMap()["client"] == "" {
+		t.Errorf("expected the failed check to be logged with its client, got %v", entries)
+	}
+}
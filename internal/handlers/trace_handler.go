@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/tracing"
+)
+
+// TraceResponse is the waterfall of one completion, from the spans of its
+// trace. Offsets are from the start of the request.
+type TraceResponse struct {
+	ID      string       `json:"id"`
+	Timings TraceTimings `json:"timings"`
+	Spans   []TraceSpan  `json:"spans"`
+}
+
+// TraceTimings breaks a completion down into the phases it went through, in
+// milliseconds. A phase the completion skipped, such as the queue without a
+// concurrency limit, is left out.
+type TraceTimings struct {
+	QueueWait      float64 `json:"queue_wait_ms,omitempty"`
+	PromptBuild    float64 `json:"prompt_build_ms,omitempty"`
+	BackendConnect float64 `json:"backend_connect_ms,omitempty"`
+	// TTFT is the time to the first token, from the start of the request.
+	TTFT   float64 `json:"ttft_ms,omitempty"`
+	Stream float64 `json:"stream_ms,omitempty"`
+	Filter float64 `json:"filter_ms,omitempty"`
+	Total  float64 `json:"total_ms"`
+}
+
+// TraceSpan is a span of the waterfall. Depth is how many parents it has in
+// the trace.
+type TraceSpan struct {
+	Name       string         `json:"name"`
+	Depth      int            `json:"depth"`
+	Offset     float64        `json:"offset_ms"`
+	Duration   float64        `json:"duration_ms"`
+	Events     []TraceEvent   `json:"events,omitempty"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+}
+
+// TraceEvent is an event of a span, such as the first token of a generation.
+type TraceEvent struct {
+	Name   string  `json:"name"`
+	Offset float64 `json:"offset_ms"`
+}
+
+// TraceHandler serves the TraceResponse of a recent completion, by the id
+// of its completion response header, as JSON or as a text waterfall with
+// ?format=text.
+type TraceHandler struct {
+	recorder *tracing.Recorder
+}
+
+// NewTraceHandler returns a TraceHandler looking traces up in recorder.
+func NewTraceHandler(recorder *tracing.Recorder) *TraceHandler {
+	return &TraceHandler{recorder: recorder}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *TraceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.PathValue("id")
+	spans, ok := h.recorder.Lookup(id)
+	if !ok {
+		http.Error(w, "unknown completion id", http.StatusNotFound)
+		return
+	}
+	resp := waterfall(id, spans)
+
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		writeWaterfall(w, resp)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("error encoding: %s", err.Error())
+	}
+}
+
+// waterfall lays spans out from the start of the root span, the first one
+// whose parent is not in the trace, such as the span of an editor sending a
+// traceparent header.
+func waterfall(id string, spans []tracing.Span) TraceResponse {
+	parents := map[string]string{}
+	for _, s := range spans {
+		parents[s.ID] = s.ParentID
+	}
+	root := spans[0]
+	for _, s := range spans {
+		if _, ok := parents[s.ParentID]; !ok {
+			root = s
+			break
+		}
+	}
+	offset := func(t time.Time) float64 { return millis(t.Sub(root.Start)) }
+
+	resp := TraceResponse{ID: id, Timings: TraceTimings{Total: millis(root.End.Sub(root.Start))}}
+	for _, s := range spans {
+		span := TraceSpan{Name: s.Name, Offset: offset(s.Start), Duration: millis(s.End.Sub(s.Start)), Attributes: s.Attributes}
+		for parent, ok := parents[s.ParentID]; ok; parent, ok = parents[parent] {
+			span.Depth++
+		}
+		for _, e := range s.Events {
+			span.Events = append(span.Events, TraceEvent{Name: e.Name, Offset: offset(e.Time)})
+		}
+		resp.Spans = append(resp.Spans, span)
+
+		// A retried generation has a span per attempt, and the phases are
+		// those of the last one.
+		switch s.Name {
+		case "wait for slot":
+			resp.Timings.QueueWait = span.Duration
+		case "build prompt":
+			resp.Timings.PromptBuild = span.Duration
+		case "ollama generate":
+			if e, ok := firstEvent(s, "connected"); ok {
+				resp.Timings.BackendConnect = millis(e.Time.Sub(s.Start))
+			}
+			if e, ok := firstEvent(s, "first token"); ok {
+				resp.Timings.TTFT = offset(e.Time)
+			}
+		case "stream write":
+			resp.Timings.Stream = span.Duration
+			if us, ok := s.Attributes["filter_us"].(int64); ok {
+				resp.Timings.Filter = millis(time.Duration(us) * time.Microsecond)
+			}
+		}
+	}
+	return resp
+}
+
+func firstEvent(s tracing.Span, name string) (tracing.Event, bool) {
+	for _, e := range s.Events {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return tracing.Event{}, false
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// waterfallWidth is the width of the bars of the text waterfall.
+const waterfallWidth = 40
+
+func writeWaterfall(w io.Writer, resp TraceResponse) {
+	fmt.Fprintf(w, "completion %s, %.1fms\n\n", resp.ID, resp.Timings.Total)
+	scale := waterfallWidth / max(resp.Timings.Total, 1e-3)
+	for _, s := range resp.Spans {
+		start := min(int(s.Offset*scale), waterfallWidth-1)
+		width := min(max(int(s.Duration*scale), 1), waterfallWidth-start)
+		bar := strings.Repeat(" ", start) + strings.Repeat("█", width) + strings.Repeat(" ", waterfallWidth-start-width)
+		name := strings.Repeat("  ", s.Depth) + s.Name
+		fmt.Fprintf(w, "%-44s |%s| %8.1fms +%.1fms\n", name, bar, s.Offset, s.Duration)
+	}
+
+	t := resp.Timings
+	fmt.Fprintln(w)
+	for _, phase := range []struct {
+		name string
+		ms   float64
+	}{
+		{"queue wait", t.QueueWait},
+		{"prompt build", t.PromptBuild},
+		{"backend connect", t.BackendConnect},
+		{"time to first token", t.TTFT},
+		{"stream", t.Stream},
+		{"filters", t.Filter},
+	} {
+		if phase.ms > 0 {
+			fmt.Fprintf(w, "%-20s %8.1fms\n", phase.name, phase.ms)
+		}
+	}
+}
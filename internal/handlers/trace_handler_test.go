@@ -0,0 +1,78 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/handlers"
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+	"github.com/josuemontano/ollama-copilot/internal/tracing"
+	"github.com/ollama/ollama/api"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestTraceHandler(t *testing.T) {
+	rec := tracing.NewRecorder(10)
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		writeChunks(w, req.Model, "return ", "x")
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/v1/engines/copilot-codex/completions", newCompletionHandler(client, handlers.CompletionConfig{Model: "primary"}))
+	mux.Handle("/debug/trace/{id}", handlers.NewTraceHandler(rec))
+	h := middleware.TraceMiddleware(mux, mux)
+
+	rr := postCompletion(t, h, `{"prompt":"x = ","suffix":"","max_tokens":20,"stream":true}`)
+	id := rr.Header().Get(handlers.CompletionIDHeader)
+	if id == "" {
+		t.Fatal("expected a completion id")
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/trace/"+id, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	var resp handlers.TraceResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != id || len(resp.Spans) == 0 || resp.Spans[0].Depth != 0 || resp.Spans[0].Offset != 0 {
+		t.Fatalf("expected the spans from the server span, got %+v", resp)
+	}
+	names := map[string]bool{}
+	for _, s := range resp.Spans {
+		names[s.Name] = true
+	}
+	for _, name := range []string{"build prompt", "ollama generate", "stream write"} {
+		if !names[name] {
+			t.Errorf("expected a %q span, got %+v", name, resp.Spans)
+		}
+	}
+	timings := resp.Timings
+	if timings.PromptBuild <= 0 || timings.BackendConnect <= 0 || timings.TTFT <= 0 || timings.Stream <= 0 {
+		t.Errorf("expected the phases of the completion, got %+v", timings)
+	}
+	if timings.TTFT > timings.Total {
+		t.Errorf("expected the first token within the request, got %+v", timings)
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/trace/"+id+"?format=text", nil))
+	if body := rr.Body.String(); !strings.Contains(body, "ollama generate") || !strings.Contains(body, "time to first token") {
+		t.Errorf("expected a text waterfall, got %s", body)
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/trace/unknown", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected status code %d for an unknown id, got %d", http.StatusNotFound, rr.Code)
+	}
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
+	"go.uber.org/zap"
+)
+
+// Pricing turns GPU time into an energy and cost estimate.
+type Pricing struct {
+	// Watts is the average power draw of the GPU while generating.
+	Watts float64 `json:"watts"`
+	// CostPerHour is the cost of one hour of GPU time.
+	CostPerHour float64 `json:"cost_per_hour"`
+}
+
+// UsageStats is the work done for one user and model with its estimated
+// energy and cost.
+type UsageStats struct {
+	User            string  `json:"user"`
+	Model           string  `json:"model"`
+	Requests        int     `json:"requests"`
+	PromptTokens    int     `json:"prompt_tokens"`
+	GeneratedTokens int     `json:"generated_tokens"`
+	GPUSeconds      float64 `json:"gpu_seconds"`
+	EnergyWh        float64 `json:"energy_wh"`
+	Cost            float64 `json:"cost"`
+}
+
+// UsageResponse is the usage export.
+type UsageResponse struct {
+	Pricing Pricing      `json:"pricing"`
+	Usage   []UsageStats `json:"usage"`
+}
+
+// UsageHandler exports accumulated usage as JSON, or as CSV with
+// ?format=csv.
+type UsageHandler struct {
+	pricing Pricing
+	logger  *zap.Logger
+}
+
+// NewUsageHandler returns a UsageHandler that prices GPU time with pricing.
+// A nil logger discards its logs.
+func NewUsageHandler(pricing Pricing, logger *zap.Logger) *UsageHandler {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return &UsageHandler{pricing: pricing, logger: logger}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *UsageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	usage := h.Usage()
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.WriteHeader(http.StatusOK)
+		if err := writeUsageCSV(w, usage.Usage); err != nil {
+			h.logger.Warn("Failed to write usage", zap.Error(err))
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(usage); err != nil {
+		h.logger.Warn("Failed to encode usage", zap.Error(err))
+	}
+}
+
+// Usage prices the usage accumulated so far.
+func (h *UsageHandler) Usage() UsageResponse {
+	resp := UsageResponse{Pricing: h.pricing, Usage: []UsageStats{}}
+	for _, r := range metrics.Usage.Records() {
+		hours := r.GPUTime.Hours()
+		resp.Usage = append(resp.Usage, UsageStats{
+			User:            r.User,
+			Model:           r.Model,
+			Requests:        r.Requests,
+			PromptTokens:    r.PromptTokens,
+			GeneratedTokens: r.EvalTokens,
+			GPUSeconds:      r.GPUTime.Seconds(),
+			EnergyWh:        hours * h.pricing.Watts,
+			Cost:            hours * h.pricing.CostPerHour,
+		})
+	}
+	return resp
+}
+
+func writeUsageCSV(w io.Writer, usage []UsageStats) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"user", "model", "requests", "prompt_tokens", "generated_tokens", "gpu_seconds", "energy_wh", "cost"})
+	for _, u := range usage {
+		_ = cw.Write([]string{
+			u.User,
+			u.Model,
+			strconv.Itoa(u.Requests),
+			strconv.Itoa(u.PromptTokens),
+			strconv.Itoa(u.GeneratedTokens),
+			strconv.FormatFloat(u.GPUSeconds, 'f', 3, 64),
+			strconv.FormatFloat(u.EnergyWh, 'f', 4, 64),
+			strconv.FormatFloat(u.Cost, 'f', 6, 64),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
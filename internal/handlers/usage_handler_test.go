@@ -0,0 +1,66 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/handlers"
+	"github.com/ollama/ollama/api"
+	"go.uber.org/zap"
+)
+
+func TestUsageHandler_ServeHTTP(t *testing.T) {
+	client := fakeOllama(t, func(w http.ResponseWriter, req api.GenerateRequest) {
+		_ = json.NewEncoder(w).Encode(api.GenerateResponse{
+			Model:    req.Model,
+			Response: "x",
+			Done:     true,
+			Metrics: api.Metrics{
+				PromptEvalCount:    100,
+				PromptEvalDuration: 30 * time.Minute,
+				EvalCount:          10,
+				EvalDuration:       30 * time.Minute,
+			},
+		})
+	})
+
+	h := newCompletionHandler(client, handlers.CompletionConfig{Model: "usage-model", UserHeader: "X-User"})
+	req := httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", strings.NewReader(`{"prompt":"x = ","suffix":""}`))
+	req.Header.Set("X-User", "alice")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	usage := handlers.NewUsageHandler(handlers.Pricing{Watts: 300, CostPerHour: 2}, zap.NewNop())
+	w := httptest.NewRecorder()
+	usage.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/usage", nil))
+
+	var resp handlers.UsageResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	var got *handlers.UsageStats
+	for i, u := range resp.Usage {
+		if u.User == "alice" && u.Model == "usage-model" {
+			got = &resp.Usage[i]
+		}
+	}
+	if got == nil {
+		t.Fatalf("expected usage for alice, got %+v", resp.Usage)
+	}
+	if got.Requests != 1 || got.PromptTokens != 100 || got.GeneratedTokens != 10 {
+		t.Errorf("expected 1 request with 100 prompt and 10 generated tokens, got %+v", got)
+	}
+	if got.GPUSeconds != 3600 || got.EnergyWh != 300 || got.Cost != 2 {
+		t.Errorf("expected one GPU hour costing 300 Wh and 2, got %+v", got)
+	}
+
+	w = httptest.NewRecorder()
+	usage.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/usage?format=csv", nil))
+	if !strings.Contains(w.Body.String(), "alice,usage-model,1,100,10,3600.000,300.0000,2.000000") {
+		t.Errorf("expected a CSV row for alice, got %s", w.Body.String())
+	}
+}
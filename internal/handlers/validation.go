@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// maxRequestTokens bounds max_tokens; no Copilot client asks for more.
+const maxRequestTokens = 8192
+
+// FieldError describes one invalid request field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is the body of a 422 response.
+type ValidationError struct {
+	Error struct {
+		Message string       `json:"message"`
+		Type    string       `json:"type"`
+		Fields  []FieldError `json:"fields"`
+	} `json:"error"`
+}
+
+// Validate checks that the request's fields are within the ranges Ollama
+// and the handler support.
+func (r CompletionRequest) Validate() []FieldError {
+	var errs []FieldError
+	check := func(ok bool, field, format string, args ...any) {
+		if !ok {
+			errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+		}
+	}
+
+	// An empty prompt is valid at the top of a file, as long as there is a
+	// suffix to complete against.
+	check(r.Prompt != "" || r.Suffix != "", "prompt", "prompt and suffix must not both be empty")
+	check(r.Temperature >= 0 && r.Temperature <= 2, "temperature", "must be between 0 and 2")
+	check(r.TopP >= 0 && r.TopP <= 1, "top_p", "must be between 0 and 1")
+	check(r.MaxTokens >= 0 && r.MaxTokens <= maxRequestTokens, "max_tokens", "must be between 0 and %d", maxRequestTokens)
+	check(r.N >= 0 && r.N <= 10, "n", "must be between 0 and 10")
+	errs = append(errs, r.Stop.check("stop")...)
+	if p := r.Extra.Position; p != nil {
+		check(p.Line >= 0, "extra.position.line", "must not be negative")
+		check(p.Character >= 0, "extra.position.character", "must not be negative")
+	}
+	if rng := r.Extra.Range; rng != nil {
+		pos := r.Extra.Position
+		switch {
+		case pos == nil:
+			check(false, "extra.range", "requires extra.position")
+		case rng.Start.Line < 0 || rng.Start.Character < 0 || positionBefore(*pos, rng.Start) || positionBefore(rng.End, *pos):
+			check(false, "extra.range", "must contain extra.position")
+		default:
+			_, _, ok := r.cutRange()
+			check(ok, "extra.range", "must lie within the prompt and suffix")
+		}
+	}
+
+	return errs
+}
+
+func writeValidationError(w http.ResponseWriter, errs []FieldError) {
+	var body ValidationError
+	body.Error.Message = "invalid request"
+	body.Error.Type = "invalid_request_error"
+	body.Error.Fields = errs
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// knownFields are the JSON keys CompletionRequest understands, with nested
+// keys written as "parent.child".
+var knownFields = jsonFields(reflect.TypeOf(CompletionRequest{}), "")
+
+func jsonFields(t reflect.Type, prefix string) map[string]bool {
+	fields := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[prefix+name] = true
+		if f.Type.Kind() == reflect.Struct {
+			for nested := range jsonFields(f.Type, prefix+name+".") {
+				fields[nested] = true
+			}
+		}
+	}
+	return fields
+}
+
+// unsupportedFields are fields Copilot and OpenAI clients are known to send
+// that CompletionRequest ignores. They are counted by name, and any other
+// unknown field as "other", so clients cannot grow the metric unbounded.
+var unsupportedFields = map[string]bool{
+	"best_of":            true,
+	"echo":               true,
+	"frequency_penalty":  true,
+	"logit_bias":         true,
+	"logprobs":           true,
+	"nwo":                true,
+	"presence_penalty":   true,
+	"seed":               true,
+	"user":               true,
+	"extra.force_indent": true,
+}
+
+// unknownFieldLabel returns the label field is counted under in
+// metrics.UnknownFields.
+func unknownFieldLabel(field string) string {
+	if unsupportedFields[field] {
+		return field
+	}
+	return "other"
+}
+
+// unknownFields returns the keys in body that CompletionRequest does not
+// understand, so schema drift in newer clients is visible.
+func unknownFields(body []byte) []string {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil
+	}
+
+	var unknown []string
+	for key, value := range raw {
+		if !knownFields[key] {
+			unknown = append(unknown, key)
+			continue
+		}
+
+		var nested map[string]json.RawMessage
+		if json.Unmarshal(value, &nested) != nil {
+			continue
+		}
+		for child := range nested {
+			if name := key + "." + child; !knownFields[name] {
+				unknown = append(unknown, name)
+			}
+		}
+	}
+
+	sort.Strings(unknown)
+	return unknown
+}
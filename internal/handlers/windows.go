@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
+	"github.com/josuemontano/ollama-copilot/internal/tokenizer"
+)
+
+// windowFiles is how many files a windowCache remembers the windows of.
+const windowFiles = 256
+
+// window is one side of the text around the cursor, cut to the lines put in
+// the prompt and with long lines clipped. tokens is its length in tokens,
+// or -1 when it was not counted.
+type window struct {
+	key    [sha256.Size]byte
+	text   string
+	tokens int
+}
+
+// windowCache remembers, for each recent file, the windows of the last
+// prompt completed in it. A request for the file reuses the side of the
+// cursor that did not change since: the suffix while typing in a line, and
+// both for repeated requests such as ghost-text cycling. Cutting the lines
+// of a large file and counting their tokens is then skipped. A nil
+// windowCache remembers nothing.
+type windowCache struct {
+	tokenizer tokenizer.Tokenizer
+	// count is whether windows are counted in tokens, which they only
+	// need to be when the prompt is fit in a context window.
+	count bool
+
+	mu    sync.Mutex
+	files map[string]*fileWindows
+	// paths are the files in the order of their last request.
+	paths []string
+}
+
+type fileWindows struct {
+	prefix, suffix window
+}
+
+func newWindowCache(t tokenizer.Tokenizer, count bool) *windowCache {
+	return &windowCache{tokenizer: t, count: count, files: map[string]*fileWindows{}}
+}
+
+// prefix returns the window of the last before lines of text, the prompt
+// of a completion in path.
+func (c *windowCache) prefix(path, text string, before int) window {
+	return c.lookup(path, text, before, func(f *fileWindows) *window { return &f.prefix }, func() string {
+		prefix, _ := getLinesAroundCursor(text, "", before, 0)
+		prefix, _ = clipLongLines(prefix, "")
+		return prefix
+	})
+}
+
+// suffix returns the window of the first after lines of text, the suffix
+// of a completion in path.
+func (c *windowCache) suffix(path, text string, after int) window {
+	return c.lookup(path, text, after, func(f *fileWindows) *window { return &f.suffix }, func() string {
+		_, suffix := getLinesAroundCursor("", text, 0, after)
+		_, suffix = clipLongLines("", suffix)
+		return suffix
+	})
+}
+
+// lookup returns the window side picks of path when it was cut from text
+// to lines, or else cuts it with cut and remembers it. Completions
+// without a path are not remembered.
+func (c *windowCache) lookup(path, text string, lines int, side func(*fileWindows) *window, cut func() string) window {
+	if c == nil {
+		return window{text: cut(), tokens: -1}
+	}
+	if path == "" {
+		return c.measure(cut())
+	}
+	key := windowKey(text, lines)
+	c.mu.Lock()
+	if f, ok := c.files[path]; ok && side(f).key == key {
+		w := *side(f)
+		c.touch(path)
+		c.mu.Unlock()
+		metrics.PromptWindows.Inc("hit")
+		return w
+	}
+	c.mu.Unlock()
+	metrics.PromptWindows.Inc("miss")
+
+	w := c.measure(cut())
+	w.key = key
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.files[path]
+	if !ok {
+		f = &fileWindows{}
+		c.files[path] = f
+	}
+	*side(f) = w
+	c.touch(path)
+	return w
+}
+
+// measure returns the window of text, counted when c counts windows.
+func (c *windowCache) measure(text string) window {
+	w := window{text: text, tokens: -1}
+	if c.count {
+		w.tokens = tokenizer.Count(c.tokenizer, w.text)
+	}
+	return w
+}
+
+// touch moves path to the end of paths, forgetting the least recently
+// requested file when there are more than windowFiles.
+func (c *windowCache) touch(path string) {
+	for i, p := range c.paths {
+		if p == path {
+			c.paths = append(c.paths[:i], c.paths[i+1:]...)
+			break
+		}
+	}
+	c.paths = append(c.paths, path)
+	if len(c.paths) > windowFiles {
+		delete(c.files, c.paths[0])
+		c.paths = c.paths[1:]
+	}
+}
+
+// windowKey identifies text cut to lines.
+func windowKey(text string, lines int) [sha256.Size]byte {
+	h := sha256.New()
+	_, _ = io.WriteString(h, strconv.Itoa(lines)+"\x00")
+	_, _ = io.WriteString(h, text)
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
+}
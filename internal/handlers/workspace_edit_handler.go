@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/google/uuid"
+	"github.com/josuemontano/ollama-copilot/internal/limiter"
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+	"github.com/ollama/ollama/api"
+	"go.uber.org/zap"
+)
+
+// WorkspaceFile is one file the client offers as context for an edit.
+type WorkspaceFile struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+}
+
+// WorkspaceEditRequest asks the model to change files in the workspace.
+type WorkspaceEditRequest struct {
+	Instruction string          `json:"instruction"`
+	Files       []WorkspaceFile `json:"files"`
+}
+
+// Position is a zero-based line and character offset, as in LSP.
+type Position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+// Range is the span of text a TextEdit replaces.
+type Range struct {
+	Start Position `json:"start"`
+	End   Position `json:"end"`
+}
+
+// TextEdit replaces the text in Range with NewText.
+type TextEdit struct {
+	Range   Range  `json:"range"`
+	NewText string `json:"newText"`
+}
+
+// WorkspaceEditResponse carries the proposed edits keyed by file path, in
+// the shape of an LSP WorkspaceEdit so clients can apply it directly.
+type WorkspaceEditResponse struct {
+	Id          string                `json:"id"`
+	Model       string                `json:"model"`
+	Explanation string                `json:"explanation,omitempty"`
+	Changes     map[string][]TextEdit `json:"changes"`
+	Error       *ErrorResponse        `json:"error,omitempty"`
+}
+
+// proposedEdit is the line-based edit the model is asked to produce. Lines
+// are one-based and inclusive; an EndLine one before StartLine inserts.
+type proposedEdit struct {
+	Path        string `json:"path"`
+	StartLine   int    `json:"start_line"`
+	EndLine     int    `json:"end_line"`
+	Replacement string `json:"replacement"`
+}
+
+type proposal struct {
+	Explanation string         `json:"explanation"`
+	Edits       []proposedEdit `json:"edits"`
+}
+
+const workspaceEditPrompt = `You are an expert programming assistant that edits code across a project.
+You are given files with numbered lines and an instruction. Reply with a single JSON object:
+{"explanation": "<one sentence>", "edits": [{"path": "<file path>", "start_line": <n>, "end_line": <n>, "replacement": "<new text>"}]}
+Lines are numbered from 1 and the range is inclusive. To insert without replacing, set end_line to start_line - 1.
+The replacement ends with a newline unless it is empty. Only edit the files you were given.`
+
+// WorkspaceEditHandler serves /v1/workspace/edits, an endpoint of its own
+// rather than a tool of the chat, that asks the model for edits across
+// several files.
+type WorkspaceEditHandler struct {
+	api     Generator
+	model   func() string
+	limiter *limiter.Limiter
+	logger  *zap.Logger
+}
+
+// NewWorkspaceEditHandler constructs a new WorkspaceEditHandler. model
+// returns the model edits are proposed with, which may change at runtime.
+// A nil logger discards its logs.
+func NewWorkspaceEditHandler(api Generator, model func() string, limiter *limiter.Limiter, logger *zap.Logger) *WorkspaceEditHandler {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return &WorkspaceEditHandler{api: api, model: model, limiter: limiter, logger: logger}
+}
+
+// ServeHTTP handles a workspace edit request.
+func (h *WorkspaceEditHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req WorkspaceEditRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logger.Error("Failed to decode workspace edit request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var errs []FieldError
+	if strings.TrimSpace(req.Instruction) == "" {
+		errs = append(errs, FieldError{Field: "instruction", Message: "must not be empty"})
+	}
+	if len(req.Files) == 0 {
+		errs = append(errs, FieldError{Field: "files", Message: "must contain at least one file"})
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, errs)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+	if rejectQueueFull(ctx, w, h.limiter) {
+		return
+	}
+
+	model := h.model()
+	middleware.AddLogField(ctx, "model", model)
+	resp := WorkspaceEditResponse{Id: uuid.New().String(), Model: model, Changes: map[string][]TextEdit{}}
+
+	p, err := h.propose(ctx, r.URL.Path, model, req)
+	if err != nil {
+		class := classifyError(err)
+		h.logger.Error("Failed to propose workspace edits", zap.Error(err), zap.String("class", class))
+		resp.Error = &ErrorResponse{Message: errMessages[class], Type: "backend_error", Code: class}
+		writeJSON(w, http.StatusBadGateway, resp)
+		return
+	}
+
+	resp.Explanation = p.Explanation
+	files := make(map[string][]string, len(req.Files))
+	for _, f := range req.Files {
+		lines := strings.SplitAfter(f.Content, "\n")
+		if lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		files[f.Path] = lines
+	}
+	for _, edit := range p.Edits {
+		textEdit, err := toTextEdit(edit, files[edit.Path])
+		if err != nil {
+			h.logger.Warn("Dropping invalid workspace edit", zap.String("path", edit.Path), zap.Error(err))
+			continue
+		}
+		resp.Changes[edit.Path] = append(resp.Changes[edit.Path], textEdit)
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// propose asks the model for line-based edits in JSON mode.
+func (h *WorkspaceEditHandler) propose(ctx context.Context, endpoint, model string, req WorkspaceEditRequest) (proposal, error) {
+	var prompt strings.Builder
+	for _, f := range req.Files {
+		fmt.Fprintf(&prompt, "File: %s\n", f.Path)
+		for i, line := range strings.Split(strings.TrimSuffix(f.Content, "\n"), "\n") {
+			fmt.Fprintf(&prompt, "%d: %s\n", i+1, line)
+		}
+		prompt.WriteString("\n")
+	}
+	fmt.Fprintf(&prompt, "Instruction: %s\n", req.Instruction)
+
+	release, err := acquireSlot(ctx, h.limiter, endpoint)
+	if err != nil {
+		return proposal{}, err
+	}
+	defer release()
+
+	stream := false
+	chatReq := api.ChatRequest{
+		Model:  model,
+		Stream: &stream,
+		Format: "json",
+		Messages: []api.Message{
+			{Role: "system", Content: workspaceEditPrompt},
+			{Role: "user", Content: prompt.String()},
+		},
+		Options: map[string]interface{}{"temperature": 0},
+	}
+
+	var content strings.Builder
+	err = h.api.Chat(ctx, &chatReq, func(resp api.ChatResponse) error {
+		content.WriteString(resp.Message.Content)
+		return nil
+	})
+	if err != nil {
+		return proposal{}, err
+	}
+
+	var p proposal
+	if err := json.Unmarshal([]byte(content.String()), &p); err != nil {
+		return proposal{}, fmt.Errorf("decoding proposed edits: %w", err)
+	}
+	return p, nil
+}
+
+// toTextEdit converts a line-based edit into a range over lines, rejecting
+// edits to files the client did not send or lines they do not have.
+func toTextEdit(edit proposedEdit, lines []string) (TextEdit, error) {
+	if lines == nil {
+		return TextEdit{}, fmt.Errorf("unknown file")
+	}
+	if edit.StartLine < 1 || edit.EndLine < edit.StartLine-1 || edit.EndLine > len(lines) {
+		return TextEdit{}, fmt.Errorf("lines %d-%d out of range", edit.StartLine, edit.EndLine)
+	}
+
+	end := Position{Line: edit.EndLine}
+	// Replacing the last line of a file without a trailing newline has to
+	// end at that line's last character rather than the next line. LSP
+	// counts characters in UTF-16 code units.
+	if edit.EndLine > 0 && edit.EndLine == len(lines) {
+		if last := lines[len(lines)-1]; !strings.HasSuffix(last, "\n") {
+			end = Position{Line: edit.EndLine - 1, Character: len(utf16.Encode([]rune(last)))}
+		}
+	}
+
+	return TextEdit{
+		Range:   Range{Start: Position{Line: edit.StartLine - 1}, End: end},
+		NewText: edit.Replacement,
+	}, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
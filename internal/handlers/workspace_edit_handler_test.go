@@ -0,0 +1,92 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/handlers"
+	"github.com/ollama/ollama/api"
+	"go.uber.org/zap"
+)
+
+func newWorkspaceEditHandler(t *testing.T, reply string) *handlers.WorkspaceEditHandler {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req api.ChatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode chat request: %v", err)
+			return
+		}
+		if req.Format != "json" {
+			t.Errorf("expected JSON mode, got format %q", req.Format)
+		}
+		_ = json.NewEncoder(w).Encode(api.ChatResponse{
+			Model:   req.Model,
+			Message: api.Message{Role: "assistant", Content: reply},
+			Done:    true,
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	t.Setenv("OLLAMA_HOST", srv.URL)
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handlers.NewWorkspaceEditHandler(client, func() string { return "editor" }, nil, zap.NewNop())
+}
+
+func TestWorkspaceEditHandler_ServeHTTP(t *testing.T) {
+	h := newWorkspaceEditHandler(t, `{"explanation":"rename","edits":[
+		{"path":"a.go","start_line":2,"end_line":2,"replacement":"func Bar() {}\n"},
+		{"path":"b.go","start_line":1,"end_line":1,"replacement":"var _ = Bar"},
+		{"path":"c.go","start_line":1,"end_line":1,"replacement":"x"},
+		{"path":"a.go","start_line":9,"end_line":9,"replacement":"x"}]}`)
+
+	body := `{"instruction":"rename Foo to Bar","files":[
+		{"path":"a.go","content":"package a\nfunc Foo() {}\n"},
+		{"path":"b.go","content":"var _ = Foo"}]}`
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1/workspace/edits", strings.NewReader(body)))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	var resp handlers.WorkspaceEditResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode workspace edit: %v", err)
+	}
+
+	if len(resp.Changes) != 2 {
+		t.Fatalf("expected edits to unknown files and lines to be dropped, got %+v", resp.Changes)
+	}
+	want := handlers.Range{Start: handlers.Position{Line: 1}, End: handlers.Position{Line: 2}}
+	if got := resp.Changes["a.go"]; len(got) != 1 || got[0].Range != want {
+		t.Errorf("expected a.go line 2 to be replaced, got %+v", got)
+	}
+	want = handlers.Range{End: handlers.Position{Character: 11}}
+	if got := resp.Changes["b.go"]; len(got) != 1 || got[0].Range != want {
+		t.Errorf("expected the edit to end on the last character of b.go, got %+v", got)
+	}
+}
+
+func TestWorkspaceEditHandler_Invalid(t *testing.T) {
+	h := newWorkspaceEditHandler(t, `not json`)
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1/workspace/edits", strings.NewReader(`{"instruction":""}`)))
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected status code %d, got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	body := `{"instruction":"fix","files":[{"path":"a.go","content":"package a\n"}]}`
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1/workspace/edits", strings.NewReader(body)))
+	if rr.Code != http.StatusBadGateway {
+		t.Errorf("expected status code %d for an unparseable reply, got %d", http.StatusBadGateway, rr.Code)
+	}
+}
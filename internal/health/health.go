@@ -0,0 +1,148 @@
+// Package health tracks what keeps completions from working, such as
+// Ollama being unreachable, so that /health and completion responses can
+// tell editor plugins to show it instead of users silently getting no
+// suggestions.
+package health
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Degradation states.
+const (
+	// BackendDown is set when Ollama refused a generation, until the next
+	// one succeeds.
+	BackendDown = "backend_down"
+	// OverQuota is set for a client out of its rate limit.
+	OverQuota = "over_quota"
+	// ModelLoading is set while a generation has waited long for its first
+	// token. Ollama sends nothing while it loads a model into memory.
+	ModelLoading = "model_loading"
+)
+
+// Header is the response header listing the degradation states, separated
+// by commas.
+const Header = "X-Degraded"
+
+// LoadingAfter is how long a generation of Default waits for its first
+// token before its model counts as loading.
+const LoadingAfter = 3 * time.Second
+
+// Condition is one degradation state.
+type Condition struct {
+	State string `json:"state"`
+	// Detail says what is degraded, such as the model being loaded.
+	Detail string    `json:"detail,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// Tracker keeps the degradation states of the server.
+type Tracker struct {
+	loadingAfter time.Duration
+
+	mu       sync.Mutex
+	failures map[string]Condition
+	waiting  map[*waiter]struct{}
+}
+
+// waiter is a generation waiting for its first token.
+type waiter struct {
+	model string
+	start time.Time
+}
+
+// NewTracker returns a tracker with nothing degraded, counting the model
+// of a generation as loading once it has waited for loadingAfter.
+func NewTracker(loadingAfter time.Duration) *Tracker {
+	return &Tracker{loadingAfter: loadingAfter, failures: map[string]Condition{}, waiting: map[*waiter]struct{}{}}
+}
+
+// Default is the tracker of the server.
+var Default = NewTracker(LoadingAfter)
+
+// Fail sets state with detail. A state that is already set keeps the time
+// it was first set.
+func (t *Tracker) Fail(state, detail string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	since := time.Now()
+	if c, ok := t.failures[state]; ok {
+		since = c.Since
+	}
+	t.failures[state] = Condition{State: state, Detail: detail, Since: since}
+}
+
+// Recover clears state.
+func (t *Tracker) Recover(state string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, state)
+}
+
+// Wait records a generation of model waiting for its first token until
+// done is called. Calling done more than once has no effect.
+func (t *Tracker) Wait(model string) (done func()) {
+	w := &waiter{model: model, start: time.Now()}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.waiting[w] = struct{}{}
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.waiting, w)
+	}
+}
+
+// Conditions returns the states set now, ordered by state. Each loading
+// model is a condition of its own.
+func (t *Tracker) Conditions() []Condition {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	conditions := make([]Condition, 0, len(t.failures))
+	for _, c := range t.failures {
+		conditions = append(conditions, c)
+	}
+	loading := map[string]time.Time{}
+	for w := range t.waiting {
+		if since, ok := loading[w.model]; time.Since(w.start) > t.loadingAfter && (!ok || w.start.Before(since)) {
+			loading[w.model] = w.start
+		}
+	}
+	for model, since := range loading {
+		conditions = append(conditions, Condition{State: ModelLoading, Detail: model, Since: since})
+	}
+	slices.SortFunc(conditions, func(a, b Condition) int {
+		return strings.Compare(a.State+"\x00"+a.Detail, b.State+"\x00"+b.Detail)
+	})
+	return conditions
+}
+
+// States returns the states of conditions without repeats, for Header.
+func States(conditions []Condition) string {
+	var states []string
+	for _, c := range conditions {
+		if !slices.Contains(states, c.State) {
+			states = append(states, c.State)
+		}
+	}
+	return strings.Join(states, ", ")
+}
+
+// Fail sets state on Default.
+func Fail(state, detail string) {
+	Default.Fail(state, detail)
+}
+
+// Recover clears state on Default.
+func Recover(state string) {
+	Default.Recover(state)
+}
+
+// Wait records a generation waiting for its first token on Default.
+func Wait(model string) (done func()) {
+	return Default.Wait(model)
+}
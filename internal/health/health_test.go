@@ -0,0 +1,48 @@
+package health_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/health"
+)
+
+func TestTracker_FailRecover(t *testing.T) {
+	tracker := health.NewTracker(time.Minute)
+	tracker.Fail(health.BackendDown, "first")
+	since := tracker.Conditions()[0].Since
+	tracker.Fail(health.BackendDown, "second")
+
+	got := tracker.Conditions()
+	if len(got) != 1 || got[0].Detail != "second" || !got[0].Since.Equal(since) {
+		t.Fatalf("expected one condition with the last detail and the first time, got %+v", got)
+	}
+	tracker.Recover(health.BackendDown)
+	if got := tracker.Conditions(); len(got) != 0 {
+		t.Errorf("expected nothing degraded after recovering, got %+v", got)
+	}
+}
+
+func TestTracker_Wait(t *testing.T) {
+	tracker := health.NewTracker(20 * time.Millisecond)
+	done := tracker.Wait("coder")
+	defer tracker.Wait("other")()
+	if got := tracker.Conditions(); len(got) != 0 {
+		t.Fatalf("expected a fresh generation not to count as loading, got %+v", got)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	got := tracker.Conditions()
+	if len(got) != 2 || got[0].State != health.ModelLoading || got[0].Detail != "coder" || got[1].Detail != "other" {
+		t.Fatalf("expected both models to be loading, got %+v", got)
+	}
+	if states := health.States(got); states != "model_loading" {
+		t.Errorf("expected the state once in the header, got %q", states)
+	}
+
+	done()
+	done()
+	if got := tracker.Conditions(); len(got) != 1 || got[0].Detail != "other" {
+		t.Errorf("expected only the other model to be loading, got %+v", got)
+	}
+}
@@ -0,0 +1,331 @@
+package internal_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal"
+	"github.com/josuemontano/ollama-copilot/internal/handlers"
+	"github.com/josuemontano/ollama-copilot/internal/ollamatest"
+	"github.com/ollama/ollama/api"
+)
+
+// startProxy serves the handler of server, against the Ollama server of the
+// last ollamatest.NewServer.
+func startProxy(t *testing.T, server *internal.Server) *httptest.Server {
+	t.Helper()
+
+	if server.Template == "" {
+		server.Template = "{{.Prefix}}<FILL>{{.Suffix}}"
+	}
+	if server.NumPredict == 0 {
+		server.NumPredict = 20
+	}
+	handler, err := server.Handler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// complete posts a completion request to the proxy and returns the text of
+// its events together and the events.
+func complete(t *testing.T, ctx context.Context, url, body string) (string, []handlers.CompletionResponse) {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/v1/engines/copilot-codex/completions", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var text strings.Builder
+	var events []handlers.CompletionResponse
+	for _, event := range strings.Split(string(raw), "\n\n") {
+		data, ok := strings.CutPrefix(strings.TrimSpace(event), "data: ")
+		if !ok {
+			continue
+		}
+		var e handlers.CompletionResponse
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			t.Fatalf("failed to decode event %q: %v", data, err)
+		}
+		events = append(events, e)
+		for _, choice := range e.Choices {
+			text.WriteString(choice.Text)
+		}
+	}
+	return text.String(), events
+}
+
+func TestIntegration_Streaming(t *testing.T) {
+	ollama := ollamatest.NewServer(t)
+	ollama.OnGenerate(func(req api.GenerateRequest) ollamatest.Reply {
+		return ollamatest.Reply{Chunks: []string{"compute", "(a, ", "b)"}, ChunkDelay: 10 * time.Millisecond}
+	})
+	proxy := startProxy(t, &internal.Server{Model: "coder", CompletionMode: "full"})
+
+	text, events := complete(t, context.Background(), proxy.URL, `{"prompt":"x := ","suffix":"\n","max_tokens":20}`)
+	if text != "compute(a, b)" {
+		t.Errorf("expected the whole completion, got %q", text)
+	}
+	if len(events) != 4 {
+		t.Errorf("expected one event per chunk and a final one, got %d", len(events))
+	}
+	for _, e := range events {
+		if e.Id != events[0].Id || e.Object != "text_completion" || e.Model != "coder" {
+			t.Errorf("expected every event to share the completion ID, object and model, got %+v", e)
+		}
+	}
+
+	generates := ollama.Generates()
+	if len(generates) != 1 || !strings.Contains(generates[0].Prompt, "x := <FILL>") {
+		t.Errorf("expected one generate request with the FIM prompt, got %+v", generates)
+	}
+}
+
+func TestIntegration_FallbackAfterTimeout(t *testing.T) {
+	ollama := ollamatest.NewServer(t)
+	ollama.OnGenerate(func(req api.GenerateRequest) ollamatest.Reply {
+		if req.Model == "slow" {
+			return ollamatest.Reply{Chunks: []string{"late"}, Delay: 5 * time.Second}
+		}
+		return ollamatest.Text("on time")
+	})
+	proxy := startProxy(t, &internal.Server{
+		Model:          "slow",
+		FallbackModel:  "fast",
+		FallbackAfter:  50 * time.Millisecond,
+		CompletionMode: "full",
+	})
+
+	text, events := complete(t, context.Background(), proxy.URL, `{"prompt":"x := ","suffix":"","max_tokens":20}`)
+	if text != "on time" || events[0].Model != "fast" {
+		t.Errorf("expected the fallback model to answer, got %q from %+v", text, events)
+	}
+	waitFor(t, func() bool { return ollama.Canceled() == 1 }, "expected the slow generation to be canceled")
+}
+
+func TestIntegration_ClientGoesAway(t *testing.T) {
+	ollama := ollamatest.NewServer(t)
+	ollama.OnGenerate(func(req api.GenerateRequest) ollamatest.Reply {
+		return ollamatest.Reply{Chunks: []string{"never"}, Delay: 5 * time.Second}
+	})
+	proxy := startProxy(t, &internal.Server{Model: "coder"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, proxy.URL+"/v1/engines/copilot-codex/completions", strings.NewReader(`{"prompt":"x := ","suffix":""}`))
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		_, _ = resp.Body.Read(make([]byte, 1))
+		resp.Body.Close()
+	}
+	waitFor(t, func() bool { return ollama.Canceled() == 1 }, "expected the generation to be canceled with the request")
+}
+
+func TestIntegration_Filters(t *testing.T) {
+	ollama := ollamatest.NewServer(t)
+	ollama.OnGenerate(func(req api.GenerateRequest) ollamatest.Reply {
+		return ollamatest.Text("a + b\n", "\treturn sum\n", "}")
+	})
+	proxy := startProxy(t, &internal.Server{Model: "coder", CompletionMode: "line"})
+	text, _ := complete(t, context.Background(), proxy.URL, `{"prompt":"func add(a, b int) int {\n\tsum := ","suffix":"\n\treturn sum\n}","max_tokens":20}`)
+	if text != "a + b" {
+		t.Errorf("expected the completion to end at the cursor line, got %q", text)
+	}
+
+	proxy = startProxy(t, &internal.Server{Model: "coder", CompletionMode: "full"})
+	text, events := complete(t, context.Background(), proxy.URL, `{"prompt":"func add(a, b int) int {\n\tsum := ","suffix":"\n\treturn sum\n}","max_tokens":20}`)
+	if text != "a + b" {
+		t.Errorf("expected the completion to stop where it repeats the suffix, got %q", text)
+	}
+	if last := events[len(events)-1]; last.Choices[0].FinishReason != "stop" {
+		t.Errorf("expected finish reason stop, got %q", last.Choices[0].FinishReason)
+	}
+}
+
+func TestIntegration_PanelStream(t *testing.T) {
+	ollama := ollamatest.NewServer(t)
+	ollama.OnGenerate(func(req api.GenerateRequest) ollamatest.Reply {
+		if req.Options["seed"].(float64) == 1 {
+			return ollamatest.Reply{Chunks: []string{"slow", "er"}, ChunkDelay: 200 * time.Millisecond}
+		}
+		return ollamatest.Text("fast")
+	})
+	proxy := startProxy(t, &internal.Server{Model: "coder", CompletionMode: "full"})
+
+	_, events := complete(t, context.Background(), proxy.URL, `{"prompt":"x := ","suffix":"","max_tokens":20,"n":2,"stream":true}`)
+	var order []string
+	for _, e := range events {
+		if choice := e.Choices[0]; choice.Text != "" {
+			order = append(order, fmt.Sprintf("%d:%s", choice.Index, choice.Text))
+		}
+	}
+	if fast, slow := slices.Index(order, "1:fast"), slices.Index(order, "0:er"); fast < 0 || slow < fast {
+		t.Errorf("expected the alternatives to be interleaved as they are generated, got %q", order)
+	}
+}
+
+func TestIntegration_Resume(t *testing.T) {
+	ollama := ollamatest.NewServer(t)
+	ollama.OnGenerate(func(req api.GenerateRequest) ollamatest.Reply {
+		return ollamatest.Reply{Chunks: []string{"a", "b", "c"}, ChunkDelay: 100 * time.Millisecond}
+	})
+	proxy := startProxy(t, &internal.Server{Model: "coder", CompletionMode: "full", ResumeWindow: time.Minute})
+	url := proxy.URL + "/v1/engines/copilot-codex/completions"
+	body := `{"prompt":"x := ","suffix":"","max_tokens":20}`
+
+	// Read the first event, then drop the connection.
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := bufio.NewReader(resp.Body).ReadString('}')
+	cancel()
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := resp.Header.Get(handlers.CompletionIDHeader)
+	if want := "id: " + id + "/1\ndata: "; !strings.HasPrefix(first, want) {
+		t.Fatalf("expected the first event to have id %s/1, got %q", id, first)
+	}
+
+	req, _ = http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	req.Header.Set(handlers.LastEventIDHeader, id+"/1")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var text strings.Builder
+	var ids []string
+	for _, event := range strings.Split(strings.TrimSpace(string(raw)), "\n\n\n") {
+		eventID, data, _ := strings.Cut(strings.TrimPrefix(event, "id: "), "\ndata: ")
+		ids = append(ids, eventID)
+		var e handlers.CompletionResponse
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			t.Fatalf("failed to decode event %q: %v", event, err)
+		}
+		text.WriteString(e.Choices[0].Text)
+	}
+	if text.String() != "bc" {
+		t.Errorf("expected the resumed stream to carry the rest of the completion, got %q", text.String())
+	}
+	if want := []string{id + "/2", id + "/3", id + "/4"}; !slices.Equal(ids, want) {
+		t.Errorf("expected event ids %q, got %q", want, ids)
+	}
+	if ollama.Canceled() != 0 || len(ollama.Generates()) != 1 {
+		t.Errorf("expected the generation to carry on without the client, got %d canceled of %d", ollama.Canceled(), len(ollama.Generates()))
+	}
+}
+
+func TestIntegration_ResumeAbandoned(t *testing.T) {
+	ollama := ollamatest.NewServer(t)
+	ollama.OnGenerate(func(req api.GenerateRequest) ollamatest.Reply {
+		return ollamatest.Reply{Chunks: []string{"never"}, Delay: 5 * time.Second}
+	})
+	proxy := startProxy(t, &internal.Server{Model: "coder", ResumeWindow: 50 * time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, proxy.URL+"/v1/engines/copilot-codex/completions", strings.NewReader(`{"prompt":"x := ","suffix":""}`))
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		_, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	waitFor(t, func() bool { return ollama.Canceled() == 1 }, "expected the generation to be canceled once nobody resumed it")
+}
+
+func TestIntegration_Failure(t *testing.T) {
+	ollama := ollamatest.NewServer(t)
+	ollama.OnGenerate(func(req api.GenerateRequest) ollamatest.Reply {
+		return ollamatest.Failure(http.StatusNotFound, "model 'coder' not found")
+	})
+	proxy := startProxy(t, &internal.Server{Model: "coder"})
+
+	_, events := complete(t, context.Background(), proxy.URL, `{"prompt":"x := ","suffix":""}`)
+	if len(events) != 1 || events[0].Error == nil || events[0].Choices[0].FinishReason != "error" {
+		t.Errorf("expected a single error event, got %+v", events)
+	}
+}
+
+func TestIntegration_Chat(t *testing.T) {
+	ollama := ollamatest.NewServer(t)
+	ollama.OnChat(func(req api.ChatRequest) ollamatest.Reply {
+		return ollamatest.Text("Use ", "a map.")
+	})
+	proxy := startProxy(t, &internal.Server{Model: "coder"})
+
+	resp, err := http.Post(proxy.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"messages":[{"role":"user","content":"How do I count words?"}],"stream":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var content strings.Builder
+	for _, event := range strings.Split(string(body), "\n\n") {
+		data, ok := strings.CutPrefix(strings.TrimSpace(event), "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk handlers.ChatResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("failed to decode chunk %q: %v", data, err)
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta != nil {
+				content.WriteString(choice.Delta.Content)
+			}
+		}
+	}
+	if content.String() != "Use a map." {
+		t.Errorf("expected the streamed answer, got %q", content.String())
+	}
+	if chats := ollama.Chats(); len(chats) != 1 || chats[0].Messages[len(chats[0].Messages)-1].Content != "How do I count words?" {
+		t.Errorf("expected the question to reach Ollama, got %+v", chats)
+	}
+}
+
+// waitFor fails t with message unless cond becomes true within a second.
+func waitFor(t *testing.T, cond func() bool, message string) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
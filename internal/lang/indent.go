@@ -0,0 +1,37 @@
+package lang
+
+import "strconv"
+
+// indents are the indentation of languages whose formatters or style
+// guides agree on one, as "tabs" or a number of spaces.
+var indents = map[string]string{
+	"csharp":   "4",
+	"dart":     "2",
+	"elixir":   "2",
+	"go":       "tabs",
+	"java":     "4",
+	"kotlin":   "4",
+	"makefile": "tabs",
+	"php":      "4",
+	"python":   "4",
+	"ruby":     "2",
+	"rust":     "4",
+	"swift":    "4",
+	"yaml":     "2",
+}
+
+// DefaultIndent returns the conventional indentation of language, used
+// when the file being completed shows none, or "" when it has none.
+func DefaultIndent(language string) string {
+	return indents[language]
+}
+
+// validIndent reports whether s is an indent param.
+func validIndent(s string) bool {
+	switch s {
+	case "", "tabs", "keep":
+		return true
+	}
+	width, err := strconv.Atoi(s)
+	return err == nil && width >= 1 && width <= 8
+}
@@ -0,0 +1,174 @@
+// Package lang infers the language of the document being completed when the
+// client does not report one. Languages are named with the VS Code language
+// identifiers that Copilot clients send in Extra.Language.
+package lang
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// byExtension maps lower-case file extensions to language identifiers.
+var byExtension = map[string]string{
+	".c":      "c",
+	".h":      "c",
+	".cc":     "cpp",
+	".cpp":    "cpp",
+	".cxx":    "cpp",
+	".hpp":    "cpp",
+	".cs":     "csharp",
+	".css":    "css",
+	".dart":   "dart",
+	".ex":     "elixir",
+	".exs":    "elixir",
+	".go":     "go",
+	".hs":     "haskell",
+	".html":   "html",
+	".htm":    "html",
+	".java":   "java",
+	".js":     "javascript",
+	".mjs":    "javascript",
+	".cjs":    "javascript",
+	".jsx":    "javascriptreact",
+	".json":   "json",
+	".kt":     "kotlin",
+	".kts":    "kotlin",
+	".lua":    "lua",
+	".md":     "markdown",
+	".php":    "php",
+	".pl":     "perl",
+	".py":     "python",
+	".r":      "r",
+	".rb":     "ruby",
+	".rs":     "rust",
+	".scala":  "scala",
+	".scss":   "scss",
+	".sh":     "shellscript",
+	".bash":   "shellscript",
+	".zsh":    "shellscript",
+	".sql":    "sql",
+	".svelte": "svelte",
+	".swift":  "swift",
+	".tf":     "terraform",
+	".toml":   "toml",
+	".ts":     "typescript",
+	".tsx":    "typescriptreact",
+	".vue":    "vue",
+	".xml":    "xml",
+	".yaml":   "yaml",
+	".yml":    "yaml",
+	".zig":    "zig",
+}
+
+// byFilename maps well-known file names without a useful extension.
+var byFilename = map[string]string{
+	"dockerfile":  "dockerfile",
+	"makefile":    "makefile",
+	"gnumakefile": "makefile",
+	"gemfile":     "ruby",
+	"rakefile":    "ruby",
+}
+
+// pathComment matches the comment Copilot clients prepend to the prompt to
+// name the file, e.g. "// Path: main.go" or "<!-- filepath: index.html -->".
+var pathComment = regexp.MustCompile(`(?i)^\s*(?://|#|--|;|/\*|<!--)\s*(?:path|filepath|file):\s*(\S+)`)
+
+// contentHints are checked in order against the start of the prompt when no
+// path is available.
+var contentHints = []struct {
+	pattern  *regexp.Regexp
+	language string
+}{
+	{regexp.MustCompile(`^#!.*\b(?:ba|z)?sh\b`), "shellscript"},
+	{regexp.MustCompile(`^#!.*\bpython`), "python"},
+	{regexp.MustCompile(`^#!.*\bnode\b`), "javascript"},
+	{regexp.MustCompile(`(?m)^\s*<\?php`), "php"},
+	{regexp.MustCompile(`(?im)^\s*<!doctype html|^\s*<html`), "html"},
+	{regexp.MustCompile(`(?m)^package \w+\s*$`), "go"},
+	{regexp.MustCompile(`(?m)^\s*(?:pub\s+)?fn \w+|^\s*use \w+::`), "rust"},
+	{regexp.MustCompile(`(?m)^\s*(?:def \w+\(.*\)\s*(?:->.*)?:|from \w[\w.]* import |import \w[\w.]*\s*$)`), "python"},
+	{regexp.MustCompile(`(?m)^\s*(?:interface \w+ \{|type \w+ = )|:\s*(?:string|number|boolean)\b`), "typescript"},
+	{regexp.MustCompile(`(?m)^\s*(?:const|let|var) \w+ = |^\s*(?:import .* from ['"]|module\.exports)`), "javascript"},
+	{regexp.MustCompile(`(?m)^\s*#include\s*[<"]`), "cpp"},
+	{regexp.MustCompile(`(?m)^\s*(?:public |private )?(?:class|interface) \w+.*\{`), "java"},
+	{regexp.MustCompile(`(?im)^\s*(?:select|insert|update|delete|create table)\b`), "sql"},
+}
+
+// hintLines bounds how much of the prompt the content heuristics look at.
+const hintLines = 40
+
+// Infer returns the language of the document whose text before the cursor is
+// prompt. It prefers a path comment, then content heuristics, and returns
+// fallback if neither is conclusive.
+func Infer(prompt, fallback string) string {
+	if language := FromPath(PathFromPrompt(prompt)); language != "" {
+		return language
+	}
+	if language := fromContent(prompt); language != "" {
+		return language
+	}
+	return fallback
+}
+
+// PathFromPrompt returns the file path named in a leading path comment of
+// prompt, or "" if there is none.
+func PathFromPrompt(prompt string) string {
+	for i, line := range strings.SplitN(prompt, "\n", 4) {
+		if i == 3 {
+			break
+		}
+		if m := pathComment.FindStringSubmatch(line); m != nil {
+			return strings.TrimSuffix(m[1], "-->")
+		}
+	}
+	return ""
+}
+
+// PathFromURI returns the file path of a document URI as LSP clients send
+// it, such as file:///home/me/main.go, or "" if it names none. Documents
+// not saved yet, such as untitled:Untitled-1, have their name as path.
+func PathFromURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme == "" {
+		return ""
+	}
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+	p := u.Path
+	// Windows drive letters come as /c:/Users/me/main.go.
+	if len(p) > 2 && p[0] == '/' && p[2] == ':' {
+		p = p[1:]
+	}
+	return p
+}
+
+// FromPath returns the language for a file path, or "" if it is unknown.
+func FromPath(p string) string {
+	if p == "" {
+		return ""
+	}
+	p = strings.ReplaceAll(p, "\\", "/")
+
+	base := strings.ToLower(path.Base(p))
+	if language, ok := byFilename[base]; ok {
+		return language
+	}
+	return byExtension[path.Ext(base)]
+}
+
+func fromContent(prompt string) string {
+	head := prompt
+	if lines := strings.SplitN(prompt, "\n", hintLines+1); len(lines) > hintLines {
+		head = strings.Join(lines[:hintLines], "\n")
+	}
+
+	for _, hint := range contentHints {
+		if hint.pattern.MatchString(head) {
+			return hint.language
+		}
+	}
+	return ""
+}
@@ -0,0 +1,88 @@
+package lang_test
+
+import (
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/lang"
+)
+
+func TestInfer(t *testing.T) {
+	tests := []struct {
+		name   string
+		prompt string
+		want   string
+	}{
+		{"go path comment", "// Path: cmd/server/main.go\npackage main\n", "go"},
+		{"python path comment", "# Path: app/models.py\nclass User:\n", "python"},
+		{"html filepath comment", "<!-- filepath: web/index.html -->\n<div>", "html"},
+		{"windows path", "// Path: C:\\src\\App.tsx\n", "typescriptreact"},
+		{"dockerfile", "# Path: build/Dockerfile\nFROM golang\n", "dockerfile"},
+		{"path wins over content", "// Path: util.js\npackage main\n", "javascript"},
+		{"go content", "package handlers\n\nimport \"fmt\"\n", "go"},
+		{"python content", "import os\n\ndef main():\n    ", "python"},
+		{"shebang", "#!/usr/bin/env bash\nset -e\n", "shellscript"},
+		{"rust content", "use std::io;\n\nfn main() {\n", "rust"},
+		{"unknown", "lorem ipsum dolor sit amet", "plaintext"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lang.Infer(tt.prompt, "plaintext"); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFromPath(t *testing.T) {
+	if got := lang.FromPath("Makefile"); got != "makefile" {
+		t.Errorf("expected makefile, got %q", got)
+	}
+	if got := lang.FromPath("notes.unknown"); got != "" {
+		t.Errorf("expected no language for an unknown extension, got %q", got)
+	}
+}
+
+func TestPathFromURI(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"file:///home/me/src/main.go", "/home/me/src/main.go"},
+		{"file:///c%3A/Users/me/main.py", "c:/Users/me/main.py"},
+		{"file:///home/me/my%20app/index.ts", "/home/me/my app/index.ts"},
+		{"untitled:Untitled-1", "Untitled-1"},
+		{"not a uri", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := lang.PathFromURI(tt.uri); got != tt.want {
+			t.Errorf("%q: expected %q, got %q", tt.uri, tt.want, got)
+		}
+	}
+}
+
+func TestIsTest(t *testing.T) {
+	tests := []struct {
+		path     string
+		language string
+		patterns []string
+		want     bool
+	}{
+		{"internal/calc/calc_test.go", "go", nil, true},
+		{"internal/calc/calc.go", "go", nil, false},
+		{"tests/test_calc.py", "python", nil, true},
+		{"src/calc.spec.ts", "typescript", nil, true},
+		{"src/__tests__/calc.js", "javascript", nil, true},
+		{`src\test\java\CalcTest.java`, "java", nil, true},
+		{"spec/calc_check.rb", "ruby", []string{"*_check.rb"}, true},
+		{"spec/calc_spec.rb", "ruby", []string{"*_check.rb"}, false},
+		{"tests/test_calc.py", "python", []string{}, false},
+		{"", "go", nil, false},
+	}
+	for _, tt := range tests {
+		if got := lang.IsTest(tt.path, tt.language, tt.patterns); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.path, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package lang
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+)
+
+// Params are generation settings for one language. Zero values leave the
+// server or client setting untouched.
+type Params struct {
+	// Model is the Ollama model completions in the language are sent to,
+	// in place of the configured and mapped ones.
+	Model       string   `json:"model,omitempty"`
+	NumPredict  int      `json:"num_predict,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	// Stop replaces the default stop sequences of the language, which end
+	// a completion before the next top-level declaration. The client's
+	// and the server's stop sequences apply as well. An empty list
+	// disables the defaults.
+	Stop []string `json:"stop,omitempty"`
+	// SingleLine stops generation at the end of the current line.
+	SingleLine bool `json:"single_line,omitempty"`
+	// Suppress lists the heuristics that skip completions unlikely to
+	// help. Unset uses DefaultSuppress; an empty list disables them.
+	Suppress []string `json:"suppress,omitempty"`
+	// TestPatterns are the base name globs of test files, where
+	// completions get a testing prompt and TestStop. Unset uses the
+	// language's defaults; an empty list disables test files.
+	TestPatterns []string `json:"test_patterns,omitempty"`
+	// TestStop replaces the default stop sequences of test files, which
+	// end a completion before the next test case starts.
+	TestStop []string `json:"test_stop,omitempty"`
+	// Indent is the indentation completions are rewritten to: "tabs" or a
+	// number of spaces. Unset detects it from the file, falling back to
+	// DefaultIndent; "keep" leaves the model's indentation alone.
+	Indent string `json:"indent,omitempty"`
+}
+
+// Table maps language identifiers to their Params. The "*" entry applies to
+// any language without its own entry.
+type Table map[string]Params
+
+// LoadTable reads a JSON object of language identifiers to Params.
+func LoadTable(file string) (Table, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading language params: %w", err)
+	}
+
+	var table Table
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("parsing language params %s: %w", file, err)
+	}
+
+	for language, params := range table {
+		if params.NumPredict < 0 {
+			return nil, fmt.Errorf("language params %q: num_predict must not be negative", language)
+		}
+		if err := ValidateSuppress(params.Suppress); err != nil {
+			return nil, fmt.Errorf("language params %q: %w", language, err)
+		}
+		if !validIndent(params.Indent) {
+			return nil, fmt.Errorf("language params %q: indent %q must be tabs, keep or a number of spaces from 1 to 8", language, params.Indent)
+		}
+		for _, pattern := range params.TestPatterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("language params %q: test pattern %q: %w", language, pattern, err)
+			}
+		}
+	}
+
+	return table, nil
+}
+
+// Lookup returns the Params for language, falling back to the "*" entry.
+func (t Table) Lookup(language string) (Params, bool) {
+	if params, ok := t[language]; ok {
+		return params, true
+	}
+	params, ok := t["*"]
+	return params, ok
+}
@@ -0,0 +1,36 @@
+package lang
+
+// blankLines ends a completion at two blank lines in a row, which separate
+// top-level declarations in most styles.
+const blankLines = "\n\n\n"
+
+// stops end a completion before the model goes on to the next top-level
+// declaration, so that completing a function does not write another one
+// after it. Stops start with a newline and match at column 0 only, so that
+// nested declarations, such as methods, are not cut.
+var stops = map[string][]string{
+	"c":               {blankLines},
+	"cpp":             {blankLines},
+	"csharp":          {blankLines},
+	"go":              {blankLines, "\nfunc ", "\ntype "},
+	"html":            {"</script>", "</style>"},
+	"java":            {blankLines},
+	"javascript":      {blankLines, "\nfunction ", "\nexport ", "\nclass "},
+	"javascriptreact": {blankLines, "\nfunction ", "\nexport ", "\nclass "},
+	"kotlin":          {blankLines, "\nfun ", "\nclass "},
+	"php":             {blankLines, "\nfunction "},
+	"python":          {blankLines, "\ndef ", "\nclass ", "\nif __name__"},
+	"ruby":            {blankLines, "\ndef ", "\nclass ", "\nmodule "},
+	"rust":            {blankLines, "\nfn ", "\npub fn ", "\nimpl "},
+	"svelte":          {"</script>", "</style>"},
+	"swift":           {blankLines, "\nfunc ", "\nclass ", "\nstruct "},
+	"typescript":      {blankLines, "\nfunction ", "\nexport ", "\nclass "},
+	"typescriptreact": {blankLines, "\nfunction ", "\nexport ", "\nclass "},
+	"vue":             {"</script>", "</style>", "</template>"},
+}
+
+// DefaultStop returns the stop sequences completions in language end at,
+// unless its Params set their own.
+func DefaultStop(language string) []string {
+	return stops[language]
+}
@@ -0,0 +1,266 @@
+package lang
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Heuristics for positions where a completion is unlikely to help. Each can
+// be enabled per language with the "suppress" language param.
+const (
+	// SuppressLockFile skips generated dependency lock files.
+	SuppressLockFile = "lock_file"
+	// SuppressCommentsOnly skips comment lines in files with no code, such
+	// as license headers and prose notes.
+	SuppressCommentsOnly = "comments_only"
+	// SuppressWhitespace skips a cursor with whitespace on both sides, in
+	// the middle of a run of spaces or tabs.
+	SuppressWhitespace = "whitespace"
+	// SuppressBinary skips documents that are not text, with control
+	// characters or invalid UTF-8, or mostly non-ASCII outside prose.
+	SuppressBinary = "binary"
+	// SuppressMinified skips minified files, named like app.min.js or
+	// made of a few very long lines.
+	SuppressMinified = "minified"
+	// SuppressGenerated skips files whose header says they are generated
+	// and must not be edited.
+	SuppressGenerated = "generated"
+)
+
+// Thresholds of the content heuristics, measured on the prompt and suffix
+// near the cursor.
+const (
+	// sampleSize is how much text before and after the cursor is looked
+	// at.
+	sampleSize = 16 << 10
+	// binaryRatio is the share of control characters and invalid UTF-8
+	// that makes a document binary, and nonASCIIRatio the share of
+	// non-ASCII characters, in languages other than prose.
+	binaryRatio   = 0.05
+	nonASCIIRatio = 0.5
+	// A document is minified when its lines average more than
+	// minifiedLineLen bytes over at least minifiedSample bytes.
+	minifiedLineLen = 300
+	minifiedSample  = 2 << 10
+)
+
+// DefaultSuppress are the heuristics applied to languages whose params do
+// not list their own.
+var DefaultSuppress = []string{SuppressLockFile, SuppressCommentsOnly, SuppressWhitespace, SuppressBinary, SuppressMinified, SuppressGenerated}
+
+var suppressions = map[string]bool{
+	SuppressLockFile:     true,
+	SuppressCommentsOnly: true,
+	SuppressWhitespace:   true,
+	SuppressBinary:       true,
+	SuppressMinified:     true,
+	SuppressGenerated:    true,
+}
+
+// proseLanguages are written in natural language, where most characters
+// may rightly be non-ASCII.
+var proseLanguages = map[string]bool{"markdown": true, "plaintext": true, "latex": true, "restructuredtext": true}
+
+// generatedHeader matches the comment of files generated by tools, such as
+// Go's "Code generated ... DO NOT EDIT." and the @generated marker.
+var generatedHeader = regexp.MustCompile(`(?i)^\W*(?:code )?generated .*\bdo not edit\b|@generated\b`)
+
+// lockFiles are lock files whose names do not end in ".lock".
+var lockFiles = map[string]bool{
+	"go.sum":              true,
+	"package-lock.json":   true,
+	"pnpm-lock.yaml":      true,
+	"npm-shrinkwrap.json": true,
+}
+
+var cLikeComments = []string{"//", "/*", "*", "*/"}
+
+// lineComments maps languages to the prefixes that start a comment line.
+var lineComments = map[string][]string{
+	"c":               cLikeComments,
+	"cpp":             cLikeComments,
+	"csharp":          cLikeComments,
+	"css":             {"/*", "*", "*/"},
+	"dart":            cLikeComments,
+	"dockerfile":      {"#"},
+	"elixir":          {"#"},
+	"go":              cLikeComments,
+	"haskell":         {"--"},
+	"java":            cLikeComments,
+	"javascript":      cLikeComments,
+	"javascriptreact": cLikeComments,
+	"kotlin":          cLikeComments,
+	"lua":             {"--"},
+	"makefile":        {"#"},
+	"perl":            {"#"},
+	"php":             append([]string{"#"}, cLikeComments...),
+	"python":          {"#"},
+	"r":               {"#"},
+	"ruby":            {"#"},
+	"rust":            cLikeComments,
+	"scala":           cLikeComments,
+	"scss":            cLikeComments,
+	"shellscript":     {"#"},
+	"sql":             {"--"},
+	"swift":           cLikeComments,
+	"terraform":       {"#", "//"},
+	"toml":            {"#"},
+	"typescript":      cLikeComments,
+	"typescriptreact": cLikeComments,
+	"yaml":            {"#"},
+	"zig":             {"//"},
+}
+
+// Suppress returns the first of heuristics that applies to a cursor between
+// prompt and suffix in the file at filePath, or "" if the completion should
+// go ahead.
+func Suppress(prompt, suffix, filePath, language string, heuristics []string) string {
+	for _, h := range heuristics {
+		var applies bool
+		switch h {
+		case SuppressLockFile:
+			applies = isLockFile(filePath)
+		case SuppressCommentsOnly:
+			applies = isCommentsOnly(prompt, suffix, language)
+		case SuppressWhitespace:
+			applies = isWhitespace(prompt, suffix)
+		case SuppressBinary:
+			applies = isBinary(sample(prompt, suffix), language)
+		case SuppressMinified:
+			applies = isMinified(filePath, sample(prompt, suffix))
+		case SuppressGenerated:
+			applies = isGenerated(prompt)
+		}
+		if applies {
+			return h
+		}
+	}
+	return ""
+}
+
+// ValidateSuppress reports an unknown heuristic name.
+func ValidateSuppress(heuristics []string) error {
+	for _, h := range heuristics {
+		if !suppressions[h] {
+			return fmt.Errorf("unknown suppress heuristic %q", h)
+		}
+	}
+	return nil
+}
+
+func isLockFile(p string) bool {
+	if p == "" {
+		return false
+	}
+	base := strings.ToLower(path.Base(strings.ReplaceAll(p, "\\", "/")))
+	return lockFiles[base] || path.Ext(base) == ".lock"
+}
+
+// isCommentsOnly reports whether every non-blank line of the document is a
+// comment and the cursor is on one of them. A blank line after comments is
+// left alone, since that is where comment-driven generation starts.
+func isCommentsOnly(prompt, suffix, language string) bool {
+	prefixes, ok := lineComments[language]
+	if !ok {
+		return false
+	}
+
+	current := prompt[strings.LastIndex(prompt, "\n")+1:]
+	if i := strings.Index(suffix, "\n"); i >= 0 {
+		current += suffix[:i]
+	} else {
+		current += suffix
+	}
+	if strings.TrimSpace(current) == "" {
+		return false
+	}
+
+	for _, line := range strings.Split(prompt+suffix, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !hasAnyPrefix(line, prefixes) {
+			return false
+		}
+	}
+	return true
+}
+
+func isWhitespace(prompt, suffix string) bool {
+	return prompt != "" && suffix != "" &&
+		strings.ContainsAny(prompt[len(prompt)-1:], " \t") &&
+		strings.ContainsAny(suffix[:1], " \t")
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sample returns the text around the cursor the content heuristics look
+// at, at most sampleSize bytes on each side.
+func sample(prompt, suffix string) string {
+	if len(prompt) > sampleSize {
+		prompt = prompt[len(prompt)-sampleSize:]
+	}
+	if len(suffix) > sampleSize {
+		suffix = suffix[:sampleSize]
+	}
+	return prompt + suffix
+}
+
+// isBinary reports whether text has too many control characters or bytes
+// that are not UTF-8 to be source code, or, outside prose, too many
+// non-ASCII characters.
+func isBinary(text, language string) bool {
+	if text == "" {
+		return false
+	}
+	var invalid, nonASCII, total int
+	for _, r := range text {
+		total++
+		switch {
+		case r == utf8.RuneError || r < 0x20 && r != '\n' && r != '\t' && r != '\r' || r == 0x7f:
+			invalid++
+		case r > unicode.MaxASCII:
+			nonASCII++
+		}
+	}
+	if float64(invalid)/float64(total) > binaryRatio {
+		return true
+	}
+	return !proseLanguages[language] && float64(nonASCII)/float64(total) > nonASCIIRatio
+}
+
+// isMinified reports whether the file at p is named like a minified file or
+// text is made of lines too long for code written by hand.
+func isMinified(p, text string) bool {
+	base := strings.ToLower(path.Base(strings.ReplaceAll(p, "\\", "/")))
+	if strings.Contains(base, ".min.") || strings.HasSuffix(base, ".map") {
+		return true
+	}
+	if len(text) < minifiedSample {
+		return false
+	}
+	return len(text)/(strings.Count(text, "\n")+1) > minifiedLineLen
+}
+
+// isGenerated reports whether one of the first lines of prompt says the
+// file is generated.
+func isGenerated(prompt string) bool {
+	for i, line := range strings.SplitN(prompt, "\n", 11) {
+		if i == 10 {
+			break
+		}
+		if generatedHeader.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
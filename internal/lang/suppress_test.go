@@ -0,0 +1,54 @@
+package lang_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/lang"
+)
+
+func TestSuppress(t *testing.T) {
+	tests := []struct {
+		name     string
+		prompt   string
+		suffix   string
+		path     string
+		language string
+		want     string
+	}{
+		{"lock file", "", "", "web/yarn.lock", "yaml", lang.SuppressLockFile},
+		{"go.sum", "github.com/x/y v1.0.0 ", "", "go.sum", "", lang.SuppressLockFile},
+		{"license header", "// Copyright 2024\n// Licensed under ", "", "", "go", lang.SuppressCommentsOnly},
+		{"blank line after comments", "# adds two numbers\n", "", "", "python", ""},
+		{"comments then code", "// Package a\npackage a\n// Foo ", "", "", "go", ""},
+		{"unknown language", "// note ", "", "", "plaintext", ""},
+		{"inside whitespace", "x :=    ", "    1", "", "go", lang.SuppressWhitespace},
+		{"after whitespace", "x := ", "", "", "go", ""},
+		{"ordinary code", "func main() {\n\t", "\n}", "main.go", "go", ""},
+		{"binary", "PK\x03\x04\x14\x00\x00\x00\x08\x00", "", "", "", lang.SuppressBinary},
+		{"invalid utf-8", "x = \xff\xfe\xfd\xfc", "", "", "python", lang.SuppressBinary},
+		{"mostly non-ascii", "x = 'данные данные данные данные'", "", "", "python", lang.SuppressBinary},
+		{"non-ascii prose", "Все данные здесь", "", "notes.md", "markdown", ""},
+		{"minified name", "!function(e){", "", "dist/app.min.js", "javascript", lang.SuppressMinified},
+		{"minified content", strings.Repeat("var a=1;", 500), "", "dist/app.js", "javascript", lang.SuppressMinified},
+		{"generated", "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n", "", "api.pb.go", "go", lang.SuppressGenerated},
+		{"mentions generation", "// generated returns the next id.\nfunc generated() int {\n\t", "\n}", "id.go", "go", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lang.Suppress(tt.prompt, tt.suffix, tt.path, tt.language, lang.DefaultSuppress); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSuppress_Disabled(t *testing.T) {
+	if got := lang.Suppress("", "", "Cargo.lock", "toml", nil); got != "" {
+		t.Errorf("expected no suppression without heuristics, got %q", got)
+	}
+	if err := lang.ValidateSuppress([]string{"lock_file", "tabs"}); err == nil {
+		t.Error("expected an error for an unknown heuristic")
+	}
+}
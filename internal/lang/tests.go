@@ -0,0 +1,75 @@
+package lang
+
+import (
+	"path"
+	"strings"
+)
+
+// testPatterns are the base name globs of each language's test files.
+var testPatterns = map[string][]string{
+	"csharp":          {"*Test.cs", "*Tests.cs"},
+	"dart":            {"*_test.dart"},
+	"elixir":          {"*_test.exs"},
+	"go":              {"*_test.go"},
+	"java":            {"*Test.java", "*Tests.java", "*IT.java"},
+	"javascript":      {"*.test.js", "*.spec.js", "*.test.mjs", "*.spec.mjs"},
+	"javascriptreact": {"*.test.jsx", "*.spec.jsx"},
+	"kotlin":          {"*Test.kt", "*Tests.kt"},
+	"php":             {"*Test.php"},
+	"python":          {"test_*.py", "*_test.py"},
+	"ruby":            {"*_spec.rb", "*_test.rb", "test_*.rb"},
+	"scala":           {"*Spec.scala", "*Test.scala", "*Suite.scala"},
+	"swift":           {"*Tests.swift"},
+	"typescript":      {"*.test.ts", "*.spec.ts"},
+	"typescriptreact": {"*.test.tsx", "*.spec.tsx"},
+}
+
+// testStops end a completion in a test file before it starts the next
+// test, so that suggestions fill in one test case at a time.
+var testStops = map[string][]string{
+	"csharp":          {"\n    [Fact]", "\n    [Test]", "\n    [TestMethod]"},
+	"dart":            {"\n  test(", "\n  group("},
+	"elixir":          {"\n  test ", "\n  describe "},
+	"go":              {"\nfunc Test", "\nfunc Benchmark", "\nfunc Fuzz"},
+	"java":            {"\n    @Test"},
+	"javascript":      {"\ntest(", "\nit(", "\ndescribe(", "\n  test(", "\n  it("},
+	"javascriptreact": {"\ntest(", "\nit(", "\ndescribe(", "\n  test(", "\n  it("},
+	"kotlin":          {"\n    @Test"},
+	"php":             {"\n    public function test"},
+	"python":          {"\ndef test_", "\n    def test_", "\nclass Test"},
+	"ruby":            {"\n  it ", "\n  def test_", "\n  describe "},
+	"scala":           {"\n  test(", "\n  it should"},
+	"swift":           {"\n    func test"},
+	"typescript":      {"\ntest(", "\nit(", "\ndescribe(", "\n  test(", "\n  it("},
+	"typescriptreact": {"\ntest(", "\nit(", "\ndescribe(", "\n  test(", "\n  it("},
+}
+
+// IsTest reports whether the file at p is a test file of language. Its
+// base name is matched against patterns or, when nil, the language's
+// defaults. Files under a __tests__ directory are tests in any language.
+func IsTest(p, language string, patterns []string) bool {
+	if p == "" {
+		return false
+	}
+	p = strings.ReplaceAll(p, "\\", "/")
+	if patterns == nil {
+		if strings.Contains("/"+p, "/__tests__/") {
+			return true
+		}
+		patterns = testPatterns[language]
+	}
+
+	base := path.Base(p)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// TestStop returns the default stop sequences of completions in test files
+// of language.
+func TestStop(language string) []string {
+	return testStops[language]
+}
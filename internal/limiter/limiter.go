@@ -0,0 +1,214 @@
+// Package limiter bounds how many generations run against Ollama at once.
+package limiter
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// window is the number of recent time-to-first-token samples the limiter
+// considers when deciding whether the backend is overloaded.
+const window = 16
+
+// ErrQueueFull is returned by Acquire when the queue of waiting requests is
+// at its maximum.
+var ErrQueueFull = errors.New("too many requests waiting for a generation slot")
+
+// Limiter is a concurrency limit that adapts to observed time to first token
+// (TTFT) using additive increase, multiplicative decrease: the limit grows by
+// one slot after a full round of fast, saturated requests and halves when the
+// rolling median TTFT rises above the target. A zero target keeps the limit
+// fixed at its maximum.
+type Limiter struct {
+	mu        sync.Mutex
+	min       int
+	max       int
+	limit     int
+	inFlight  int
+	target    time.Duration
+	samples   []time.Duration
+	fast      int
+	saturated bool
+	waiters   []chan struct{}
+	maxQueue  int
+	logger    *zap.Logger
+}
+
+// New returns a Limiter allowing between minLimit and maxLimit concurrent
+// generations. When target is zero the limit stays at maxLimit. Limit
+// changes are logged to logger unless it is nil.
+func New(minLimit, maxLimit int, target time.Duration, logger *zap.Logger) *Limiter {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	if maxLimit < 1 {
+		maxLimit = 1
+	}
+	if minLimit < 1 || minLimit > maxLimit {
+		minLimit = 1
+	}
+
+	limit := maxLimit
+	if target > 0 {
+		limit = minLimit
+	}
+
+	return &Limiter{
+		min:    minLimit,
+		max:    maxLimit,
+		limit:  limit,
+		target: target,
+		logger: logger,
+	}
+}
+
+// SetMaxQueue bounds the number of requests waiting for a slot to n, zero
+// for no bound.
+func (l *Limiter) SetMaxQueue(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxQueue = max(n, 0)
+}
+
+// Acquire blocks until a generation slot is free or ctx is done. It returns
+// ErrQueueFull right away when no slot is free and the queue is full. Every
+// successful Acquire must be paired with a call to Release.
+func (l *Limiter) Acquire(ctx context.Context) error {
+	l.mu.Lock()
+	if l.inFlight < l.limit && len(l.waiters) == 0 {
+		l.inFlight++
+		l.saturated = l.saturated || l.inFlight == l.limit
+		l.mu.Unlock()
+		return nil
+	}
+	if l.maxQueue > 0 && len(l.waiters) >= l.maxQueue {
+		l.saturated = true
+		l.mu.Unlock()
+		return ErrQueueFull
+	}
+
+	ready := make(chan struct{})
+	l.waiters = append(l.waiters, ready)
+	l.saturated = true
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		select {
+		case <-ready:
+			// The slot was handed over while we were giving up; pass it on.
+			l.inFlight--
+			l.wake()
+		default:
+			l.waiters = slices.DeleteFunc(l.waiters, func(c chan struct{}) bool { return c == ready })
+		}
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot obtained with Acquire.
+func (l *Limiter) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	l.wake()
+}
+
+// Observe records the time to first token of a completed generation and
+// adjusts the limit.
+func (l *Limiter) Observe(ttft time.Duration) {
+	if l.target <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.samples = append(l.samples, ttft)
+	if len(l.samples) > window {
+		l.samples = l.samples[len(l.samples)-window:]
+	}
+
+	if median(l.samples) > l.target {
+		l.fast = 0
+		l.saturated = false
+		if l.limit > l.min {
+			l.setLimit(max(l.min, l.limit/2))
+			// Start from a clean window so one slow burst only halves once.
+			l.samples = l.samples[:0]
+		}
+		return
+	}
+
+	l.fast++
+	if l.fast >= l.limit && l.saturated && l.limit < l.max {
+		l.fast = 0
+		l.saturated = false
+		l.setLimit(l.limit + 1)
+		l.wake()
+	}
+}
+
+// Limit returns the current concurrency limit.
+func (l *Limiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// InFlight returns the number of generations currently holding a slot.
+func (l *Limiter) InFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight
+}
+
+// Queued returns the number of requests waiting for a slot.
+func (l *Limiter) Queued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.waiters)
+}
+
+// QueueFull reports whether a request would be turned away with
+// ErrQueueFull now.
+func (l *Limiter) QueueFull() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.maxQueue > 0 && l.inFlight >= l.limit && len(l.waiters) >= l.maxQueue
+}
+
+// setLimit must be called with l.mu held.
+func (l *Limiter) setLimit(limit int) {
+	l.logger.Debug("Concurrency limit changed", zap.Int("from", l.limit), zap.Int("to", limit), zap.Duration("median_ttft", median(l.samples)))
+	l.limit = limit
+}
+
+// wake hands free slots to queued waiters in arrival order. It must be called
+// with l.mu held.
+func (l *Limiter) wake() {
+	for l.inFlight < l.limit && len(l.waiters) > 0 {
+		l.inFlight++
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+	}
+}
+
+func median(samples []time.Duration) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+	return sorted[len(sorted)/2]
+}
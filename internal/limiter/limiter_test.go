@@ -0,0 +1,155 @@
+package limiter_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/limiter"
+	"go.uber.org/zap"
+)
+
+func TestLimiter_StaticLimit(t *testing.T) {
+	l := limiter.New(1, 2, 0, zap.NewNop())
+
+	for i := 0; i < 2; i++ {
+		if err := l.Acquire(context.Background()); err != nil {
+			t.Fatalf("expected slot %d to be free, got %v", i, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.Acquire(ctx); err == nil {
+		t.Fatal("expected third acquire to wait until the context expired")
+	}
+
+	l.Release()
+	if err := l.Acquire(context.Background()); err != nil {
+		t.Fatalf("expected released slot to be reusable, got %v", err)
+	}
+	if got := l.InFlight(); got != 2 {
+		t.Errorf("expected 2 in flight, got %d", got)
+	}
+}
+
+func TestLimiter_ReleaseWakesWaiter(t *testing.T) {
+	l := limiter.New(1, 1, 0, zap.NewNop())
+	if err := l.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan error)
+	go func() { acquired <- l.Acquire(context.Background()) }()
+
+	time.Sleep(10 * time.Millisecond)
+	l.Release()
+
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("expected waiter to acquire, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter was not woken by Release")
+	}
+}
+
+func TestLimiter_AdditiveIncrease(t *testing.T) {
+	l := limiter.New(1, 4, time.Second, zap.NewNop())
+	if got := l.Limit(); got != 1 {
+		t.Fatalf("expected adaptive limiter to start at the minimum, got %d", got)
+	}
+
+	// Saturate the single slot, then report a fast generation.
+	if err := l.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	l.Observe(100 * time.Millisecond)
+	l.Release()
+
+	if got := l.Limit(); got != 2 {
+		t.Errorf("expected limit to grow to 2, got %d", got)
+	}
+}
+
+func TestLimiter_NoIncreaseWithoutSaturation(t *testing.T) {
+	l := limiter.New(1, 4, time.Second, zap.NewNop())
+	for i := 0; i < 10; i++ {
+		l.Observe(100 * time.Millisecond)
+	}
+
+	if got := l.Limit(); got != 1 {
+		t.Errorf("expected limit to stay at 1 while idle, got %d", got)
+	}
+}
+
+func TestLimiter_MultiplicativeDecrease(t *testing.T) {
+	l := limiter.New(1, 8, time.Second, zap.NewNop())
+
+	// Grow the limit to 4 with saturated, fast rounds.
+	for l.Limit() < 4 {
+		limit := l.Limit()
+		for i := 0; i < limit; i++ {
+			if err := l.Acquire(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < limit; i++ {
+			l.Observe(100 * time.Millisecond)
+			l.Release()
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		l.Observe(5 * time.Second)
+	}
+
+	if got := l.Limit(); got != 1 {
+		t.Errorf("expected sustained slow TTFT to shrink the limit to the minimum, got %d", got)
+	}
+}
+
+func TestLimiter_NilLogger(t *testing.T) {
+	l := limiter.New(1, 4, time.Second, nil)
+	if err := l.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Changing the limit logs it.
+	l.Observe(100 * time.Millisecond)
+	l.Release()
+
+	if got := l.Limit(); got != 2 {
+		t.Errorf("expected limit to grow to 2, got %d", got)
+	}
+}
+
+func TestLimiter_MaxQueue(t *testing.T) {
+	l := limiter.New(1, 1, 0, zap.NewNop())
+	l.SetMaxQueue(1)
+	if err := l.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan error)
+	go func() { acquired <- l.Acquire(context.Background()) }()
+	for l.Queued() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if !l.QueueFull() {
+		t.Error("expected the queue to be full")
+	}
+	if err := l.Acquire(context.Background()); !errors.Is(err, limiter.ErrQueueFull) {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+
+	l.Release()
+	if err := <-acquired; err != nil {
+		t.Fatalf("expected the queued request to acquire, got %v", err)
+	}
+	if l.QueueFull() {
+		t.Error("expected room in the queue once it drained")
+	}
+}
@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+)
+
+// Ports the listeners use when their address names only a host.
+const (
+	DefaultPort         = "11437"
+	DefaultPortSSL      = "11436"
+	DefaultProxyPort    = "11438"
+	DefaultProxyPortSSL = "11435"
+)
+
+// unixScheme starts the address of a listener on a unix domain socket,
+// such as unix:///tmp/ollama-copilot.sock.
+const unixScheme = "unix://"
+
+// Listener is a named HTTP or HTTPS listener and the middleware in front of
+// it, such as a loopback listener open to anyone on the machine next to a
+// LAN listener that asks for API keys.
+type Listener struct {
+	// Name identifies the listener in the logs.
+	Name string `json:"name"`
+	// Addr is the address to listen on, in the form of Server.Port. A bare
+	// host listens on DefaultPort, or DefaultPortSSL with TLS, and
+	// unix:///path on a unix domain socket.
+	Addr string `json:"addr"`
+	// TLS serves HTTPS with Server.Certificate and Server.Key, or a
+	// certificate signed by the local authority in Server.CertDir.
+	TLS bool `json:"tls,omitempty"`
+	// Proxy, when set, is the TCP address where a CONNECT proxy forwarding
+	// to the listener listens.
+	Proxy string `json:"proxy,omitempty"`
+	// APIKeys, when set, are the keys requests must present, as checked by
+	// middleware.APIKeyMiddleware.
+	APIKeys []string `json:"api_keys,omitempty"`
+}
+
+// LoadListeners reads a JSON array of listeners and completes their
+// addresses.
+func LoadListeners(file string) ([]Listener, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading listeners: %w", err)
+	}
+
+	var listeners []Listener
+	if err := json.Unmarshal(data, &listeners); err != nil {
+		return nil, fmt.Errorf("parsing listeners %s: %w", file, err)
+	}
+	if err := completeListeners(listeners); err != nil {
+		return nil, fmt.Errorf("listeners %s: %w", file, err)
+	}
+	return listeners, nil
+}
+
+// completeListeners validates listeners and completes their addresses with
+// the default ports.
+func completeListeners(listeners []Listener) error {
+	names := map[string]bool{}
+	for i := range listeners {
+		l := &listeners[i]
+		if l.Name == "" {
+			return fmt.Errorf("listener %d: name is required", i)
+		}
+		if names[l.Name] {
+			return fmt.Errorf("listener %q: duplicate name", l.Name)
+		}
+		names[l.Name] = true
+		if l.Addr == "" {
+			return fmt.Errorf("listener %q: addr is required", l.Name)
+		}
+
+		port, proxyPort := DefaultPort, DefaultProxyPort
+		if l.TLS {
+			port, proxyPort = DefaultPortSSL, DefaultProxyPortSSL
+		}
+		var err error
+		if l.Addr, err = listenAddr(l.Addr, port); err != nil {
+			return fmt.Errorf("listener %q: %w", l.Name, err)
+		}
+		if l.Proxy, err = listenAddr(l.Proxy, proxyPort); err != nil {
+			return fmt.Errorf("listener %q: proxy: %w", l.Name, err)
+		}
+		if strings.HasPrefix(l.Proxy, unixScheme) {
+			return fmt.Errorf("listener %q: the proxy must listen on TCP", l.Name)
+		}
+	}
+	return nil
+}
+
+// listenAddr completes the listen address addr, such as 127.0.0.1:11437,
+// [::1]:11437, :11437 or a bare host like 0.0.0.0, with port when it names
+// none. An empty addr stays empty, as the listener is disabled, and socket
+// addresses stay as they are.
+func listenAddr(addr, port string) (string, error) {
+	if addr == "" {
+		return "", nil
+	}
+	if path, ok := strings.CutPrefix(addr, unixScheme); ok {
+		if path == "" {
+			return "", fmt.Errorf("invalid listen address %q, expected unix:///path", addr)
+		}
+		return addr, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr, nil
+	}
+
+	host := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid listen address %q, expected host, host:port or :port", addr)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// listen listens on a completed address. A socket is only open to the user
+// running the server, and one left behind by a server that is gone is
+// replaced.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixScheme)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket at path unless a server still
+// answers on it.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another server", path)
+	}
+	return os.Remove(path)
+}
+
+// dialNetwork returns the network and address to dial a completed listen
+// address at.
+func dialNetwork(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, unixScheme); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// dialAddr returns the address the proxies reach a listener on addr at:
+// addr itself, or localhost when it listens on every interface.
+func dialAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// answersACME reports whether Let's Encrypt can reach one of listeners for
+// its challenges: an HTTPS listener on port 443 or an HTTP one on port 80.
+func answersACME(listeners []Listener) bool {
+	for _, l := range listeners {
+		_, port, err := net.SplitHostPort(l.Addr)
+		if err == nil && (l.TLS && port == "443" || !l.TLS && port == "80") {
+			return true
+		}
+	}
+	return false
+}
+
+// isLoopback reports whether addr only accepts connections from this
+// machine, as sockets do.
+func isLoopback(addr string) bool {
+	if strings.HasPrefix(addr, unixScheme) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
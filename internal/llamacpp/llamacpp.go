@@ -0,0 +1,182 @@
+// Package llamacpp completes code with llama.cpp's llama-server, filling in
+// the middle with its native /infill endpoint. The server places the text
+// before and after the cursor with the FIM tokens of the model it loaded,
+// so no prompt template has to match them. Chats and other generations use
+// the server's OpenAI-compatible API.
+package llamacpp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/openai"
+	"github.com/ollama/ollama/api"
+)
+
+// Client talks to a llama-server. Its requests go through
+// http.DefaultClient, like the Ollama client's, so that backend routing and
+// forwarded headers apply to them too.
+type Client struct {
+	*openai.Client
+	base *url.URL
+	key  string
+}
+
+// New returns a Client for the llama-server at baseURL, such as
+// http://127.0.0.1:8080, authenticating with key unless it is empty.
+func New(baseURL, key string) (*Client, error) {
+	u, err := url.Parse(strings.TrimRight(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("parsing the llama.cpp server URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("llama.cpp server URL %q must be an http or https URL", baseURL)
+	}
+	client, err := openai.New(u.JoinPath("v1").String(), key)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{Client: client, base: u, key: key}, nil
+}
+
+// options are the Ollama options llama-server takes, by its name for them.
+// Most are named alike.
+var options = map[string]string{
+	"num_predict":       "n_predict",
+	"temperature":       "temperature",
+	"top_k":             "top_k",
+	"top_p":             "top_p",
+	"min_p":             "min_p",
+	"typical_p":         "typical_p",
+	"repeat_penalty":    "repeat_penalty",
+	"repeat_last_n":     "repeat_last_n",
+	"presence_penalty":  "presence_penalty",
+	"frequency_penalty": "frequency_penalty",
+	"mirostat":          "mirostat",
+	"mirostat_tau":      "mirostat_tau",
+	"mirostat_eta":      "mirostat_eta",
+	"seed":              "seed",
+	"stop":              "stop",
+	// The draft model is loaded by llama-server with --model-draft, and
+	// requests tune how far it speculates.
+	"draft_max":   "speculative.n_max",
+	"draft_min":   "speculative.n_min",
+	"draft_p_min": "speculative.p_min",
+}
+
+// DraftOptions names the options that tune the speculation of
+// llama-server's draft model. Only completions take them, since chats go
+// through the OpenAI-compatible API.
+func (c *Client) DraftOptions() []string {
+	return []string{"draft_max", "draft_min", "draft_p_min"}
+}
+
+// event is a streamed chunk of /infill. The last one has Stop set, with
+// the token counts and timings of the completion.
+type event struct {
+	Content         string `json:"content"`
+	Stop            bool   `json:"stop"`
+	TokensPredicted int    `json:"tokens_predicted"`
+	TokensEvaluated int    `json:"tokens_evaluated"`
+	Timings         *struct {
+		PromptN     int     `json:"prompt_n"`
+		PromptMS    float64 `json:"prompt_ms"`
+		PredictedN  int     `json:"predicted_n"`
+		PredictedMS float64 `json:"predicted_ms"`
+	} `json:"timings"`
+}
+
+// Infill fills in between prefix and suffix with the model and options of
+// req, and calls fn with each piece of the completion, then once more with
+// Done set and the metrics. The Prompt and System of req are left out.
+func (c *Client) Infill(ctx context.Context, req *api.GenerateRequest, prefix, suffix string, fn api.GenerateResponseFunc) error {
+	body := map[string]any{
+		"input_prefix": prefix,
+		"input_suffix": suffix,
+		"stream":       true,
+		// The prompt of the last completion stays in the KV cache, and the
+		// next one, typed in the same place, only evaluates what changed.
+		"cache_prompt": true,
+	}
+	for name, value := range req.Options {
+		if param, ok := options[name]; ok {
+			body[param] = value
+		}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.base.JoinPath("infill").String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "text/event-stream")
+	if c.key != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.key)
+	}
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return openai.ResponseError(resp)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+		var e event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return fmt.Errorf("decoding a llama.cpp event: %w", err)
+		}
+		if e.Stop {
+			return fn(api.GenerateResponse{Model: req.Model, CreatedAt: time.Now(), Response: e.Content, Done: true, Metrics: metrics(e, start)})
+		}
+		if e.Content == "" {
+			continue
+		}
+		if err := fn(api.GenerateResponse{Model: req.Model, CreatedAt: time.Now(), Response: e.Content}); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fn(api.GenerateResponse{Model: req.Model, CreatedAt: time.Now(), Done: true, Metrics: api.Metrics{TotalDuration: time.Since(start)}})
+}
+
+// metrics returns the metrics of the last event of a completion started at
+// start.
+func metrics(e event, start time.Time) api.Metrics {
+	m := api.Metrics{
+		TotalDuration:   time.Since(start),
+		PromptEvalCount: e.TokensEvaluated,
+		EvalCount:       e.TokensPredicted,
+	}
+	if t := e.Timings; t != nil {
+		m.PromptEvalCount, m.EvalCount = t.PromptN, t.PredictedN
+		m.PromptEvalDuration = time.Duration(t.PromptMS * float64(time.Millisecond))
+		m.EvalDuration = time.Duration(t.PredictedMS * float64(time.Millisecond))
+	}
+	return m
+}
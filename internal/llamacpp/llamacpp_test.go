@@ -0,0 +1,109 @@
+package llamacpp_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/llamacpp"
+	"github.com/ollama/ollama/api"
+)
+
+func TestClient_Infill(t *testing.T) {
+	var body map[string]any
+	var path, auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, auth = r.URL.Path, r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, e := range []string{
+			`{"content":"fmt.","stop":false}`,
+			`{"content":"Println","stop":false}`,
+			`{"content":"","stop":true,"tokens_predicted":2,"tokens_evaluated":9,"timings":{"prompt_n":7,"prompt_ms":12.5,"predicted_n":2,"predicted_ms":40}}`,
+		} {
+			fmt.Fprintf(w, "data: %s\n\n", e)
+		}
+	}))
+	defer srv.Close()
+	client, err := llamacpp.New(srv.URL+"/", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []api.GenerateResponse
+	err = client.Infill(context.Background(), &api.GenerateRequest{
+		Model:   "qwen2.5-coder:7b",
+		Prompt:  "ignored",
+		Options: map[string]interface{}{"num_predict": 50, "temperature": 0.2, "stop": []string{"\n\n"}, "num_ctx": 4096, "draft_max": 16},
+	}, "func main() {\n\t", "\n}", func(resp api.GenerateResponse) error {
+		got = append(got, resp)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if path != "/infill" || auth != "Bearer secret" {
+		t.Errorf("expected an authorized request to /infill, got %s with %q", path, auth)
+	}
+	if body["input_prefix"] != "func main() {\n\t" || body["input_suffix"] != "\n}" || body["n_predict"] != float64(50) || body["temperature"] != 0.2 || body["speculative.n_max"] != float64(16) {
+		t.Errorf("expected the prefix, suffix and options to be passed on, got %v", body)
+	}
+	for _, key := range []string{"prompt", "num_ctx", "num_predict"} {
+		if _, ok := body[key]; ok {
+			t.Errorf("expected %s to be left out, got %v", key, body)
+		}
+	}
+	if len(got) != 3 || got[0].Response != "fmt." || got[1].Response != "Println" || !got[2].Done {
+		t.Fatalf("expected two pieces and a done response, got %+v", got)
+	}
+	if m := got[2].Metrics; m.PromptEvalCount != 7 || m.EvalCount != 2 || m.EvalDuration.Milliseconds() != 40 {
+		t.Errorf("expected the timings in the done response, got %+v", m)
+	}
+}
+
+func TestClient_InfillError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"error":{"code":503,"message":"Loading model","type":"unavailable_error"}}`))
+	}))
+	defer srv.Close()
+	client, err := llamacpp.New(srv.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Infill(context.Background(), &api.GenerateRequest{}, "a", "b", func(api.GenerateResponse) error { return nil })
+	var statusErr api.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable || statusErr.ErrorMessage != "Loading model" {
+		t.Errorf("expected the server's status error, got %v", err)
+	}
+}
+
+func TestClient_Chat(t *testing.T) {
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer srv.Close()
+	client, err := llamacpp.New(srv.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var text string
+	err = client.Chat(context.Background(), &api.ChatRequest{Messages: []api.Message{{Role: "user", Content: "hello"}}}, func(resp api.ChatResponse) error {
+		text += resp.Message.Content
+		return nil
+	})
+	if err != nil || path != "/v1/chat/completions" || text != "hi" {
+		t.Errorf("expected chats to use the OpenAI-compatible API, got %q from %s (%v)", text, path, err)
+	}
+}
@@ -0,0 +1,333 @@
+// Package mdns advertises the server on the local network with multicast
+// DNS service discovery, as described in RFC 6762 and RFC 6763, so that
+// editor plugins and other machines can find it without being configured,
+// and browses for servers that advertise themselves.
+package mdns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Service is the DNS-SD service type the server is advertised as.
+const Service = "_ollama-copilot._tcp"
+
+// TTL is how long the advertised records may be cached.
+const TTL = 2 * time.Minute
+
+const (
+	domain = "local."
+	// services is the name browsers ask to list every service type.
+	services = "_services._dns-sd._udp.local."
+	// cacheFlush marks the records only this host answers for.
+	cacheFlush = 1 << 15
+)
+
+// group is the address mDNS queries and answers are multicast to.
+var group = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// Instance is one advertised server.
+type Instance struct {
+	// Name is the instance name, such as "ollama-copilot on desk".
+	Name string
+	// Host is the host name, without the .local domain.
+	Host string
+	Port int
+	// Text are the key=value pairs of the TXT record, such as the port of
+	// the HTTPS listener.
+	Text map[string]string
+	IPs  []net.IP
+}
+
+func (inst Instance) serviceName() string { return Service + "." + domain }
+
+func (inst Instance) instanceName() string {
+	return strings.ReplaceAll(inst.Name, ".", "-") + "." + inst.serviceName()
+}
+
+func (inst Instance) hostName() string {
+	return strings.ReplaceAll(inst.Host, ".", "-") + "." + domain
+}
+
+// Advertise answers the mDNS queries for inst on every IPv4 interface until
+// ctx is done, having announced it when it starts. It says goodbye when it
+// stops, so that browsers forget the instance at once.
+func Advertise(ctx context.Context, inst Instance) error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		if goodbye, err := inst.response(0, nil, 0); err == nil {
+			_, _ = conn.WriteToUDP(goodbye, group)
+		}
+		conn.Close()
+	})
+	defer stop()
+
+	// Announcements are repeated once, a second apart, as packets get lost.
+	announce := func() {
+		if msg, err := inst.response(0, nil, TTL); err == nil {
+			_, _ = conn.WriteToUDP(msg, group)
+		}
+	}
+	announce()
+	announcement := time.AfterFunc(time.Second, announce)
+	defer announcement.Stop()
+
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		answer, ok := inst.answer(buf[:n])
+		if !ok {
+			continue
+		}
+		// Queries from ports other than 5353 come from simple resolvers
+		// that wait for a unicast answer.
+		to := group
+		if from.Port != group.Port {
+			to = from
+		}
+		_, _ = conn.WriteToUDP(answer, to)
+	}
+}
+
+// answer returns the response to the query msg, and false when msg asks
+// nothing about inst.
+func (inst Instance) answer(msg []byte) ([]byte, bool) {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil || header.Response {
+		return nil, false
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, false
+	}
+	var asked []dnsmessage.Question
+	for _, q := range questions {
+		if inst.answers(q) {
+			asked = append(asked, q)
+		}
+	}
+	if len(asked) == 0 {
+		return nil, false
+	}
+	reply, err := inst.response(header.ID, asked, TTL)
+	return reply, err == nil
+}
+
+// answers reports whether inst has records for q.
+func (inst Instance) answers(q dnsmessage.Question) bool {
+	name := strings.ToLower(q.Name.String())
+	switch q.Type {
+	case dnsmessage.TypePTR:
+		return name == strings.ToLower(inst.serviceName()) || name == services
+	case dnsmessage.TypeSRV, dnsmessage.TypeTXT:
+		return name == strings.ToLower(inst.instanceName())
+	case dnsmessage.TypeA:
+		return name == strings.ToLower(inst.hostName())
+	case dnsmessage.TypeALL:
+		return slices.ContainsFunc([]string{inst.serviceName(), inst.instanceName(), inst.hostName()}, func(s string) bool {
+			return strings.EqualFold(s, name)
+		})
+	}
+	return false
+}
+
+// response returns a message with the records of inst, answering the
+// questions of the query id. Without questions it is an announcement of
+// every record, or a goodbye when ttl is zero.
+func (inst Instance) response(id uint16, questions []dnsmessage.Question, ttl time.Duration) ([]byte, error) {
+	service, err := dnsmessage.NewName(inst.serviceName())
+	if err != nil {
+		return nil, err
+	}
+	instance, err := dnsmessage.NewName(inst.instanceName())
+	if err != nil {
+		return nil, err
+	}
+	host, err := dnsmessage.NewName(inst.hostName())
+	if err != nil {
+		return nil, err
+	}
+	header := func(name dnsmessage.Name, typ dnsmessage.Type, unique bool) dnsmessage.ResourceHeader {
+		class := dnsmessage.ClassINET
+		if unique {
+			class |= cacheFlush
+		}
+		return dnsmessage.ResourceHeader{Name: name, Type: typ, Class: class, TTL: uint32(ttl / time.Second)}
+	}
+
+	var text []string
+	for key, value := range inst.Text {
+		text = append(text, key+"="+value)
+	}
+	slices.Sort(text)
+	ptr := dnsmessage.Resource{Header: header(service, dnsmessage.TypePTR, false), Body: &dnsmessage.PTRResource{PTR: instance}}
+	srv := dnsmessage.Resource{Header: header(instance, dnsmessage.TypeSRV, true), Body: &dnsmessage.SRVResource{Port: uint16(inst.Port), Target: host}}
+	txt := dnsmessage.Resource{Header: header(instance, dnsmessage.TypeTXT, true), Body: &dnsmessage.TXTResource{TXT: text}}
+	var addresses []dnsmessage.Resource
+	for _, ip := range inst.IPs {
+		if ip4 := ip.To4(); ip4 != nil {
+			addresses = append(addresses, dnsmessage.Resource{Header: header(host, dnsmessage.TypeA, true), Body: &dnsmessage.AResource{A: [4]byte(ip4)}})
+		}
+	}
+
+	msg := dnsmessage.Message{Header: dnsmessage.Header{ID: id, Response: true, Authoritative: true}}
+	if len(questions) == 0 {
+		msg.Answers = append([]dnsmessage.Resource{ptr, srv, txt}, addresses...)
+		return msg.Pack()
+	}
+	for _, q := range questions {
+		switch {
+		case q.Type == dnsmessage.TypePTR && strings.EqualFold(q.Name.String(), services):
+			name, _ := dnsmessage.NewName(services)
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: header(name, dnsmessage.TypePTR, false), Body: &dnsmessage.PTRResource{PTR: service}})
+		case q.Type == dnsmessage.TypePTR:
+			msg.Answers = append(msg.Answers, ptr)
+			msg.Additionals = append(append(msg.Additionals, srv, txt), addresses...)
+		case q.Type == dnsmessage.TypeSRV:
+			msg.Answers = append(msg.Answers, srv)
+			msg.Additionals = append(msg.Additionals, addresses...)
+		case q.Type == dnsmessage.TypeTXT:
+			msg.Answers = append(msg.Answers, txt)
+		case q.Type == dnsmessage.TypeA:
+			msg.Answers = append(msg.Answers, addresses...)
+		default:
+			msg.Answers = append(append(msg.Answers, ptr, srv, txt), addresses...)
+		}
+	}
+	// Unicast answers echo the questions, as ordinary DNS responses do.
+	if id != 0 {
+		msg.Questions = questions
+	}
+	return msg.Pack()
+}
+
+// Browse asks the local network for the instances of Service and returns
+// those that answer until ctx is done, ordered by name.
+func Browse(ctx context.Context) ([]Instance, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	service, err := dnsmessage.NewName(Service + "." + domain)
+	if err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1},
+		Questions: []dnsmessage.Question{{Name: service, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}},
+	}
+	msg, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(msg, group); err != nil {
+		return nil, err
+	}
+	// The query is repeated once, as packets get lost.
+	retry := time.AfterFunc(250*time.Millisecond, func() { _, _ = conn.WriteToUDP(msg, group) })
+	defer retry.Stop()
+
+	found := map[string]*Instance{}
+	addresses := map[string][]net.IP{}
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		collect(buf[:n], found, addresses)
+	}
+
+	instances := make([]Instance, 0, len(found))
+	for _, inst := range found {
+		if inst.Port == 0 {
+			continue
+		}
+		inst.IPs = addresses[inst.Host]
+		inst.Host = strings.TrimSuffix(inst.Host, "."+domain)
+		instances = append(instances, *inst)
+	}
+	slices.SortFunc(instances, func(a, b Instance) int { return strings.Compare(a.Name, b.Name) })
+	return instances, nil
+}
+
+// collect adds the records of the response msg to the instances found and
+// the addresses of their hosts.
+func collect(msg []byte, found map[string]*Instance, addresses map[string][]net.IP) {
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil || !m.Header.Response {
+		return
+	}
+	suffix := "." + Service + "." + domain
+	instance := func(name string) *Instance {
+		if found[name] == nil {
+			found[name] = &Instance{Name: strings.TrimSuffix(name, suffix), Text: map[string]string{}}
+		}
+		return found[name]
+	}
+	for _, r := range append(m.Answers, m.Additionals...) {
+		name := r.Header.Name.String()
+		switch body := r.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if ptr := body.PTR.String(); strings.HasSuffix(ptr, suffix) {
+				instance(ptr)
+			}
+		case *dnsmessage.SRVResource:
+			if strings.HasSuffix(name, suffix) {
+				inst := instance(name)
+				inst.Host, inst.Port = body.Target.String(), int(body.Port)
+			}
+		case *dnsmessage.TXTResource:
+			if strings.HasSuffix(name, suffix) {
+				inst := instance(name)
+				for _, kv := range body.TXT {
+					key, value, _ := strings.Cut(kv, "=")
+					inst.Text[key] = value
+				}
+			}
+		case *dnsmessage.AResource:
+			ip := net.IP(body.A[:])
+			if !slices.ContainsFunc(addresses[name], ip.Equal) {
+				addresses[name] = append(addresses[name], ip)
+			}
+		}
+	}
+}
+
+// LocalIPs returns the IPv4 addresses of the interfaces that are up, other
+// than loopback ones, which are the addresses other machines reach the
+// server at.
+func LocalIPs() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips
+}
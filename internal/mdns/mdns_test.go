@@ -0,0 +1,52 @@
+package mdns_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/mdns"
+)
+
+func TestAdvertise_Browse(t *testing.T) {
+	inst := mdns.Instance{
+		Name: "ollama-copilot test " + time.Now().Format("150405"),
+		Host: "test-host",
+		Port: 11437,
+		Text: map[string]string{"tls_port": "11436", "fingerprint": "ab12"},
+		IPs:  []net.IP{net.IPv4(192, 168, 1, 20)},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	advertised := make(chan error, 1)
+	go func() { advertised <- mdns.Advertise(ctx, inst) }()
+	defer func() {
+		cancel()
+		<-advertised
+	}()
+
+	browse, stop := context.WithTimeout(context.Background(), time.Second)
+	defer stop()
+	instances, err := mdns.Browse(browse)
+	if err != nil {
+		t.Skipf("multicast is not available: %v", err)
+	}
+	for _, found := range instances {
+		if found.Name != inst.Name {
+			continue
+		}
+		if found.Host != "test-host" || found.Port != 11437 || found.Text["tls_port"] != "11436" || found.Text["fingerprint"] != "ab12" {
+			t.Errorf("expected the advertised instance, got %+v", found)
+		}
+		if len(found.IPs) != 1 || !found.IPs[0].Equal(inst.IPs[0]) {
+			t.Errorf("expected the advertised address, got %v", found.IPs)
+		}
+		return
+	}
+	select {
+	case err := <-advertised:
+		t.Skipf("multicast is not available: %v", err)
+	default:
+	}
+	t.Skipf("the instance was not found, multicast may not reach this host: %+v", instances)
+}
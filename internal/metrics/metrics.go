@@ -0,0 +1,145 @@
+// Package metrics holds the process-wide counters describing what the proxy
+// and its Ollama backend are doing.
+package metrics
+
+import (
+	"sort"
+	"sync"
+)
+
+// CounterVec is a family of counters partitioned by the value of one label.
+type CounterVec struct {
+	Name  string
+	Help  string
+	Label string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounterVec returns an empty CounterVec.
+func NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{Name: name, Help: help, Label: label, values: map[string]float64{}}
+	register(c)
+	return c
+}
+
+// Inc increments the counter for value.
+func (c *CounterVec) Inc(value string) {
+	c.Add(value, 1)
+}
+
+// Add adds delta, which must not be negative, to the counter for value.
+func (c *CounterVec) Add(value string, delta float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[value] += delta
+}
+
+// Get returns the current count for value.
+func (c *CounterVec) Get(value string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[value]
+}
+
+// Values returns the label values seen so far in sorted order.
+func (c *CounterVec) Values() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	values := make([]string, 0, len(c.values))
+	for value := range c.values {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values
+}
+
+var (
+	// Requests counts requests by the route that served them, "unmatched"
+	// for paths no route serves, and RequestSeconds times them.
+	Requests       = NewCounterVec("http_requests_total", "Requests served, by route.", "endpoint")
+	RequestSeconds = NewHistogramVec("http_request_duration_seconds", "Time spent serving requests, by route.", "endpoint", LatencyBuckets)
+
+	// TTFTSeconds and GenerationSeconds time completions by model, from
+	// asking Ollama to the first token and to the last one.
+	// TokensPerSecond is the generation speed Ollama reports, for
+	// completions and chats.
+	TTFTSeconds       = NewHistogramVec("completion_ttft_seconds", "Time from asking Ollama for a completion to its first token.", "model", LatencyBuckets)
+	GenerationSeconds = NewHistogramVec("completion_generation_seconds", "Time Ollama took to generate a whole completion.", "model", LatencyBuckets)
+	TokensPerSecond   = NewHistogramVec("generation_tokens_per_second", "Tokens generated per second of evaluation.", "model", ThroughputBuckets)
+
+	// CacheLookups counts completion cache lookups by result: hit,
+	// extension or miss.
+	CacheLookups = NewCounterVec("completion_cache_lookups_total", "Completion cache lookups, by result.", "result")
+
+	// PromptWindows counts the sides of the cursor looked up in the prompt
+	// windows of their file, by result: hit or miss.
+	PromptWindows = NewCounterVec("prompt_window_lookups_total", "Prompt windows looked up by file, by result.", "result")
+
+	// UnknownFields counts request fields the server does not understand,
+	// which usually means a client started sending something new. Fields
+	// that are not known to be sent by clients are counted as "other".
+	UnknownFields = NewCounterVec("request_unknown_fields_total", "Unknown fields seen in completion requests.", "field")
+
+	// Suppressed counts completions skipped by a heuristic, by heuristic.
+	Suppressed = NewCounterVec("completions_suppressed_total", "Completions answered empty by a suppression heuristic, the first-token timeout or an open circuit.", "reason")
+
+	// Superseded counts generations canceled because the same client asked
+	// again for the same position, by model.
+	Superseded = NewCounterVec("completions_superseded_total", "Generations canceled by a newer request for the same position.", "model")
+
+	// QueueWaitSeconds times how long requests waited for a generation
+	// slot of the concurrency limit, by route.
+	QueueWaitSeconds = NewHistogramVec("generation_queue_wait_seconds", "Time requests waited for a generation slot, by route.", "endpoint", LatencyBuckets)
+
+	// Throttled counts requests answered 429, by reason: rate_limit for a
+	// client over its rate and queue_full for a full generation queue.
+	Throttled = NewCounterVec("requests_throttled_total", "Requests turned away with 429.", "reason")
+
+	// CompletionsAccepted and CompletionsRejected count client feedback on
+	// completions by the model that served them.
+	CompletionsAccepted = NewCounterVec("completions_accepted_total", "Completions the user accepted.", "model")
+	CompletionsRejected = NewCounterVec("completions_rejected_total", "Completions the user dismissed.", "model")
+
+	// CompletionsDiagnosed counts accepted completions the editor reported
+	// language server diagnostics for, and CompletionsBroken those of them
+	// that introduced errors, by the model that served them.
+	CompletionsDiagnosed = NewCounterVec("completions_diagnosed_total", "Accepted completions reported with their diagnostics.", "model")
+	CompletionsBroken    = NewCounterVec("completions_broken_total", "Accepted completions the editor reported errors for.", "model")
+
+	// OllamaErrors counts failed generations by error class, and
+	// OllamaRetries the retries of transient ones.
+	OllamaErrors  = NewCounterVec("ollama_errors_total", "Failed Ollama generations by error class.", "class")
+	OllamaRetries = NewCounterVec("ollama_retries_total", "Generations retried after a transient Ollama error, by error class.", "class")
+
+	// BackendFailovers counts completions moved to another backend, by the
+	// backend they failed on.
+	BackendFailovers = NewCounterVec("backend_failovers_total", "Completions moved to another backend after failing on this one.", "backend")
+
+	// StickyRoutes counts completions looked up for sticky routing, by
+	// whether their prompt head had a backend: hit or miss.
+	StickyRoutes = NewCounterVec("backend_sticky_routes_total", "Completions looked up for sticky routing, by result.", "result")
+
+	// PromptEvalTokens and PromptEvalSeconds measure prompt processing by
+	// model, EvalTokens and EvalSeconds token generation. Comparing the two
+	// shows whether a slow completion spent its time reading the context or
+	// writing the answer.
+	PromptEvalTokens  = NewCounterVec("ollama_prompt_eval_tokens_total", "Prompt tokens evaluated by Ollama.", "model")
+	PromptEvalSeconds = NewCounterVec("ollama_prompt_eval_seconds_total", "Time Ollama spent evaluating prompts.", "model")
+	EvalTokens        = NewCounterVec("ollama_eval_tokens_total", "Tokens generated by Ollama.", "model")
+	EvalSeconds       = NewCounterVec("ollama_eval_seconds_total", "Time Ollama spent generating tokens.", "model")
+)
+
+var (
+	// StreamStageSeconds, StreamStageDropped and StreamStageStops describe
+	// the filters completions stream through, by stage name: the time each
+	// spends, the chunks it passes nothing on for and the streams it ends.
+	StreamStageSeconds = NewCounterVec("stream_stage_seconds_total", "Time spent in each completion stream stage.", "stage")
+	StreamStageDropped = NewCounterVec("stream_stage_dropped_total", "Chunks a completion stream stage passed nothing on for.", "stage")
+	StreamStageStops   = NewCounterVec("stream_stage_stops_total", "Completion streams ended by each stream stage.", "stage")
+)
+
+// Events counts the events the daemon published, by type.
+var Events = NewCounterVec("events_total", "Events published by the daemon.", "type")
@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// collector is a metric family that can write itself in the Prometheus
+// text format.
+type collector interface {
+	writeText(w io.Writer) error
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []collector
+)
+
+func register(c collector) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, c)
+}
+
+// WriteText writes every counter and histogram in the Prometheus text
+// exposition format, in the order they were created.
+func WriteText(w io.Writer) error {
+	registryMu.Lock()
+	collectors := append([]collector(nil), registry...)
+	registryMu.Unlock()
+
+	for _, c := range collectors {
+		if err := c.writeText(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (c *CounterVec) writeText(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.Name, c.Help, c.Name); err != nil {
+		return err
+	}
+	for _, value := range c.Values() {
+		if _, err := fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", c.Name, c.Label, labelEscaper.Replace(value), formatFloat(c.Get(value))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bucket upper bounds, in seconds for LatencyBuckets and tokens per second
+// for ThroughputBuckets.
+var (
+	LatencyBuckets    = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	ThroughputBuckets = []float64{5, 10, 20, 40, 80, 160, 320}
+)
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec is a family of histograms partitioned by the value of one
+// label.
+type HistogramVec struct {
+	Name    string
+	Help    string
+	Label   string
+	Buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+// NewHistogramVec returns an empty HistogramVec with the given bucket upper
+// bounds, which must be sorted.
+func NewHistogramVec(name, help, label string, buckets []float64) *HistogramVec {
+	h := &HistogramVec{Name: name, Help: help, Label: label, Buckets: buckets, values: map[string]*histogram{}}
+	register(h)
+	return h
+}
+
+// Observe adds an observation of v to the histogram for value.
+func (h *HistogramVec) Observe(value string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hist, ok := h.values[value]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.Buckets))}
+		h.values[value] = hist
+	}
+	if i := sort.SearchFloat64s(h.Buckets, v); i < len(h.Buckets) {
+		hist.counts[i]++
+	}
+	hist.sum += v
+	hist.count++
+}
+
+// Count returns the number of observations for value.
+func (h *HistogramVec) Count(value string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if hist, ok := h.values[value]; ok {
+		return hist.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) writeText(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.Name, h.Help, h.Name); err != nil {
+		return err
+	}
+	values := make([]string, 0, len(h.values))
+	for value := range h.values {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	for _, value := range values {
+		hist := h.values[value]
+		label := fmt.Sprintf("%s=\"%s\"", h.Label, labelEscaper.Replace(value))
+		var cumulative uint64
+		for i, le := range h.Buckets {
+			cumulative += hist.counts[i]
+			if _, err := fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", h.Name, label, formatFloat(le), cumulative); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n%s_sum{%s} %s\n%s_count{%s} %d\n",
+			h.Name, label, hist.count, h.Name, label, formatFloat(hist.sum), h.Name, label, hist.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Request is a generation currently being served.
+type Request struct {
+	ID      uint64
+	Path    string
+	Model   string
+	Started time.Time
+}
+
+// Tracker keeps the set of in-flight requests.
+type Tracker struct {
+	mu     sync.Mutex
+	next   uint64
+	active map[uint64]Request
+}
+
+// NewTracker returns an empty Tracker.
+func NewTracker() *Tracker {
+	return &Tracker{active: map[uint64]Request{}}
+}
+
+// Start records a request as in flight and returns the function that marks
+// it finished.
+func (t *Tracker) Start(path, model string) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.next++
+	id := t.next
+	t.active[id] = Request{ID: id, Path: path, Model: model, Started: time.Now()}
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.active, id)
+	}
+}
+
+// Active returns the in-flight requests, oldest first.
+func (t *Tracker) Active() []Request {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	requests := make([]Request, 0, len(t.active))
+	for _, r := range t.active {
+		requests = append(requests, r)
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].ID < requests[j].ID })
+	return requests
+}
+
+// ErrorEvent is a single failed generation.
+type ErrorEvent struct {
+	Time  time.Time
+	Class string
+	Model string
+}
+
+// ErrorLog keeps the most recent failed generations.
+type ErrorLog struct {
+	mu     sync.Mutex
+	size   int
+	events []ErrorEvent
+}
+
+// NewErrorLog returns an ErrorLog remembering the last size errors.
+func NewErrorLog(size int) *ErrorLog {
+	return &ErrorLog{size: size}
+}
+
+// Add records an error of class for model.
+func (l *ErrorLog) Add(class, model string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.events = append(l.events, ErrorEvent{Time: time.Now(), Class: class, Model: model})
+	if len(l.events) > l.size {
+		l.events = l.events[len(l.events)-l.size:]
+	}
+}
+
+// Recent returns the remembered errors, newest first.
+func (l *ErrorLog) Recent() []ErrorEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	events := make([]ErrorEvent, len(l.events))
+	for i, e := range l.events {
+		events[len(events)-1-i] = e
+	}
+	return events
+}
+
+// CompletionLog remembers which model served recent completions, so
+// feedback sent later can be attributed.
+type CompletionLog struct {
+	mu     sync.Mutex
+	size   int
+	order  []string
+	models map[string]string
+}
+
+// NewCompletionLog returns a CompletionLog remembering the last size
+// completions.
+func NewCompletionLog(size int) *CompletionLog {
+	return &CompletionLog{size: size, models: map[string]string{}}
+}
+
+// Add records that model served the completion id.
+func (l *CompletionLog) Add(id, model string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.models[id]; !ok {
+		l.order = append(l.order, id)
+	}
+	l.models[id] = model
+	for len(l.order) > l.size {
+		delete(l.models, l.order[0])
+		l.order = l.order[1:]
+	}
+}
+
+// Model returns the model that served the completion id.
+func (l *CompletionLog) Model(id string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	model, ok := l.models[id]
+	return model, ok
+}
+
+var (
+	// InFlight tracks the completions currently being generated.
+	InFlight = NewTracker()
+	// RecentErrors keeps the last failed generations.
+	RecentErrors = NewErrorLog(20)
+	// RecentCompletions maps the last completion IDs to their models.
+	RecentCompletions = NewCompletionLog(1000)
+)
@@ -0,0 +1,219 @@
+package metrics
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/storage"
+)
+
+// usageBucket is the storage bucket of the usage records.
+const usageBucket = "usage"
+
+// usageCounters is the bucket of the usage counters of servers sharing a
+// storage, one for each user, model and field of a UsageRecord.
+const usageCounters = "usage_counters"
+
+// MaxUsageUsers bounds the users a UsageLedger keeps apart. Users are
+// named by a request header, so the work of those beyond the first
+// MaxUsageUsers is added up as OtherUsers rather than growing the ledger.
+const MaxUsageUsers = 1000
+
+// OtherUsers is the user of the work of the users beyond MaxUsageUsers.
+const OtherUsers = "(other)"
+
+// UsageRecord is the work Ollama did for one user and model.
+type UsageRecord struct {
+	User         string
+	Model        string
+	Requests     int
+	PromptTokens int
+	EvalTokens   int
+	// GPUTime is the time Ollama spent evaluating the prompt and
+	// generating, which is when the GPU is busy.
+	GPUTime time.Duration
+}
+
+type usageKey struct {
+	user  string
+	model string
+}
+
+// UsageLedger accumulates generation work per user and model.
+type UsageLedger struct {
+	mu      sync.Mutex
+	records map[usageKey]*UsageRecord
+	// users are the users of records.
+	users map[string]bool
+	// store, when set, keeps the records across restarts.
+	store storage.Storage
+	// shared, when set, adds up the records of every server using it.
+	shared storage.Shared
+}
+
+// NewUsageLedger returns an empty UsageLedger.
+func NewUsageLedger() *UsageLedger {
+	return &UsageLedger{records: map[usageKey]*UsageRecord{}, users: map[string]bool{}}
+}
+
+// Store keeps the records in s as well, adding the ones s kept to the
+// ledger. Writes to s that fail lose the usage across restarts only. When
+// s is shared, the work is counted there, and Records returns the usage of
+// every server.
+func (l *UsageLedger) Store(s storage.Storage) error {
+	if shared, ok := s.(storage.Shared); ok {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.shared = shared
+		return nil
+	}
+
+	var stored []UsageRecord
+	err := s.Each(usageBucket, func(_ string, value []byte) error {
+		var r UsageRecord
+		if err := json.Unmarshal(value, &r); err != nil {
+			return err
+		}
+		stored = append(stored, r)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.store = s
+	for _, r := range stored {
+		key := usageKey{user: r.User, model: r.Model}
+		if existing, ok := l.records[key]; ok {
+			r.Requests += existing.Requests
+			r.PromptTokens += existing.PromptTokens
+			r.EvalTokens += existing.EvalTokens
+			r.GPUTime += existing.GPUTime
+			l.records[key] = &r
+			l.put(key)
+			continue
+		}
+		l.records[key] = &r
+		l.users[r.User] = true
+	}
+	return nil
+}
+
+// Record adds one completed generation. A user beyond the first
+// MaxUsageUsers is recorded as OtherUsers.
+func (l *UsageLedger) Record(user, model string, promptTokens, evalTokens int, gpuTime time.Duration) {
+	l.mu.Lock()
+	if !l.users[user] && len(l.users) >= MaxUsageUsers {
+		user = OtherUsers
+	}
+	l.users[user] = true
+	l.add(user, model, promptTokens, evalTokens, gpuTime)
+	shared := l.shared
+	l.mu.Unlock()
+
+	// The shared counters are added to without holding the lock.
+	if shared != nil {
+		prefix := user + "\x00" + model + "\x00"
+		_, _ = shared.Add(usageCounters, prefix+"requests", 1)
+		_, _ = shared.Add(usageCounters, prefix+"prompt_tokens", int64(promptTokens))
+		_, _ = shared.Add(usageCounters, prefix+"eval_tokens", int64(evalTokens))
+		_, _ = shared.Add(usageCounters, prefix+"gpu_time", int64(gpuTime))
+	}
+}
+
+// add adds one completed generation to the records. l.mu is held.
+func (l *UsageLedger) add(user, model string, promptTokens, evalTokens int, gpuTime time.Duration) {
+	key := usageKey{user: user, model: model}
+	r, ok := l.records[key]
+	if !ok {
+		r = &UsageRecord{User: user, Model: model}
+		l.records[key] = r
+	}
+	r.Requests++
+	r.PromptTokens += promptTokens
+	r.EvalTokens += evalTokens
+	r.GPUTime += gpuTime
+	l.put(key)
+}
+
+// put writes the record of key to the storage, if any.
+func (l *UsageLedger) put(key usageKey) {
+	if l.store == nil {
+		return
+	}
+	if value, err := json.Marshal(l.records[key]); err == nil {
+		_ = l.store.Put(usageBucket, key.user+"\x00"+key.model, value)
+	}
+}
+
+// Records returns a copy of the accumulated usage ordered by user and model.
+// With a shared storage it is the usage of every server, or this server's
+// when the storage cannot be read.
+func (l *UsageLedger) Records() []UsageRecord {
+	l.mu.Lock()
+	shared := l.shared
+	records := make([]UsageRecord, 0, len(l.records))
+	for _, r := range l.records {
+		records = append(records, *r)
+	}
+	l.mu.Unlock()
+
+	if shared != nil {
+		if counted, err := sharedRecords(shared); err == nil {
+			records = counted
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].User != records[j].User {
+			return records[i].User < records[j].User
+		}
+		return records[i].Model < records[j].Model
+	})
+	return records
+}
+
+// sharedRecords adds up the usage counters of shared into records.
+func sharedRecords(shared storage.Shared) ([]UsageRecord, error) {
+	byKey := map[usageKey]*UsageRecord{}
+	err := shared.Each(usageCounters, func(key string, value []byte) error {
+		parts := strings.Split(key, "\x00")
+		n, err := strconv.ParseInt(string(value), 10, 64)
+		if len(parts) != 3 || err != nil {
+			return nil
+		}
+		k := usageKey{user: parts[0], model: parts[1]}
+		r, ok := byKey[k]
+		if !ok {
+			r = &UsageRecord{User: k.user, Model: k.model}
+			byKey[k] = r
+		}
+		switch parts[2] {
+		case "requests":
+			r.Requests = int(n)
+		case "prompt_tokens":
+			r.PromptTokens = int(n)
+		case "eval_tokens":
+			r.EvalTokens = int(n)
+		case "gpu_time":
+			r.GPUTime = time.Duration(n)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	records := make([]UsageRecord, 0, len(byKey))
+	for _, r := range byKey {
+		records = append(records, *r)
+	}
+	return records, nil
+}
+
+// Usage accumulates generation work for the usage export.
+var Usage = NewUsageLedger()
@@ -0,0 +1,30 @@
+package metrics_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
+)
+
+func TestUsageLedger_MaxUsers(t *testing.T) {
+	l := metrics.NewUsageLedger()
+	for i := range metrics.MaxUsageUsers + 2 {
+		l.Record("user-"+strconv.Itoa(i), "model", 10, 1, time.Second)
+	}
+	l.Record("user-0", "model", 10, 1, time.Second)
+
+	records := l.Records()
+	if len(records) != metrics.MaxUsageUsers+1 {
+		t.Fatalf("expected %d records, got %d", metrics.MaxUsageUsers+1, len(records))
+	}
+	if other := records[0]; other.User != metrics.OtherUsers || other.Requests != 2 {
+		t.Errorf("expected the users over the limit to be added up, got %+v", other)
+	}
+	for _, r := range records {
+		if r.User == "user-0" && r.Requests != 2 {
+			t.Errorf("expected a known user to keep being counted, got %+v", r)
+		}
+	}
+}
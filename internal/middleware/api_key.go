@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// APIKeyHeader names the request header clients may send an API key in,
+// instead of the Authorization header.
+const APIKeyHeader = "X-API-Key"
+
+// APIKeyMiddleware answers requests that present none of keys with 401.
+// A key is accepted as an Authorization bearer or token credential, or in
+// APIKeyHeader. With no keys, every request is let through.
+func APIKeyMiddleware(keys []string, next http.Handler) http.Handler {
+	if len(keys) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validKey(keys, presentedKey(r)) {
+			AddLogField(r.Context(), "auth", "rejected")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ollama-copilot"`)
+			http.Error(w, "missing or invalid API key", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// presentedKey returns the key r carries, or "" when it has none.
+func presentedKey(r *http.Request) string {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return key
+	}
+	scheme, credential, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") && !strings.EqualFold(scheme, "token") {
+		return ""
+	}
+	return strings.TrimSpace(credential)
+}
+
+// validKey compares key with every one of keys in constant time.
+func validKey(keys []string, key string) bool {
+	valid := 0
+	for _, k := range keys {
+		valid |= subtle.ConstantTimeCompare([]byte(k), []byte(key))
+	}
+	return key != "" && valid == 1
+}
@@ -0,0 +1,54 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+)
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := middleware.APIKeyMiddleware([]string{"first", "second"}, ok)
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		want   int
+	}{
+		{"bearer", "Authorization", "Bearer second", http.StatusOK},
+		{"token scheme", "Authorization", "token first", http.StatusOK},
+		{"key header", middleware.APIKeyHeader, "first", http.StatusOK},
+		{"missing", "", "", http.StatusUnauthorized},
+		{"wrong key", "Authorization", "Bearer third", http.StatusUnauthorized},
+		{"prefix of a key", middleware.APIKeyHeader, "fir", http.StatusUnauthorized},
+		{"other scheme", "Authorization", "Basic first", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != tt.want {
+				t.Errorf("expected status %d, got %d", tt.want, rr.Code)
+			}
+		})
+	}
+}
+
+func TestAPIKeyMiddleware_NoKeys(t *testing.T) {
+	h := middleware.APIKeyMiddleware(nil, http.NotFoundHandler())
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected requests to pass without keys configured, got %d", rr.Code)
+	}
+}
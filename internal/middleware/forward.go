@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+type forwardKey struct{}
+
+// ForwardingTransport adds the request headers selected by
+// GithubHeaderMiddleware to outgoing requests made with the same context,
+// which is how they reach Ollama: the Ollama client does not take per
+// request headers.
+type ForwardingTransport struct {
+	Base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *ForwardingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	forwarded, ok := req.Context().Value(forwardKey{}).(http.Header)
+	if !ok {
+		return base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	for name, values := range forwarded {
+		req.Header[name] = values
+	}
+	return base.RoundTrip(req)
+}
@@ -1,15 +1,58 @@
 package middleware
 
 import (
+	"context"
 	"net/http"
 )
 
-func GithubHeaderMiddleware(next http.Handler) http.Handler {
+// GithubHeaderPolicy configures GithubHeaderMiddleware.
+type GithubHeaderPolicy struct {
+	// Headers are set on every response, replacing any value set by the
+	// handler.
+	Headers map[string]string
+	// Forward lists request headers that are passed on to Ollama.
+	Forward []string
+	// Bypass disables the middleware entirely.
+	Bypass bool
+}
+
+// DefaultGithubHeaderPolicy returns the headers the Copilot clients are
+// known to require.
+func DefaultGithubHeaderPolicy() GithubHeaderPolicy {
+	return GithubHeaderPolicy{
+		Headers: map[string]string{
+			// The copilot-language-server npm module uses this
+			// header to check if the connection to GitHub is working,
+			// and otherwise errors out.
+			"x-github-request-id": "foobar",
+		},
+	}
+}
+
+func GithubHeaderMiddleware(policy GithubHeaderPolicy, next http.Handler) http.Handler {
+	if policy.Bypass {
+		return next
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// The copilot-language-server npm module uses this
-		// header to check if the connection to GitHub is working,
-		// and otherwise errors out.
-		w.Header().Set("x-github-request-id", "foobar")
+		for name, value := range policy.Headers {
+			w.Header().Set(name, value)
+		}
+
+		if forwarded := forwardedHeaders(r.Header, policy.Forward); len(forwarded) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), forwardKey{}, forwarded))
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
+
+func forwardedHeaders(header http.Header, names []string) http.Header {
+	forwarded := http.Header{}
+	for _, name := range names {
+		if values := header.Values(name); len(values) > 0 {
+			forwarded[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	return forwarded
+}
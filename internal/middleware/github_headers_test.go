@@ -0,0 +1,67 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+)
+
+func TestGithubHeaderMiddleware_Defaults(t *testing.T) {
+	h := middleware.GithubHeaderMiddleware(middleware.DefaultGithubHeaderPolicy(), http.NotFoundHandler())
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if got := rr.Header().Get("x-github-request-id"); got != "foobar" {
+		t.Errorf("expected x-github-request-id to be injected, got %q", got)
+	}
+}
+
+func TestGithubHeaderMiddleware_Bypass(t *testing.T) {
+	policy := middleware.DefaultGithubHeaderPolicy()
+	policy.Bypass = true
+	h := middleware.GithubHeaderMiddleware(policy, http.NotFoundHandler())
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if got := rr.Header().Get("x-github-request-id"); got != "" {
+		t.Errorf("expected no headers in bypass mode, got %q", got)
+	}
+}
+
+func TestGithubHeaderMiddleware_Forward(t *testing.T) {
+	var upstream http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header
+	}))
+	defer backend.Close()
+
+	client := &http.Client{Transport: &middleware.ForwardingTransport{}}
+	policy := middleware.GithubHeaderPolicy{Forward: []string{"x-request-id"}}
+	h := middleware.GithubHeaderMiddleware(policy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, backend.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set("X-Request-Id", "abc")
+	req.Header.Set("Authorization", "Bearer secret")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got := upstream.Get("X-Request-Id"); got != "abc" {
+		t.Errorf("expected X-Request-Id to be forwarded, got %q", got)
+	}
+	if got := upstream.Get("Authorization"); got != "" {
+		t.Errorf("expected headers outside the allowlist to stay local, got %q", got)
+	}
+}
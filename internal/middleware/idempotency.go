@@ -0,0 +1,289 @@
+package middleware
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IdempotencyKeyHeader names the request header clients set to the same
+// value when they retry a request.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// MaxRequestBytes bounds the body of a completion or chat request. Prompts
+// are cut to a few thousand tokens by clients, so a larger body is not one.
+const MaxRequestBytes = 1 << 20
+
+// DefaultReplays is how many responses a ReplayStore of the server keeps
+// at most. Once it is full, the oldest finished one is forgotten first.
+const DefaultReplays = 1000
+
+// MaxReplayBytes bounds the response a ReplayStore keeps for a request.
+// Longer responses are passed on but not replayed.
+const MaxReplayBytes = 1 << 20
+
+// ReplayStore keeps the responses of requests with an IdempotencyKeyHeader
+// for a retention window, shared by the listeners.
+type ReplayStore struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	results map[string]*replay
+	// order has the replays of results, oldest first.
+	order *list.List
+}
+
+// replay is one response, complete once done is closed.
+type replay struct {
+	key    string
+	body   [sha256.Size]byte
+	done   chan struct{}
+	status int
+	header http.Header
+	buf    bytes.Buffer
+	// failed is set when the response is not to be replayed: it ended
+	// with an error or outgrew MaxReplayBytes.
+	failed atomic.Bool
+	// clients counts the requests waiting for the response, the first
+	// included. The work is canceled once the last one has gone away.
+	clients  int
+	cancel   context.CancelFunc
+	finished bool
+	elem     *list.Element
+}
+
+// replayKey is the context key of the replay a response is recorded into.
+type replayKey struct{}
+
+// NewReplayStore returns a store keeping up to size responses for ttl after
+// they end.
+func NewReplayStore(size int, ttl time.Duration) *ReplayStore {
+	return &ReplayStore{size: size, ttl: ttl, results: map[string]*replay{}, order: list.New()}
+}
+
+// claim returns the response stored under key, or registers a new one for
+// the caller to fill, canceling its work with cancel, when first is true.
+// When the store is full of responses still running, it returns nil.
+func (s *ReplayStore) claim(key string, body [sha256.Size]byte, cancel context.CancelFunc) (res *replay, first bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if res, ok := s.results[key]; ok {
+		if !res.finished {
+			res.clients++
+		}
+		return res, false
+	}
+	if len(s.results) >= s.size && !s.evict() {
+		return nil, false
+	}
+	res = &replay{key: key, body: body, done: make(chan struct{}), status: http.StatusOK, clients: 1, cancel: cancel}
+	res.elem = s.order.PushBack(res)
+	s.results[key] = res
+	return res, true
+}
+
+// evict forgets the oldest finished response and reports whether there was
+// one. s.mu is held.
+func (s *ReplayStore) evict() bool {
+	for e := s.order.Front(); e != nil; e = e.Next() {
+		if res := e.Value.(*replay); res.finished {
+			s.remove(res)
+			return true
+		}
+	}
+	return false
+}
+
+// remove forgets res, if it is still stored. s.mu is held.
+func (s *ReplayStore) remove(res *replay) {
+	if s.results[res.key] == res {
+		delete(s.results, res.key)
+		s.order.Remove(res.elem)
+	}
+}
+
+// leave is called when a request waiting for res goes away, and cancels
+// the work of res when it was the last.
+func (s *ReplayStore) leave(res *replay) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res.clients--
+	if res.clients == 0 && !res.finished {
+		res.cancel()
+	}
+}
+
+// finish marks res complete. Responses that failed, were canceled or are
+// server errors are forgotten so that a retry tries again; the others are
+// forgotten after the ttl.
+func (s *ReplayStore) finish(ctx context.Context, res *replay) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res.finished = true
+	if res.status >= http.StatusInternalServerError || res.failed.Load() || ctx.Err() != nil {
+		res.failed.Store(true)
+		s.remove(res)
+	} else {
+		time.AfterFunc(s.ttl, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.remove(res)
+		})
+	}
+	close(res.done)
+}
+
+// ResponseFailed tells the IdempotencyMiddleware recording the response of
+// ctx, if any, that it ended with an error, such as a stream ended by an
+// error event, so that retries run again instead of getting it replayed.
+func ResponseFailed(ctx context.Context) {
+	if res, ok := ctx.Value(replayKey{}).(*replay); ok {
+		res.failed.Store(true)
+	}
+}
+
+// IdempotencyMiddleware replays the response of an earlier request from the
+// same client with the same IdempotencyKeyHeader and path instead of
+// handling it again, such as an editor retrying after its connection
+// dropped. A retry that arrives while the first request is running waits
+// for it, and the first request runs on while one does. Reusing a key for a
+// different body is rejected.
+func IdempotencyMiddleware(store *ReplayStore, next http.Handler) http.Handler {
+	if store == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idempotencyKey := r.Header.Get(IdempotencyKeyHeader)
+		if idempotencyKey == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxRequestBytes))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "the request body is too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "reading the request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+
+		key := r.Method + " " + r.URL.Path + " " + ClientID(r) + " " + idempotencyKey
+		for {
+			ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+			res, first := store.claim(key, sum, cancel)
+			if res == nil {
+				cancel()
+				next.ServeHTTP(w, r)
+				return
+			}
+			if first {
+				serveFirst(ctx, w, r, store, res, next)
+				cancel()
+				return
+			}
+			cancel()
+
+			AddLogField(r.Context(), "idempotent_replay", true)
+			if res.body != sum {
+				store.leave(res)
+				http.Error(w, IdempotencyKeyHeader+" was used for a different request", http.StatusUnprocessableEntity)
+				return
+			}
+			select {
+			case <-res.done:
+			case <-r.Context().Done():
+				store.leave(res)
+				return
+			}
+			// A response that is not replayed was forgotten, and the next
+			// claim runs the request again.
+			if res.failed.Load() {
+				continue
+			}
+			maps.Copy(w.Header(), res.header)
+			w.WriteHeader(res.status)
+			_, _ = w.Write(res.buf.Bytes())
+			return
+		}
+	})
+}
+
+// serveFirst handles r, the first request of res, recording its response.
+// The work runs under ctx, which is canceled once neither r nor a retry is
+// waiting for it.
+func serveFirst(ctx context.Context, w http.ResponseWriter, r *http.Request, store *ReplayStore, res *replay, next http.Handler) {
+	defer store.finish(ctx, res)
+	stop := context.AfterFunc(r.Context(), func() { store.leave(res) })
+	defer stop()
+
+	recorder := &replayWriter{ResponseWriter: w, replay: res}
+	next.ServeHTTP(recorder, r.WithContext(context.WithValue(ctx, replayKey{}, res)))
+	if res.header == nil {
+		res.header = w.Header().Clone()
+	}
+}
+
+// replayWriter copies a response into a replay while passing it on. Once
+// the client has gone away, writes still succeed so the handler finishes
+// for the retries waiting on it.
+type replayWriter struct {
+	http.ResponseWriter
+	replay *replay
+	gone   bool
+}
+
+func (w *replayWriter) WriteHeader(status int) {
+	w.replay.status = status
+	w.replay.header = w.Header().Clone()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *replayWriter) Write(b []byte) (int, error) {
+	if w.replay.header == nil {
+		w.replay.header = w.Header().Clone()
+	}
+	if !w.replay.failed.Load() {
+		if w.replay.buf.Len()+len(b) > MaxReplayBytes {
+			w.replay.failed.Store(true)
+			w.replay.buf = bytes.Buffer{}
+		} else {
+			w.replay.buf.Write(b)
+		}
+	}
+	if !w.gone {
+		if _, err := w.ResponseWriter.Write(b); err != nil {
+			w.gone = true
+		}
+	}
+	return len(b), nil
+}
+
+// Flush lets streaming handlers flush through the wrapper.
+func (w *replayWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && !w.gone {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (w *replayWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
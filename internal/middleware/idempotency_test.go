@@ -0,0 +1,175 @@
+package middleware_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+)
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	var calls atomic.Int32
+	h := middleware.IdempotencyMiddleware(middleware.NewReplayStore(middleware.DefaultReplays, time.Minute), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: completion " + string(rune('0'+n)) + "\n\n"))
+	}))
+
+	post := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set(middleware.IdempotencyKeyHeader, key)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := post("abc", `{"prompt":"x"}`)
+	retry := post("abc", `{"prompt":"x"}`)
+	if retry.Body.String() != first.Body.String() || retry.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("expected the retry to replay %q, got %q", first.Body.String(), retry.Body.String())
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected the handler to run once, got %d", n)
+	}
+
+	if rr := post("abc", `{"prompt":"y"}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected status %d for a reused key, got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+	post("", `{"prompt":"x"}`)
+	post("other", `{"prompt":"x"}`)
+	if n := calls.Load(); n != 3 {
+		t.Errorf("expected requests without the key or with another to run, got %d runs", n)
+	}
+}
+
+func TestIdempotencyMiddleware_ClientGone(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	h := middleware.IdempotencyMiddleware(middleware.NewReplayStore(middleware.DefaultReplays, time.Minute), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		if err := r.Context().Err(); err != nil {
+			t.Errorf("expected the first request to outlive its client while a retry waits, got %v", err)
+		}
+		_, _ = w.Write([]byte("done"))
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/chat/completions", nil).WithContext(ctx)
+	req.Header.Set(middleware.IdempotencyKeyHeader, "abc")
+	go h.ServeHTTP(httptest.NewRecorder(), req)
+	<-started
+
+	// The retry arrives while the first request still runs, and waits for
+	// it, so the first goes on when its client goes away.
+	replayed := make(chan string)
+	go func() {
+		req := httptest.NewRequest(http.MethodPost, "/chat/completions", nil)
+		req.Header.Set(middleware.IdempotencyKeyHeader, "abc")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		replayed <- rr.Body.String()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	if got := <-replayed; got != "done" {
+		t.Errorf("expected the retry to replay the whole response, got %q", got)
+	}
+}
+
+func TestIdempotencyMiddleware_Canceled(t *testing.T) {
+	var calls atomic.Int32
+	canceled := make(chan struct{})
+	h := middleware.IdempotencyMiddleware(middleware.NewReplayStore(middleware.DefaultReplays, time.Minute), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) > 1 {
+			_, _ = w.Write([]byte("second"))
+			return
+		}
+		<-r.Context().Done()
+		close(canceled)
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/chat/completions", nil).WithContext(ctx)
+	req.Header.Set(middleware.IdempotencyKeyHeader, "abc")
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the work to be canceled with no request waiting for it")
+	}
+	<-done
+
+	req = httptest.NewRequest(http.MethodPost, "/chat/completions", nil)
+	req.Header.Set(middleware.IdempotencyKeyHeader, "abc")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Body.String() != "second" {
+		t.Errorf("expected the retry of a canceled request to run it again, got %q", rr.Body.String())
+	}
+}
+
+func TestIdempotencyMiddleware_NotReplayed(t *testing.T) {
+	var calls atomic.Int32
+	h := middleware.IdempotencyMiddleware(middleware.NewReplayStore(1, time.Minute), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		switch r.URL.Path {
+		case "/error":
+			_, _ = w.Write([]byte("data: {\"error\": {}}\n\n"))
+			middleware.ResponseFailed(r.Context())
+		case "/large":
+			_, _ = w.Write([]byte(strings.Repeat("x", middleware.MaxReplayBytes+1)))
+		default:
+			_, _ = w.Write([]byte("ok"))
+		}
+	}))
+	post := func(path, key, apiKey, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set(middleware.IdempotencyKeyHeader, key)
+		if apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for _, path := range []string{"/error", "/large"} {
+		before := calls.Load()
+		post(path, "abc", "", "")
+		post(path, "abc", "", "")
+		if n := calls.Load() - before; n != 2 {
+			t.Errorf("expected the retry of %s to run again, got %d runs", path, n)
+		}
+	}
+
+	if rr := post("/v1/completions", "abc", "", strings.Repeat("x", middleware.MaxRequestBytes+1)); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status %d for a body that is too large, got %d", http.StatusRequestEntityTooLarge, rr.Code)
+	}
+
+	before := calls.Load()
+	post("/v1/completions", "same", "alice", "x")
+	if rr := post("/v1/completions", "same", "bob", "y"); rr.Code != http.StatusOK || calls.Load()-before != 2 {
+		t.Errorf("expected clients to have keys of their own, got status %d after %d runs", rr.Code, calls.Load()-before)
+	}
+	// The store keeps one response, so bob's replaced alice's.
+	post("/v1/completions", "same", "alice", "x")
+	if n := calls.Load() - before; n != 3 {
+		t.Errorf("expected the oldest response to be evicted, got %d runs", n)
+	}
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+type logFieldsKey struct{}
+
+// logFields collects the fields that handlers attach to the access log line
+// of the request they are serving.
+type logFields struct {
+	mu     sync.Mutex
+	fields []zap.Field
+}
+
+func (f *logFields) Fields() []zap.Field {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.fields)
+}
+
+// AddLogField attaches key=value to the access log line of the request
+// carrying ctx. It does nothing outside of LogMiddleware.
+func AddLogField(ctx context.Context, key string, value any) {
+	f, ok := ctx.Value(logFieldsKey{}).(*logFields)
+	if !ok {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fields = append(f.fields, zap.Any(key, value))
+}
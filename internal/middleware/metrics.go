@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
+)
+
+// MetricsMiddleware counts and times requests by the routes pattern that
+// serves them. Requests no route serves are counted as "unmatched", so
+// the number of label values stays bounded.
+func MetricsMiddleware(routes *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint := route(routes, r)
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		metrics.Requests.Inc(endpoint)
+		metrics.RequestSeconds.Observe(endpoint, time.Since(start).Seconds())
+	})
+}
+
+// route returns the pattern of routes that serves r, or "unmatched".
+func route(routes *http.ServeMux, r *http.Request) string {
+	if _, pattern := routes.Handler(r); pattern != "" {
+		return pattern
+	}
+	return "unmatched"
+}
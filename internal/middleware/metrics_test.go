@@ -0,0 +1,31 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/metered", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h := middleware.MetricsMiddleware(mux, mux)
+
+	before, unmatched := metrics.Requests.Get("/metered"), metrics.Requests.Get("unmatched")
+	for _, path := range []string{"/metered", "/metered", "/no-such-route"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	if got := metrics.Requests.Get("/metered") - before; got != 2 {
+		t.Errorf("expected 2 requests for the route, got %v", got)
+	}
+	if got := metrics.Requests.Get("unmatched") - unmatched; got != 1 {
+		t.Errorf("expected 1 unmatched request, got %v", got)
+	}
+	if got := metrics.RequestSeconds.Count("/metered"); got < 2 {
+		t.Errorf("expected the route's requests to be timed, got %d observations", got)
+	}
+}
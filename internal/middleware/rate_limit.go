@@ -0,0 +1,241 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/events"
+	"github.com/josuemontano/ollama-copilot/internal/health"
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
+	"github.com/josuemontano/ollama-copilot/internal/storage"
+)
+
+// QuotaWarning is the share of its burst a client has left when an
+// events.QuotaNearing event warns that it is running out of requests.
+const QuotaWarning = 0.2
+
+// rateBucket is the storage bucket of the token buckets of a shared
+// RateLimiter.
+const rateBucket = "rate_limits"
+
+// RateLimiter keeps a token bucket per client, shared by the listeners. A
+// client is identified by the API key it presents or else by its IP address.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	// shared, when set, keeps the buckets where every server behind a
+	// load balancer takes from them.
+	shared storage.Shared
+}
+
+// bucket holds the tokens a client has left as of updated.
+type bucket struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+}
+
+// NewRateLimiter returns a limiter letting each client make rate requests
+// per second on average and up to burst at once. A burst below one allows
+// one request at a time.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{rate: rate, burst: math.Max(float64(burst), 1), buckets: map[string]*bucket{}}
+}
+
+// Share keeps the buckets in s, so that the servers using it limit each
+// client together. It must be called before serving. A server that cannot
+// reach s limits its clients on its own meanwhile.
+func (l *RateLimiter) Share(s storage.Shared) {
+	l.shared = s
+}
+
+// take takes a token from the bucket of client. When it is empty, it
+// returns how long until the next token instead.
+func (l *RateLimiter) take(client string, now time.Time) (time.Duration, bool) {
+	if l.shared != nil {
+		if wait, left, err := l.takeShared(client, now); err == nil {
+			return wait, l.took(client, left)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Forget the clients whose buckets have refilled, as a full bucket is
+	// the same as a new one.
+	if now.Sub(l.lastSweep) > time.Minute {
+		for k, b := range l.buckets {
+			if l.tokens(b, now) >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{Tokens: l.burst, Updated: now}
+		l.buckets[client] = b
+	}
+	wait, ok := l.takeFrom(b, now)
+	if !ok {
+		return wait, false
+	}
+	return 0, l.took(client, b.Tokens)
+}
+
+// takeShared takes a token from the bucket of client in the shared
+// storage, under its label so that API keys stay out of it. It returns the
+// tokens left, or -1 and how long until the next token when it is empty.
+func (l *RateLimiter) takeShared(client string, now time.Time) (time.Duration, float64, error) {
+	var wait time.Duration
+	left := -1.0
+	// A full bucket is the same as a new one, so it is kept until then.
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	err := l.shared.Update(rateBucket, clientLabel(client), full+time.Second, func(value []byte, found bool) []byte {
+		b := bucket{Tokens: l.burst, Updated: now}
+		if found {
+			_ = json.Unmarshal(value, &b)
+		}
+		var ok bool
+		left = -1
+		if wait, ok = l.takeFrom(&b, now); ok {
+			left = b.Tokens
+		}
+		value, _ = json.Marshal(b)
+		return value
+	})
+	return wait, left, err
+}
+
+// takeFrom refills b as of now and takes a token from it. When it is
+// empty, it returns how long until the next token instead.
+func (l *RateLimiter) takeFrom(b *bucket, now time.Time) (time.Duration, bool) {
+	b.Tokens = l.tokens(b, now)
+	b.Updated = now
+	if b.Tokens < 1 {
+		return time.Duration((1 - b.Tokens) / l.rate * float64(time.Second)), false
+	}
+	b.Tokens--
+	return 0, true
+}
+
+// took reports whether client took a token, leaving it left, and warns
+// once each time its bucket drains past QuotaWarning.
+func (l *RateLimiter) took(client string, left float64) bool {
+	if left < 0 {
+		return false
+	}
+	if warn := l.burst * QuotaWarning; left < warn && left+1 >= warn {
+		events.Publish(events.QuotaNearing, events.Fields{"client": clientLabel(client), "remaining": int(left), "burst": int(l.burst)})
+	}
+	return true
+}
+
+// tokens returns the tokens b has as of now.
+func (l *RateLimiter) tokens(b *bucket, now time.Time) float64 {
+	return math.Min(l.burst, b.Tokens+now.Sub(b.Updated).Seconds()*l.rate)
+}
+
+// Exhausted reports whether the client of r is out of its rate, and how
+// long until it may make a request again. It takes no token. A nil limiter
+// is never exhausted.
+func (l *RateLimiter) Exhausted(r *http.Request) (time.Duration, bool) {
+	if l == nil {
+		return 0, false
+	}
+	b, ok := l.bucket(clientKey(r))
+	if !ok {
+		return 0, false
+	}
+	tokens := l.tokens(&b, time.Now())
+	if tokens >= 1 {
+		return 0, false
+	}
+	return time.Duration((1 - tokens) / l.rate * float64(time.Second)), true
+}
+
+// bucket returns a copy of the bucket of client, from the shared storage
+// when the limiter has one.
+func (l *RateLimiter) bucket(client string) (bucket, bool) {
+	if l.shared != nil {
+		if value, ok, err := l.shared.Get(rateBucket, clientLabel(client)); err == nil {
+			var b bucket
+			return b, ok && json.Unmarshal(value, &b) == nil
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[client]
+	if !ok {
+		return bucket{}, false
+	}
+	return *b, true
+}
+
+// RateLimitMiddleware answers requests of clients over their rate with 429
+// and a Retry-After header. A nil limiter lets every request through.
+func RateLimitMiddleware(limiter *RateLimiter, next http.Handler) http.Handler {
+	if limiter == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wait, ok := limiter.take(clientKey(r), time.Now()); !ok {
+			metrics.Throttled.Inc("rate_limit")
+			AddLogField(r.Context(), "throttled", "rate_limit")
+			w.Header().Set(health.Header, health.OverQuota)
+			TooManyRequests(w, wait, "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TooManyRequests answers 429 with message, asking the client to retry
+// after wait, rounded up to whole seconds.
+func TooManyRequests(w http.ResponseWriter, wait time.Duration, message string) {
+	seconds := max(int(math.Ceil(wait.Seconds())), 1)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, message, http.StatusTooManyRequests)
+}
+
+// ClientID identifies the client of r as rate limits do, without revealing
+// its API key, for events that concern one client only.
+func ClientID(r *http.Request) string {
+	return clientLabel(clientKey(r))
+}
+
+// clientLabel returns key as ClientID does: API keys are replaced by the
+// start of their SHA-256.
+func clientLabel(key string) string {
+	apiKey, ok := strings.CutPrefix(key, "key:")
+	if !ok {
+		return key
+	}
+	sum := sha256.Sum256([]byte(apiKey))
+	return "key:" + hex.EncodeToString(sum[:6])
+}
+
+// clientKey identifies the client of r for rate limits.
+func clientKey(r *http.Request) string {
+	if key := presentedKey(r); key != "" {
+		return "key:" + key
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
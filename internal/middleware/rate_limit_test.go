@@ -0,0 +1,123 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/events"
+	"github.com/josuemontano/ollama-copilot/internal/health"
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+	"github.com/josuemontano/ollama-copilot/internal/redistest"
+	"github.com/josuemontano/ollama-copilot/internal/storage"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := middleware.RateLimitMiddleware(middleware.NewRateLimiter(0.5, 2), ok)
+
+	get := func(remoteAddr, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", nil)
+		req.RemoteAddr = remoteAddr
+		if key != "" {
+			req.Header.Set(middleware.APIKeyHeader, key)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for i := range 2 {
+		if rr := get("10.0.0.1:5000", ""); rr.Code != http.StatusOK {
+			t.Fatalf("expected request %d within the burst to pass, got %d", i, rr.Code)
+		}
+	}
+	rr := get("10.0.0.1:5001", "")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429 over the burst, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("expected Retry-After 2 at half a request per second, got %q", got)
+	}
+	if got := rr.Header().Get(health.Header); got != health.OverQuota {
+		t.Errorf("expected the response to say the client is over quota, got %q", got)
+	}
+
+	if rr := get("10.0.0.2:5000", ""); rr.Code != http.StatusOK {
+		t.Errorf("expected another address to have its own bucket, got %d", rr.Code)
+	}
+	if rr := get("10.0.0.1:5000", "editor-key"); rr.Code != http.StatusOK {
+		t.Errorf("expected an API key to have its own bucket, got %d", rr.Code)
+	}
+}
+
+func TestRateLimitMiddleware_Shared(t *testing.T) {
+	srv := redistest.NewServer(t)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	var servers []http.Handler
+	for range 2 {
+		store, err := storage.OpenRedis(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		limiter := middleware.NewRateLimiter(0.5, 3)
+		limiter.Share(store)
+		servers = append(servers, middleware.RateLimitMiddleware(limiter, ok))
+	}
+
+	codes := make([]int, 4)
+	for i := range codes {
+		req := httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", nil)
+		req.Header.Set(middleware.APIKeyHeader, "editor-key")
+		rr := httptest.NewRecorder()
+		servers[i%2].ServeHTTP(rr, req)
+		codes[i] = rr.Code
+	}
+	if codes[2] != http.StatusOK || codes[3] != http.StatusTooManyRequests {
+		t.Errorf("expected both servers to take from one burst of 3, got %v", codes)
+	}
+}
+
+func TestRateLimitMiddleware_Disabled(t *testing.T) {
+	h := middleware.RateLimitMiddleware(nil, http.NotFoundHandler())
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected requests to pass without rate limits, got %d", rr.Code)
+	}
+}
+
+func TestRateLimitMiddleware_QuotaNearing(t *testing.T) {
+	var mu sync.Mutex
+	var warnings []events.Event
+	unsubscribe := events.Default.Subscribe(func(e events.Event) {
+		if e.Type == events.QuotaNearing {
+			mu.Lock()
+			warnings = append(warnings, e)
+			mu.Unlock()
+		}
+	})
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := middleware.RateLimitMiddleware(middleware.NewRateLimiter(0.001, 10), ok)
+	req := httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", nil)
+	req.Header.Set(middleware.APIKeyHeader, "secret-key")
+	for range 10 {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	unsubscribe()
+
+	if len(warnings) != 1 {
+		t.Fatalf("expected one warning as the bucket drained, got %+v", warnings)
+	}
+	if client := warnings[0].Fields["client"]; client != middleware.ClientID(req) || strings.Contains(client.(string), "secret-key") {
+		t.Errorf("expected the client to be named without its key, got %v", client)
+	}
+	if remaining := warnings[0].Fields["remaining"]; remaining != 1 {
+		t.Errorf("expected 1 request left, got %v", remaining)
+	}
+}
@@ -1,14 +1,28 @@
 package middleware
 
 import (
-	"log"
+	"context"
+	"errors"
 	"net/http"
 	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/events"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
+// ResponseWriterLogged records what a handler wrote so it can be reported
+// in the access log.
 type ResponseWriterLogged struct {
 	http.ResponseWriter
 	Status int
+	// Bytes is the number of body bytes written.
+	Bytes int64
+	// FirstByte is when the first body byte was written.
+	FirstByte time.Time
+	// WriteFailed reports whether a write to the client failed, which for
+	// streams means the client went away before the end.
+	WriteFailed bool
 }
 
 func (w *ResponseWriterLogged) WriteHeader(status int) {
@@ -16,12 +30,63 @@ func (w *ResponseWriterLogged) WriteHeader(status int) {
 	w.ResponseWriter.WriteHeader(status)
 }
 
-func LogMiddleware(next http.Handler) http.Handler {
+func (w *ResponseWriterLogged) Write(b []byte) (int, error) {
+	if w.FirstByte.IsZero() {
+		w.FirstByte = time.Now()
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.Bytes += int64(n)
+	if err != nil {
+		w.WriteFailed = true
+	}
+	return n, err
+}
+
+// Flush lets streaming handlers flush through the wrapper.
+func (w *ResponseWriterLogged) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (w *ResponseWriterLogged) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// LogMiddleware writes an access log line to logger for every request and
+// publishes its start and end as events. Handlers add fields to the line
+// with AddLogField. A nil logger only publishes the events.
+func LogMiddleware(logger *zap.Logger, next http.Handler) http.Handler {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		record := ResponseWriterLogged{w, http.StatusOK}
-		log.Printf("request: %s %s", r.Method, r.URL.Path)
-		next.ServeHTTP(&record, r)
-		log.Printf("response: %s %s %d %s", r.Method, r.URL.Path, record.Status, time.Since(start))
+		record := ResponseWriterLogged{ResponseWriter: w, Status: http.StatusOK}
+		fields := &logFields{}
+		logger.Debug("request", zap.String("method", r.Method), zap.String("path", r.URL.Path))
+		events.Publish(events.RequestStarted, events.Fields{"method": r.Method, "path": r.URL.Path})
+		next.ServeHTTP(&record, r.WithContext(context.WithValue(r.Context(), logFieldsKey{}, fields)))
+
+		access := []zap.Field{
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path),
+			zap.Int("status", record.Status),
+			zap.Int64("bytes", record.Bytes),
+			zap.Duration("duration", time.Since(start)),
+			zap.Bool("client_gone", record.WriteFailed || errors.Is(r.Context().Err(), context.Canceled)),
+		}
+		if !record.FirstByte.IsZero() {
+			access = append(access, zap.Duration("first_byte", record.FirstByte.Sub(start)))
+		}
+		access = append(access, fields.Fields()...)
+		logger.Info("response", access...)
+
+		finished := zapcore.NewMapObjectEncoder()
+		for _, f := range access {
+			f.AddTo(finished)
+		}
+		events.Publish(events.RequestFinished, finished.Fields)
 	})
 }
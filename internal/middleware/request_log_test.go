@@ -0,0 +1,72 @@
+package middleware_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLogMiddleware_AccessLog(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	h := middleware.LogMiddleware(zap.New(core), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		middleware.AddLogField(r.Context(), "model", "qwen")
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = w.Write([]byte("hello"))
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", nil))
+
+	entries := logs.FilterMessage("response").All()
+	if len(entries) != 1 {
+		t.Fatalf("expected one access log entry, got %d", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if fields["status"] != int64(http.StatusTeapot) {
+		t.Errorf("expected status %d, got %v", http.StatusTeapot, fields["status"])
+	}
+	if fields["bytes"] != int64(5) {
+		t.Errorf("expected 5 bytes, got %v", fields["bytes"])
+	}
+	if fields["model"] != "qwen" {
+		t.Errorf("expected the handler field to be logged, got %v", fields["model"])
+	}
+	if fields["client_gone"] != false {
+		t.Errorf("expected client_gone to be false, got %v", fields["client_gone"])
+	}
+	if _, ok := fields["first_byte"]; !ok {
+		t.Error("expected the time to first byte to be logged")
+	}
+}
+
+func TestLogMiddleware_ClientGone(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	h := middleware.LogMiddleware(zap.New(core), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+
+	entries := logs.FilterMessage("response").All()
+	if len(entries) != 1 || entries[0].ContextMap()["client_gone"] != true {
+		t.Errorf("expected client_gone to be logged for a canceled request, got %v", entries)
+	}
+}
+
+func TestLogMiddleware_NilLogger(t *testing.T) {
+	h := middleware.LogMiddleware(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		middleware.AddLogField(r.Context(), "model", "qwen")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("expected status code %d, got %d", http.StatusNoContent, rr.Code)
+	}
+}
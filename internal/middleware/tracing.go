@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/josuemontano/ollama-copilot/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TraceMiddleware starts a server span for every request, named after the
+// routes pattern that serves it. A traceparent header sent by the client
+// makes the span a child of the client's, so editor and server spans line
+// up in one trace.
+func TraceMiddleware(routes *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint := route(routes, r)
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Tracer().Start(ctx, r.Method+" "+endpoint,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", endpoint),
+				attribute.String("url.path", r.URL.Path),
+			))
+		defer span.End()
+
+		record := &ResponseWriterLogged{ResponseWriter: w, Status: http.StatusOK}
+		next.ServeHTTP(record, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", record.Status), attribute.Int64("http.response.body.size", record.Bytes))
+		if record.Status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(record.Status))
+		}
+	})
+}
@@ -0,0 +1,57 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceMiddleware(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	previous, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/traced", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !trace.SpanFromContext(r.Context()).SpanContext().IsValid() {
+			t.Error("expected the handler's context to carry the request span")
+		}
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	h := middleware.TraceMiddleware(mux, mux)
+
+	req := httptest.NewRequest(http.MethodGet, "/traced", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected one span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name != "GET /traced" {
+		t.Errorf("expected span name %q, got %q", "GET /traced", span.Name)
+	}
+	if got := span.SpanContext.TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected the client's trace ID, got %s", got)
+	}
+	found := false
+	for _, attr := range span.Attributes {
+		found = found || (attr.Key == "http.response.status_code" && attr.Value.AsInt64() == http.StatusTeapot)
+	}
+	if !found {
+		t.Errorf("expected the status code to be recorded, got %v", span.Attributes)
+	}
+}
@@ -0,0 +1,266 @@
+// Package ollamatest provides a fake Ollama server for tests. It implements
+// the part of the Ollama API the proxy uses, answering generate and chat
+// requests with scripted replies.
+package ollamatest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// Reply scripts the answer to a generate or chat request.
+type Reply struct {
+	// Chunks are the pieces of the response, one line each when the
+	// request streams. The last one is done.
+	Chunks []string
+	// Delay is waited before the first chunk and ChunkDelay before each
+	// next one. Both end early when the client goes away.
+	Delay      time.Duration
+	ChunkDelay time.Duration
+	// Status, when set, answers with that status code and Error instead.
+	Status int
+	Error  string
+	// Metrics are sent with the last chunk.
+	Metrics api.Metrics
+}
+
+// Text returns a reply streaming chunks.
+func Text(chunks ...string) Reply {
+	return Reply{Chunks: chunks}
+}
+
+// Failure returns a reply answering with status and an error message, like
+// Ollama does for a missing model or a crashed runner.
+func Failure(status int, message string) Reply {
+	return Reply{Status: status, Error: message}
+}
+
+// Server is a fake Ollama server. Its handlers may be replaced while it
+// runs. Unscripted generate and chat requests get an empty reply.
+type Server struct {
+	// URL is the base URL of the server, as OLLAMA_HOST takes it.
+	URL string
+
+	client    *api.Client
+	mu        sync.Mutex
+	generate  func(api.GenerateRequest) Reply
+	chat      func(api.ChatRequest) Reply
+	models    []api.ModelResponse
+	show      api.ShowResponse
+	generates []api.GenerateRequest
+	chats     []api.ChatRequest
+	canceled  int
+}
+
+// NewServer starts a fake Ollama server that is closed when t ends, and
+// points OLLAMA_HOST at it for the rest of t.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+
+	s := &Server{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("Ollama is running"))
+	})
+	mux.HandleFunc("GET /api/version", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"version": "0.0.0"})
+	})
+	mux.HandleFunc("GET /api/tags", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		writeJSON(w, http.StatusOK, api.ListResponse{Models: s.models})
+	})
+	mux.HandleFunc("GET /api/ps", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string][]any{"models": {}})
+	})
+	mux.HandleFunc("POST /api/show", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		writeJSON(w, http.StatusOK, s.show)
+	})
+	mux.HandleFunc("POST /api/generate", s.serveGenerate)
+	mux.HandleFunc("POST /api/chat", s.serveChat)
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	s.URL = srv.URL
+
+	t.Setenv("OLLAMA_HOST", srv.URL)
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.client = client
+	return s
+}
+
+// Client returns an Ollama client of the server.
+func (s *Server) Client() *api.Client {
+	return s.client
+}
+
+// OnGenerate answers generate requests with the reply of fn.
+func (s *Server) OnGenerate(fn func(api.GenerateRequest) Reply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generate = fn
+}
+
+// OnChat answers chat requests with the reply of fn.
+func (s *Server) OnChat(fn func(api.ChatRequest) Reply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chat = fn
+}
+
+// SetModels sets the models /api/tags lists.
+func (s *Server) SetModels(names ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.models = nil
+	for _, name := range names {
+		s.models = append(s.models, api.ModelResponse{Name: name})
+	}
+}
+
+// SetShow sets the metadata /api/show returns for every model.
+func (s *Server) SetShow(show api.ShowResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.show = show
+}
+
+// Generates returns the generate requests received so far.
+func (s *Server) Generates() []api.GenerateRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]api.GenerateRequest(nil), s.generates...)
+}
+
+// Chats returns the chat requests received so far.
+func (s *Server) Chats() []api.ChatRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]api.ChatRequest(nil), s.chats...)
+}
+
+// Canceled returns how many replies the client went away from before
+// they were done.
+func (s *Server) Canceled() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.canceled
+}
+
+func (s *Server) serveGenerate(w http.ResponseWriter, r *http.Request) {
+	var req api.GenerateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	s.mu.Lock()
+	s.generates = append(s.generates, req)
+	fn := s.generate
+	s.mu.Unlock()
+
+	var reply Reply
+	if fn != nil {
+		reply = fn(req)
+	}
+	s.reply(w, r, reply, req.Stream, func(chunk string, done bool) any {
+		resp := api.GenerateResponse{Model: req.Model, CreatedAt: time.Now(), Response: chunk, Done: done}
+		if done {
+			resp.Metrics = reply.Metrics
+		}
+		return resp
+	})
+}
+
+func (s *Server) serveChat(w http.ResponseWriter, r *http.Request) {
+	var req api.ChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	s.mu.Lock()
+	s.chats = append(s.chats, req)
+	fn := s.chat
+	s.mu.Unlock()
+
+	var reply Reply
+	if fn != nil {
+		reply = fn(req)
+	}
+	s.reply(w, r, reply, req.Stream, func(chunk string, done bool) any {
+		resp := api.ChatResponse{Model: req.Model, CreatedAt: time.Now(), Message: api.Message{Role: "assistant", Content: chunk}, Done: done}
+		if done {
+			resp.Metrics = reply.Metrics
+		}
+		return resp
+	})
+}
+
+// reply writes reply, as one line per chunk when stream is unset or true
+// and as a single response otherwise. chunk builds the response of a chunk.
+func (s *Server) reply(w http.ResponseWriter, r *http.Request, reply Reply, stream *bool, chunk func(text string, done bool) any) {
+	if !s.wait(r, reply.Delay) {
+		return
+	}
+	if reply.Status != 0 {
+		writeJSON(w, reply.Status, map[string]string{"error": reply.Error})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if stream != nil && !*stream {
+		writeJSON(w, http.StatusOK, chunk(strings.Join(reply.Chunks, ""), true))
+		return
+	}
+	chunks := reply.Chunks
+	if len(chunks) == 0 {
+		chunks = []string{""}
+	}
+	enc := json.NewEncoder(w)
+	for i, text := range chunks {
+		if i > 0 && !s.wait(r, reply.ChunkDelay) {
+			return
+		}
+		_ = enc.Encode(chunk(text, i == len(chunks)-1))
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+// wait waits for d, returning false when the client went away first.
+func (s *Server) wait(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-r.Context().Done():
+		s.mu.Lock()
+		s.canceled++
+		s.mu.Unlock()
+		return false
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
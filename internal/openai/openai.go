@@ -0,0 +1,305 @@
+// Package openai generates completions and chats with servers speaking the
+// OpenAI API, such as llama.cpp's llama-server, vLLM, LM Studio or a hosted
+// endpoint, in place of Ollama. Client takes and returns the Ollama API's
+// types, so that the handlers use either without knowing which.
+package openai
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// Client talks to an OpenAI-compatible server. Its requests go through
+// http.DefaultClient, like the Ollama client's, so that backend routing and
+// forwarded headers apply to them too.
+type Client struct {
+	base *url.URL
+	key  string
+}
+
+// New returns a Client for the server at baseURL, such as
+// http://127.0.0.1:8080/v1, authenticating with key unless it is empty.
+func New(baseURL, key string) (*Client, error) {
+	u, err := url.Parse(strings.TrimRight(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("parsing the OpenAI base URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("OpenAI base URL %q must be an http or https URL", baseURL)
+	}
+	return &Client{base: u, key: key}, nil
+}
+
+// BaseURL returns the URL the API paths are relative to.
+func (c *Client) BaseURL() *url.URL {
+	u := *c.base
+	return &u
+}
+
+// streamOptions asks for the token counts in the last event.
+type streamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type completionRequest struct {
+	Model         string        `json:"model"`
+	Prompt        string        `json:"prompt"`
+	Stream        bool          `json:"stream"`
+	StreamOptions streamOptions `json:"stream_options"`
+	sampling
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatRequest struct {
+	Model         string        `json:"model"`
+	Messages      []chatMessage `json:"messages"`
+	Stream        bool          `json:"stream"`
+	StreamOptions streamOptions `json:"stream_options"`
+	sampling
+}
+
+// sampling holds the Ollama options the OpenAI API has a parameter for.
+type sampling struct {
+	MaxTokens        *int     `json:"max_tokens,omitempty"`
+	Temperature      *float64 `json:"temperature,omitempty"`
+	TopP             *float64 `json:"top_p,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	// DraftModel is the draft model servers such as LM Studio speculate
+	// with.
+	DraftModel string `json:"draft_model,omitempty"`
+}
+
+// samplingOf maps Ollama options to OpenAI parameters. Options without one,
+// such as num_ctx, are left out.
+func samplingOf(options map[string]interface{}) sampling {
+	var s sampling
+	if n, ok := number(options["num_predict"]); ok && n > 0 {
+		s.MaxTokens = ptr(int(n))
+	}
+	if v, ok := number(options["temperature"]); ok {
+		s.Temperature = &v
+	}
+	// Ollama takes a top_p of 0 as unset.
+	if v, ok := number(options["top_p"]); ok && v > 0 {
+		s.TopP = &v
+	}
+	if n, ok := number(options["seed"]); ok {
+		s.Seed = ptr(int(n))
+	}
+	if v, ok := number(options["presence_penalty"]); ok {
+		s.PresencePenalty = &v
+	}
+	if v, ok := number(options["frequency_penalty"]); ok {
+		s.FrequencyPenalty = &v
+	}
+	if model, ok := options["draft_model"].(string); ok {
+		s.DraftModel = model
+	}
+	switch stop := options["stop"].(type) {
+	case []string:
+		s.Stop = stop
+	case []interface{}:
+		for _, v := range stop {
+			if v, ok := v.(string); ok {
+				s.Stop = append(s.Stop, v)
+			}
+		}
+	}
+	return s
+}
+
+// DraftOptions names the draft_model option, which is sent as the
+// draft_model parameter that servers such as LM Studio take. Servers
+// without one ignore it.
+func (c *Client) DraftOptions() []string {
+	return []string{"draft_model"}
+}
+
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func ptr[T any](v T) *T { return &v }
+
+// event is a streamed chunk of either API.
+type event struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Text  string `json:"text"`
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+// Generate sends req to the completions API and calls fn with each piece of
+// the completion, then once more with Done set and the metrics. The prompt
+// is sent as it is, as Ollama does with Raw: there is no model template to
+// place a system prompt with, so System is left out.
+func (c *Client) Generate(ctx context.Context, req *api.GenerateRequest, fn api.GenerateResponseFunc) error {
+	body := completionRequest{
+		Model:         req.Model,
+		Prompt:        req.Prompt,
+		Stream:        true,
+		StreamOptions: streamOptions{IncludeUsage: true},
+		sampling:      samplingOf(req.Options),
+	}
+	return c.stream(ctx, "/completions", body, func(e event, done bool, m api.Metrics) error {
+		resp := api.GenerateResponse{Model: req.Model, CreatedAt: time.Now(), Done: done, Metrics: m}
+		if len(e.Choices) > 0 {
+			resp.Response = e.Choices[0].Text
+		}
+		if resp.Response == "" && !done {
+			return nil
+		}
+		return fn(resp)
+	})
+}
+
+// Chat sends req to the chat completions API and calls fn with each piece
+// of the answer, then once more with Done set and the metrics. Images are
+// left out.
+func (c *Client) Chat(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+	body := chatRequest{
+		Model:         req.Model,
+		Stream:        true,
+		StreamOptions: streamOptions{IncludeUsage: true},
+		sampling:      samplingOf(req.Options),
+	}
+	for _, m := range req.Messages {
+		body.Messages = append(body.Messages, chatMessage{Role: m.Role, Content: m.Content})
+	}
+	return c.stream(ctx, "/chat/completions", body, func(e event, done bool, m api.Metrics) error {
+		resp := api.ChatResponse{Model: req.Model, CreatedAt: time.Now(), Message: api.Message{Role: "assistant"}, Done: done, Metrics: m}
+		if len(e.Choices) > 0 {
+			resp.Message.Content = e.Choices[0].Delta.Content
+		}
+		if resp.Message.Content == "" && !done {
+			return nil
+		}
+		return fn(resp)
+	})
+}
+
+// stream posts body to path and calls fn with each server-sent event, and
+// with done set once the stream ends. The metrics of the last call are
+// timed from the request, the time to the first token standing for prompt
+// evaluation.
+func (c *Client) stream(ctx context.Context, path string, body any, fn func(e event, done bool, m api.Metrics) error) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	u := c.base.JoinPath(path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+	if c.key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.key)
+	}
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return ResponseError(resp)
+	}
+
+	var m api.Metrics
+	var first time.Time
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+		var e event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return fmt.Errorf("decoding an OpenAI event: %w", err)
+		}
+		if e.Usage != nil {
+			m.PromptEvalCount, m.EvalCount = e.Usage.PromptTokens, e.Usage.CompletionTokens
+		}
+		if first.IsZero() && len(e.Choices) > 0 {
+			first = time.Now()
+		}
+		if err := fn(e, false, api.Metrics{}); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	m.TotalDuration = time.Since(start)
+	if !first.IsZero() {
+		m.PromptEvalDuration = first.Sub(start)
+		m.EvalDuration = time.Since(first)
+	}
+	return fn(event{}, true, m)
+}
+
+// ResponseError reads the error of a failed response as the Ollama client
+// would report it, so that errors are classified the same way.
+func ResponseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	err := api.StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	// OpenAI nests the message in an object, some servers do not.
+	var nested struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	var flat struct {
+		Error string `json:"error"`
+	}
+	switch {
+	case json.Unmarshal(body, &nested) == nil && nested.Error.Message != "":
+		err.ErrorMessage = nested.Error.Message
+	case json.Unmarshal(body, &flat) == nil && flat.Error != "":
+		err.ErrorMessage = flat.Error
+	default:
+		err.ErrorMessage = strings.TrimSpace(string(body))
+	}
+	return err
+}
@@ -0,0 +1,138 @@
+package openai_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/openai"
+	"github.com/ollama/ollama/api"
+)
+
+// fakeServer answers every request with the SSE events, and keeps the path,
+// authorization and body of the last request.
+func fakeServer(t *testing.T, last *map[string]any, path, auth *string, events ...string) *openai.Client {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*path, *auth = r.URL.Path, r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(last); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, e := range events {
+			fmt.Fprintf(w, "data: %s\n\n", e)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	client, err := openai.New(srv.URL+"/v1/", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestClient_Generate(t *testing.T) {
+	var body map[string]any
+	var path, auth string
+	client := fakeServer(t, &body, &path, &auth,
+		`{"choices":[{"text":"fmt."}]}`,
+		`{"choices":[{"text":"Println"}]}`,
+		`{"choices":[],"usage":{"prompt_tokens":12,"completion_tokens":2}}`,
+		`[DONE]`)
+
+	var got []api.GenerateResponse
+	err := client.Generate(context.Background(), &api.GenerateRequest{
+		Model:   "qwen2.5-coder:7b",
+		Prompt:  "<|fim_prefix|>x<|fim_suffix|><|fim_middle|>",
+		System:  "You are an expert programming assistant.",
+		Options: map[string]interface{}{"num_predict": 50, "temperature": 0.2, "top_p": 0.0, "stop": []string{"\n\n"}, "num_ctx": 4096, "draft_model": "qwen2.5-coder:0.5b"},
+	}, func(resp api.GenerateResponse) error {
+		got = append(got, resp)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if path != "/v1/completions" || auth != "Bearer secret" {
+		t.Errorf("expected an authorized request to /v1/completions, got %s with %q", path, auth)
+	}
+	if body["prompt"] != "<|fim_prefix|>x<|fim_suffix|><|fim_middle|>" || body["max_tokens"] != float64(50) || body["temperature"] != 0.2 || body["draft_model"] != "qwen2.5-coder:0.5b" {
+		t.Errorf("expected the prompt and options to be passed on, got %v", body)
+	}
+	for _, key := range []string{"top_p", "num_ctx", "system"} {
+		if _, ok := body[key]; ok {
+			t.Errorf("expected %s to be left out, got %v", key, body)
+		}
+	}
+	if len(got) != 3 || got[0].Response != "fmt." || got[1].Response != "Println" || !got[2].Done {
+		t.Fatalf("expected two pieces and a done response, got %+v", got)
+	}
+	if got[2].PromptEvalCount != 12 || got[2].EvalCount != 2 || got[2].TotalDuration == 0 {
+		t.Errorf("expected the token counts and durations in the done response, got %+v", got[2].Metrics)
+	}
+}
+
+func TestClient_Chat(t *testing.T) {
+	var body map[string]any
+	var path, auth string
+	client := fakeServer(t, &body, &path, &auth,
+		`{"choices":[{"delta":{"role":"assistant"}}]}`,
+		`{"choices":[{"delta":{"content":"Use "}}]}`,
+		`{"choices":[{"delta":{"content":"errors.Is."}}]}`,
+		`[DONE]`)
+
+	var answer string
+	var done bool
+	err := client.Chat(context.Background(), &api.ChatRequest{
+		Model:    "llama3.1:8b",
+		Messages: []api.Message{{Role: "system", Content: "Be brief."}, {Role: "user", Content: "How do I compare errors?"}},
+	}, func(resp api.ChatResponse) error {
+		answer += resp.Message.Content
+		done = resp.Done
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/v1/chat/completions" {
+		t.Errorf("expected a request to /v1/chat/completions, got %s", path)
+	}
+	if messages, _ := body["messages"].([]any); len(messages) != 2 {
+		t.Errorf("expected the messages to be passed on, got %v", body["messages"])
+	}
+	if answer != "Use errors.Is." || !done {
+		t.Errorf("expected the whole answer and a done response, got %q (done %v)", answer, done)
+	}
+}
+
+func TestClient_StatusError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"error":{"message":"Loading model","type":"unavailable_error"}}`))
+	}))
+	t.Cleanup(srv.Close)
+	client, err := openai.New(srv.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Generate(context.Background(), &api.GenerateRequest{Model: "m", Prompt: "x"}, func(api.GenerateResponse) error { return nil })
+	var statusErr api.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable || statusErr.ErrorMessage != "Loading model" {
+		t.Errorf("expected the error as an Ollama status error, got %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, baseURL := range []string{"", "127.0.0.1:8080", "ftp://host/v1"} {
+		if _, err := openai.New(baseURL, ""); err == nil {
+			t.Errorf("expected %q to be refused", baseURL)
+		}
+	}
+}
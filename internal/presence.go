@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/backends"
+	"github.com/josuemontano/ollama-copilot/internal/presence"
+	"github.com/ollama/ollama/api"
+	"go.uber.org/zap"
+)
+
+// presenceInterval is how often, at most, heartbeats extend the keep_alive
+// of the model, and how often the server checks whether editors went idle.
+const presenceInterval = time.Minute
+
+// WatchPresence loads the model when the heartbeats of editor plugins start,
+// keeps it loaded while they go on and, with IdleUnload, unloads it once
+// none has come for that long, on every Ollama backend. Without heartbeats
+// it does nothing, so editors whose plugins send none get Ollama's own
+// keep_alive. OpenAI-compatible and llama.cpp servers choose what to keep
+// loaded themselves. It blocks and is meant to run in its own goroutine.
+func (s *Server) WatchPresence() {
+	if name, _ := s.remote(); name != "" {
+		return
+	}
+
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		s.logger().Error("Error initializing the Ollama client", zap.Error(err))
+		return
+	}
+	pool, err := s.backendPool()
+	if err != nil {
+		return
+	}
+	tracker := s.presenceTracker()
+
+	ticker := time.NewTicker(presenceInterval)
+	defer ticker.Stop()
+
+	// extended is when the keep_alive of the model was last extended, and
+	// the zero time while it may not be loaded.
+	var extended time.Time
+	for {
+		select {
+		case <-tracker.Beats():
+			if time.Since(extended) < presenceInterval {
+				continue
+			}
+			model := s.currentModel()
+			if err := setKeepAlive(client, pool, model, s.presenceKeepAlive()); err != nil {
+				s.logger().Warn("Error loading the model for an active editor", zap.String("model", model), zap.Error(err))
+				continue
+			}
+			if extended.IsZero() {
+				s.logger().Info("Model loaded for an active editor", zap.String("model", model))
+			}
+			extended = time.Now()
+		case <-ticker.C:
+			if s.IdleUnload <= 0 || extended.IsZero() || time.Since(tracker.LastBeat()) < s.IdleUnload {
+				continue
+			}
+			model := s.currentModel()
+			if err := setKeepAlive(client, pool, model, 0); err != nil {
+				s.logger().Warn("Error unloading the model", zap.String("model", model), zap.Error(err))
+				continue
+			}
+			s.logger().Info("Model unloaded, editors are idle", zap.String("model", model), zap.Duration("idle", time.Since(tracker.LastBeat())))
+			extended = time.Time{}
+		}
+	}
+}
+
+// presenceKeepAlive is how long Ollama keeps the model loaded after a
+// heartbeat, past the next idle check so Ollama does not unload it first.
+// Without IdleUnload, the model stays loaded for as long as Ollama runs.
+func (s *Server) presenceKeepAlive() time.Duration {
+	if s.IdleUnload <= 0 {
+		return -1
+	}
+	return s.IdleUnload + presenceInterval
+}
+
+// currentModel returns the model completions are generated with, which
+// reloads and the admin endpoints may have changed since the start.
+func (s *Server) currentModel() string {
+	if completions := s.completions.Load(); completions != nil {
+		return completions.Config().Model
+	}
+	return s.Model
+}
+
+// setKeepAlive loads model on every backend of pool, where it is not, and
+// keeps it loaded for keepAlive, a negative duration meaning forever. Zero
+// unloads it.
+func setKeepAlive(client *api.Client, pool *backends.Pool, model string, keepAlive time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	all := pool.Backends()
+	errs := make([]error, len(all))
+	var wg sync.WaitGroup
+	for i, b := range all {
+		wg.Go(func() {
+			req := &api.GenerateRequest{Model: model, KeepAlive: &api.Duration{Duration: keepAlive}}
+			err := client.Generate(backends.WithBackend(ctx, b), req, func(api.GenerateResponse) error {
+				return nil
+			})
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %w", b.Name, err)
+			}
+		})
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// presenceTracker returns the tracker of heartbeats shared by all
+// listeners.
+func (s *Server) presenceTracker() *presence.Tracker {
+	s.presenceOnce.Do(func() {
+		s.presence = presence.NewTracker()
+	})
+	return s.presence
+}
@@ -0,0 +1,58 @@
+// Package presence tracks whether someone is working in an editor, from the
+// heartbeats editor plugins send on focus and typing events, so the model
+// can be loaded before the first completion and unloaded once everyone has
+// left.
+package presence
+
+import (
+	"sync"
+	"time"
+)
+
+// Tracker records the heartbeats of editor plugins. It is safe for
+// concurrent use.
+type Tracker struct {
+	mu    sync.Mutex
+	last  time.Time
+	file  string
+	beats chan struct{}
+}
+
+// NewTracker returns a Tracker that has seen no heartbeat yet.
+func NewTracker() *Tracker {
+	return &Tracker{beats: make(chan struct{}, 1)}
+}
+
+// Beat records a heartbeat from an editor showing file, which may be empty
+// when the plugin does not say. It reports whether file is another file
+// than the one of the last heartbeat naming a file.
+func (t *Tracker) Beat(file string) bool {
+	t.mu.Lock()
+	t.last = time.Now()
+	changed := file != "" && file != t.file
+	if file != "" {
+		t.file = file
+	}
+	t.mu.Unlock()
+
+	// A watcher only needs to know that heartbeats arrived since it last
+	// looked, so a beat is dropped while one is pending.
+	select {
+	case t.beats <- struct{}{}:
+	default:
+	}
+	return changed
+}
+
+// LastBeat returns the time of the last heartbeat, or the zero time when
+// there has been none.
+func (t *Tracker) LastBeat() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.last
+}
+
+// Beats receives a value when heartbeats arrived since the last receive.
+func (t *Tracker) Beats() <-chan struct{} {
+	return t.beats
+}
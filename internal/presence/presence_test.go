@@ -0,0 +1,41 @@
+package presence_test
+
+import (
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/presence"
+)
+
+func TestTracker(t *testing.T) {
+	tracker := presence.NewTracker()
+	if !tracker.LastBeat().IsZero() {
+		t.Fatal("expected no heartbeat yet")
+	}
+
+	if !tracker.Beat("a.go") {
+		t.Error("expected the first file to be reported as changed")
+	}
+	if tracker.Beat("a.go") {
+		t.Error("expected the same file not to be reported as changed")
+	}
+	if tracker.Beat("") {
+		t.Error("expected a heartbeat without a file not to be reported as changed")
+	}
+	if !tracker.Beat("b.go") {
+		t.Error("expected another file to be reported as changed")
+	}
+	if tracker.LastBeat().IsZero() {
+		t.Error("expected the heartbeats to be recorded")
+	}
+
+	select {
+	case <-tracker.Beats():
+	default:
+		t.Fatal("expected the heartbeats to be signaled")
+	}
+	select {
+	case <-tracker.Beats():
+		t.Error("expected the heartbeats to be signaled once")
+	default:
+	}
+}
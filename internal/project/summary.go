@@ -0,0 +1,214 @@
+// Package project summarizes the local project so small models get some
+// orientation beyond the lines around the cursor.
+package project
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/josuemontano/ollama-copilot/internal/lang"
+	"github.com/josuemontano/ollama-copilot/internal/tokenizer"
+	"github.com/ollama/ollama/api"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxFiles bounds how much of a large tree is walked per refresh.
+	maxFiles = 5000
+	// maxManifestBytes is how much of each manifest file the model sees.
+	maxManifestBytes = 2048
+)
+
+// manifests are files that name a project's dependencies and frameworks.
+var manifests = []string{
+	"go.mod", "package.json", "Cargo.toml", "pyproject.toml", "requirements.txt",
+	"Gemfile", "pom.xml", "build.gradle", "build.gradle.kts", "composer.json", "mix.exs",
+}
+
+// skipDirs are never walked; they hold dependencies or build output rather
+// than the project itself.
+var skipDirs = map[string]bool{
+	"node_modules": true, "vendor": true, "target": true, "dist": true,
+	"build": true, "__pycache__": true,
+}
+
+const summaryPrompt = `Summarize this software project for a code completion model in at most %d words.
+Mention the main languages, key frameworks and libraries, and what the top-level directories contain.
+Write plain sentences without markdown.
+
+%s`
+
+// Generator generates text. Ollama's *api.Client is one.
+type Generator interface {
+	Generate(ctx context.Context, req *api.GenerateRequest, fn api.GenerateResponseFunc) error
+}
+
+// Summarizer keeps a short, model-written summary of a project directory.
+type Summarizer struct {
+	api    Generator
+	model  string
+	dir    string
+	budget int
+	tok    tokenizer.Tokenizer
+	logger *zap.Logger
+
+	mu      sync.RWMutex
+	summary string
+}
+
+// NewSummarizer creates a Summarizer for dir whose summary stays under
+// budget tokens, as counted by tok. Refresh failures are logged to logger
+// unless it is nil.
+func NewSummarizer(api Generator, model, dir string, budget int, tok tokenizer.Tokenizer, logger *zap.Logger) *Summarizer {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return &Summarizer{api: api, model: model, dir: dir, budget: budget, tok: tok, logger: logger}
+}
+
+// Summary returns the latest summary, or an empty string before the first
+// refresh. A nil Summarizer has no summary.
+func (s *Summarizer) Summary() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.summary
+}
+
+// Refresh scans the project and asks the model for a new summary. When the
+// model is unavailable the scanned facts are used as the summary instead.
+func (s *Summarizer) Refresh(ctx context.Context) error {
+	facts, err := Describe(s.dir)
+	if err != nil {
+		return err
+	}
+
+	var out strings.Builder
+	err = s.api.Generate(ctx, &api.GenerateRequest{
+		Model:   s.model,
+		Prompt:  fmt.Sprintf(summaryPrompt, s.budget*3/4, facts),
+		Options: map[string]interface{}{"temperature": 0, "num_predict": s.budget},
+	}, func(resp api.GenerateResponse) error {
+		out.WriteString(resp.Response)
+		return nil
+	})
+
+	summary := strings.TrimSpace(out.String())
+	if err != nil || summary == "" {
+		s.logger.Warn("Error generating the project summary, using scanned facts", zap.Error(err))
+		summary = facts
+	}
+
+	s.mu.Lock()
+	s.summary = truncate(s.tok, summary, s.budget)
+	s.mu.Unlock()
+
+	s.logger.Debug("Project summary refreshed", zap.String("dir", s.dir), zap.Int("chars", len(s.summary)))
+	return nil
+}
+
+// Describe lists the languages, top-level directories and manifest files
+// found under dir.
+func Describe(dir string) (string, error) {
+	languages := map[string]int{}
+	var topLevel []string
+	files := 0
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if strings.HasPrefix(name, ".") || skipDirs[name] {
+				return filepath.SkipDir
+			}
+			if filepath.Dir(path) == dir {
+				topLevel = append(topLevel, name+"/")
+			}
+			return nil
+		}
+
+		files++
+		if files > maxFiles {
+			return filepath.SkipAll
+		}
+		if language := lang.FromPath(path); language != "" {
+			languages[language]++
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("scanning project %s: %w", dir, err)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Project: %s\n", filepath.Base(dir))
+	if len(languages) > 0 {
+		names := make([]string, 0, len(languages))
+		for name := range languages {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			if languages[names[i]] != languages[names[j]] {
+				return languages[names[i]] > languages[names[j]]
+			}
+			return names[i] < names[j]
+		})
+		parts := make([]string, len(names))
+		for i, name := range names {
+			parts[i] = fmt.Sprintf("%s (%d files)", name, languages[name])
+		}
+		fmt.Fprintf(&b, "Languages: %s\n", strings.Join(parts, ", "))
+	}
+	if len(topLevel) > 0 {
+		fmt.Fprintf(&b, "Directories: %s\n", strings.Join(topLevel, " "))
+	}
+	for _, name := range manifests {
+		head, err := readHead(filepath.Join(dir, name), maxManifestBytes)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s:\n%s\n", name, head)
+	}
+
+	return b.String(), nil
+}
+
+func readHead(path string, n int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, n))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// truncate cuts s to at most n tokens, at the last line or word boundary.
+func truncate(tok tokenizer.Tokenizer, s string, n int) string {
+	if tokenizer.Count(tok, s) <= n {
+		return s
+	}
+	s = tokenizer.Head(tok, s, n)
+	if i := strings.LastIndexAny(s, "\n "); i > 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
@@ -0,0 +1,107 @@
+package project_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/project"
+	"github.com/josuemontano/ollama-copilot/internal/tokenizer"
+	"github.com/ollama/ollama/api"
+	"go.uber.org/zap"
+)
+
+func writeProject(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"go.mod":                  "module example.com/app\n\nrequire github.com/gin-gonic/gin v1.9.0\n",
+		"main.go":                 "package main\n",
+		"internal/server.go":      "package internal\n",
+		"web/app.ts":              "export {}\n",
+		"node_modules/x/index.js": "",
+		".git/config":             "",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func newClient(t *testing.T, handler http.HandlerFunc) *api.Client {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	t.Setenv("OLLAMA_HOST", srv.URL)
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestDescribe(t *testing.T) {
+	facts, err := project.Describe(writeProject(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"go (2 files)", "typescript (1 files)", "internal/", "web/", "gin-gonic/gin"} {
+		if !strings.Contains(facts, want) {
+			t.Errorf("expected the description to contain %q, got:\n%s", want, facts)
+		}
+	}
+	for _, unwanted := range []string{"node_modules", ".git", "javascript"} {
+		if strings.Contains(facts, unwanted) {
+			t.Errorf("expected %q to be skipped, got:\n%s", unwanted, facts)
+		}
+	}
+}
+
+func TestSummarizer_Refresh(t *testing.T) {
+	client := newClient(t, func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(api.GenerateResponse{Response: "A Go web service using gin. " + strings.Repeat("word ", 100), Done: true})
+	})
+
+	s := project.NewSummarizer(client, "model", writeProject(t), 10, tokenizer.Default, zap.NewNop())
+	if got := s.Summary(); got != "" {
+		t.Errorf("expected no summary before the first refresh, got %q", got)
+	}
+	if err := s.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := s.Summary()
+	if !strings.HasPrefix(got, "A Go web service") {
+		t.Errorf("expected the model's summary, got %q", got)
+	}
+	if len(got) > 40 {
+		t.Errorf("expected the summary to fit a 10 token budget, got %d characters", len(got))
+	}
+}
+
+func TestSummarizer_RefreshWithoutModel(t *testing.T) {
+	client := newClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	s := project.NewSummarizer(client, "model", writeProject(t), 100, tokenizer.Default, zap.NewNop())
+	if err := s.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Summary(); !strings.Contains(got, "Languages:") {
+		t.Errorf("expected the scanned facts when the model fails, got %q", got)
+	}
+}
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/project"
+	"github.com/ollama/ollama/api"
+	"go.uber.org/zap"
+)
+
+// SummarizeProject keeps the project summary fresh by regenerating it every
+// ProjectSummaryInterval. It blocks and is meant to run in its own goroutine.
+func (s *Server) SummarizeProject() {
+	summarizer := s.projectSummarizer()
+	if summarizer == nil {
+		return
+	}
+
+	ticker := time.NewTicker(s.ProjectSummaryInterval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		if err := summarizer.Refresh(ctx); err != nil {
+			s.logger().Warn("Error summarizing the project", zap.Error(err))
+		}
+		cancel()
+		<-ticker.C
+	}
+}
+
+// projectSummarizer returns the summarizer shared by all listeners, or nil
+// when no project directory is configured.
+func (s *Server) projectSummarizer() *project.Summarizer {
+	s.projectOnce.Do(func() {
+		if s.ProjectDir == "" || s.ProjectSummaryInterval <= 0 {
+			return
+		}
+
+		client, err := api.ClientFromEnvironment()
+		if err != nil {
+			s.logger().Error("Error initializing the Ollama client", zap.Error(err))
+			return
+		}
+		generator, err := s.generator(client)
+		if err != nil {
+			s.logger().Error("Error initializing the generation client", zap.Error(err))
+			return
+		}
+		s.project = project.NewSummarizer(generator, s.Model, s.ProjectDir, s.ProjectSummaryTokens, s.modelTokenizer(client), s.logger())
+	})
+	return s.project
+}
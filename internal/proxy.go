@@ -2,31 +2,45 @@ package internal
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"strings"
 	"time"
+
+	"go.uber.org/zap"
 )
 
-func Proxy(port string, forward string) {
-	listener, err := net.Listen("tcp", port)
-	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+// Proxy listens on addr as an HTTPS proxy for the Copilot clients until ctx
+// is done. CONNECT requests to GitHub's Copilot hosts are tunneled to the
+// address forward instead, and other hosts are tunneled to as asked.
+// A nil logger discards the proxy's errors.
+func Proxy(ctx context.Context, addr string, forward string, logger *zap.Logger) error {
+	if logger == nil {
+		logger = zap.NewNop()
 	}
 
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("proxy listening on %s: %w", addr, err)
+	}
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
 	defer listener.Close()
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Fatalf("failed to accept: %v", err)
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("proxy accepting on %s: %w", addr, err)
 		}
 
-		go handle(conn, forward)
+		go handle(conn, forward, logger)
 	}
 }
 
@@ -39,37 +53,37 @@ var hosts = []string{
 	"proxy.individual.githubcopilot.com",
 }
 
-func handle(conn net.Conn, forward string) {
+func handle(conn net.Conn, forward string, logger *zap.Logger) {
 	req, err := http.ReadRequest(bufio.NewReader(conn))
 	if err != nil {
 		conn.Close()
-		log.Printf("failed to read request: %v", err)
+		logger.Warn("Failed to read proxy request", zap.Error(err))
 		return
 	}
 
-	address := fmt.Sprintf("%s:%s", req.URL.Hostname(), req.URL.Port())
+	network, address := "tcp", net.JoinHostPort(req.URL.Hostname(), req.URL.Port())
 
 	for _, host := range hosts {
 		if strings.Contains(req.URL.Hostname(), host) {
 			// This is a host we know and want to forward back to ourselves
-			address = "localhost" + forward
+			network, address = dialNetwork(forward)
 			break
 		}
 	}
 
 	if req.Method != http.MethodConnect {
 		conn.Close()
-		log.Printf("unsupported method: %s", req.Method)
+		logger.Warn("Unsupported proxy method", zap.String("method", req.Method))
 		return
 	}
 
-	client, err := net.DialTimeout("tcp", address, 10*time.Second)
+	client, err := net.DialTimeout(network, address, 10*time.Second)
 	if err != nil {
 		conn.Close()
-		log.Printf("failed to dial: %v", err)
+		logger.Warn("Failed to dial", zap.String("address", address), zap.Error(err))
 		_, err = conn.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n\r\n"))
 		if err != nil {
-			log.Printf("failed to write response: %v", err)
+			logger.Warn("Failed to write proxy response", zap.Error(err))
 		}
 		return
 	}
@@ -77,15 +91,15 @@ func handle(conn net.Conn, forward string) {
 	_, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
 	if err != nil {
 		conn.Close()
-		log.Printf("failed to write response: %v", err)
+		logger.Warn("Failed to write proxy response", zap.Error(err))
 		return
 	}
 
-	go transfer(client, conn)
-	go transfer(conn, client)
+	go transfer(client, conn, logger)
+	go transfer(conn, client, logger)
 }
 
-func transfer(w io.WriteCloser, r io.ReadCloser) {
+func transfer(w io.WriteCloser, r io.ReadCloser, logger *zap.Logger) {
 	defer w.Close()
 	defer r.Close()
 	_, err := io.Copy(w, r)
@@ -98,6 +112,6 @@ func transfer(w io.WriteCloser, r io.ReadCloser) {
 	}
 
 	if err != nil {
-		log.Printf("failed to transfer: %v", err)
+		logger.Warn("Failed to transfer", zap.Error(err))
 	}
 }
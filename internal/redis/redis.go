@@ -0,0 +1,260 @@
+// Package redis is a small client of the Redis protocol, enough for the
+// storage several servers share. It speaks RESP2, which Redis and the
+// servers compatible with it, such as Valkey, KeyDB and Dragonfly, all
+// understand.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// idleConns is how many connections a Client keeps open between commands.
+const idleConns = 8
+
+// dialTimeout bounds connecting to the server, when the context of a
+// command does not end sooner.
+const dialTimeout = 5 * time.Second
+
+// Error is an error reply of the server, such as "WRONGTYPE Operation
+// against a key holding the wrong kind of value".
+type Error string
+
+func (e Error) Error() string { return "redis: " + string(e) }
+
+// Client sends commands to a Redis server over a pool of connections. It is
+// safe for concurrent use.
+type Client struct {
+	addr     string
+	tls      *tls.Config
+	user     string
+	password string
+	db       int
+	idle     chan *Conn
+}
+
+// New returns a Client for the server at rawURL, such as
+// redis://:password@127.0.0.1:6379/0, or rediss:// for TLS. No connection
+// is made until the first command.
+func New(rawURL string) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the Redis URL: %w", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" || u.Host == "" {
+		return nil, fmt.Errorf("Redis URL %q must be a redis or rediss URL", rawURL)
+	}
+	c := &Client{addr: u.Host, idle: make(chan *Conn, idleConns)}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.Scheme == "rediss" {
+		c.tls = &tls.Config{ServerName: u.Hostname()}
+	}
+	if u.User != nil {
+		c.user = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil || c.db < 0 {
+			return nil, fmt.Errorf("Redis URL %q must name a database by its number", rawURL)
+		}
+	}
+	return c, nil
+}
+
+// Do sends a command and returns its reply: a string for simple and bulk
+// strings, an int64 for integers, a []any for arrays and nil for nil
+// replies. An error reply is returned as an Error.
+func (c *Client) Do(ctx context.Context, args ...string) (any, error) {
+	conn, err := c.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.Do(ctx, args...)
+}
+
+// Conn returns a connection of the pool, for commands that have to run on
+// the same one, such as WATCH and the transaction that follows. It must be
+// closed to give it back.
+func (c *Client) Conn(ctx context.Context) (*Conn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var nc net.Conn
+	var err error
+	if c.tls != nil {
+		nc, err = (&tls.Dialer{NetDialer: dialer, Config: c.tls}).DialContext(ctx, "tcp", c.addr)
+	} else {
+		nc, err = dialer.DialContext(ctx, "tcp", c.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connecting to Redis: %w", err)
+	}
+	conn := &Conn{client: c, nc: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	if c.password != "" {
+		auth := []string{"AUTH", c.password}
+		if c.user != "" {
+			auth = []string{"AUTH", c.user, c.password}
+		}
+		if _, err := conn.Do(ctx, auth...); err != nil {
+			conn.broken = true
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.Do(ctx, "SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.broken = true
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Close closes the idle connections. Connections in use are closed when
+// they are given back.
+func (c *Client) Close() error {
+	for {
+		select {
+		case conn := <-c.idle:
+			conn.nc.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// Conn is a connection to the server. It is not safe for concurrent use.
+type Conn struct {
+	client *Client
+	nc     net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	// broken is set once the connection failed, or a reply was not read
+	// to its end, so that it is not reused.
+	broken bool
+}
+
+// Do sends a command on the connection and returns its reply, as
+// Client.Do does.
+func (c *Conn) Do(ctx context.Context, args ...string) (any, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.nc.SetDeadline(deadline)
+	} else {
+		_ = c.nc.SetDeadline(time.Time{})
+	}
+	reply, err := c.roundTrip(args)
+	var replyErr Error
+	if err != nil && !errors.As(err, &replyErr) {
+		c.broken = true
+	}
+	return reply, err
+}
+
+func (c *Conn) roundTrip(args []string) (any, error) {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(c.r)
+}
+
+// Close gives the connection back to the pool, or closes it when it broke
+// or the pool is full.
+func (c *Conn) Close() {
+	if !c.broken {
+		select {
+		case c.client.idle <- c:
+			return
+		default:
+		}
+	}
+	c.nc.Close()
+}
+
+// readReply reads one RESP2 reply from r.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	kind, rest := line[0], line[1:]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, Error(rest)
+	case ':':
+		n, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad integer reply %q", rest)
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad bulk string length %q", rest)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad array length %q", rest)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		// An error inside an array, as EXEC returns for a failed command,
+		// is kept as an item rather than failing the whole reply.
+		for i := range items {
+			item, err := readReply(r)
+			var replyErr Error
+			if errors.As(err, &replyErr) {
+				item = replyErr
+			} else if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
@@ -0,0 +1,372 @@
+// Package redistest provides a fake Redis server for tests. It keeps its
+// data in memory and implements the commands the Redis storage uses:
+// strings with expiry, counters, lists, SCAN and WATCH transactions.
+package redistest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Server is a fake Redis server.
+type Server struct {
+	// URL is the redis:// URL of the server.
+	URL string
+
+	mu       sync.Mutex
+	strings  map[string]value
+	lists    map[string][]string
+	versions map[string]int
+	commands int
+	conns    map[net.Conn]bool
+}
+
+type value struct {
+	data    string
+	expires time.Time
+}
+
+// NewServer starts a fake Redis server that is closed when t ends.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		URL:      "redis://" + ln.Addr().String(),
+		strings:  map[string]value{},
+		lists:    map[string][]string{},
+		versions: map[string]int{},
+		conns:    map[net.Conn]bool{},
+	}
+	var wg sync.WaitGroup
+	// The clients keep their connections open, which are closed with the
+	// listener so that the cleanup does not wait for them.
+	t.Cleanup(func() {
+		ln.Close()
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns[conn] = true
+			s.mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.serve(conn)
+			}()
+		}
+	}()
+	return s
+}
+
+// Commands returns how many commands the server has run.
+func (s *Server) Commands() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commands
+}
+
+// session is the state of one connection.
+type session struct {
+	watched map[string]int
+	queued  [][]string
+	multi   bool
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	sess := &session{}
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		writeReply(w, s.run(sess, args))
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) run(sess *session, args []string) any {
+	name := strings.ToUpper(args[0])
+	switch name {
+	case "MULTI":
+		sess.multi, sess.queued = true, nil
+		return "OK"
+	case "DISCARD":
+		sess.multi, sess.queued, sess.watched = false, nil, nil
+		return "OK"
+	case "EXEC":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		watched, queued := sess.watched, sess.queued
+		sess.multi, sess.queued, sess.watched = false, nil, nil
+		for key, version := range watched {
+			if s.versions[key] != version {
+				return nil
+			}
+		}
+		replies := make([]any, len(queued))
+		for i, args := range queued {
+			replies[i] = s.command(args)
+		}
+		return replies
+	case "WATCH":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.expire(time.Now())
+		if sess.watched == nil {
+			sess.watched = map[string]int{}
+		}
+		for _, key := range args[1:] {
+			sess.watched[key] = s.versions[key]
+		}
+		return "OK"
+	case "UNWATCH":
+		sess.watched = nil
+		return "OK"
+	}
+	if sess.multi {
+		sess.queued = append(sess.queued, args)
+		return "QUEUED"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.command(args)
+}
+
+// command runs a command other than those of transactions. s.mu is held.
+func (s *Server) command(args []string) any {
+	s.commands++
+	now := time.Now()
+	s.expire(now)
+	switch name := strings.ToUpper(args[0]); name {
+	case "PING":
+		return "PONG"
+	case "AUTH", "SELECT":
+		return "OK"
+	case "GET":
+		if len(args) != 2 {
+			return arity(name)
+		}
+		if v, ok := s.strings[args[1]]; ok {
+			return v.data
+		}
+		return nil
+	case "SET":
+		if len(args) != 3 && len(args) != 5 {
+			return arity(name)
+		}
+		v := value{data: args[2]}
+		if len(args) == 5 {
+			ms, err := strconv.Atoi(args[4])
+			if !strings.EqualFold(args[3], "PX") || err != nil || ms <= 0 {
+				return errors.New("ERR syntax error")
+			}
+			v.expires = now.Add(time.Duration(ms) * time.Millisecond)
+		}
+		s.strings[args[1]] = v
+		s.versions[args[1]]++
+		return "OK"
+	case "DEL":
+		var n int64
+		for _, key := range args[1:] {
+			if _, ok := s.strings[key]; ok {
+				n++
+			}
+			if _, ok := s.lists[key]; ok {
+				n++
+			}
+			delete(s.strings, key)
+			delete(s.lists, key)
+			s.versions[key]++
+		}
+		return n
+	case "INCRBY":
+		if len(args) != 3 {
+			return arity(name)
+		}
+		by, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return errors.New("ERR value is not an integer or out of range")
+		}
+		v := s.strings[args[1]]
+		n, err := strconv.ParseInt(v.data, 10, 64)
+		if v.data != "" && err != nil {
+			return errors.New("ERR value is not an integer or out of range")
+		}
+		v.data = strconv.FormatInt(n+by, 10)
+		s.strings[args[1]] = v
+		s.versions[args[1]]++
+		return n + by
+	case "SCAN":
+		// Every key is returned at once, so the cursor is always 0. Only
+		// patterns ending with a single * are supported.
+		if len(args) < 4 || !strings.EqualFold(args[2], "MATCH") {
+			return errors.New("ERR SCAN without MATCH is not supported")
+		}
+		prefix, ok := strings.CutSuffix(args[3], "*")
+		if !ok || strings.ContainsAny(prefix, "*?[") {
+			return fmt.Errorf("ERR pattern %q is not supported", args[3])
+		}
+		keys := []any{}
+		for key := range s.strings {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		return []any{"0", keys}
+	case "RPUSH":
+		if len(args) < 3 {
+			return arity(name)
+		}
+		s.lists[args[1]] = append(s.lists[args[1]], args[2:]...)
+		s.versions[args[1]]++
+		return int64(len(s.lists[args[1]]))
+	case "LTRIM":
+		if len(args) != 4 {
+			return arity(name)
+		}
+		list := s.lists[args[1]]
+		start, stop, ok := span(list, args[2], args[3])
+		if !ok {
+			return errors.New("ERR value is not an integer or out of range")
+		}
+		s.lists[args[1]] = append([]string(nil), list[start:stop]...)
+		s.versions[args[1]]++
+		return "OK"
+	case "LRANGE":
+		if len(args) != 4 {
+			return arity(name)
+		}
+		list := s.lists[args[1]]
+		start, stop, ok := span(list, args[2], args[3])
+		if !ok {
+			return errors.New("ERR value is not an integer or out of range")
+		}
+		items := make([]any, 0, stop-start)
+		for _, item := range list[start:stop] {
+			items = append(items, item)
+		}
+		return items
+	}
+	return fmt.Errorf("ERR unknown command '%s'", args[0])
+}
+
+// expire drops the strings that expired by now. s.mu is held.
+func (s *Server) expire(now time.Time) {
+	for key, v := range s.strings {
+		if !v.expires.IsZero() && !now.Before(v.expires) {
+			delete(s.strings, key)
+			s.versions[key]++
+		}
+	}
+}
+
+// span returns the slice bounds of the inclusive range from start to stop
+// of list, which count from the end when negative, as LRANGE takes them.
+func span(list []string, start, stop string) (int, int, bool) {
+	from, err1 := strconv.Atoi(start)
+	to, err2 := strconv.Atoi(stop)
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	n := len(list)
+	if from < 0 {
+		from = max(n+from, 0)
+	}
+	if to < 0 {
+		to = n + to
+	}
+	to = min(to+1, n)
+	if from >= to {
+		return 0, 0, true
+	}
+	return from, to, true
+}
+
+func arity(name string) error {
+	return fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(name))
+}
+
+// readCommand reads a command sent as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(line, "*"), "\r\n"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("bad command %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(line, "$"), "\r\n"))
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("bad argument %q", line)
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func writeReply(w *bufio.Writer, reply any) {
+	switch reply := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case error:
+		fmt.Fprintf(w, "-%s\r\n", reply)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", reply)
+	case string:
+		if reply == "OK" || reply == "QUEUED" || reply == "PONG" {
+			fmt.Fprintf(w, "+%s\r\n", reply)
+			return
+		}
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(reply), reply)
+	case []any:
+		fmt.Fprintf(w, "*%d\r\n", len(reply))
+		for _, item := range reply {
+			writeReply(w, item)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Package rules implements per-file overrides keyed by the path of the
+// document being completed, for cases where the language a client reports
+// is missing or too coarse (templated files, generated code, lock files).
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// Rule overrides completion behavior for files whose path matches Match.
+//
+// Match is a glob in path.Match syntax. Patterns without a slash are matched
+// against the file name only ("*.lock", "Dockerfile"); patterns with a slash
+// are matched against the whole path, and a leading "**/" matches any number
+// of leading directories ("**/testdata/*.json").
+type Rule struct {
+	Match string `json:"match"`
+	// Model replaces the configured Ollama model.
+	Model string `json:"model,omitempty"`
+	// Template replaces the FIM prompt template.
+	Template string `json:"template,omitempty"`
+	// MaxLines limits how many lines before and after the cursor are sent.
+	MaxLines int `json:"max_lines,omitempty"`
+	// Block disables completions for matching files.
+	Block bool `json:"block,omitempty"`
+}
+
+// Override is the effective behavior for a matched file.
+type Override struct {
+	Model    string
+	Template *template.Template
+	MaxLines int
+	Block    bool
+}
+
+// Set is an ordered list of rules; the first matching rule wins.
+type Set struct {
+	rules     []Rule
+	templates []*template.Template
+}
+
+// Load reads a JSON array of rules from file.
+func Load(file string) (*Set, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading rules: %w", err)
+	}
+
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parsing rules %s: %w", file, err)
+	}
+
+	return New(rules)
+}
+
+// New validates rules and compiles their templates.
+func New(rules []Rule) (*Set, error) {
+	set := &Set{rules: rules, templates: make([]*template.Template, len(rules))}
+
+	for i, rule := range rules {
+		if rule.Match == "" {
+			return nil, fmt.Errorf("rule %d: match is required", i)
+		}
+		if _, err := path.Match(strings.TrimPrefix(rule.Match, "**/"), ""); err != nil {
+			return nil, fmt.Errorf("rule %d: invalid match %q: %w", i, rule.Match, err)
+		}
+		if rule.Template != "" {
+			tmpl, err := template.New(rule.Match).Parse(rule.Template)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: parsing template: %w", i, err)
+			}
+			set.templates[i] = tmpl
+		}
+	}
+
+	return set, nil
+}
+
+// Match returns the override for filePath. It reports false when filePath is
+// empty or no rule matches. A nil Set matches nothing.
+func (s *Set) Match(filePath string) (Override, bool) {
+	if s == nil || filePath == "" {
+		return Override{}, false
+	}
+
+	filePath = strings.ReplaceAll(filePath, "\\", "/")
+	for i, rule := range s.rules {
+		if matches(rule.Match, filePath) {
+			return Override{
+				Model:    rule.Model,
+				Template: s.templates[i],
+				MaxLines: rule.MaxLines,
+				Block:    rule.Block,
+			}, true
+		}
+	}
+
+	return Override{}, false
+}
+
+func matches(pattern, filePath string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(filePath))
+		return ok
+	}
+
+	if rest, ok := strings.CutPrefix(pattern, "**/"); ok {
+		parts := strings.Split(filePath, "/")
+		for i := range parts {
+			if ok, _ := path.Match(rest, strings.Join(parts[i:], "/")); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	ok, _ := path.Match(pattern, strings.TrimPrefix(filePath, "./"))
+	return ok
+}
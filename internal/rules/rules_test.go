@@ -0,0 +1,65 @@
+package rules_test
+
+import (
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/rules"
+)
+
+func TestSet_Match(t *testing.T) {
+	set, err := rules.New([]rules.Rule{
+		{Match: "*.lock", Block: true},
+		{Match: "**/templates/*.html", Model: "small", MaxLines: 30},
+		{Match: "web/*.html", Model: "web"},
+		{Match: "*.sql", Template: "{{.Prefix}}<FILL>{{.Suffix}}"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		ok    bool
+		model string
+		block bool
+	}{
+		{"Cargo.lock", true, "", true},
+		{"deps/yarn.lock", true, "", true},
+		{"app/views/templates/index.html", true, "small", false},
+		{"templates/index.html", true, "small", false},
+		{"web/index.html", true, "web", false},
+		{"src\\web\\index.html", false, "", false},
+		{"main.go", false, "", false},
+		{"", false, "", false},
+	}
+
+	for _, tt := range tests {
+		override, ok := set.Match(tt.path)
+		if ok != tt.ok || override.Model != tt.model || override.Block != tt.block {
+			t.Errorf("Match(%q) = %+v, %v; expected model %q, block %v, ok %v", tt.path, override, ok, tt.model, tt.block, tt.ok)
+		}
+	}
+
+	if override, _ := set.Match("db/schema.sql"); override.Template == nil {
+		t.Error("expected the sql rule to carry a compiled template")
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	if _, err := rules.New([]rules.Rule{{Model: "x"}}); err == nil {
+		t.Error("expected an error for a rule without match")
+	}
+	if _, err := rules.New([]rules.Rule{{Match: "[", Block: true}}); err == nil {
+		t.Error("expected an error for a malformed glob")
+	}
+	if _, err := rules.New([]rules.Rule{{Match: "*.go", Template: "{{.Prefix"}}); err == nil {
+		t.Error("expected an error for a malformed template")
+	}
+}
+
+func TestSet_NilMatchesNothing(t *testing.T) {
+	var set *rules.Set
+	if _, ok := set.Match("main.go"); ok {
+		t.Error("expected a nil set to match nothing")
+	}
+}
@@ -0,0 +1,131 @@
+package secrets
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// keychain returns the store of the OS keychain, when there is one to use:
+// the login keychain on macOS, or the secret service of a Linux desktop
+// session, through secret-tool.
+func keychain() (Store, bool) {
+	switch runtime.GOOS {
+	case "darwin":
+		return macKeychain{}, true
+	case "linux":
+		if _, err := exec.LookPath("secret-tool"); err != nil || os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+			return nil, false
+		}
+		return secretService{}, true
+	}
+	return nil, false
+}
+
+// macKeychain keeps secrets as generic passwords of Service in the login
+// keychain.
+type macKeychain struct{}
+
+// errItemNotFound is the exit status of security for a missing item.
+const errItemNotFound = 44
+
+func (macKeychain) Get(name string) (string, error) {
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+	out, err := command(nil, "security", "find-generic-password", "-s", Service, "-a", name, "-w")
+	if exitCode(err) == errItemNotFound {
+		return "", ErrNotFound
+	}
+	return strings.TrimSuffix(out, "\n"), err
+}
+
+func (macKeychain) Set(name, value string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	// The command is read from stdin and the password given in hex, so
+	// that it shows in neither the process list nor a quoting mistake.
+	cmd := fmt.Sprintf("add-generic-password -U -s %s -a %s -X %s\n", Service, name, hex.EncodeToString([]byte(value)))
+	if _, err := command(strings.NewReader(cmd), "security", "-i"); err != nil {
+		return err
+	}
+	// security -i exits successfully even when its commands fail, so the
+	// password is read back.
+	if stored, err := (macKeychain{}).Get(name); err != nil || stored != value {
+		return fmt.Errorf("security: the password of %q was not stored: %v", name, err)
+	}
+	return nil
+}
+
+func (macKeychain) Delete(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	_, err := command(nil, "security", "delete-generic-password", "-s", Service, "-a", name)
+	if exitCode(err) == errItemNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+// secretService keeps secrets in the secret service, such as GNOME Keyring
+// or KWallet, with the attributes service=Service and name=name.
+type secretService struct{}
+
+func (secretService) Get(name string) (string, error) {
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+	out, err := command(nil, "secret-tool", "lookup", "service", Service, "name", name)
+	// secret-tool fails without a word when nothing matches.
+	if exitCode(err) == 1 && out == "" {
+		return "", ErrNotFound
+	}
+	return out, err
+}
+
+func (secretService) Set(name, value string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	_, err := command(strings.NewReader(value), "secret-tool", "store", "--label", Service+" "+name, "service", Service, "name", name)
+	return err
+}
+
+func (secretService) Delete(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	_, err := command(nil, "secret-tool", "clear", "service", Service, "name", name)
+	return err
+}
+
+// command runs name with stdin and returns what it wrote to stdout. Its
+// stderr is put in the error.
+func command(stdin *strings.Reader, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return string(out), fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// exitCode returns the exit status of the command err is from, or -1.
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
@@ -0,0 +1,148 @@
+// Package secrets keeps API keys and tokens out of flags and config files.
+// They are stored in the OS keychain: the login keychain on macOS, the
+// secret service on Linux desktops and files encrypted with DPAPI on
+// Windows. Elsewhere, they are kept in files only the user can read.
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Service names the secrets of ollama-copilot in the keychain.
+const Service = "ollama-copilot"
+
+// Prefix marks a flag or config value as the name of a secret, as in
+// keychain:openai-key, to be looked up in the store in its place.
+const Prefix = "keychain:"
+
+// ErrNotFound is returned for a secret that is not stored.
+var ErrNotFound = errors.New("secret not found")
+
+// Store keeps secrets by name.
+type Store interface {
+	Get(name string) (string, error)
+	Set(name, value string) error
+	Delete(name string) error
+}
+
+// validName matches the names secrets may have, which are also file names.
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+func checkName(name string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("secret name %q must be letters, digits, dots, dashes and underscores", name)
+	}
+	return nil
+}
+
+// DefaultDir is where secrets are kept in files, under the user's config
+// directory.
+func DefaultDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "ollama-copilot", "secrets"), nil
+}
+
+// Open returns the store of the OS keychain, or the files of dir when the
+// OS has none this package can use, as on a server without a desktop
+// session.
+func Open(dir string) Store {
+	if k, ok := keychain(); ok {
+		return k
+	}
+	return Files{Dir: dir}
+}
+
+// Resolve returns value, or the secret it names when it starts with Prefix.
+func Resolve(store Store, value string) (string, error) {
+	name, ok := strings.CutPrefix(value, Prefix)
+	if !ok {
+		return value, nil
+	}
+	secret, err := store.Get(name)
+	if err != nil {
+		return "", fmt.Errorf("reading secret %q: %w", name, err)
+	}
+	return secret, nil
+}
+
+// Files keeps each secret in a file of Dir, readable by the user only. On
+// Windows the files are encrypted with DPAPI for the user.
+type Files struct {
+	Dir string
+}
+
+func (f Files) path(name string) (string, error) {
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(f.Dir, name), nil
+}
+
+func (f Files) Get(name string) (string, error) {
+	path, err := f.path(name)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	value, err := unprotect(data)
+	if err != nil {
+		return "", fmt.Errorf("decrypting %s: %w", path, err)
+	}
+	return string(value), nil
+}
+
+func (f Files) Set(name, value string) error {
+	path, err := f.path(name)
+	if err != nil {
+		return err
+	}
+	data, err := protect([]byte(value))
+	if err != nil {
+		return fmt.Errorf("encrypting secret %q: %w", name, err)
+	}
+	if err := os.MkdirAll(f.Dir, 0o700); err != nil {
+		return err
+	}
+	// The secret is written next to its file and renamed over it, so that
+	// a failed write leaves the previous value.
+	tmp, err := os.CreateTemp(f.Dir, "."+name+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (f Files) Delete(name string) error {
+	path, err := f.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package secrets_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/secrets"
+)
+
+func TestFiles(t *testing.T) {
+	store := secrets.Files{Dir: filepath.Join(t.TempDir(), "secrets")}
+
+	if _, err := store.Get("openai-key"); !errors.Is(err, secrets.ErrNotFound) {
+		t.Errorf("expected ErrNotFound before the secret is set, got %v", err)
+	}
+	if err := store.Set("openai-key", "sk-first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("openai-key", "sk-second"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.Get("openai-key"); err != nil || got != "sk-second" {
+		t.Errorf("expected the last value set, got %q (%v)", got, err)
+	}
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(filepath.Join(store.Dir, "openai-key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0o600 {
+			t.Errorf("expected the secret to be readable by the user only, got %v", mode)
+		}
+	}
+
+	if err := store.Delete("openai-key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("openai-key"); !errors.Is(err, secrets.ErrNotFound) {
+		t.Errorf("expected ErrNotFound once deleted, got %v", err)
+	}
+	for _, name := range []string{"", "../escape", ".hidden", "a/b"} {
+		if err := store.Set(name, "value"); err == nil {
+			t.Errorf("expected the name %q to be rejected", name)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	store := secrets.Files{Dir: t.TempDir()}
+	if err := store.Set("admin", "change-me"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := secrets.Resolve(store, "keychain:admin"); err != nil || got != "change-me" {
+		t.Errorf("expected the stored secret, got %q (%v)", got, err)
+	}
+	if got, err := secrets.Resolve(store, "plain-key"); err != nil || got != "plain-key" {
+		t.Errorf("expected a plain value to be kept, got %q (%v)", got, err)
+	}
+	if _, err := secrets.Resolve(store, "keychain:missing"); !errors.Is(err, secrets.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a missing secret, got %v", err)
+	}
+}
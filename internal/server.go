@@ -1,117 +1,1291 @@
 package internal
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
+	"context"
 	"crypto/tls"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"math/big"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 
+	"github.com/josuemontano/ollama-copilot/internal/backends"
+	"github.com/josuemontano/ollama-copilot/internal/cache"
+	"github.com/josuemontano/ollama-copilot/internal/certs"
+	"github.com/josuemontano/ollama-copilot/internal/corpus"
+	"github.com/josuemontano/ollama-copilot/internal/events"
 	"github.com/josuemontano/ollama-copilot/internal/handlers"
+	"github.com/josuemontano/ollama-copilot/internal/health"
+	"github.com/josuemontano/ollama-copilot/internal/lang"
+	"github.com/josuemontano/ollama-copilot/internal/limiter"
+	"github.com/josuemontano/ollama-copilot/internal/llamacpp"
+	"github.com/josuemontano/ollama-copilot/internal/mdns"
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
 	"github.com/josuemontano/ollama-copilot/internal/middleware"
+	"github.com/josuemontano/ollama-copilot/internal/openai"
+	"github.com/josuemontano/ollama-copilot/internal/presence"
+	"github.com/josuemontano/ollama-copilot/internal/project"
+	"github.com/josuemontano/ollama-copilot/internal/rules"
+	"github.com/josuemontano/ollama-copilot/internal/secrets"
+	"github.com/josuemontano/ollama-copilot/internal/storage"
+	"github.com/josuemontano/ollama-copilot/internal/templates"
+	"github.com/josuemontano/ollama-copilot/internal/tokenizer"
+	"github.com/josuemontano/ollama-copilot/internal/tracing"
 	"github.com/ollama/ollama/api"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/sync/errgroup"
 )
 
 // Server is the main server struct.
 type Server struct {
-	PortSSL     string
-	Port        string
+	// Port and PortSSL are the addresses the HTTP and HTTPS listeners bind
+	// to, such as 127.0.0.1:11437, [::1]:11437 or :11437 for every
+	// interface. A bare host listens on DefaultPort or DefaultPortSSL.
+	// Empty disables a listener.
+	PortSSL string
+	Port    string
+	// Certificate and Key are the files of the HTTPS certificate. Without
+	// them, a certificate signed by a local authority kept in CertDir is
+	// served, by default under the user's config directory.
 	Certificate string
 	Key         string
-	Template    string
-	Model       string
-	NumPredict  int
-	Logger      *zap.Logger
+	CertDir     string
+	// ACMEDomains, when set, are the host names HTTPS certificates are
+	// obtained and renewed for from Let's Encrypt, instead of the local
+	// authority, unless Certificate and Key are set. Plain HTTP listeners
+	// answer the HTTP-01 challenges. Certificates are kept in ACMECacheDir,
+	// by default next to CertDir.
+	ACMEDomains  []string
+	ACMECacheDir string
+	// ProxyPort and ProxyPortSSL are where the CONNECT proxies forwarding
+	// to Port and PortSSL listen, in the same form. Empty disables a proxy.
+	ProxyPort    string
+	ProxyPortSSL string
+	// Listeners is an optional JSON file of listeners that replaces the
+	// ports above, each with its own address, TLS setting, proxy and API
+	// keys.
+	Listeners string
+	// Secrets, when set, resolves the API keys of Listeners given as
+	// keychain:NAME, see secrets.Resolve.
+	Secrets secrets.Store
+	// Listen are further plain HTTP listeners, on TCP addresses or on unix
+	// domain sockets as unix:///path, next to the ones above.
+	Listen []string
+	// ShutdownGrace is how long requests in flight may run once Run is
+	// asked to stop. Zero closes them right away.
+	ShutdownGrace time.Duration
+	// Template is the FIM prompt template. When empty, the preset of
+	// ModelFamily is used, inferred from Model if ModelFamily is empty.
+	Template      string
+	ModelFamily   string
+	Model         string
+	FallbackModel string
+	FallbackAfter time.Duration
+	// AutoPull pulls the models Ollama does not have on startup, and Warmup
+	// loads Model into memory once it is there, see PrepareModels.
+	AutoPull bool
+	Warmup   bool
+	// SystemTemplate replaces the built-in system prompts when set.
+	// NoSystem omits the system prompt. Raw sends the rendered Template to
+	// the model verbatim, bypassing the model's own template, and so
+	// without a system prompt either.
+	SystemTemplate string
+	NoSystem       bool
+	Raw            bool
+	// ChatModel answers Copilot Chat requests, defaulting to Model.
+	ChatModel string
+	// ModelMap routes the model names clients request to Ollama models,
+	// overriding Model and ChatModel for those names.
+	ModelMap handlers.ModelMap
+	// ModelOptions are Ollama options of the model names clients request,
+	// as name.option=value pairs, see handlers.ParseModelOptions.
+	ModelOptions map[string]string
+	NumPredict   int
+	// FunctionNumPredict is the num_predict of completions writing a whole
+	// function body, when larger than NumPredict.
+	FunctionNumPredict int
+	// PrefixLines and SuffixLines are how many lines around the cursor
+	// are put in completion prompts, handlers.DefaultContextLines when
+	// zero.
+	PrefixLines int
+	SuffixLines int
+	// NumCtx is the model's context window in tokens, which completion
+	// prompts are cut to fit. Zero uses the model's num_ctx parameter, or
+	// handlers.DefaultNumCtx.
+	NumCtx int
+	// CacheSize is how many completions are kept to answer repeated
+	// requests, for CacheTTL each. Zero disables the cache.
+	CacheSize int
+	CacheTTL  time.Duration
+	// IdempotencyTTL is how long the response to a completion or chat
+	// request with an Idempotency-Key is replayed to retries. Zero
+	// disables replays.
+	IdempotencyTTL time.Duration
+	// CancelSuperseded cancels a client's running completion when it asks
+	// for another at the same document position.
+	CancelSuperseded bool
+	// SuppressRejected keeps a suggestion the user rejected from being
+	// shown again at the same position of the same editor session.
+	SuppressRejected bool
+	// CommentLanguage is the natural language completions are asked to
+	// write comments and documentation in. Empty leaves it to the model.
+	CommentLanguage string
+	// ResumeWindow is how long a client whose connection dropped may resume
+	// a streamed completion with Last-Event-ID. Zero disables resumption.
+	ResumeWindow time.Duration
+	// RequestTimeout bounds each completion request, a minute when zero.
+	// FirstTokenTimeout, when set, answers a completion empty when the
+	// model produces no token for that long.
+	RequestTimeout    time.Duration
+	FirstTokenTimeout time.Duration
+	// RetryBudget is how long completions failing with transient Ollama
+	// errors are retried for. Zero disables retries.
+	RetryBudget time.Duration
+	// BurstModel, when set, answers the completions of users who asked for
+	// burst mode at /v1/burst, with at least BurstNumPredict tokens, for
+	// BurstDuration unless they asked for another length.
+	BurstModel      string
+	BurstNumPredict int
+	BurstDuration   time.Duration
+	// EventWebhooks are URLs every event is posted to as JSON.
+	EventWebhooks []string
+	// Advertise announces the server on the local network with mDNS, as
+	// mdns.Service, so that editor plugins and other machines find it.
+	Advertise bool
+	// Storage keeps the completion cache, the usage stats, the feedback
+	// and the recorded events. Nil keeps no more than the process does. A
+	// storage.Shared keeps the rate limits too, for servers sharing it.
+	Storage storage.Storage
+	// RecordEvents appends every event to Storage, when set.
+	RecordEvents bool
+	// RecordCompletions keeps the prompt and text of every completion in
+	// a corpus in Storage, when set.
+	RecordCompletions bool
+	// CompletionMode cuts completions to the cursor line, block or
+	// function: auto, line, block, function or full. Empty means auto.
+	CompletionMode string
+	// PostProcess is the comma-separated chain of post-processors
+	// completions stream through, as handlers.ParsePostProcess takes it.
+	// Empty means handlers.DefaultPostProcess.
+	PostProcess string
+	// MinConcurrent and MaxConcurrent bound the number of simultaneous
+	// generations. Within them the limit adapts to keep time to first
+	// token under TTFTTarget; a zero target pins it at MaxConcurrent.
+	MinConcurrent int
+	MaxConcurrent int
+	TTFTTarget    time.Duration
+	// MaxQueue bounds the requests waiting for a generation slot; those
+	// beyond it are answered 429. Zero lets the queue grow.
+	MaxQueue int
+	// RateLimit is how many generation requests per second each client,
+	// by API key or IP address, may make on average, and RateBurst how
+	// many at once. Zero disables rate limits.
+	RateLimit float64
+	RateBurst int
+	// DefaultLanguage is assumed when a request names no language and
+	// none can be inferred.
+	DefaultLanguage string
+	// PathRules is an optional JSON file of per-path overrides.
+	PathRules string
+	// LanguageParams is an optional JSON file of per-language generation
+	// settings.
+	LanguageParams string
+	// PromptTemplates is an optional JSON file of named prompt templates
+	// that requests can select with the X-Prompt-Template header.
+	PromptTemplates string
+	// TokenTTL is how long issued Copilot tokens are valid.
+	TokenTTL time.Duration
+	// PublicHost is the host name clients use to reach this server. It is
+	// advertised in the token's endpoints together with each listener's
+	// port.
+	PublicHost string
+	// Headers controls the headers injected into responses and forwarded
+	// to Ollama.
+	Headers middleware.GithubHeaderPolicy
+	// EntitlementURL, when set, is the GitHub Copilot token endpoint used
+	// to check that a user has a Copilot license before issuing a local
+	// token. Answers are cached for EntitlementTTL.
+	EntitlementURL string
+	EntitlementTTL time.Duration
+	// ProjectDir, when set, is summarized every ProjectSummaryInterval and
+	// the summary, at most ProjectSummaryTokens long, is added to prompts.
+	ProjectDir             string
+	ProjectSummaryInterval time.Duration
+	ProjectSummaryTokens   int
+	// UserHeader identifies users in the usage export; see
+	// handlers.CompletionConfig.
+	UserHeader string
+	// AdminKeys, when set, are the keys requests to /admin/model,
+	// /admin/template and /admin/options must present, which swap the
+	// completion model, prompt template and options at runtime. Without
+	// them, those endpoints, /admin/stats, /admin/usage and /admin/events
+	// are not served and backends cannot be pinned at runtime.
+	// /admin/backends and /debug/trace need the keys too when they are set. Listeners with API keys accept the admin keys
+	// too.
+	AdminKeys []string
+	// OpenAIURL, when set, is the base URL of an OpenAI-compatible server,
+	// such as llama-server or vLLM, that completions and chats are
+	// generated with in place of Ollama. OpenAIKey authenticates to it.
+	OpenAIURL string
+	OpenAIKey string
+	// LlamaCppURL, when set, is the URL of a llama.cpp llama-server that
+	// completions are filled in with natively, through its /infill
+	// endpoint, and chats are generated with, in place of Ollama.
+	// LlamaCppKey authenticates to it. It cannot be set with OpenAIURL.
+	LlamaCppURL string
+	LlamaCppKey string
+	// Backends are the Ollama servers completions are routed between, as
+	// name to [scheme://]host[:port]. OllamaHosts are more, each named by
+	// its address. Without either, OLLAMA_HOST is the only backend, named
+	// "ollama". Balance is how completions are spread over them, and
+	// PinBackend names one to use whatever its latency.
+	Backends    map[string]string
+	OllamaHosts []string
+	Balance     string
+	PinBackend  string
+	// StickyRouting sends completions whose prompts start the same way to
+	// the backend that served the last one, whose KV cache still holds it.
+	StickyRouting bool
+	// Pricing estimates the energy and cost of the GPU time in the usage
+	// export.
+	Pricing handlers.Pricing
+	// IdleUnload unloads the model once editor plugins have sent no
+	// heartbeat for that long; zero keeps it loaded. See WatchPresence.
+	IdleUnload time.Duration
+	Logger     *zap.Logger
+
+	limiterOnce sync.Once
+	limiter     *limiter.Limiter
+	rateOnce    sync.Once
+	rates       *middleware.RateLimiter
+
+	cacheOnce  sync.Once
+	cache      *cache.Cache
+	replayOnce sync.Once
+	replays    *middleware.ReplayStore
+
+	rejectionsOnce sync.Once
+	rejections     *handlers.Rejections
+
+	completionsOnce sync.Once
+	completions     atomic.Pointer[handlers.CompletionHandler]
+	// configured is the configuration of completions as the flags or the
+	// last reload left it, before changes at the admin endpoints.
+	configured atomic.Pointer[handlers.CompletionConfig]
+
+	// certificate is served by the HTTPS listeners, unless they get theirs
+	// from ACME. Reload reads it again from the Certificate and Key files or
+	// from CertDir, for certHosts.
+	certificate atomic.Pointer[tls.Certificate]
+	certHosts   []string
+
+	burstsOnce sync.Once
+	bursts     *handlers.Bursts
+
+	entitlementsOnce sync.Once
+	entitlements     *handlers.EntitlementChecker
+
+	projectOnce sync.Once
+	project     *project.Summarizer
+
+	presenceOnce sync.Once
+	presence     *presence.Tracker
+
+	presetOnce sync.Once
+	preset     templates.Preset
+	numCtx     int
+
+	lintOnce sync.Once
+	problems []string
+
+	backendsOnce sync.Once
+	backends     *backends.Pool
+	backendsErr  error
 }
 
-// Serve starts the server.
-func (s *Server) Serve() {
-	err := http.ListenAndServe(s.Port, s.mux())
+// Run serves the listeners, by default HTTP on Port, HTTPS on PortSSL and
+// the CONNECT proxies on ProxyPort and ProxyPortSSL, until ctx is done or
+// one of them fails. It then stops accepting connections and gives the
+// requests in flight, such as completion streams, ShutdownGrace to finish
+// before closing them. The first error is returned; a clean shutdown
+// returns nil.
+func (s *Server) Run(ctx context.Context) error {
+	listeners, err := s.listeners()
 	if err != nil {
-		s.Logger.Fatal("Error starting the HTTP server", zap.Error(err))
+		return err
+	}
+	if len(listeners) == 0 {
+		return errors.New("no listener enabled, set Port, PortSSL or Listeners")
+	}
+	if s.Storage != nil {
+		if err := metrics.Usage.Store(s.Storage); err != nil {
+			return fmt.Errorf("loading the stored usage: %w", err)
+		}
 	}
-}
 
-// ServeTLS starts the server with TLS.
-func (s *Server) ServeTLS() {
-	server := http.Server{
-		Addr:      s.PortSSL,
-		Handler:   s.mux(),
-		TLSConfig: &tls.Config{Certificates: []tls.Certificate{}, MinVersion: tls.VersionTLS13, MaxVersion: tls.VersionTLS13},
+	var manager *autocert.Manager
+	if len(s.ACMEDomains) > 0 && (s.Certificate == "" || s.Key == "") {
+		if manager, err = certs.ACME(s.ACMECacheDir, s.ACMEDomains...); err != nil {
+			return fmt.Errorf("locating the ACME cache: %w", err)
+		}
+		if !answersACME(listeners) {
+			s.logger().Warn("No listener on port 80 or 443 answers the Let's Encrypt challenges, so certificates are only obtained when one of these ports forwards to a listener", zap.Strings("domains", s.ACMEDomains))
+		}
+	}
+
+	var tlsConfig *tls.Config
+	servers := make([]*http.Server, len(listeners))
+	for i, l := range listeners {
+		handler, err := s.handler(l)
+		if err != nil {
+			return fmt.Errorf("building the handler of listener %q: %w", l.Name, err)
+		}
+		if manager != nil && !l.TLS {
+			handler = manager.HTTPHandler(handler)
+		}
+		servers[i] = &http.Server{Addr: l.Addr, Handler: handler}
+		if l.TLS {
+			if tlsConfig == nil {
+				if tlsConfig, err = s.tlsConfig(listeners, manager); err != nil {
+					return err
+				}
+			}
+			servers[i].TLSConfig = tlsConfig
+		}
+
+		for _, addr := range []string{l.Addr, l.Proxy} {
+			if addr != "" && !isLoopback(addr) {
+				s.logger().Warn("Listening on an address other machines can reach", zap.String("listener", l.Name), zap.String("addr", addr))
+			}
+		}
 	}
 
-	if s.Certificate == "" || s.Key == "" {
-		selfAssignCertificate, err := selfAssignCertificate()
+	sockets := make([]net.Listener, 0, len(listeners))
+	for _, l := range listeners {
+		socket, err := listen(l.Addr)
 		if err != nil {
-			s.Logger.Fatal("Error self assigning certificate", zap.Error(err))
+			for _, socket := range sockets {
+				socket.Close()
+			}
+			return fmt.Errorf("listener %q listening on %s: %w", l.Name, l.Addr, err)
 		}
+		sockets = append(sockets, socket)
+	}
 
-		server.TLSConfig.Certificates = append(server.TLSConfig.Certificates, selfAssignCertificate)
+	g, ctx := errgroup.WithContext(ctx)
+	for i, l := range listeners {
+		srv, socket := servers[i], sockets[i]
+		g.Go(func() error {
+			if l.TLS {
+				return serve(srv, func() error { return srv.ServeTLS(socket, "", "") })
+			}
+			return serve(srv, func() error { return srv.Serve(socket) })
+		})
+		if l.Proxy != "" {
+			g.Go(func() error { return Proxy(ctx, l.Proxy, dialAddr(l.Addr), s.logger()) })
+		}
 	}
+	if s.Advertise {
+		if inst, ok := s.mdnsInstance(listeners, tlsConfig); ok {
+			g.Go(func() error {
+				if err := mdns.Advertise(ctx, inst); err != nil {
+					s.logger().Warn("Error advertising the server with mDNS", zap.Error(err))
+				}
+				return nil
+			})
+		} else {
+			s.logger().Warn("Not advertising the server with mDNS, no listener is reachable from other machines")
+		}
+	}
+	g.Go(func() error {
+		<-ctx.Done()
+		s.shutdown(servers...)
+		return nil
+	})
+	return g.Wait()
+}
 
-	err := server.ListenAndServeTLS(s.Certificate, s.Key)
+// mdnsInstance returns the mDNS instance of the listeners other machines
+// can reach, and false when there is none. The SRV record points at the
+// first of them, and the TXT record has the ports of the others and the
+// fingerprint of the HTTPS certificate.
+func (s *Server) mdnsInstance(listeners []Listener, tlsConfig *tls.Config) (mdns.Instance, bool) {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "ollama-copilot"
+	}
+	host, _, _ = strings.Cut(host, ".")
+	inst := mdns.Instance{Name: "ollama-copilot on " + host, Host: host, Text: map[string]string{}, IPs: mdns.LocalIPs()}
+
+	port := func(addr string) string {
+		if addr == "" || isLoopback(addr) {
+			return ""
+		}
+		_, port, _ := net.SplitHostPort(addr)
+		return port
+	}
+	for _, l := range listeners {
+		p := port(l.Addr)
+		if p == "" {
+			continue
+		}
+		if inst.Port == 0 {
+			inst.Port, _ = strconv.Atoi(p)
+			if l.TLS {
+				inst.Text["tls"] = "true"
+			}
+		}
+		key := "port"
+		if l.TLS {
+			key = "tls_port"
+		}
+		if _, ok := inst.Text[key]; !ok {
+			inst.Text[key] = p
+		}
+		if proxy := port(l.Proxy); proxy != "" {
+			if _, ok := inst.Text["proxy_"+key]; !ok {
+				inst.Text["proxy_"+key] = proxy
+			}
+		}
+		if len(l.APIKeys) > 0 {
+			inst.Text["api_key"] = "required"
+		}
+	}
+	if inst.Port == 0 {
+		return mdns.Instance{}, false
+	}
+
+	if certificate := s.certificate.Load(); tlsConfig != nil && certificate != nil && len(certificate.Certificate) > 0 {
+		inst.Text["fingerprint"] = certs.Fingerprint(certificate.Certificate[0])
+	}
+	return inst, true
+}
+
+// tlsConfig returns the TLS configuration of the HTTPS listeners. Unless
+// Certificate and Key are set, they serve the certificates of manager or,
+// without one, a certificate from CertDir, valid for localhost, PublicHost
+// and the hosts the listeners are bound to.
+func (s *Server) tlsConfig(listeners []Listener, manager *autocert.Manager) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS13, MaxVersion: tls.VersionTLS13}
+	if manager != nil {
+		config.GetCertificate = manager.GetCertificate
+		config.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+		return config, nil
+	}
+
+	var hosts []string
+	if s.PublicHost != "" {
+		hosts = append(hosts, s.PublicHost)
+	}
+	for _, l := range listeners {
+		host, _, err := net.SplitHostPort(l.Addr)
+		if ip := net.ParseIP(host); err != nil || host == "" || ip != nil && ip.IsUnspecified() {
+			continue
+		}
+		if l.TLS && !slices.Contains(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+
+	s.certHosts = hosts
+	certificate, err := s.loadCertificate()
 	if err != nil {
-		s.Logger.Fatal("Error starting the HTTPS server", zap.Error(err))
+		return nil, err
+	}
+	s.certificate.Store(&certificate)
+	config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return s.certificate.Load(), nil
 	}
+	return config, nil
 }
 
-// selfAssignCertificate generates a self-signed certificate for localhost.
-func selfAssignCertificate() (tls.Certificate, error) {
-	private, err := rsa.GenerateKey(rand.Reader, 2048)
+// loadCertificate reads the Certificate and Key files or, without them, the
+// certificate from CertDir for certHosts.
+func (s *Server) loadCertificate() (tls.Certificate, error) {
+	if s.Certificate != "" && s.Key != "" {
+		certificate, err := tls.LoadX509KeyPair(s.Certificate, s.Key)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("loading the certificate: %w", err)
+		}
+		return certificate, nil
+	}
+
+	dir := s.CertDir
+	if dir == "" {
+		var err error
+		if dir, err = certs.DefaultDir(); err != nil {
+			return tls.Certificate{}, fmt.Errorf("locating the certificate directory: %w", err)
+		}
+	}
+	certificate, err := certs.Load(dir, s.certHosts...)
 	if err != nil {
-		return tls.Certificate{}, err
+		return tls.Certificate{}, fmt.Errorf("loading the certificate in %s: %w", dir, err)
 	}
+	return certificate, nil
+}
 
-	template := &x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			CommonName: "localhost",
-		},
-		NotBefore: time.Now(),
-		NotAfter:  time.Now().AddDate(30, 0, 0),
-		KeyUsage:  x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
-		ExtKeyUsage: []x509.ExtKeyUsage{
-			x509.ExtKeyUsageServerAuth,
-		},
-		BasicConstraintsValid: true,
+// listeners returns the listeners of the Listeners file or, without one,
+// an "http" listener on Port and an "https" listener on PortSSL with their
+// proxies, and then a plain listener named after each address of Listen. A
+// proxy is disabled with the listener it forwards to.
+func (s *Server) listeners() ([]Listener, error) {
+	var listeners []Listener
+	if s.Listeners != "" {
+		loaded, err := LoadListeners(s.Listeners)
+		if err != nil {
+			return nil, err
+		}
+		if s.Secrets != nil {
+			for _, l := range loaded {
+				for i, key := range l.APIKeys {
+					if l.APIKeys[i], err = secrets.Resolve(s.Secrets, key); err != nil {
+						return nil, fmt.Errorf("listener %q: %w", l.Name, err)
+					}
+				}
+			}
+		}
+		listeners = loaded
+	} else {
+		for _, l := range []struct {
+			name, addr, proxy string
+			tls               bool
+		}{
+			{"http", s.Port, s.ProxyPort, false},
+			{"https", s.PortSSL, s.ProxyPortSSL, true},
+		} {
+			if l.addr == "" {
+				if l.proxy != "" {
+					s.logger().Info("Proxy disabled with the listener it forwards to", zap.String("listener", l.name), zap.String("addr", l.proxy))
+				}
+				continue
+			}
+			listeners = append(listeners, Listener{Name: l.name, Addr: l.addr, TLS: l.tls, Proxy: l.proxy})
+		}
+	}
+	for _, addr := range s.Listen {
+		listeners = append(listeners, Listener{Name: addr, Addr: addr})
 	}
 
-	cert, err := x509.CreateCertificate(rand.Reader, template, template, private.Public(), private)
+	if err := completeListeners(listeners); err != nil {
+		return nil, err
+	}
+	return listeners, nil
+}
 
-	return tls.Certificate{
-		Certificate: [][]byte{cert},
-		PrivateKey:  private,
-	}, err
+// serve runs listen, which serves srv, and treats the server being shut
+// down as success.
+func serve(srv *http.Server, listen func() error) error {
+	if err := listen(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serving on %s: %w", srv.Addr, err)
+	}
+	return nil
 }
 
-// mux returns the main mux for the server.
-func (s *Server) mux() http.Handler {
-	api, err := api.ClientFromEnvironment()
+// shutdown stops the servers, waiting up to ShutdownGrace for requests in
+// flight before closing their connections, and then closes the idle
+// connections of the Ollama client.
+func (s *Server) shutdown(servers ...*http.Server) {
+	s.logger().Info("Shutting down", zap.Duration("grace", s.ShutdownGrace))
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownGrace)
+	defer cancel()
 
-	if err != nil {
-		s.Logger.Fatal("Error initializing the Ollama client", zap.Error(err))
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				s.logger().Warn("Closing connections still open after the grace period", zap.String("addr", srv.Addr), zap.Error(err))
+				_ = srv.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The Ollama client always uses http.DefaultClient.
+	http.DefaultClient.CloseIdleConnections()
+}
+
+// generationLimiter returns the limiter shared by the HTTP and HTTPS
+// listeners, so both count against the same Ollama capacity.
+func (s *Server) generationLimiter() *limiter.Limiter {
+	s.limiterOnce.Do(func() {
+		if s.MaxConcurrent > 0 {
+			s.limiter = limiter.New(s.MinConcurrent, s.MaxConcurrent, s.TTFTTarget, s.logger())
+			s.limiter.SetMaxQueue(s.MaxQueue)
+		}
+	})
+	return s.limiter
+}
+
+// rateLimiter returns the client rate limits shared by the listeners, or
+// nil when they are disabled.
+func (s *Server) rateLimiter() *middleware.RateLimiter {
+	s.rateOnce.Do(func() {
+		if s.RateLimit > 0 {
+			s.rates = middleware.NewRateLimiter(s.RateLimit, s.RateBurst)
+			if shared, ok := s.Storage.(storage.Shared); ok {
+				s.rates.Share(shared)
+			}
+		}
+	})
+	return s.rates
+}
+
+// completionCache returns the completion cache shared by the listeners, or
+// nil when it is disabled.
+func (s *Server) completionCache() *cache.Cache {
+	s.cacheOnce.Do(func() {
+		if s.CacheSize > 0 {
+			s.cache = cache.New(s.CacheSize, s.CacheTTL)
+			if s.Storage == nil {
+				return
+			}
+			if err := s.cache.Store(s.Storage); err != nil {
+				s.logger().Warn("Error loading the stored completion cache", zap.Error(err))
+			}
+		}
+	})
+	return s.cache
+}
+
+// replayStore returns the idempotent responses shared by the listeners, or
+// nil when replays are disabled.
+func (s *Server) replayStore() *middleware.ReplayStore {
+	s.replayOnce.Do(func() {
+		if s.IdempotencyTTL > 0 {
+			s.replays = middleware.NewReplayStore(middleware.DefaultReplays, s.IdempotencyTTL)
+		}
+	})
+	return s.replays
+}
+
+// rejectionLog returns the rejected suggestions shared by the listeners, or
+// nil when they are shown again.
+func (s *Server) rejectionLog() *handlers.Rejections {
+	s.rejectionsOnce.Do(func() {
+		if s.SuppressRejected {
+			s.rejections = handlers.NewRejections(0)
+		}
+	})
+	return s.rejections
+}
+
+// burstModes returns the users in burst mode, shared by all listeners, or
+// nil when there is no burst model.
+func (s *Server) burstModes() *handlers.Bursts {
+	s.burstsOnce.Do(func() {
+		if s.BurstModel != "" {
+			s.bursts = handlers.NewBursts(s.BurstModel, s.BurstNumPredict, s.BurstDuration)
+		}
+	})
+	return s.bursts
+}
+
+// corpus returns the corpus completions are recorded in, or nil when they
+// are not recorded.
+func (s *Server) corpus() *corpus.Corpus {
+	if !s.RecordCompletions || s.Storage == nil {
 		return nil
 	}
+	return corpus.New(s.Storage)
+}
+
+// baseURL returns the URL clients use to reach the listener on addr, or ""
+// when no public host is configured.
+func (s *Server) baseURL(scheme, addr string) string {
+	if s.PublicHost == "" {
+		return ""
+	}
 
-	promptTemplate, err := template.New("prompt").Parse(s.Template)
+	_, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		s.Logger.Fatal("Error parsing the prompt template", zap.Error(err))
-		return nil
+		return ""
+	}
+	return (&url.URL{Scheme: scheme, Host: net.JoinHostPort(s.PublicHost, port)}).String()
+}
+
+// Handler returns the HTTP handler serving the Copilot API, as mounted on the
+// plain HTTP listener. It is safe to use with httptest or to embed in another
+// server, once InstallTransport has been called.
+func (s *Server) Handler() (http.Handler, error) {
+	addr, err := listenAddr(s.Port, DefaultPort)
+	if err != nil {
+		return nil, err
+	}
+	return s.handler(Listener{Name: "http", Addr: addr})
+}
+
+// handler builds the handler for a listener. The listener's address is
+// advertised to clients in the token endpoints.
+func (s *Server) handler(l Listener) (http.Handler, error) {
+	scheme := "http"
+	if l.TLS {
+		scheme = "https"
+	}
+	baseURL := s.baseURL(scheme, l.Addr)
+
+	api, err := api.ClientFromEnvironment()
+	if err != nil {
+		return nil, fmt.Errorf("initializing the Ollama client: %w", err)
+	}
+	generator, err := s.generator(api)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := s.backendPool()
+	if err != nil {
+		return nil, err
+	}
+	settings, preset, err := s.completionSettings(api)
+	if err != nil {
+		return nil, err
+	}
+	s.lintTemplates(settings.PromptTemplate, preset, settings.Templates)
+	modelOptions := settings.ModelOptions
+
+	// Listeners share one completion handler, so that the settings changed
+	// at the admin endpoints and by Reload apply to all of them.
+	s.completionsOnce.Do(func() {
+		config := settings
+		config.Limiter = s.generationLimiter()
+		config.Project = s.projectSummarizer()
+		config.UserHeader = s.UserHeader
+		config.Backends = pool
+		config.Cache = s.completionCache()
+		config.CancelSuperseded = s.CancelSuperseded
+		config.CommentLanguage = s.CommentLanguage
+		config.ResumeWindow = s.ResumeWindow
+		config.RequestTimeout = s.RequestTimeout
+		config.FirstTokenTimeout = s.FirstTokenTimeout
+		config.RetryBudget = s.RetryBudget
+		config.Rejections = s.rejectionLog()
+		config.Corpus = s.corpus()
+		config.Bursts = s.burstModes()
+		config.StickyRouting = s.StickyRouting
+		completions := handlers.NewCompletionHandler(generator, config, s.logger())
+		configured := completions.Config()
+		s.completions.Store(completions)
+		s.configured.Store(&configured)
+	})
+	completions := s.completions.Load()
+
+	var endpoints *handlers.TokenEndpoints
+	if baseURL != "" {
+		endpoints = handlers.NewTokenEndpoints(baseURL)
 	}
 
 	mux := http.NewServeMux()
 
-	mux.Handle("/health", handlers.NewHealthHandler())
-	mux.Handle("/copilot_internal/v2/token", handlers.NewTokenHandler())
-	mux.Handle("/v1/engines/copilot-codex/completions", handlers.NewCompletionHandler(api, s.Model, promptTemplate, s.NumPredict, s.Logger))
-	mux.Handle("/v1/engines/chat-control/completions", handlers.NewCompletionHandler(api, s.Model, promptTemplate, s.NumPredict, s.Logger))
-	mux.Handle("/v1/engines/gpt-4o-copilot/completions", handlers.NewCompletionHandler(api, s.Model, promptTemplate, s.NumPredict, s.Logger))
-	mux.Handle("/v1/engines/gpt-41-copilot/completions", handlers.NewCompletionHandler(api, s.Model, promptTemplate, s.NumPredict, s.Logger))
+	// Readiness is checked against every Ollama backend, and servers
+	// generating in its place only report the health of the proxy.
+	var readiness *handlers.Readiness
+	if name, _ := s.remote(); name == "" {
+		readiness = &handlers.Readiness{Client: api, Pool: pool, Model: func() string { return completions.Config().Model }}
+	}
+	mux.Handle("/health", handlers.NewHealthHandler(health.Default, s.rateLimiter(), readiness))
+	mux.Handle("/metrics", handlers.NewMetricsHandler())
+	mux.Handle("/debug/trace/{id}", middleware.APIKeyMiddleware(s.AdminKeys, handlers.NewTraceHandler(tracing.Recent)))
+	mux.Handle("/copilot_internal/v2/token", handlers.NewTokenHandler(s.TokenTTL, endpoints, s.entitlementChecker(), s.logger()))
+	mux.Handle("/telemetry", handlers.NewTelemetryHandler())
+	mux.Handle("/v1/events", handlers.NewNotificationsHandler(events.Default))
+	mux.Handle("/v1/completions/feedback", handlers.NewFeedbackHandler(s.Storage, s.rejectionLog()))
+	mux.Handle("/v1/heartbeat", handlers.NewHeartbeatHandler(s.presenceTracker(), completions, s.logger()))
+	if bursts := s.burstModes(); bursts != nil {
+		mux.Handle("/v1/burst", handlers.NewBurstHandler(bursts, s.UserHeader))
+	}
+	var backendsHandler http.Handler = handlers.NewBackendsHandler(pool)
+	if len(s.AdminKeys) == 0 {
+		// Pinning moves the completions of every user, so like the other
+		// runtime changes it needs an admin key.
+		backendsHandler = readOnly(backendsHandler)
+	}
+	mux.Handle("/admin/backends", middleware.APIKeyMiddleware(s.AdminKeys, backendsHandler))
+	if len(s.AdminKeys) > 0 {
+		mux.Handle("/admin/model", middleware.APIKeyMiddleware(s.AdminKeys, handlers.NewModelHandler(completions)))
+		mux.Handle("/admin/template", middleware.APIKeyMiddleware(s.AdminKeys, handlers.NewTemplateHandler(completions)))
+		mux.Handle("/admin/options", middleware.APIKeyMiddleware(s.AdminKeys, handlers.NewOptionsHandler(completions)))
+		// The stats, usage and events name users and clients, so they
+		// are only served to admins.
+		mux.Handle("/admin/stats", middleware.APIKeyMiddleware(s.AdminKeys, handlers.NewStatsHandler(s.generationLimiter(), s.completionCache())))
+		mux.Handle("/admin/usage", middleware.APIKeyMiddleware(s.AdminKeys, handlers.NewUsageHandler(s.Pricing, s.logger())))
+		mux.Handle("/admin/events", middleware.APIKeyMiddleware(s.AdminKeys, handlers.NewEventsHandler(events.Default)))
+	}
+	chatModel := s.ChatModel
+	if chatModel == "" {
+		chatModel = s.Model
+	}
+	// Rate limits come before replays, so that retries of a request
+	// count against its client too.
+	chat := middleware.RateLimitMiddleware(s.rateLimiter(), middleware.IdempotencyMiddleware(s.replayStore(),
+		handlers.NewChatHandler(generator, chatModel, s.ModelMap, modelOptions, s.generationLimiter(), s.UserHeader, s.logger())))
+	mux.Handle("/chat/completions", chat)
+	mux.Handle("/v1/chat/completions", chat)
+	mux.Handle("/v1/workspace/edits", middleware.RateLimitMiddleware(s.rateLimiter(),
+		handlers.NewWorkspaceEditHandler(generator, func() string { return completions.Config().Model }, s.generationLimiter(), s.logger())))
+	replayed := middleware.RateLimitMiddleware(s.rateLimiter(), middleware.IdempotencyMiddleware(s.replayStore(), completions))
+	mux.Handle("/v1/engines/copilot-codex/completions", replayed)
+	mux.Handle("/v1/engines/chat-control/completions", replayed)
+	mux.Handle("/v1/engines/gpt-4o-copilot/completions", replayed)
+	mux.Handle("/v1/engines/gpt-41-copilot/completions", replayed)
+
+	apiKeys := l.APIKeys
+	if len(apiKeys) > 0 {
+		apiKeys = append(slices.Clone(apiKeys), s.AdminKeys...)
+	}
+	handler := middleware.APIKeyMiddleware(apiKeys, middleware.GithubHeaderMiddleware(s.Headers, mux))
+	handler = middleware.TraceMiddleware(mux, middleware.MetricsMiddleware(mux, handler))
+	named := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		middleware.AddLogField(r.Context(), "listener", l.Name)
+		handler.ServeHTTP(w, r)
+	})
+	return middleware.LogMiddleware(s.logger(), named), nil
+}
+
+// readOnly answers the requests to next that are not GET with 403.
+func readOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "changing this at runtime requires --admin-key", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// completionSettings returns the settings of completions that Reload
+// changes: the model, its prompt template and stop tokens, the options and
+// the rule files. It also returns the FIM preset the prompt template is
+// checked against, empty when none applies.
+func (s *Server) completionSettings(client *api.Client) (handlers.CompletionConfig, templates.Preset, error) {
+	source, stop := s.Template, []string(nil)
+	preset, ok, err := templates.LookupPreset(s.ModelFamily, s.Model)
+	if err != nil {
+		return handlers.CompletionConfig{}, templates.Preset{}, err
+	}
+	if s.ModelFamily == "" {
+		detected := s.detectedPreset(client)
+		if detected.Family != "" {
+			preset, ok = detected, true
+		} else {
+			stop = detected.Stop
+		}
+	}
+	if ok {
+		if source == "" {
+			source = preset.Template
+		}
+		stop = append(slices.Clone(preset.Stop), stop...)
+	}
+	if source == "" {
+		source = templates.DefaultTemplate
+	}
+
+	promptTemplate, err := template.New("prompt").Parse(source)
+	if err != nil {
+		return handlers.CompletionConfig{}, templates.Preset{}, fmt.Errorf("parsing the prompt template: %w", err)
+	}
+
+	var systemTemplate *template.Template
+	if s.SystemTemplate != "" {
+		systemTemplate, err = template.New("system").Parse(s.SystemTemplate)
+		if err != nil {
+			return handlers.CompletionConfig{}, templates.Preset{}, fmt.Errorf("parsing the system template: %w", err)
+		}
+	}
+
+	mode := handlers.ModeAuto
+	if s.CompletionMode != "" {
+		mode, err = handlers.ParseCompletionMode(s.CompletionMode)
+		if err != nil {
+			return handlers.CompletionConfig{}, templates.Preset{}, err
+		}
+	}
+	var postProcess []handlers.PostProcessor
+	if s.PostProcess != "" {
+		postProcess, err = handlers.ParsePostProcess(s.PostProcess)
+		if err != nil {
+			return handlers.CompletionConfig{}, templates.Preset{}, err
+		}
+	}
+
+	modelOptions, err := handlers.ParseModelOptions(s.ModelOptions)
+	if err != nil {
+		return handlers.CompletionConfig{}, templates.Preset{}, err
+	}
 
-	return middleware.LogMiddleware(middleware.GithubHeaderMiddleware(mux))
+	var pathRules *rules.Set
+	if s.PathRules != "" {
+		pathRules, err = rules.Load(s.PathRules)
+		if err != nil {
+			return handlers.CompletionConfig{}, templates.Preset{}, err
+		}
+	}
+
+	var languageParams lang.Table
+	if s.LanguageParams != "" {
+		languageParams, err = lang.LoadTable(s.LanguageParams)
+		if err != nil {
+			return handlers.CompletionConfig{}, templates.Preset{}, err
+		}
+	}
+
+	var promptTemplates *templates.Set
+	if s.PromptTemplates != "" {
+		promptTemplates, err = templates.Load(s.PromptTemplates)
+		if err != nil {
+			return handlers.CompletionConfig{}, templates.Preset{}, err
+		}
+	}
+	if !ok {
+		preset = templates.Preset{}
+	}
+
+	return handlers.CompletionConfig{
+		Model:              s.Model,
+		Models:             s.ModelMap,
+		ModelOptions:       modelOptions,
+		FallbackModel:      s.FallbackModel,
+		FallbackAfter:      s.FallbackAfter,
+		PromptTemplate:     promptTemplate,
+		SystemTemplate:     systemTemplate,
+		NoSystem:           s.NoSystem,
+		Raw:                s.Raw,
+		Stop:               stop,
+		NumPredict:         s.NumPredict,
+		FunctionNumPredict: s.FunctionNumPredict,
+		PrefixLines:        s.PrefixLines,
+		SuffixLines:        s.SuffixLines,
+		NumCtx:             s.contextWindow(client),
+		DefaultLanguage:    s.DefaultLanguage,
+		Rules:              pathRules,
+		LanguageParams:     languageParams,
+		Templates:          promptTemplates,
+		Tokenizer:          s.modelTokenizer(client),
+		Mode:               mode,
+		PostProcess:        postProcess,
+	}, preset, nil
+}
+
+// Reload applies the completion settings of next, as read again from the
+// config file, to the completions being served: the model, prompt template,
+// options and rule files, replacing changes made at the admin endpoints,
+// which it warns of.
+// The HTTPS certificate is read again from its files, unless it comes from
+// ACME. The listeners keep serving, requests in flight finish with the
+// settings they started with, and the other settings of next take a
+// restart. On error nothing changes.
+func (s *Server) Reload(next *Server) error {
+	completions := s.completions.Load()
+	if completions == nil {
+		return errors.New("nothing to reload before serving")
+	}
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return fmt.Errorf("initializing the Ollama client: %w", err)
+	}
+	settings, preset, err := next.completionSettings(client)
+	if err != nil {
+		return err
+	}
+	var certificate *tls.Certificate
+	if s.certificate.Load() != nil {
+		loaded, err := s.loadCertificate()
+		if err != nil {
+			return err
+		}
+		certificate = &loaded
+	}
+
+	for _, problem := range templateProblems(settings.PromptTemplate, preset, settings.Templates) {
+		s.logger().Warn("Prompt template problem, completions may be poor", zap.String("problem", problem))
+	}
+	if certificate != nil {
+		s.certificate.Store(certificate)
+	}
+	if changed := adminChanges(*s.configured.Load(), completions.Config()); len(changed) > 0 {
+		s.logger().Warn("Reloading replaces the settings changed at the admin endpoints", zap.Strings("settings", changed))
+	}
+	configured := completions.Reconfigure(func(config *handlers.CompletionConfig) {
+		config.Model = settings.Model
+		config.Models = settings.Models
+		config.ModelOptions = settings.ModelOptions
+		config.FallbackModel = settings.FallbackModel
+		config.FallbackAfter = settings.FallbackAfter
+		config.PromptTemplate = settings.PromptTemplate
+		config.SystemTemplate = settings.SystemTemplate
+		config.NoSystem = settings.NoSystem
+		config.Raw = settings.Raw
+		config.Stop = settings.Stop
+		config.NumPredict = settings.NumPredict
+		config.FunctionNumPredict = settings.FunctionNumPredict
+		config.PrefixLines = settings.PrefixLines
+		config.SuffixLines = settings.SuffixLines
+		config.NumCtx = settings.NumCtx
+		config.DefaultLanguage = settings.DefaultLanguage
+		config.Rules = settings.Rules
+		config.LanguageParams = settings.LanguageParams
+		config.Templates = settings.Templates
+		config.Tokenizer = settings.Tokenizer
+		config.Mode = settings.Mode
+		config.PostProcess = settings.PostProcess
+	})
+	s.configured.Store(&configured)
+	return nil
+}
+
+// adminChanges returns the settings the admin endpoints change that differ
+// between configured and current, by the names the endpoints give them.
+func adminChanges(configured, current handlers.CompletionConfig) []string {
+	var changed []string
+	if configured.Model != current.Model {
+		changed = append(changed, "model")
+	}
+	if configured.PromptTemplate != current.PromptTemplate {
+		changed = append(changed, "template")
+	}
+	if !slices.Equal(configured.Stop, current.Stop) {
+		changed = append(changed, "stop")
+	}
+	if configured.NumPredict != current.NumPredict {
+		changed = append(changed, "num_predict")
+	}
+	if configured.FunctionNumPredict != current.FunctionNumPredict {
+		changed = append(changed, "function_num_predict")
+	}
+	if configured.NumCtx != current.NumCtx {
+		changed = append(changed, "num_ctx")
+	}
+	if !reflect.DeepEqual(configured.ModelOptions, current.ModelOptions) {
+		changed = append(changed, "model_options")
+	}
+	return changed
+}
+
+// Validate builds the handler as Serve does, without listening, and returns
+// the problems templates.Lint finds in the prompt templates.
+func (s *Server) Validate() ([]string, error) {
+	if _, err := s.Handler(); err != nil {
+		return nil, err
+	}
+	return s.problems, nil
+}
+
+// lintTemplates checks the prompt template and the named templates against
+// the model's preset once, and logs a warning for each problem.
+func (s *Server) lintTemplates(prompt *template.Template, preset templates.Preset, named *templates.Set) {
+	s.lintOnce.Do(func() {
+		s.problems = templateProblems(prompt, preset, named)
+		for _, problem := range s.problems {
+			s.logger().Warn("Prompt template problem, completions may be poor", zap.String("problem", problem))
+		}
+	})
+}
+
+// templateProblems returns what templates.Lint finds in the prompt template
+// and the named templates.
+func templateProblems(prompt *template.Template, preset templates.Preset, named *templates.Set) []string {
+	var problems []string
+	for _, problem := range templates.Lint(prompt, preset) {
+		problems = append(problems, "prompt template: "+problem)
+	}
+	for _, name := range named.Names() {
+		tmpl, _ := named.Lookup(name)
+		for _, problem := range templates.Lint(tmpl, preset) {
+			problems = append(problems, fmt.Sprintf("prompt template %q: %s", name, problem))
+		}
+	}
+	return problems
+}
+
+// SubscribeEvents writes the daemon's events to the log, counts them in the
+// metrics, posts them to the EventWebhooks and, with RecordEvents, records
+// them in Storage. It is meant to be called once, before serving.
+func (s *Server) SubscribeEvents() {
+	events.Default.Subscribe(events.Log(s.logger()))
+	events.Default.Subscribe(func(e events.Event) { metrics.Events.Inc(e.Type) })
+	for _, url := range s.EventWebhooks {
+		events.Default.Subscribe(events.Webhook(url, s.logger()))
+	}
+	if s.RecordEvents && s.Storage != nil {
+		events.Default.Subscribe(events.Record(s.Storage, s.logger()))
+	}
+}
+
+// generator returns what completions and chats are generated with: the
+// server at OpenAIURL or LlamaCppURL when set, or else ollama.
+func (s *Server) generator(ollama *api.Client) (handlers.Generator, error) {
+	switch {
+	case s.OpenAIURL != "" && s.LlamaCppURL != "":
+		return nil, errors.New("set either OpenAIURL or LlamaCppURL, not both")
+	case s.OpenAIURL != "":
+		return openai.New(s.OpenAIURL, s.OpenAIKey)
+	case s.LlamaCppURL != "":
+		return llamacpp.New(s.LlamaCppURL, s.LlamaCppKey)
+	}
+	return ollama, nil
+}
+
+// remote returns the name and URL of the server generating in place of
+// Ollama, or empty strings when Ollama does.
+func (s *Server) remote() (name, address string) {
+	switch {
+	case s.OpenAIURL != "":
+		return "openai", s.OpenAIURL
+	case s.LlamaCppURL != "":
+		return "llama.cpp", s.LlamaCppURL
+	}
+	return "", ""
+}
+
+// detectedPreset asks Ollama for the model's metadata once and derives its
+// FIM preset from it. Without metadata, as with another server than
+// Ollama, the preset is empty and the family is inferred from the model
+// name instead.
+func (s *Server) detectedPreset(client *api.Client) templates.Preset {
+	s.presetOnce.Do(func() {
+		if name, _ := s.remote(); name != "" {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		show, err := client.Show(ctx, &api.ShowRequest{Model: s.Model})
+		if err != nil {
+			s.logger().Warn("Error reading the model metadata", zap.String("model", s.Model), zap.Error(err))
+			return
+		}
+		s.preset = templates.DetectPreset(show.Template, show.Parameters, show.Details.Families)
+		s.numCtx = templates.ParseNumCtx(show.Parameters)
+		s.logger().Info("Detected the model's FIM format",
+			zap.String("model", s.Model),
+			zap.String("family", s.preset.Family),
+			zap.Strings("stop", s.preset.Stop))
+	})
+	return s.preset
+}
+
+// contextWindow returns NumCtx, or else the context window of the model as
+// Ollama reports it.
+func (s *Server) contextWindow(client *api.Client) int {
+	if s.NumCtx > 0 {
+		return s.NumCtx
+	}
+	s.detectedPreset(client)
+	if s.numCtx > 0 {
+		return s.numCtx
+	}
+	return handlers.DefaultNumCtx
+}
+
+// modelTokenizer returns the tokenizer registered for the model's family,
+// resolved like the FIM preset.
+func (s *Server) modelTokenizer(client *api.Client) tokenizer.Tokenizer {
+	if s.ModelFamily != "" {
+		return tokenizer.For(s.ModelFamily)
+	}
+	if detected := s.detectedPreset(client); detected.Family != "" {
+		return tokenizer.For(detected.Family)
+	}
+	preset, _, _ := templates.LookupPreset("", s.Model)
+	return tokenizer.For(preset.Family)
+}
+
+// backendPool returns the backend pool shared by all listeners. Requests
+// reach its backends through the transport of InstallTransport.
+func (s *Server) backendPool() (*backends.Pool, error) {
+	s.backendsOnce.Do(func() {
+		addresses := maps.Clone(s.Backends)
+		if name, address := s.remote(); len(addresses) == 0 && len(s.OllamaHosts) == 0 && name != "" {
+			u, err := url.Parse(address)
+			if err != nil {
+				s.backendsErr = fmt.Errorf("parsing the %s server URL: %w", name, err)
+				return
+			}
+			addresses = map[string]string{name: u.Scheme + "://" + u.Host}
+		}
+		for _, host := range s.OllamaHosts {
+			if addresses == nil {
+				addresses = map[string]string{}
+			}
+			addresses[host] = host
+		}
+		if len(addresses) == 0 {
+			host := os.Getenv("OLLAMA_HOST")
+			if host == "" {
+				host = "127.0.0.1"
+			}
+			addresses = map[string]string{"ollama": host}
+		}
+
+		pool, err := backends.New(addresses)
+		if err == nil {
+			err = pool.SetStrategy(backends.Strategy(s.Balance))
+		}
+		if err == nil {
+			err = pool.Pin(s.PinBackend)
+		}
+		if err != nil {
+			s.backendsErr = err
+			return
+		}
+		s.backends = pool
+	})
+	return s.backends, s.backendsErr
+}
+
+var transportOnce sync.Once
+
+// InstallTransport sets the transport of http.DefaultClient, which the
+// Ollama client always uses, to one sending each request to the backend
+// picked for it, with the headers forwarded from the client request. It must
+// be called once before any server is built or serves, and before any other
+// goroutine uses http.DefaultClient, since it replaces the transport without
+// synchronization. Later calls do nothing.
+func InstallTransport() {
+	transportOnce.Do(func() {
+		http.DefaultClient.Transport = &middleware.ForwardingTransport{Base: &backends.Transport{Base: http.DefaultClient.Transport}}
+	})
+}
+
+// ProbeBackends keeps the latency of the configured backends up to date. It
+// blocks and is meant to run in its own goroutine.
+func (s *Server) ProbeBackends() {
+	pool, err := s.backendPool()
+	if err != nil {
+		return
+	}
+	pool.Run()
+}
+
+// entitlementChecker returns the checker shared by all listeners, or nil when
+// entitlement checks are disabled.
+func (s *Server) entitlementChecker() *handlers.EntitlementChecker {
+	s.entitlementsOnce.Do(func() {
+		if s.EntitlementURL != "" {
+			s.entitlements = handlers.NewEntitlementChecker(s.EntitlementURL, s.EntitlementTTL)
+		}
+	})
+	return s.entitlements
+}
+
+// logger returns s.Logger, or a no-op logger when none is set.
+func (s *Server) logger() *zap.Logger {
+	if s.Logger == nil {
+		return zap.NewNop()
+	}
+	return s.Logger
 }
@@ -0,0 +1,807 @@
+package internal_test
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal"
+	"github.com/josuemontano/ollama-copilot/internal/certs"
+	"github.com/josuemontano/ollama-copilot/internal/handlers"
+	"github.com/josuemontano/ollama-copilot/internal/mdns"
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+	"github.com/josuemontano/ollama-copilot/internal/ollamatest"
+	"github.com/josuemontano/ollama-copilot/internal/storage"
+	"github.com/ollama/ollama/api"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestMain(m *testing.M) {
+	internal.InstallTransport()
+	os.Exit(m.Run())
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	ollama := ollamatest.NewServer(t)
+	ollama.OnGenerate(func(api.GenerateRequest) ollamatest.Reply { return ollamatest.Text("return 42") })
+	ollama.SetModels("test-model:latest")
+
+	server := &internal.Server{
+		Port:       ":11437",
+		Template:   "{{.Prefix}}<FILL>{{.Suffix}}",
+		Model:      "test-model",
+		NumPredict: 20,
+		TokenTTL:   time.Hour,
+		PublicHost: "localhost",
+		Headers:    middleware.DefaultGithubHeaderPolicy(),
+	}
+	handler, err := server.Handler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestServer_Handler(t *testing.T) {
+	srv := newTestServer(t)
+
+	resp, err := http.Get(srv.URL + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected health status code %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if got := resp.Header.Get("x-github-request-id"); got == "" {
+		t.Error("expected the GitHub headers to be injected")
+	}
+
+	resp, err = http.Get(srv.URL + "/copilot_internal/v2/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var token handlers.TokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		t.Fatalf("failed to decode token: %v", err)
+	}
+	resp.Body.Close()
+	if token.Endpoints == nil || token.Endpoints.Proxy != "http://localhost:11437" {
+		t.Errorf("expected endpoints to point at the HTTP listener, got %+v", token.Endpoints)
+	}
+
+	resp, err = http.Post(srv.URL+"/v1/engines/copilot-codex/completions", "application/json", strings.NewReader(`{"prompt":"def f():\n    ","suffix":"","max_tokens":10}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"text":"return 42"`) {
+		t.Errorf("expected the completion to be streamed, got %s", body)
+	}
+}
+
+func TestServer_HandlerError(t *testing.T) {
+	server := &internal.Server{Template: "{{.Prefix"}
+	if _, err := server.Handler(); err == nil {
+		t.Error("expected an error for an invalid prompt template")
+	}
+}
+
+func TestServer_AdminKeys(t *testing.T) {
+	ollamatest.NewServer(t)
+	server := &internal.Server{
+		Template:  "{{.Prefix}}<FILL>{{.Suffix}}",
+		Model:     "test-model",
+		AdminKeys: []string{"admin-secret"},
+	}
+	handler, err := server.Handler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := get("/admin/model", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected status code %d without the admin key, got %d", http.StatusUnauthorized, rr.Code)
+	}
+	rr := get("/admin/model", "admin-secret")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"model":"test-model"`) {
+		t.Errorf("expected the current model with the admin key, got %d: %s", rr.Code, rr.Body)
+	}
+	for _, path := range []string{"/admin/stats", "/admin/usage", "/admin/events", "/admin/backends", "/debug/trace/unknown"} {
+		if rr := get(path, ""); rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status code %d for %s without the admin key, got %d", http.StatusUnauthorized, path, rr.Code)
+		}
+	}
+	if rr := get("/admin/stats", "admin-secret"); rr.Code != http.StatusOK {
+		t.Errorf("expected the stats with the admin key, got %d", rr.Code)
+	}
+
+	// Without admin keys, nobody may reconfigure the server.
+	server = &internal.Server{Template: "{{.Prefix}}<FILL>{{.Suffix}}", Model: "test-model"}
+	if handler, err = server.Handler(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/admin/options", "/admin/stats", "/admin/usage", "/admin/events"} {
+		if rr := get(path, ""); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d for %s without admin keys, got %d", http.StatusNotFound, path, rr.Code)
+		}
+	}
+	req := httptest.NewRequest(http.MethodPost, "/admin/backends", strings.NewReader(`{"pinned":"ollama"}`))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected status code %d pinning a backend without admin keys, got %d", http.StatusForbidden, rr.Code)
+	}
+	if rr := get("/admin/backends", ""); rr.Code != http.StatusOK {
+		t.Errorf("expected the backends to be listed without admin keys, got %d", rr.Code)
+	}
+}
+
+func TestServer_DetectsModelFamily(t *testing.T) {
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/show" {
+			t.Errorf("expected only the model metadata to be requested, got %s", r.URL.Path)
+		}
+		_ = json.NewEncoder(w).Encode(api.ShowResponse{
+			Template:   "<fim_prefix>{{ .Prompt }}<fim_suffix>{{ .Suffix }}<fim_middle>",
+			Parameters: `stop "<custom>"`,
+		})
+	}))
+	defer ollama.Close()
+	t.Setenv("OLLAMA_HOST", ollama.URL)
+
+	server := &internal.Server{Model: "my-coder", NumPredict: 20}
+	handler, err := server.Handler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", strings.NewReader(`{"prompt":"a","suffix":"b"}`))
+	req.Header.Set(handlers.DebugPromptHeader, "true")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	var debug handlers.DebugPrompt
+	if err := json.NewDecoder(rr.Body).Decode(&debug); err != nil {
+		t.Fatalf("failed to decode debug prompt: %v", err)
+	}
+	if debug.Prompt != "<fim_prefix>a<fim_suffix>b<fim_middle>" {
+		t.Errorf("expected the starcoder2 template, got %q", debug.Prompt)
+	}
+	if !strings.Contains(fmt.Sprint(debug.Options["stop"]), "<custom>") {
+		t.Errorf("expected the model's stop parameter, got %v", debug.Options["stop"])
+	}
+}
+
+func TestServer_PrepareModels(t *testing.T) {
+	var mu sync.Mutex
+	local := map[string]bool{"small-coder": true}
+	var pulled, generated []string
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model string `json:"model"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/api/show":
+			if !local[req.Model] {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprintf(w, `{"error":"model '%s' not found"}`, req.Model)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(api.ShowResponse{})
+		case "/api/pull":
+			pulled = append(pulled, req.Model)
+			local[req.Model] = true
+			fmt.Fprint(w, `{"status":"pulling manifest"}`+"\n")
+			fmt.Fprint(w, `{"status":"pulling 6a0746a1ec1a","total":100,"completed":50}`+"\n")
+			fmt.Fprint(w, `{"status":"success"}`+"\n")
+		case "/api/generate":
+			generated = append(generated, req.Model)
+			fmt.Fprint(w, `{"done":true}`+"\n")
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+	}))
+	defer ollama.Close()
+	t.Setenv("OLLAMA_HOST", ollama.URL)
+
+	server := &internal.Server{Model: "my-coder", ChatModel: "small-coder", BurstModel: "big-coder"}
+	server.PrepareModels()
+	if len(pulled) != 0 || len(generated) != 0 {
+		t.Errorf("expected nothing to be pulled or loaded without --auto-pull and --warmup, got %v and %v", pulled, generated)
+	}
+
+	server = &internal.Server{Model: "my-coder", ChatModel: "small-coder", BurstModel: "big-coder", AutoPull: true, Warmup: true}
+	server.PrepareModels()
+	if !slices.Equal(pulled, []string{"my-coder", "big-coder"}) {
+		t.Errorf("expected the missing models to be pulled, model first, got %v", pulled)
+	}
+	if !slices.Equal(generated, []string{"my-coder"}) {
+		t.Errorf("expected the model to be warmed up, got %v", generated)
+	}
+}
+
+func TestServer_OpenAI(t *testing.T) {
+	openai := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			return
+		}
+		if r.URL.Path != "/v1/completions" {
+			t.Errorf("expected only completions to be requested, got %s %s", r.Method, r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("expected the API key, got %q", got)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"text\":\"return 42\"}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer openai.Close()
+
+	server := &internal.Server{
+		Template:   "{{.Prefix}}<FILL>{{.Suffix}}",
+		Model:      "my-coder",
+		NumPredict: 20,
+		OpenAIURL:  openai.URL + "/v1",
+		OpenAIKey:  "secret",
+	}
+	handler, err := server.Handler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", strings.NewReader(`{"prompt":"a","suffix":"b"}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+	if !strings.Contains(rr.Body.String(), "return 42") {
+		t.Errorf("expected the completion from the OpenAI server, got %s", rr.Body)
+	}
+
+	server = &internal.Server{Model: "my-coder", OpenAIURL: openai.URL + "/v1", LlamaCppURL: openai.URL}
+	if _, err := server.Handler(); err == nil {
+		t.Error("expected an error for both an OpenAI and a llama.cpp server")
+	}
+}
+
+func TestServer_StorageKeepsCache(t *testing.T) {
+	ollama := ollamatest.NewServer(t)
+	var generated atomic.Int32
+	ollama.OnGenerate(func(api.GenerateRequest) ollamatest.Reply {
+		generated.Add(1)
+		return ollamatest.Text("return 42")
+	})
+
+	path := filepath.Join(t.TempDir(), "state.db")
+	complete := func() string {
+		store, err := storage.OpenSQLite(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		server := &internal.Server{Template: "{{.Prefix}}<FILL>{{.Suffix}}", Model: "test-model", NumPredict: 20, CacheSize: 10, CacheTTL: time.Minute, Storage: store}
+		handler, err := server.Handler()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1/engines/copilot-codex/completions", strings.NewReader(`{"prompt":"def f():\n    ","suffix":"","max_tokens":10}`)))
+		return rr.Body.String()
+	}
+
+	complete()
+	if body := complete(); !strings.Contains(body, `"text":"return 42"`) {
+		t.Errorf("expected the cached completion, got %s", body)
+	}
+	if n := generated.Load(); n != 1 {
+		t.Errorf("expected a restarted server to answer from the stored cache, got %d generations", n)
+	}
+}
+
+// freeAddr returns a local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestServer_RunDrainsStreams(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/generate" {
+			_ = json.NewEncoder(w).Encode(api.ShowResponse{})
+			return
+		}
+		close(started)
+		<-release
+		_ = json.NewEncoder(w).Encode(api.GenerateResponse{Model: "test-model", Response: "return 42", Done: true})
+	}))
+	defer ollama.Close()
+	t.Setenv("OLLAMA_HOST", ollama.URL)
+
+	addr := freeAddr(t)
+	server := &internal.Server{
+		Port:          addr,
+		PortSSL:       freeAddr(t),
+		CertDir:       t.TempDir(),
+		Template:      "{{.Prefix}}<FILL>{{.Suffix}}",
+		Model:         "test-model",
+		NumPredict:    20,
+		ShutdownGrace: 5 * time.Second,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan error, 1)
+	go func() { stopped <- server.Run(ctx) }()
+
+	for range 100 {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Response headers are only sent with the first event, which waits for
+	// Ollama.
+	bodies := make(chan string, 1)
+	go func() {
+		resp, err := http.Post("http://"+addr+"/v1/engines/copilot-codex/completions", "application/json", strings.NewReader(`{"prompt":"x = ","suffix":"","max_tokens":20}`))
+		if err != nil {
+			t.Errorf("expected the request to be answered, got %v", err)
+			bodies <- ""
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Errorf("expected the stream to finish, got %v", err)
+		}
+		bodies <- string(body)
+	}()
+
+	<-started
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if body := <-bodies; !strings.Contains(body, "return 42") {
+		t.Errorf("expected the completion to be streamed to the end, got %q", body)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Run to return after the stream finished")
+	}
+}
+
+func TestServer_RunStartupFailure(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	server := &internal.Server{
+		Port:     busy.Addr().String(),
+		PortSSL:  freeAddr(t),
+		CertDir:  t.TempDir(),
+		Template: "{{.Prefix}}<FILL>{{.Suffix}}",
+		Model:    "test-model",
+	}
+	done := make(chan error, 1)
+	go func() { done <- server.Run(context.Background()) }()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected an error for a port in use")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Run to stop the other listeners and return")
+	}
+}
+
+func TestServer_RunHTTPOnly(t *testing.T) {
+	t.Setenv("OLLAMA_HOST", "http://127.0.0.1:1")
+
+	addr := freeAddr(t)
+	server := &internal.Server{
+		Port:         addr,
+		ProxyPortSSL: freeAddr(t),
+		Template:     "{{.Prefix}}<FILL>{{.Suffix}}",
+		Model:        "test-model",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- server.Run(ctx) }()
+
+	var resp *http.Response
+	var err error
+	for range 100 {
+		if resp, err = http.Get("http://" + addr + "/metrics"); err == nil {
+			resp.Body.Close()
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("expected the HTTP listener to serve, got %v", err)
+	}
+
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Errorf("expected a clean shutdown with the HTTPS listener and its proxy disabled, got %v", err)
+	}
+}
+
+func TestServer_RunAdvertises(t *testing.T) {
+	t.Setenv("OLLAMA_HOST", "http://127.0.0.1:1")
+
+	_, port, _ := net.SplitHostPort(freeAddr(t))
+	server := &internal.Server{Port: ":" + port, Template: "{{.Prefix}}<FILL>{{.Suffix}}", Model: "test-model", Advertise: true}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- server.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	browse, stop := context.WithTimeout(context.Background(), time.Second)
+	defer stop()
+	instances, err := mdns.Browse(browse)
+	if err != nil {
+		t.Skipf("multicast is not available: %v", err)
+	}
+	for _, inst := range instances {
+		if strconv.Itoa(inst.Port) != port {
+			continue
+		}
+		if inst.Text["port"] != port || inst.Text["tls_port"] != "" {
+			t.Errorf("expected only the HTTP listener in the TXT record, got %v", inst.Text)
+		}
+		return
+	}
+	t.Skipf("the server was not found, multicast may not reach this host: %+v", instances)
+}
+
+func TestServer_RunListenAddresses(t *testing.T) {
+	tests := []struct {
+		name          string
+		port, portSSL string
+		want          string
+	}{
+		{"no listeners", "", "", "no listener enabled"},
+		{"invalid address", "::1::", "", "invalid listen address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &internal.Server{Port: tt.port, PortSSL: tt.portSSL, Template: "{{.Prefix}}<FILL>{{.Suffix}}"}
+			err := server.Run(context.Background())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestServer_RunListeners(t *testing.T) {
+	t.Setenv("OLLAMA_HOST", "http://127.0.0.1:1")
+
+	open, locked := freeAddr(t), freeAddr(t)
+	file := filepath.Join(t.TempDir(), "listeners.json")
+	listeners := fmt.Sprintf(`[
+		{"name": "loopback", "addr": %q},
+		{"name": "lan", "addr": %q, "api_keys": ["secret"]}
+	]`, open, locked)
+	if err := os.WriteFile(file, []byte(listeners), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	server := &internal.Server{
+		Port:      freeAddr(t),
+		Listeners: file,
+		Template:  "{{.Prefix}}<FILL>{{.Suffix}}",
+		Model:     "test-model",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- server.Run(ctx) }()
+
+	get := func(addr, key string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/metrics", nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		for range 100 {
+			resp, err := http.DefaultClient.Do(req)
+			if err == nil {
+				resp.Body.Close()
+				return resp.StatusCode
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("expected a listener on %s", addr)
+		return 0
+	}
+	if got := get(open, ""); got != http.StatusOK {
+		t.Errorf("expected the loopback listener to need no key, got status %d", got)
+	}
+	if got := get(locked, ""); got != http.StatusUnauthorized {
+		t.Errorf("expected the lan listener to reject a request without a key, got status %d", got)
+	}
+	if got := get(locked, "secret"); got != http.StatusOK {
+		t.Errorf("expected the lan listener to accept its key, got status %d", got)
+	}
+	if conn, err := net.Dial("tcp", server.Port); err == nil {
+		conn.Close()
+		t.Error("expected the listeners file to replace Port")
+	}
+
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Errorf("expected a clean shutdown, got %v", err)
+	}
+}
+
+func TestServer_RunUnixSocket(t *testing.T) {
+	t.Setenv("OLLAMA_HOST", "http://127.0.0.1:1")
+
+	path := filepath.Join(t.TempDir(), "copilot.sock")
+	// A socket left behind by a server that is gone is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	server := &internal.Server{
+		Port:     freeAddr(t),
+		Listen:   []string{"unix://" + path},
+		Template: "{{.Prefix}}<FILL>{{.Suffix}}",
+		Model:    "test-model",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- server.Run(ctx) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	var resp *http.Response
+	for range 100 {
+		if resp, err = client.Get("http://unix/metrics"); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("expected the socket to serve, got %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200 over the socket, got %d", resp.StatusCode)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("expected the socket to be private to the user, got %v, %v", info.Mode(), err)
+	}
+
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Errorf("expected a clean shutdown, got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed on shutdown, got %v", err)
+	}
+}
+
+func TestServer_RunACMEHostPolicy(t *testing.T) {
+	t.Setenv("OLLAMA_HOST", "http://127.0.0.1:1")
+
+	addr := freeAddr(t)
+	server := &internal.Server{
+		PortSSL:      addr,
+		ACMEDomains:  []string{"copilot.example.com"},
+		ACMECacheDir: t.TempDir(),
+		Template:     "{{.Prefix}}<FILL>{{.Suffix}}",
+		Model:        "test-model",
+	}
+	core, logs := observer.New(zapcore.WarnLevel)
+	server.Logger = zap.New(core)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- server.Run(ctx) }()
+
+	var conn net.Conn
+	var err error
+	for range 100 {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("expected the HTTPS listener to accept connections, got %v", err)
+	}
+	// A host outside the domains is refused before Let's Encrypt is asked.
+	client := tls.Client(conn, &tls.Config{ServerName: "other.example.com"})
+	if err := client.Handshake(); err == nil {
+		t.Error("expected the handshake to fail for a host outside --acme-domain")
+	}
+	client.Close()
+	// The listener is on neither port 80 nor 443.
+	if warnings := logs.FilterMessageSnippet("answers the Let's Encrypt challenges").Len(); warnings != 1 {
+		t.Errorf("expected a warning about the ACME challenges, got %d", warnings)
+	}
+
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Errorf("expected a clean shutdown, got %v", err)
+	}
+}
+
+func TestServer_Reload(t *testing.T) {
+	ollamatest.NewServer(t)
+
+	// Certificate and Key are the generated certificate of a first
+	// authority, replaced below with that of a second.
+	first, second := t.TempDir(), t.TempDir()
+	for _, dir := range []string{first, second} {
+		if _, err := certs.Load(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	certFile, keyFile := filepath.Join(first, "server.crt"), filepath.Join(first, "server.key")
+
+	addr, addrSSL := freeAddr(t), freeAddr(t)
+	settings := func(model, template string) *internal.Server {
+		return &internal.Server{
+			Port:        addr,
+			PortSSL:     addrSSL,
+			Certificate: certFile,
+			Key:         keyFile,
+			Template:    template,
+			Model:       model,
+			AdminKeys:   []string{"admin-secret"},
+		}
+	}
+	core, logs := observer.New(zapcore.WarnLevel)
+	server := settings("test-model", "{{.Prefix}}<FILL>{{.Suffix}}")
+	server.Logger = zap.New(core)
+	if err := server.Reload(settings("other-model", "{{.Prefix}}")); err == nil {
+		t.Error("expected an error reloading before serving")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- server.Run(ctx) }()
+
+	// The server routes http.DefaultClient through its backends as it
+	// starts, so the test has a client of its own.
+	client := &http.Client{}
+	model := func() string {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/admin/model", nil)
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		for range 100 {
+			resp, err := client.Do(req)
+			if err == nil {
+				defer resp.Body.Close()
+				var got handlers.ModelResponse
+				_ = json.NewDecoder(resp.Body).Decode(&got)
+				return got.Model
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("expected a listener on %s", addr)
+		return ""
+	}
+	served := func() []byte {
+		t.Helper()
+		conn, err := tls.Dial("tcp", addrSSL, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Raw
+	}
+	if got := model(); got != "test-model" {
+		t.Fatalf("expected the configured model, got %q", got)
+	}
+	before := served()
+
+	for _, name := range []string{"server.crt", "server.key"} {
+		data, err := os.ReadFile(filepath.Join(second, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(first, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := server.Reload(settings("other-model", "{{.Prefix}}")); err != nil {
+		t.Fatal(err)
+	}
+	if got := model(); got != "other-model" {
+		t.Errorf("expected the reloaded model, got %q", got)
+	}
+	if after := served(); string(after) == string(before) {
+		t.Error("expected the HTTPS listener to serve the new certificate")
+	}
+
+	if err := server.Reload(settings("broken-model", "{{.Prefix")); err == nil {
+		t.Error("expected an error for a template that does not parse")
+	}
+	if got := model(); got != "other-model" {
+		t.Errorf("expected a failed reload to keep the settings, got %q", got)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://"+addr+"/admin/model", strings.NewReader(`{"model": "admin-model"}`))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if err := server.Reload(settings("other-model", "{{.Prefix}}")); err != nil {
+		t.Fatal(err)
+	}
+	warnings := logs.FilterMessage("Reloading replaces the settings changed at the admin endpoints").All()
+	if len(warnings) != 1 || !slices.Equal(warnings[0].ContextMap()["settings"].([]any), []any{"model"}) {
+		t.Errorf("expected a warning that the model set at runtime is replaced, got %+v", warnings)
+	}
+	if got := model(); got != "other-model" {
+		t.Errorf("expected the reload to replace the model set at runtime, got %q", got)
+	}
+
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Errorf("expected a clean shutdown, got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"go.uber.org/zap"
+)
+
+// standbyInterval is how often the fallback model is pinged. It stays below
+// Ollama's default five minute keep_alive so the model is never unloaded.
+const standbyInterval = 4 * time.Minute
+
+// KeepStandbyWarm keeps the fallback model loaded in Ollama so failing over
+// to it does not pay a cold start. Other servers than Ollama choose what to
+// keep loaded themselves. It blocks and is meant to run in its own
+// goroutine.
+func (s *Server) KeepStandbyWarm() {
+	if name, _ := s.remote(); s.FallbackModel == "" || name != "" {
+		return
+	}
+
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		s.Logger.Error("Error initializing the Ollama client", zap.Error(err))
+		return
+	}
+
+	ticker := time.NewTicker(standbyInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := loadModel(context.Background(), client, s.FallbackModel); err != nil {
+			s.Logger.Warn("Error loading standby model", zap.String("model", s.FallbackModel), zap.Error(err))
+		} else {
+			s.Logger.Debug("Standby model loaded", zap.String("model", s.FallbackModel))
+		}
+		<-ticker.C
+	}
+}
+
+// loadModel asks Ollama to load model into memory. A generate request with an
+// empty prompt loads the model without producing any tokens.
+func loadModel(ctx context.Context, client *api.Client, model string) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+
+	return client.Generate(ctx, &api.GenerateRequest{Model: model}, func(api.GenerateResponse) error {
+		return nil
+	})
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"slices"
+	"sync"
+)
+
+// MemoryLogSize is how many records each log of a memory storage keeps.
+// Older records are dropped, so that a long-running server does not grow
+// without bound.
+const MemoryLogSize = 10000
+
+// Memory is a storage that keeps everything in memory, for deployments that
+// need no state across restarts and for tests.
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+	logs    map[string][][]byte
+}
+
+// NewMemory returns an empty memory storage.
+func NewMemory() *Memory {
+	return &Memory{buckets: map[string]map[string][]byte{}, logs: map[string][][]byte{}}
+}
+
+func (m *Memory) Get(bucket, key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := m.buckets[bucket][key]
+	return slices.Clone(value), ok, nil
+}
+
+func (m *Memory) Put(bucket, key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.buckets[bucket] == nil {
+		m.buckets[bucket] = map[string][]byte{}
+	}
+	m.buckets[bucket][key] = slices.Clone(value)
+	return nil
+}
+
+func (m *Memory) Delete(bucket, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.buckets[bucket], key)
+	return nil
+}
+
+func (m *Memory) Each(bucket string, fn func(key string, value []byte) error) error {
+	m.mu.Lock()
+	keys := make([]string, 0, len(m.buckets[bucket]))
+	for key := range m.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	m.mu.Unlock()
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		value, ok, _ := m.Get(bucket, key)
+		if !ok {
+			continue
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Append(log string, record []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	records := append(m.logs[log], slices.Clone(record))
+	if len(records) > MemoryLogSize {
+		records = slices.Delete(records, 0, len(records)-MemoryLogSize)
+	}
+	m.logs[log] = records
+	return nil
+}
+
+func (m *Memory) Scan(log string, fn func(record []byte) error) error {
+	m.mu.Lock()
+	records := slices.Clone(m.logs[log])
+	m.mu.Unlock()
+
+	for _, record := range records {
+		if err := fn(slices.Clone(record)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close does nothing; the storage stays usable.
+func (m *Memory) Close() error { return nil }
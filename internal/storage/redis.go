@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/redis"
+)
+
+// RedisLogSize is how many records each log of a Redis storage keeps, as a
+// shared server should not grow without bound either.
+const RedisLogSize = 100000
+
+// redisTimeout bounds each operation on a Redis storage.
+const redisTimeout = 5 * time.Second
+
+// updateAttempts is how many times Update retries when another server
+// changed the value in between.
+const updateAttempts = 16
+
+// Redis is a storage kept in a Redis server, shared by the servers behind
+// a load balancer so that they cache, count and limit together. Values are
+// strings under prefix:bucket:key and logs are lists under prefix:log:log.
+type Redis struct {
+	client *redis.Client
+	prefix string
+}
+
+// OpenRedis returns the storage of the Redis server at rawURL, such as
+// redis://:password@cache:6379/0. The prefix query parameter, by default
+// ollama-copilot, starts every key, so that deployments can share a server.
+func OpenRedis(rawURL string) (*Redis, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the Redis URL: %w", err)
+	}
+	prefix := u.Query().Get("prefix")
+	if prefix == "" {
+		prefix = "ollama-copilot"
+	}
+	if strings.ContainsAny(prefix, "*?[]\\") {
+		return nil, fmt.Errorf("Redis key prefix %q must not contain glob characters", prefix)
+	}
+	u.RawQuery = ""
+	client, err := redis.New(u.String())
+	if err != nil {
+		return nil, err
+	}
+	r := &Redis{client: client, prefix: prefix}
+	if _, err := r.do("PING"); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Redis) key(bucket, key string) string {
+	return r.prefix + ":" + bucket + ":" + key
+}
+
+func (r *Redis) logKey(log string) string {
+	return r.prefix + ":log:" + log
+}
+
+func (r *Redis) do(args ...string) (any, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return r.client.Do(ctx, args...)
+}
+
+func (r *Redis) Get(bucket, key string) ([]byte, bool, error) {
+	reply, err := r.do("GET", r.key(bucket, key))
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected reply %T to GET", reply)
+	}
+	return []byte(value), true, nil
+}
+
+func (r *Redis) Put(bucket, key string, value []byte) error {
+	_, err := r.do("SET", r.key(bucket, key), string(value))
+	return err
+}
+
+func (r *Redis) Delete(bucket, key string) error {
+	_, err := r.do("DEL", r.key(bucket, key))
+	return err
+}
+
+func (r *Redis) Each(bucket string, fn func(key string, value []byte) error) error {
+	prefix := r.key(bucket, "")
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := r.do("SCAN", cursor, "MATCH", prefix+"*", "COUNT", "1000")
+		if err != nil {
+			return err
+		}
+		page, ok := reply.([]any)
+		if !ok || len(page) != 2 {
+			return fmt.Errorf("redis: unexpected reply %T to SCAN", reply)
+		}
+		cursor, _ = page[0].(string)
+		found, _ := page[1].([]any)
+		for _, k := range found {
+			if k, ok := k.(string); ok {
+				keys = append(keys, strings.TrimPrefix(k, prefix))
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			break
+		}
+	}
+	// SCAN may return a key more than once.
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+
+	for _, key := range keys {
+		value, ok, err := r.Get(bucket, key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Redis) Append(log string, record []byte) error {
+	if _, err := r.do("RPUSH", r.logKey(log), string(record)); err != nil {
+		return err
+	}
+	_, err := r.do("LTRIM", r.logKey(log), strconv.Itoa(-RedisLogSize), "-1")
+	return err
+}
+
+func (r *Redis) Scan(log string, fn func(record []byte) error) error {
+	const page = 1000
+	for start := 0; ; start += page {
+		reply, err := r.do("LRANGE", r.logKey(log), strconv.Itoa(start), strconv.Itoa(start+page-1))
+		if err != nil {
+			return err
+		}
+		records, _ := reply.([]any)
+		for _, record := range records {
+			record, _ := record.(string)
+			if err := fn([]byte(record)); err != nil {
+				return err
+			}
+		}
+		if len(records) < page {
+			return nil
+		}
+	}
+}
+
+func (r *Redis) Add(bucket, key string, n int64) (int64, error) {
+	reply, err := r.do("INCRBY", r.key(bucket, key), strconv.FormatInt(n, 10))
+	if err != nil {
+		return 0, err
+	}
+	sum, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected reply %T to INCRBY", reply)
+	}
+	return sum, nil
+}
+
+func (r *Redis) PutExpiring(bucket, key string, value []byte, ttl time.Duration) error {
+	_, err := r.do("SET", r.key(bucket, key), string(value), "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	return err
+}
+
+// Update watches the key, and sets it in a transaction that the server
+// aborts when another server set it since.
+func (r *Redis) Update(bucket, key string, ttl time.Duration, fn func(value []byte, ok bool) []byte) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	conn, err := r.client.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// A failed update may leave the key watched, which would abort
+		// the next transaction on the connection.
+		if err != nil {
+			_, _ = conn.Do(ctx, "UNWATCH")
+		}
+		conn.Close()
+	}()
+
+	k := r.key(bucket, key)
+	px := strconv.FormatInt(max(ttl.Milliseconds(), 1), 10)
+	for range updateAttempts {
+		if _, err := conn.Do(ctx, "WATCH", k); err != nil {
+			return err
+		}
+		reply, err := conn.Do(ctx, "GET", k)
+		if err != nil {
+			return err
+		}
+		current, ok := reply.(string)
+		value := fn([]byte(current), ok)
+
+		if _, err := conn.Do(ctx, "MULTI"); err != nil {
+			return err
+		}
+		if _, err := conn.Do(ctx, "SET", k, string(value), "PX", px); err != nil {
+			_, _ = conn.Do(ctx, "DISCARD")
+			return err
+		}
+		reply, err = conn.Do(ctx, "EXEC")
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			return nil
+		}
+	}
+	return errors.New("redis: the value kept changing during the update")
+}
+
+// Close closes the connections to the server.
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	_ "modernc.org/sqlite"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS kv (
+	bucket TEXT NOT NULL,
+	key    TEXT NOT NULL,
+	value  BLOB NOT NULL,
+	PRIMARY KEY (bucket, key)
+);
+CREATE TABLE IF NOT EXISTS log (
+	seq    INTEGER PRIMARY KEY AUTOINCREMENT,
+	log    TEXT NOT NULL,
+	record BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS log_by_name ON log (log, seq);
+`
+
+// SQLite is a storage kept in a SQLite database file, for state that
+// survives restarts.
+type SQLite struct {
+	db *sql.DB
+}
+
+// OpenSQLite opens the SQLite database at path, creating it and its tables
+// when they do not exist.
+func OpenSQLite(path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	// A single connection serializes the writers, which SQLite would
+	// otherwise answer with SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA journal_mode = WAL", "PRAGMA busy_timeout = 5000", schema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("preparing %s: %w", path, err)
+		}
+	}
+	return &SQLite{db: db}, nil
+}
+
+func (s *SQLite) Get(bucket, key string) ([]byte, bool, error) {
+	var value []byte
+	err := s.db.QueryRow(`SELECT value FROM kv WHERE bucket = ? AND key = ?`, bucket, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (s *SQLite) Put(bucket, key string, value []byte) error {
+	_, err := s.db.Exec(`INSERT INTO kv (bucket, key, value) VALUES (?, ?, ?)
+		ON CONFLICT (bucket, key) DO UPDATE SET value = excluded.value`, bucket, key, value)
+	return err
+}
+
+func (s *SQLite) Delete(bucket, key string) error {
+	_, err := s.db.Exec(`DELETE FROM kv WHERE bucket = ? AND key = ?`, bucket, key)
+	return err
+}
+
+func (s *SQLite) Each(bucket string, fn func(key string, value []byte) error) error {
+	type pair struct {
+		key   string
+		value []byte
+	}
+	// The rows are read before calling fn, whose own queries would wait
+	// for the only connection otherwise.
+	var pairs []pair
+	err := s.query(func(rows *sql.Rows) error {
+		var p pair
+		if err := rows.Scan(&p.key, &p.value); err != nil {
+			return err
+		}
+		pairs = append(pairs, p)
+		return nil
+	}, `SELECT key, value FROM kv WHERE bucket = ? ORDER BY key`, bucket)
+	if err != nil {
+		return err
+	}
+	for _, p := range pairs {
+		if err := fn(p.key, p.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLite) Append(log string, record []byte) error {
+	_, err := s.db.Exec(`INSERT INTO log (log, record) VALUES (?, ?)`, log, record)
+	return err
+}
+
+func (s *SQLite) Scan(log string, fn func(record []byte) error) error {
+	var records [][]byte
+	err := s.query(func(rows *sql.Rows) error {
+		var record []byte
+		if err := rows.Scan(&record); err != nil {
+			return err
+		}
+		records = append(records, record)
+		return nil
+	}, `SELECT record FROM log WHERE log = ? ORDER BY seq`, log)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the database.
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+// query calls scan for each row of query.
+func (s *SQLite) query(scan func(*sql.Rows) error, query string, args ...any) error {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,68 @@
+// Package storage keeps the state of the server's stateful features, such
+// as the completion cache and the usage stats, either in memory, in a
+// SQLite file that survives restarts or in a Redis server that several
+// servers share.
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Storage holds values by key in named buckets, and logs that records are
+// appended to. Implementations are safe for concurrent use.
+type Storage interface {
+	// Get returns the value of key in bucket, and false when there is none.
+	Get(bucket, key string) ([]byte, bool, error)
+	// Put sets the value of key in bucket.
+	Put(bucket, key string, value []byte) error
+	// Delete removes key from bucket. Deleting a missing key is not an
+	// error.
+	Delete(bucket, key string) error
+	// Each calls fn with the keys of bucket and their values, in key order,
+	// until fn returns an error, which Each returns. fn may use the storage.
+	Each(bucket string, fn func(key string, value []byte) error) error
+
+	// Append adds record to the end of log.
+	Append(log string, record []byte) error
+	// Scan calls fn with the records of log in the order they were
+	// appended, until fn returns an error, which Scan returns. fn may use
+	// the storage.
+	Scan(log string, fn func(record []byte) error) error
+
+	Close() error
+}
+
+// Shared is implemented by storages several servers use at once. What the
+// servers count or limit together has to change in place there, as a value
+// one server read, changed and put back would undo the changes the others
+// made meanwhile.
+type Shared interface {
+	Storage
+	// Add adds n to the counter key of bucket, which starts at zero, and
+	// returns the sum. Get returns counters in decimal.
+	Add(bucket, key string, n int64) (int64, error)
+	// PutExpiring sets the value of key in bucket for ttl.
+	PutExpiring(bucket, key string, value []byte, ttl time.Duration) error
+	// Update sets the value of key in bucket to what fn returns for the
+	// current one, for ttl. No other change comes in between, and fn may
+	// be called again when one would have.
+	Update(bucket, key string, ttl time.Duration, fn func(value []byte, ok bool) []byte) error
+}
+
+// Open returns the storage spec names: "memory", the default when spec is
+// empty, "sqlite:" followed by the path of the database file, or the
+// redis:// or rediss:// URL of a Redis server.
+func Open(spec string) (Storage, error) {
+	if spec == "" || spec == "memory" {
+		return NewMemory(), nil
+	}
+	if path, ok := strings.CutPrefix(spec, "sqlite:"); ok && path != "" {
+		return OpenSQLite(path)
+	}
+	if strings.HasPrefix(spec, "redis://") || strings.HasPrefix(spec, "rediss://") {
+		return OpenRedis(spec)
+	}
+	return nil, fmt.Errorf("unknown storage %q, expected memory, sqlite:FILE or redis://HOST", spec)
+}
@@ -0,0 +1,210 @@
+package storage_test
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/redistest"
+	"github.com/josuemontano/ollama-copilot/internal/storage"
+)
+
+// backends returns a storage of each kind, opened in a temporary directory.
+func backends(t *testing.T) map[string]func() storage.Storage {
+	dir := t.TempDir()
+	return map[string]func() storage.Storage{
+		"memory": func() storage.Storage { return storage.NewMemory() },
+		"sqlite": func() storage.Storage {
+			s, err := storage.OpenSQLite(filepath.Join(dir, "state.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			return s
+		},
+		"redis": func() storage.Storage {
+			return openRedis(t, redistest.NewServer(t).URL)
+		},
+	}
+}
+
+func openRedis(t *testing.T, url string) *storage.Redis {
+	t.Helper()
+	s, err := storage.OpenRedis(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestStorage_KV(t *testing.T) {
+	for name, open := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			s := open()
+			if _, ok, err := s.Get("b", "missing"); ok || err != nil {
+				t.Errorf("expected no value, got %v (%v)", ok, err)
+			}
+			for _, kv := range [][2]string{{"y", "1"}, {"x", "2"}, {"y", "3"}} {
+				if err := s.Put("b", kv[0], []byte(kv[1])); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_ = s.Put("other", "z", []byte("4"))
+			if value, ok, err := s.Get("b", "y"); !ok || err != nil || string(value) != "3" {
+				t.Errorf("expected the last value put, got %q, %v (%v)", value, ok, err)
+			}
+
+			var keys []string
+			err := s.Each("b", func(key string, value []byte) error {
+				keys = append(keys, key+"="+string(value))
+				return s.Delete("b", key)
+			})
+			if want := []string{"x=2", "y=3"}; err != nil || !reflect.DeepEqual(keys, want) {
+				t.Errorf("expected %v, got %v (%v)", want, keys, err)
+			}
+			if _, ok, _ := s.Get("b", "x"); ok {
+				t.Error("expected the deleted key to be gone")
+			}
+			if err := s.Delete("b", "x"); err != nil {
+				t.Errorf("expected deleting a missing key to succeed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStorage_Log(t *testing.T) {
+	for name, open := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			s := open()
+			for _, record := range []string{"a", "b", "c"} {
+				if err := s.Append("events", []byte(record)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_ = s.Append("other", []byte("x"))
+
+			var records []string
+			stop := errors.New("stop")
+			err := s.Scan("events", func(record []byte) error {
+				records = append(records, string(record))
+				if len(records) == 2 {
+					return stop
+				}
+				return nil
+			})
+			if want := []string{"a", "b"}; err != stop || !reflect.DeepEqual(records, want) {
+				t.Errorf("expected %v, got %v (%v)", want, records, err)
+			}
+		})
+	}
+}
+
+func TestSQLite_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	s, err := storage.Open("sqlite:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Put("b", "k", []byte("v"))
+	_ = s.Append("log", []byte("r"))
+	s.Close()
+
+	s, err = storage.Open("sqlite:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if value, ok, _ := s.Get("b", "k"); !ok || string(value) != "v" {
+		t.Errorf("expected the value to survive reopening, got %q", value)
+	}
+	var n int
+	_ = s.Scan("log", func([]byte) error { n++; return nil })
+	if n != 1 {
+		t.Errorf("expected 1 record after reopening, got %d", n)
+	}
+}
+
+func TestRedis_Shared(t *testing.T) {
+	srv := redistest.NewServer(t)
+	a, b := openRedis(t, srv.URL), openRedis(t, srv.URL)
+
+	var wg sync.WaitGroup
+	for _, s := range []*storage.Redis{a, b} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				if _, err := s.Add("counters", "requests", 2); err != nil {
+					t.Error(err)
+				}
+				err := s.Update("values", "n", time.Minute, func(value []byte, ok bool) []byte {
+					return append(value, 'x')
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if value, _, _ := b.Get("counters", "requests"); string(value) != "200" {
+		t.Errorf("expected every addition counted, got %q", value)
+	}
+	if value, _, _ := a.Get("values", "n"); len(value) != 100 {
+		t.Errorf("expected every update applied, got %d", len(value))
+	}
+
+	if err := a.PutExpiring("values", "short", []byte("v"), 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := b.Get("values", "short"); !ok {
+		t.Error("expected the value to be shared")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, ok, _ := b.Get("values", "short"); ok {
+		t.Error("expected the value to expire")
+	}
+}
+
+func TestMemory_LogSize(t *testing.T) {
+	s := storage.NewMemory()
+	for i := 0; i <= storage.MemoryLogSize; i++ {
+		_ = s.Append("log", []byte{byte(i)})
+	}
+	var n int
+	var first []byte
+	_ = s.Scan("log", func(record []byte) error {
+		if n == 0 {
+			first = record
+		}
+		n++
+		return nil
+	})
+	if n != storage.MemoryLogSize || first[0] != 1 {
+		t.Errorf("expected the oldest record dropped, got %d records starting with %v", n, first)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	for _, spec := range []string{"", "memory"} {
+		if s, err := storage.Open(spec); err != nil {
+			t.Errorf("expected %q to open, got %v", spec, err)
+		} else if _, ok := s.(*storage.Memory); !ok {
+			t.Errorf("expected %q to open a memory storage, got %T", spec, s)
+		}
+	}
+	if s, err := storage.Open(redistest.NewServer(t).URL + "/2?prefix=team"); err != nil {
+		t.Errorf("expected a Redis URL to open, got %v", err)
+	} else {
+		s.Close()
+	}
+	for _, spec := range []string{"redis", "sqlite:", "redis://127.0.0.1:1", "redis://host/db"} {
+		if _, err := storage.Open(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
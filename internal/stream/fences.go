@@ -0,0 +1,137 @@
+package stream
+
+import "strings"
+
+const fence = "```"
+
+// Fences drops the markdown code fences chat-tuned models wrap code in:
+// lines starting with ``` and any language tag after them, together with
+// one newline. A line that is only language right after an opening fence
+// is dropped as well, for models that put the tag on a line of its own.
+// Lines are judged whole, so a fence split over chunks is still dropped and
+// code merely containing ``` or the language name is kept. Only the start
+// of a line and the newline before it are held back while they could turn
+// out to be a fence.
+func Fences(language string) Filter {
+	return &fences{language: strings.ToLower(language), start: true}
+}
+
+type fences struct {
+	language string
+	// start is set at the start of a line, while line collects the text
+	// that may still turn out to be a fence.
+	start bool
+	line  strings.Builder
+	// dropping is set in the rest of a fence line.
+	dropping bool
+	// newline is set when the newline that ended the previous line is
+	// held back, and beforeFence keeps it while a fence line is dropped.
+	newline     bool
+	beforeFence bool
+	// open is set between an opening and a closing fence, and tagNext on
+	// the line after an opening fence.
+	open    bool
+	tagNext bool
+	// fenced is set when nothing but fences and tags came since the
+	// newline held back.
+	fenced bool
+}
+
+// fenceLine is what the start of a line turns out to be.
+type fenceLine int
+
+const (
+	lineUndecided fenceLine = iota
+	lineFence
+	lineTag
+	lineCode
+)
+
+func (f *fences) Push(chunk string) (string, bool) {
+	var out strings.Builder
+	for i := 0; i < len(chunk); i++ {
+		c := chunk[i]
+		switch {
+		case f.dropping:
+			if c == '\n' {
+				f.dropping, f.start = false, true
+				f.newline, f.fenced = f.beforeFence, true
+			}
+		case f.start:
+			f.line.WriteByte(c)
+			switch f.classify(f.line.String(), false) {
+			case lineFence:
+				f.dropping, f.start = true, false
+				f.beforeFence, f.newline = f.newline, false
+				f.open = !f.open
+				f.tagNext = f.open
+				f.line.Reset()
+			case lineTag:
+				f.tagNext = false
+				f.line.Reset()
+			case lineCode:
+				f.emitLine(&out)
+			}
+		case c == '\n':
+			f.newline, f.start = true, true
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String(), false
+}
+
+// emitLine passes on the held newline and line. A line ending in a newline
+// is a blank one, whose newline is held back in turn.
+func (f *fences) emitLine(out *strings.Builder) {
+	line := f.line.String()
+	f.line.Reset()
+	f.tagNext, f.fenced = false, false
+	if f.newline {
+		out.WriteByte('\n')
+	}
+	if text, ok := strings.CutSuffix(line, "\n"); ok {
+		out.WriteString(text)
+		f.newline = true
+		return
+	}
+	out.WriteString(line)
+	f.newline, f.start = false, false
+}
+
+// classify says what the start of a line is, once it can tell. At the end
+// of the completion, a last line that is still undecided is code unless it
+// is the language tag.
+func (f *fences) classify(line string, end bool) fenceLine {
+	body := strings.TrimLeft(line, " \t")
+	text := strings.TrimRight(body, "\r\n")
+	switch {
+	case strings.HasPrefix(body, fence):
+		return lineFence
+	case f.tagNext && f.language != "" && strings.ToLower(text) == f.language && (end || text != body):
+		return lineTag
+	case end || text != body:
+		return lineCode
+	case strings.HasPrefix(fence, body):
+		return lineUndecided
+	case f.tagNext && strings.HasPrefix(f.language, strings.ToLower(body)):
+		return lineUndecided
+	}
+	return lineCode
+}
+
+// Flush drops a fence or tag at the end of the completion, with the newline
+// before it, and passes on anything else held back.
+func (f *fences) Flush() string {
+	if f.dropping {
+		return ""
+	}
+	var out strings.Builder
+	if f.start && f.line.Len() > 0 && f.classify(f.line.String(), true) != lineTag {
+		f.emitLine(&out)
+	}
+	if f.newline && !f.fenced {
+		out.WriteByte('\n')
+	}
+	return out.String()
+}
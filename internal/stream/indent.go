@@ -0,0 +1,131 @@
+package stream
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// IndentStyle is how a file indents its lines: with tabs, or with Width
+// spaces per level.
+type IndentStyle struct {
+	Tabs  bool
+	Width int
+}
+
+// ParseIndent parses an indentation setting, "tabs" or a number of spaces
+// from 1 to 8.
+func ParseIndent(s string) (IndentStyle, error) {
+	if s == "tabs" {
+		return IndentStyle{Tabs: true, Width: tabWidth}, nil
+	}
+	width, err := strconv.Atoi(s)
+	if err != nil || width < 1 || width > 8 {
+		return IndentStyle{}, fmt.Errorf("indent %q must be tabs or a number of spaces from 1 to 8", s)
+	}
+	return IndentStyle{Width: width}, nil
+}
+
+// DetectIndent returns the indentation style of the lines of text, and
+// false when too few of them are indented to tell. Text indented with
+// tabs more often than with spaces uses tabs. Otherwise the width is the
+// most common step between the indentation of consecutive lines. Single
+// spaces, as in the continuation lines of block comments, are ignored.
+func DetectIndent(text string) (IndentStyle, bool) {
+	var tabs, spaces int
+	steps := map[int]int{}
+	// prev is the number of leading spaces of the last line with text, -1
+	// after a line indented with tabs.
+	prev := 0
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if line[0] == '\t' {
+			tabs++
+			prev = -1
+			continue
+		}
+		n := len(line) - len(strings.TrimLeft(line, " "))
+		if n >= 2 {
+			spaces++
+		}
+		if step := n - prev; prev >= 0 && step >= 2 && step <= 8 {
+			steps[step]++
+		}
+		prev = n
+	}
+
+	switch {
+	case tabs == 0 && spaces == 0:
+		return IndentStyle{}, false
+	case tabs >= spaces:
+		return IndentStyle{Tabs: true, Width: tabWidth}, true
+	}
+	width := 0
+	for step, count := range steps {
+		if width == 0 || count > steps[width] || count == steps[width] && step < width {
+			width = step
+		}
+	}
+	if width == 0 {
+		return IndentStyle{}, false
+	}
+	return IndentStyle{Width: width}, true
+}
+
+// Reindent rewrites the leading whitespace of each line the completion
+// starts to style, because local models often indent with spaces in files
+// indented with tabs and the other way around. For tabs, every tabWidth
+// spaces become a tab, the width models mostly indent with. For spaces,
+// every tab becomes style.Width spaces, and spaces are kept. The first
+// line is rewritten too when lineStart says the completion starts a line.
+func Reindent(style IndentStyle, lineStart bool) Filter {
+	return &reindent{style: style, leading: lineStart}
+}
+
+type reindent struct {
+	style IndentStyle
+	// leading is set at the start of a line, while pending collects its
+	// whitespace.
+	leading bool
+	pending string
+}
+
+func (f *reindent) Push(chunk string) (string, bool) {
+	var out strings.Builder
+	for i := 0; i < len(chunk); i++ {
+		c := chunk[i]
+		switch {
+		case f.leading && (c == ' ' || c == '\t'):
+			f.pending += string(c)
+		case f.leading:
+			out.WriteString(f.convert(f.pending))
+			out.WriteByte(c)
+			f.pending, f.leading = "", c == '\n'
+		default:
+			out.WriteByte(c)
+			f.leading = c == '\n'
+		}
+	}
+	return out.String(), false
+}
+
+// Flush passes on the whitespace of a last line without text.
+func (f *reindent) Flush() string {
+	out := f.convert(f.pending)
+	f.pending = ""
+	return out
+}
+
+// convert rewrites the leading whitespace ws to the style.
+func (f *reindent) convert(ws string) string {
+	if ws == "" {
+		return ""
+	}
+	if !f.style.Tabs {
+		return strings.ReplaceAll(ws, "\t", strings.Repeat(" ", f.style.Width))
+	}
+	width := Indent(ws)
+	return strings.Repeat("\t", width/tabWidth) + strings.Repeat(" ", width%tabWidth)
+}
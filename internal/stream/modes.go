@@ -0,0 +1,98 @@
+package stream
+
+import "strings"
+
+// tabWidth is the number of columns a tab counts for when comparing
+// indentation.
+const tabWidth = 4
+
+// SingleLine ends the stream at the first newline, for inline suggestions
+// that complete the rest of the cursor line.
+func SingleLine() Filter {
+	return FilterFunc(func(chunk string) (string, bool) {
+		if i := strings.IndexByte(chunk, '\n'); i >= 0 {
+			return chunk[:i], true
+		}
+		return chunk, false
+	})
+}
+
+// MaxLines ends the stream before the n-th newline, so that a completion is
+// at most n lines long, counting the rest of the cursor line.
+func MaxLines(n int) Filter {
+	lines := 0
+	return FilterFunc(func(chunk string) (string, bool) {
+		for i := 0; i < len(chunk); i++ {
+			if chunk[i] != '\n' {
+				continue
+			}
+			if lines++; lines == n {
+				return chunk[:i], true
+			}
+		}
+		return chunk, false
+	})
+}
+
+// Block ends the stream before the first line indented less than indent
+// columns, which closes the block the completion started in. The rest of
+// the cursor line is never cut. Blank lines are held back until the next
+// line shows whether the block goes on.
+func Block(indent int) Filter {
+	return &block{indent: indent}
+}
+
+type block struct {
+	indent int
+	// pending is the whitespace since the last newline of the completion,
+	// held until a line with content shows whether it is kept.
+	pending string
+	leading bool
+}
+
+func (b *block) Push(chunk string) (string, bool) {
+	var out strings.Builder
+	for i := 0; i < len(chunk); i++ {
+		c := chunk[i]
+		switch {
+		case c == '\n':
+			if !b.leading {
+				b.leading = true
+				b.pending = ""
+			}
+			b.pending += "\n"
+		case b.leading && (c == ' ' || c == '\t'):
+			b.pending += string(c)
+		case b.leading:
+			last := b.pending[strings.LastIndexByte(b.pending, '\n')+1:]
+			if Indent(last) < b.indent {
+				return out.String(), true
+			}
+			out.WriteString(b.pending)
+			out.WriteByte(c)
+			b.pending, b.leading = "", false
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String(), false
+}
+
+// Flush drops the trailing blank lines held back.
+func (b *block) Flush() string { return "" }
+
+// Indent returns the width of the leading whitespace of line in columns.
+func Indent(line string) int {
+	width := 0
+	for _, c := range line {
+		switch c {
+		case ' ':
+			width++
+		case '\t':
+			width += tabWidth
+		default:
+			return width
+		}
+	}
+	return width
+}
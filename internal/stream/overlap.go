@@ -0,0 +1,100 @@
+package stream
+
+import "strings"
+
+// SuffixOverlap ends the stream when the model starts writing the code that
+// already follows the cursor: a generated line equal to the first non-blank
+// line of suffix. cursorLine is the text before the cursor on its line.
+// Lines are held back only while they could still turn out to be the
+// duplicate.
+func SuffixOverlap(cursorLine, suffix string) Filter {
+	rest, after, _ := strings.Cut(suffix, "\n")
+	atLineStart := strings.TrimSpace(cursorLine) == ""
+
+	f := &overlap{prefix: cursorLine, first: true}
+	switch {
+	case strings.TrimSpace(rest) != "" && atLineStart:
+		// The cursor is in the indentation of a line: a new line the
+		// model writes is followed by the rest of this one.
+		f.target = cursorLine + rest
+	default:
+		for _, line := range strings.Split(after, "\n") {
+			if strings.TrimSpace(line) != "" {
+				f.target = line
+				break
+			}
+		}
+		// The first generated line completes the cursor line, which is
+		// a whole line only when nothing precedes the cursor.
+		f.checkFirst = strings.TrimSpace(rest) == "" && atLineStart
+	}
+	f.target = strings.TrimRight(f.target, " \t\r")
+	if f.target == "" {
+		return FilterFunc(func(chunk string) (string, bool) { return chunk, false })
+	}
+	f.diverged = !f.checkFirst
+	return f
+}
+
+type overlap struct {
+	target     string
+	prefix     string
+	checkFirst bool
+
+	// first is set while the completion is still on the cursor line.
+	first bool
+	line  string
+	// held is the current line, and the newline before it, while it may
+	// still be the duplicate.
+	held     string
+	diverged bool
+}
+
+// full returns the current line as it will read in the file.
+func (f *overlap) full() string {
+	if !f.first {
+		return f.line
+	}
+	return f.prefix + f.line
+}
+
+func (f *overlap) duplicate() bool {
+	return !f.diverged && strings.TrimRight(f.full(), " \t\r") == f.target
+}
+
+func (f *overlap) Push(chunk string) (string, bool) {
+	var out strings.Builder
+	for i := 0; i < len(chunk); i++ {
+		c := chunk[i]
+		if c == '\n' {
+			if f.duplicate() {
+				return out.String(), true
+			}
+			if !f.diverged {
+				out.WriteString(f.held)
+			}
+			f.first, f.line, f.held, f.diverged = false, "", "\n", false
+			continue
+		}
+
+		f.line += string(c)
+		if f.diverged {
+			out.WriteByte(c)
+			continue
+		}
+		f.held += string(c)
+		if !strings.HasPrefix(f.target, f.full()) {
+			out.WriteString(f.held)
+			f.held, f.diverged = "", true
+		}
+	}
+	return out.String(), false
+}
+
+// Flush drops a final line that duplicates the suffix.
+func (f *overlap) Flush() string {
+	if f.duplicate() || f.diverged {
+		return ""
+	}
+	return f.held
+}
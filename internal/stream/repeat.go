@@ -0,0 +1,44 @@
+package stream
+
+import "strings"
+
+// Except drops the completion when it turns out to be one of texts, such as
+// suggestions the user has just rejected. The completion is held back while
+// it is the start of one of them, and passed on as soon as it differs.
+func Except(texts []string) Filter {
+	return &except{texts: texts}
+}
+
+type except struct {
+	texts []string
+	held  strings.Builder
+	// diverged is set once the completion is none of texts.
+	diverged bool
+}
+
+func (e *except) Push(chunk string) (string, bool) {
+	if e.diverged {
+		return chunk, false
+	}
+	e.held.WriteString(chunk)
+	for _, text := range e.texts {
+		if strings.HasPrefix(text, e.held.String()) {
+			return "", false
+		}
+	}
+	e.diverged = true
+	return e.held.String(), false
+}
+
+func (e *except) Flush() string {
+	if e.diverged {
+		return ""
+	}
+	for _, text := range e.texts {
+		if text == e.held.String() {
+			return ""
+		}
+	}
+	// The completion stopped short of the texts it started like.
+	return e.held.String()
+}
@@ -0,0 +1,190 @@
+// Package stream post-processes completions as they stream from Ollama to
+// the client. Chunks from the source pass through a chain of filters, each
+// of which may rewrite, hold back or drop text, or end the stream, before
+// the encoder turns what is left into events for the writer.
+package stream
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
+)
+
+// ErrStopped is returned by Pipeline.Write once a filter has ended the
+// stream. Sources should stop generating when they see it.
+var ErrStopped = errors.New("stream stopped by filter")
+
+// Filter transforms the text of a completion as it streams.
+type Filter interface {
+	// Push receives the next chunk and returns the text to pass on, which
+	// may be empty, and whether the stream ends after it.
+	Push(chunk string) (string, bool)
+	// Flush returns any text held back when the source is done.
+	Flush() string
+}
+
+// Stage is a named filter. The name labels the stage's metrics.
+type Stage struct {
+	Name   string
+	Filter Filter
+}
+
+// Encoder turns the text of one chunk into an event for the writer.
+type Encoder func(text string) ([]byte, error)
+
+// Pipeline connects a source to a writer through filters and an encoder.
+// It is used by a single request and is not safe for concurrent use.
+type Pipeline struct {
+	stages []Stage
+	encode Encoder
+	w      io.Writer
+
+	stopped bool
+	events  int
+	// in and out count the bytes each stage received and passed on.
+	in, out []int
+	stopper int
+	// filtering is the time spent in the filters.
+	filtering time.Duration
+}
+
+// New creates a Pipeline writing events encoded by encode to w. Stages run
+// in the order given.
+func New(w io.Writer, encode Encoder, stages ...Stage) *Pipeline {
+	return &Pipeline{stages: stages, encode: encode, w: w, in: make([]int, len(stages)), out: make([]int, len(stages)), stopper: -1}
+}
+
+// Write passes a chunk from the source through the filters and writes
+// what comes out. A stage that passes nothing on ends the chunk's way
+// through the pipeline.
+func (p *Pipeline) Write(chunk string) error {
+	if p.stopped {
+		return ErrStopped
+	}
+	if chunk == "" {
+		return nil
+	}
+
+	text := chunk
+	for i, s := range p.stages {
+		start := time.Now()
+		out, stop := p.push(i, text)
+		metrics.StreamStageSeconds.Add(s.Name, time.Since(start).Seconds())
+		if text != "" && out == "" {
+			metrics.StreamStageDropped.Inc(s.Name)
+		}
+		text = out
+
+		if stop {
+			metrics.StreamStageStops.Inc(s.Name)
+			p.stopped = true
+			p.stopper = i
+			// Later stages still see the final text and what they hold.
+			for j := i + 1; j < len(p.stages); j++ {
+				if text != "" {
+					text, _ = p.push(j, text)
+				}
+				text += p.flush(j)
+			}
+			if err := p.emit(text); err != nil {
+				return err
+			}
+			return ErrStopped
+		}
+		if text == "" {
+			return nil
+		}
+	}
+	return p.emit(text)
+}
+
+// Close flushes the text the filters hold back. It does nothing when a
+// filter has already ended the stream.
+func (p *Pipeline) Close() error {
+	if p.stopped {
+		return nil
+	}
+	p.stopped = true
+
+	text := ""
+	for i := range p.stages {
+		if text != "" {
+			text, _ = p.push(i, text)
+		}
+		text += p.flush(i)
+	}
+	return p.emit(text)
+}
+
+func (p *Pipeline) push(i int, text string) (string, bool) {
+	start := time.Now()
+	out, stop := p.stages[i].Filter.Push(text)
+	p.filtering += time.Since(start)
+	p.in[i] += len(text)
+	p.out[i] += len(out)
+	return out, stop
+}
+
+func (p *Pipeline) flush(i int) string {
+	start := time.Now()
+	out := p.stages[i].Filter.Flush()
+	p.filtering += time.Since(start)
+	p.out[i] += len(out)
+	return out
+}
+
+// FilterTime returns the time spent in the filters so far.
+func (p *Pipeline) FilterTime() time.Duration {
+	return p.filtering
+}
+
+// Applied returns the names of the stages that changed the completion, by
+// passing on more or less text than they received or by ending the stream,
+// in order. Text a stage holds back counts as changed until the stream
+// ends.
+func (p *Pipeline) Applied() []string {
+	var names []string
+	for i, s := range p.stages {
+		if p.in[i] != p.out[i] || i == p.stopper {
+			names = append(names, s.Name)
+		}
+	}
+	return names
+}
+
+// Events returns the number of events written so far.
+func (p *Pipeline) Events() int {
+	return p.events
+}
+
+func (p *Pipeline) emit(text string) error {
+	if text == "" {
+		return nil
+	}
+
+	event, err := p.encode(text)
+	if err != nil {
+		return err
+	}
+	if _, err := p.w.Write(event); err != nil {
+		return err
+	}
+	p.events++
+	if f, ok := p.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// FilterFunc adapts a stateless function to a Filter that holds nothing
+// back.
+type FilterFunc func(chunk string) (string, bool)
+
+// Push implements Filter.
+func (f FilterFunc) Push(chunk string) (string, bool) { return f(chunk) }
+
+// Flush implements Filter.
+func (f FilterFunc) Flush() string { return "" }
@@ -0,0 +1,442 @@
+package stream_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/metrics"
+	"github.com/josuemontano/ollama-copilot/internal/stream"
+)
+
+// collect returns a pipeline over stages whose events are the plain text
+// of each chunk, and the slice the events are appended to.
+func collect(stages ...stream.Stage) (*stream.Pipeline, *[]string) {
+	var events []string
+	w := writerFunc(func(p []byte) (int, error) {
+		events = append(events, string(p))
+		return len(p), nil
+	})
+	return stream.New(w, func(text string) ([]byte, error) { return []byte(text), nil }, stages...), &events
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// holdLast holds back the last character of each chunk until the next one
+// or the end of the stream.
+type holdLast struct{ held string }
+
+func (h *holdLast) Push(chunk string) (string, bool) {
+	text := h.held + chunk
+	h.held = text[len(text)-1:]
+	return text[:len(text)-1], false
+}
+
+func (h *holdLast) Flush() string { return h.held }
+
+func TestPipeline_FiltersInOrder(t *testing.T) {
+	upper := stream.FilterFunc(func(chunk string) (string, bool) { return strings.ToUpper(chunk), false })
+	out, events := collect(
+		stream.Stage{Name: "test_hold", Filter: &holdLast{}},
+		stream.Stage{Name: "test_upper", Filter: upper},
+	)
+
+	for _, chunk := range []string{"ab", "c", "", "de"} {
+		if err := out.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"A", "B", "CD", "E"}; !reflect.DeepEqual(*events, want) {
+		t.Errorf("expected events %q, got %q", want, *events)
+	}
+	if got := out.Events(); got != 4 {
+		t.Errorf("expected 4 events, got %d", got)
+	}
+}
+
+func TestPipeline_Stop(t *testing.T) {
+	untilNewline := stream.FilterFunc(func(chunk string) (string, bool) {
+		if i := strings.Index(chunk, "\n"); i >= 0 {
+			return chunk[:i], true
+		}
+		return chunk, false
+	})
+	stops := metrics.StreamStageStops.Get("test_line")
+	out, events := collect(
+		stream.Stage{Name: "test_line", Filter: untilNewline},
+		stream.Stage{Name: "test_hold_after_stop", Filter: &holdLast{}},
+	)
+
+	if err := out.Write("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Write("bar\nbaz"); !errors.Is(err, stream.ErrStopped) {
+		t.Fatalf("expected ErrStopped, got %v", err)
+	}
+	if err := out.Write("more"); !errors.Is(err, stream.ErrStopped) {
+		t.Errorf("expected writes after a stop to fail with ErrStopped, got %v", err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"fo", "obar"}; !reflect.DeepEqual(*events, want) {
+		t.Errorf("expected events %q, got %q", want, *events)
+	}
+	if got := metrics.StreamStageStops.Get("test_line") - stops; got != 1 {
+		t.Errorf("expected one stop recorded for the stage, got %v", got)
+	}
+}
+
+func TestPipeline_Applied(t *testing.T) {
+	dropDigits := stream.FilterFunc(func(chunk string) (string, bool) {
+		return strings.Map(func(r rune) rune {
+			if r >= '0' && r <= '9' {
+				return -1
+			}
+			return r
+		}, chunk), false
+	})
+	out, _ := collect(
+		stream.Stage{Name: "hold", Filter: &holdLast{}},
+		stream.Stage{Name: "digits", Filter: dropDigits},
+	)
+
+	for _, chunk := range []string{"ab", "cd", "e1"} {
+		if err := out.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"digits"}; !reflect.DeepEqual(out.Applied(), want) {
+		t.Errorf("expected stages %q to have changed the completion, got %q", want, out.Applied())
+	}
+}
+
+func TestFences(t *testing.T) {
+	dropped := metrics.StreamStageDropped.Get("fences")
+	out, events := collect(stream.Stage{Name: "fences", Filter: stream.Fences("go")})
+
+	for _, chunk := range []string{"```", "go", "\nfunc main() {}", "\n```"} {
+		if err := out.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := []string{"func main() {}"}; !reflect.DeepEqual(*events, want) {
+		t.Errorf("expected events %q, got %q", want, *events)
+	}
+	if got := metrics.StreamStageDropped.Get("fences") - dropped; got != 3 {
+		t.Errorf("expected 3 dropped chunks, got %v", got)
+	}
+}
+
+// filtered returns what filter makes of chunks, once the stream is closed.
+func filtered(t *testing.T, filter stream.Filter, chunks ...string) string {
+	t.Helper()
+
+	out, events := collect(stream.Stage{Name: "test", Filter: filter})
+	for _, chunk := range chunks {
+		if err := out.Write(chunk); err != nil && !errors.Is(err, stream.ErrStopped) {
+			t.Fatal(err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(*events, "")
+}
+
+func TestFences_AcrossChunks(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"split fence", []string{"``", "`py", "thon\nx = 1", "\n`", "``\n"}, "x = 1"},
+		{"tag on its own line", []string{"```\n", "Python\n", "x = 1\n"}, "x = 1\n"},
+		{"language in code", []string{"python", "_version = 3\n", "python\n"}, "python_version = 3\npython\n"},
+		{"fence inside a line", []string{"s = \"```\"", "\n"}, "s = \"```\"\n"},
+		{"code after a closing fence", []string{"a = 1\n```\n", "b = 2"}, "a = 1\nb = 2"},
+		{"backticks at the end", []string{"x = ``"}, "x = ``"},
+		{"blank lines kept", []string{"a\n\n", "\tb"}, "a\n\n\tb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := filtered(t, stream.Fences("python"), tt.chunks...); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestTrimBlank(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"leading blank lines", []string{"\n", "\n  \n\t", "return x"}, "\n\treturn x"},
+		{"trailing blank lines", []string{"return x\n", "\n  ", "\n"}, "return x"},
+		{"inner blank lines", []string{"a\n\n", "b"}, "a\n\nb"},
+		{"trailing spaces", []string{"foo(a, "}, "foo(a, "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := filtered(t, stream.TrimBlank(), tt.chunks...); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMaxLines(t *testing.T) {
+	if got := filtered(t, stream.MaxLines(2), "a\n", "b\nc", "\nd"); got != "a\nb" {
+		t.Errorf("expected two lines, got %q", got)
+	}
+}
+
+func TestSingleLine(t *testing.T) {
+	out, events := collect(stream.Stage{Name: "single_line", Filter: stream.SingleLine()})
+
+	if err := out.Write("x := "); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Write("1\ny := 2"); !errors.Is(err, stream.ErrStopped) {
+		t.Fatalf("expected ErrStopped, got %v", err)
+	}
+
+	if want := []string{"x := ", "1"}; !reflect.DeepEqual(*events, want) {
+		t.Errorf("expected events %q, got %q", want, *events)
+	}
+}
+
+func TestBlock(t *testing.T) {
+	tests := []struct {
+		name   string
+		indent int
+		chunks []string
+		want   string
+	}{
+		{
+			name:   "stops at dedent",
+			indent: 4,
+			chunks: []string{"fmt.Println(1)\n    ", "fmt.Println(2)\n}\n\nfunc other() {"},
+			want:   "fmt.Println(1)\n    fmt.Println(2)",
+		},
+		{
+			name:   "keeps deeper lines and blank lines inside the block",
+			indent: 1,
+			chunks: []string{"\n\tif x {\n\t\treturn\n\t}\n", "\n\tdone()\n", "}"},
+			want:   "\n\tif x {\n\t\treturn\n\t}\n\n\tdone()",
+		},
+		{
+			name:   "drops trailing blank lines",
+			indent: 0,
+			chunks: []string{"a\n", "b\n\n  "},
+			want:   "a\nb",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, events := collect(stream.Stage{Name: "block", Filter: stream.Block(tt.indent)})
+			for _, chunk := range tt.chunks {
+				if err := out.Write(chunk); err != nil && !errors.Is(err, stream.ErrStopped) {
+					t.Fatal(err)
+				}
+			}
+			if err := out.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := strings.Join(*events, ""); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDetectIndent(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want stream.IndentStyle
+		ok   bool
+	}{
+		{name: "tabs", text: "func f() {\n\tif x {\n\t\treturn\n\t}\n}", want: stream.IndentStyle{Tabs: true, Width: 4}, ok: true},
+		{name: "two spaces", text: "def f():\n  if x:\n    return\n  y()\n", want: stream.IndentStyle{Width: 2}, ok: true},
+		{name: "four spaces under a comment", text: "/**\n * Docs.\n */\nclass A {\n    f() {\n        g();\n    }\n}", want: stream.IndentStyle{Width: 4}, ok: true},
+		{name: "no indented lines", text: "x = 1\ny = 2", ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := stream.DetectIndent(tt.text)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("expected %+v, %v, got %+v, %v", tt.want, tt.ok, got, ok)
+			}
+		})
+	}
+}
+
+func TestReindent(t *testing.T) {
+	tests := []struct {
+		name      string
+		style     stream.IndentStyle
+		lineStart bool
+		chunks    []string
+		want      string
+	}{
+		{
+			name:   "spaces to tabs",
+			style:  stream.IndentStyle{Tabs: true, Width: 4},
+			chunks: []string{"if x {\n  ", "      return\n    }"},
+			want:   "if x {\n\t\treturn\n\t}",
+		},
+		{
+			name:      "first line at the start of a line",
+			style:     stream.IndentStyle{Tabs: true, Width: 4},
+			lineStart: true,
+			chunks:    []string{"    x := 1\n  y"},
+			want:      "\tx := 1\n  y",
+		},
+		{
+			name:   "tabs to spaces",
+			style:  stream.IndentStyle{Width: 2},
+			chunks: []string{"\n\tif x:\n\t\tpass\n\t"},
+			want:   "\n  if x:\n    pass\n  ",
+		},
+		{
+			name:   "keeps the rest of the cursor line",
+			style:  stream.IndentStyle{Width: 2},
+			chunks: []string{"\ta\tb"},
+			want:   "\ta\tb",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, events := collect(stream.Stage{Name: "indent", Filter: stream.Reindent(tt.style, tt.lineStart)})
+			for _, chunk := range tt.chunks {
+				if err := out.Write(chunk); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := out.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := strings.Join(*events, ""); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSuffixOverlap(t *testing.T) {
+	tests := []struct {
+		name       string
+		cursorLine string
+		suffix     string
+		chunks     []string
+		want       string
+		stopped    bool
+	}{
+		{
+			name:       "stops at the next line of the suffix",
+			cursorLine: "\tx := 1",
+			suffix:     "\n\treturn x\n}",
+			chunks:     []string{"\n\ty := 2\n\tre", "turn x\n}"},
+			want:       "\n\ty := 2",
+			stopped:    true,
+		},
+		{
+			name:       "stops at the rest of the cursor line",
+			cursorLine: "\t",
+			suffix:     "return x\n}",
+			chunks:     []string{"x++\n", "\treturn x\n"},
+			want:       "x++",
+			stopped:    true,
+		},
+		{
+			name:       "checks the first line on a blank line",
+			cursorLine: "    ",
+			suffix:     "\n    return x",
+			chunks:     []string{"return x", "\n"},
+			want:       "",
+			stopped:    true,
+		},
+		{
+			name:       "keeps lines with a different indentation",
+			cursorLine: "\tif ok {",
+			suffix:     "\n}",
+			chunks:     []string{"\n\t\tdone()\n\t}\n\tfmt.Println()"},
+			want:       "\n\t\tdone()\n\t}\n\tfmt.Println()",
+		},
+		{
+			name:       "drops a duplicate final line",
+			cursorLine: "func main() {",
+			suffix:     "\n}",
+			chunks:     []string{"\n\trun()\n}"},
+			want:       "\n\trun()",
+		},
+		{
+			name:       "passes through without a suffix",
+			cursorLine: "x := ",
+			suffix:     "",
+			chunks:     []string{"1\n", "y := 2"},
+			want:       "1\ny := 2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, events := collect(stream.Stage{Name: "suffix_overlap", Filter: stream.SuffixOverlap(tt.cursorLine, tt.suffix)})
+			stopped := false
+			for _, chunk := range tt.chunks {
+				if err := out.Write(chunk); errors.Is(err, stream.ErrStopped) {
+					stopped = true
+				} else if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := out.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := strings.Join(*events, ""); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+			if stopped != tt.stopped {
+				t.Errorf("expected stopped %v, got %v", tt.stopped, stopped)
+			}
+		})
+	}
+}
+
+func TestExcept(t *testing.T) {
+	rejected := []string{"compute()", "count += 1"}
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"rejected", []string{"comp", "ute()"}, ""},
+		{"diverges", []string{"co", "py()"}, "copy()"},
+		{"longer", []string{"compute()", " + 1"}, "compute() + 1"},
+		{"shorter", []string{"comp"}, "comp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := filtered(t, stream.Except(rejected), tt.chunks...); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package stream
+
+import "strings"
+
+// TrimBlank drops the blank lines at the start and the end of a completion.
+// Whitespace is held back until the next text shows whether more follows.
+// At the start, the newline ending the cursor line and the indentation of
+// the first line with text are kept. At the end, whitespace containing a
+// newline is dropped, and spaces after the last text are kept.
+func TrimBlank() Filter {
+	return &trimBlank{}
+}
+
+type trimBlank struct {
+	started bool
+	held    strings.Builder
+}
+
+func (f *trimBlank) Push(chunk string) (string, bool) {
+	var out strings.Builder
+	for i := 0; i < len(chunk); i++ {
+		c := chunk[i]
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			f.held.WriteByte(c)
+			continue
+		}
+		ws := f.held.String()
+		if i := strings.LastIndexByte(ws, '\n'); !f.started && i >= 0 {
+			ws = "\n" + ws[i+1:]
+		}
+		out.WriteString(ws)
+		out.WriteByte(c)
+		f.held.Reset()
+		f.started = true
+	}
+	return out.String(), false
+}
+
+func (f *trimBlank) Flush() string {
+	ws := f.held.String()
+	f.held.Reset()
+	if strings.Contains(ws, "\n") {
+		return ""
+	}
+	return ws
+}
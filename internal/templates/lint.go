@@ -0,0 +1,110 @@
+package templates
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// lintSamples are the prompts Lint renders: the middle of a function and
+// the end of a file.
+var lintSamples = []struct{ Prefix, Suffix string }{
+	{"func add(a, b int) int {\n\treturn ", "\n}\n"},
+	{"package main\n\nfunc main() {\n}\n", ""},
+}
+
+// Lint renders tmpl with sample prompts and returns the problems found:
+// errors executing it, prefixes or suffixes it drops, template actions left
+// in its output, FIM tokens that appear more than once or without the rest
+// of their family's, and, when preset names a family, tokens of that family
+// it does not use. A template with problems still parses, but the model
+// rarely completes it well.
+func Lint(tmpl *template.Template, preset Preset) []string {
+	var problems []string
+	add := func(format string, args ...any) {
+		problem := fmt.Sprintf(format, args...)
+		if !slices.Contains(problems, problem) {
+			problems = append(problems, problem)
+		}
+	}
+
+	var rendered string
+	for _, sample := range lintSamples {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, sample); err != nil {
+			return []string{fmt.Sprintf("executing the template: %v", err)}
+		}
+		out := buf.String()
+		if !strings.Contains(out, sample.Prefix) {
+			add("the prefix is not rendered, use {{.Prefix}}")
+		}
+		if sample.Suffix != "" && !strings.Contains(out, sample.Suffix) {
+			add("the suffix is not rendered, use {{.Suffix}}")
+		}
+		if rendered == "" {
+			rendered = out
+		}
+	}
+
+	for _, leftover := range []string{"{{", "}}", ".Prefix", ".Suffix"} {
+		if strings.Contains(rendered, leftover) {
+			add("the output contains %q, a template action may be mistyped", leftover)
+		}
+	}
+
+	var used []Preset
+	for _, p := range presets {
+		for _, tok := range p.Tokens() {
+			if n := strings.Count(rendered, tok); n > 1 {
+				add("the FIM token %s appears %d times", tok, n)
+			}
+		}
+		if missing := p.missing(rendered); len(missing) < len(p.Tokens()) {
+			used = append(used, p.Preset)
+		}
+	}
+	if len(used) > 0 {
+		closest := slices.MinFunc(used, func(a, b Preset) int { return len(a.missing(rendered)) - len(b.missing(rendered)) })
+		if missing := closest.missing(rendered); len(missing) > 0 {
+			add("the FIM tokens are unbalanced: %s of the %s format is missing", strings.Join(missing, ", "), closest.Family)
+		}
+	}
+
+	if preset.Family != "" {
+		if missing := preset.missing(rendered); len(missing) > 0 {
+			add("the %s model family expects the FIM tokens %s", preset.Family, strings.Join(missing, ", "))
+		}
+	}
+	return problems
+}
+
+// Tokens returns the FIM tokens of the preset's template: the text around
+// its prefix and suffix.
+func (p Preset) Tokens() []string {
+	tree, err := parse.Parse("preset", p.Template, "", "")
+	if err != nil {
+		return nil
+	}
+
+	var tokens []string
+	for _, node := range tree["preset"].Root.Nodes {
+		if text, ok := node.(*parse.TextNode); ok {
+			tokens = append(tokens, strings.Fields(string(text.Text))...)
+		}
+	}
+	return tokens
+}
+
+// missing returns the preset's tokens that do not appear in s.
+func (p Preset) missing(s string) []string {
+	var missing []string
+	for _, tok := range p.Tokens() {
+		if !strings.Contains(s, tok) {
+			missing = append(missing, tok)
+		}
+	}
+	return missing
+}
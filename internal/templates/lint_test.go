@@ -0,0 +1,53 @@
+package templates_test
+
+import (
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/josuemontano/ollama-copilot/internal/templates"
+)
+
+func TestLint(t *testing.T) {
+	qwen, _, _ := templates.LookupPreset("qwen2.5-coder", "")
+	codellama, _, _ := templates.LookupPreset("codellama", "")
+
+	tests := []struct {
+		name   string
+		source string
+		preset templates.Preset
+		want   []string
+	}{
+		{"preset", qwen.Template, qwen, nil},
+		{"default", templates.DefaultTemplate, templates.Preset{}, nil},
+		{"missing suffix", "<PRE> {{.Prefix}} <SUF> <MID>", codellama, []string{"the suffix is not rendered"}},
+		{"leftover action", "<PRE> {.Prefix} <SUF>{{.Suffix}} <MID>", codellama, []string{"the prefix is not rendered", `".Prefix"`}},
+		{"unbalanced", "<|fim_prefix|>{{.Prefix}}<|fim_suffix|>{{.Suffix}}", templates.Preset{}, []string{"<|fim_middle|> of the qwen2.5-coder format is missing"}},
+		{"repeated token", "<MID><PRE> {{.Prefix}} <SUF>{{.Suffix}} <MID>", codellama, []string{"<MID> appears 2 times"}},
+		{"wrong family", qwen.Template, codellama, []string{"codellama model family expects the FIM tokens <PRE>, <SUF>, <MID>"}},
+		{"execution error", "{{.Missing}}", templates.Preset{}, []string{"executing the template"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := templates.Lint(template.Must(template.New(tt.name).Parse(tt.source)), tt.preset)
+			if len(tt.want) == 0 && len(problems) > 0 {
+				t.Fatalf("expected no problems, got %q", problems)
+			}
+			all := strings.Join(problems, "\n")
+			for _, want := range tt.want {
+				if !strings.Contains(all, want) {
+					t.Errorf("expected a problem containing %q, got %q", want, problems)
+				}
+			}
+		})
+	}
+}
+
+func TestLint_Presets(t *testing.T) {
+	for _, family := range templates.Families() {
+		preset, _, _ := templates.LookupPreset(family, "")
+		if problems := templates.Lint(template.Must(template.New(family).Parse(preset.Template)), preset); len(problems) > 0 {
+			t.Errorf("expected the %s preset to have no problems, got %q", family, problems)
+		}
+	}
+}
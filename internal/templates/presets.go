@@ -0,0 +1,188 @@
+package templates
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultTemplate is used when the model family is unknown and no template
+// is configured.
+const DefaultTemplate = "<|fim_prefix|> {{.Prefix}} <|fim_suffix|>{{.Suffix}} <|fim_middle|>"
+
+// Preset is the FIM prompt format and stop tokens of a model family.
+type Preset struct {
+	Family   string
+	Template string
+	Stop     []string
+}
+
+// presets are the built-in model families. match lists name fragments that
+// identify the family; all of them must appear in the model name.
+var presets = []struct {
+	Preset
+	match []string
+}{
+	{Preset{
+		Family:   "codellama",
+		Template: "<PRE> {{.Prefix}} <SUF>{{.Suffix}} <MID>",
+		Stop:     []string{"<EOT>", "<PRE>", "<SUF>", "<MID>"},
+	}, []string{"codellama"}},
+	{Preset{
+		Family:   "starcoder2",
+		Template: "<fim_prefix>{{.Prefix}}<fim_suffix>{{.Suffix}}<fim_middle>",
+		Stop:     []string{"<|endoftext|>", "<file_sep>", "<fim_prefix>", "<fim_suffix>", "<fim_middle>"},
+	}, []string{"starcoder"}},
+	{Preset{
+		Family:   "deepseek-coder",
+		Template: "<｜fim▁begin｜>{{.Prefix}}<｜fim▁hole｜>{{.Suffix}}<｜fim▁end｜>",
+		Stop:     []string{"<｜end▁of▁sentence｜>", "<｜EOT｜>", "<｜fim▁begin｜>", "<｜fim▁hole｜>", "<｜fim▁end｜>"},
+	}, []string{"deepseek", "coder"}},
+	{Preset{
+		Family:   "qwen2.5-coder",
+		Template: "<|fim_prefix|>{{.Prefix}}<|fim_suffix|>{{.Suffix}}<|fim_middle|>",
+		Stop:     []string{"<|endoftext|>", "<|fim_pad|>", "<|repo_name|>", "<|file_sep|>", "<|im_start|>", "<|im_end|>"},
+	}, []string{"qwen", "coder"}},
+	{Preset{
+		Family:   "codegemma",
+		Template: "<|fim_prefix|>{{.Prefix}}<|fim_suffix|>{{.Suffix}}<|fim_middle|>",
+		Stop:     []string{"<|file_separator|>", "<|fim_prefix|>", "<|fim_suffix|>", "<|fim_middle|>", "<eos>"},
+	}, []string{"codegemma"}},
+	{Preset{
+		Family:   "codestral",
+		Template: "[SUFFIX]{{.Suffix}}[PREFIX]{{.Prefix}}",
+		Stop:     []string{"[INST]", "[/INST]", "[PREFIX]", "[SUFFIX]", "[MIDDLE]", "</s>"},
+	}, []string{"codestral"}},
+}
+
+// LookupPreset returns the preset for family. An empty family is inferred
+// from the model name; ok is false if it cannot be.
+func LookupPreset(family, model string) (Preset, bool, error) {
+	if family != "" {
+		for _, p := range presets {
+			if p.Family == family {
+				return p.Preset, true, nil
+			}
+		}
+		return Preset{}, false, fmt.Errorf("unknown model family %q, expected one of %s", family, strings.Join(Families(), ", "))
+	}
+
+	name := strings.ToLower(model)
+	for _, p := range presets {
+		if containsAll(name, p.match) {
+			return p.Preset, true, nil
+		}
+	}
+	return Preset{}, false, nil
+}
+
+// Families returns the names of the built-in model families.
+func Families() []string {
+	names := make([]string, len(presets))
+	for i, p := range presets {
+		names[i] = p.Family
+	}
+	sort.Strings(names)
+	return names
+}
+
+func containsAll(s string, fragments []string) bool {
+	for _, f := range fragments {
+		if !strings.Contains(s, f) {
+			return false
+		}
+	}
+	return true
+}
+
+// fimMarkers identify a model family by the special tokens in the template
+// Ollama reports for the model. Families sharing tokens are told apart by
+// the model's architecture family.
+var fimMarkers = []struct {
+	marker       string
+	architecture string
+	family       string
+}{
+	{"<｜fim▁begin｜>", "", "deepseek-coder"},
+	{"<fim_prefix>", "", "starcoder2"},
+	{"<PRE>", "", "codellama"},
+	{"[SUFFIX]", "", "codestral"},
+	{"<|fim_prefix|>", "gemma", "codegemma"},
+	{"<|fim_prefix|>", "", "qwen2.5-coder"},
+}
+
+// DetectPreset derives the preset of a model from the template, parameters
+// and architecture families Ollama's show API reports for it. The stop
+// parameters of the model are added to the preset's stop tokens. When no
+// family is recognized, the returned Preset has only those stop tokens.
+func DetectPreset(template, parameters string, architectures []string) Preset {
+	stop := ParseStop(parameters)
+
+	for _, m := range fimMarkers {
+		if !strings.Contains(template, m.marker) {
+			continue
+		}
+		if m.architecture != "" && !containsAny(architectures, m.architecture) {
+			continue
+		}
+		preset, _, _ := LookupPreset(m.family, "")
+		preset.Stop = appendMissing(slices.Clone(preset.Stop), stop...)
+		return preset
+	}
+	return Preset{Stop: stop}
+}
+
+// ParseStop returns the stop parameters of an Ollama Modelfile parameter
+// listing, one "stop" line per token.
+func ParseStop(parameters string) []string {
+	var stop []string
+	for _, line := range strings.Split(parameters, "\n") {
+		name, value, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if !ok || name != "stop" {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		if value != "" {
+			stop = append(stop, value)
+		}
+	}
+	return stop
+}
+
+// ParseNumCtx returns the num_ctx parameter of an Ollama Modelfile parameter
+// listing, or 0 when it is not set.
+func ParseNumCtx(parameters string) int {
+	for _, line := range strings.Split(parameters, "\n") {
+		name, value, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if !ok || name != "num_ctx" {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+func containsAny(values []string, fragment string) bool {
+	for _, v := range values {
+		if strings.Contains(strings.ToLower(v), fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+func appendMissing(stop []string, tokens ...string) []string {
+	for _, tok := range tokens {
+		if !slices.Contains(stop, tok) {
+			stop = append(stop, tok)
+		}
+	}
+	return stop
+}
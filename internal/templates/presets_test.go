@@ -0,0 +1,79 @@
+package templates_test
+
+import (
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/templates"
+)
+
+func TestLookupPreset(t *testing.T) {
+	tests := []struct {
+		family string
+		model  string
+		want   string
+	}{
+		{"", "codellama:7b-code", "codellama"},
+		{"", "starcoder2:3b", "starcoder2"},
+		{"", "deepseek-coder-v2:16b", "deepseek-coder"},
+		{"", "qwen2.5-coder:7b-base", "qwen2.5-coder"},
+		{"", "qwen3-coder:30b", "qwen2.5-coder"},
+		{"", "CodeGemma:2b", "codegemma"},
+		{"", "codestral:22b", "codestral"},
+		{"codellama", "my-finetune", "codellama"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			preset, ok, err := templates.LookupPreset(tt.family, tt.model)
+			if err != nil || !ok {
+				t.Fatalf("expected a preset, got ok=%v err=%v", ok, err)
+			}
+			if preset.Family != tt.want {
+				t.Errorf("expected family %q, got %q", tt.want, preset.Family)
+			}
+			if preset.Template == "" || len(preset.Stop) == 0 {
+				t.Errorf("expected a template and stop tokens, got %+v", preset)
+			}
+		})
+	}
+}
+
+func TestLookupPreset_Unknown(t *testing.T) {
+	if _, ok, err := templates.LookupPreset("", "llama3:8b"); ok || err != nil {
+		t.Errorf("expected no preset for an unknown model, got ok=%v err=%v", ok, err)
+	}
+	if _, _, err := templates.LookupPreset("gpt", "llama3:8b"); err == nil {
+		t.Error("expected an error for an unknown family")
+	}
+}
+
+func TestDetectPreset(t *testing.T) {
+	qwen := "{{- if .Suffix }}<|fim_prefix|>{{ .Prompt }}<|fim_suffix|>{{ .Suffix }}<|fim_middle|>{{- else }}{{ .Prompt }}{{- end }}"
+	params := "stop                           \"<|endoftext|>\"\nstop                           \"<|custom|>\"\ntemperature                    0.7"
+
+	preset := templates.DetectPreset(qwen, params, []string{"qwen2"})
+	if preset.Family != "qwen2.5-coder" {
+		t.Errorf("expected qwen2.5-coder, got %q", preset.Family)
+	}
+	if n := len(preset.Stop); n == 0 || preset.Stop[n-1] != "<|custom|>" {
+		t.Errorf("expected the model's stop parameters to be added once, got %q", preset.Stop)
+	}
+
+	if preset := templates.DetectPreset(qwen, "", []string{"gemma"}); preset.Family != "codegemma" {
+		t.Errorf("expected codegemma for a gemma model, got %q", preset.Family)
+	}
+
+	preset = templates.DetectPreset("{{ .Prompt }}", params, nil)
+	if preset.Family != "" || len(preset.Stop) != 2 {
+		t.Errorf("expected only the stop parameters for an unknown template, got %+v", preset)
+	}
+}
+
+func TestParseNumCtx(t *testing.T) {
+	if n := templates.ParseNumCtx("stop \"<EOT>\"\nnum_ctx                        16384\n"); n != 16384 {
+		t.Errorf("expected 16384, got %d", n)
+	}
+	if n := templates.ParseNumCtx("temperature 0.7"); n != 0 {
+		t.Errorf("expected 0 without num_ctx, got %d", n)
+	}
+}
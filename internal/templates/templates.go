@@ -0,0 +1,76 @@
+// Package templates holds the named FIM prompt templates a request can
+// select at runtime.
+package templates
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/template"
+)
+
+// Set is a collection of parsed prompt templates keyed by name.
+type Set struct {
+	templates map[string]*template.Template
+}
+
+// Load reads a JSON object of template names to template strings.
+func Load(file string) (*Set, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading prompt templates: %w", err)
+	}
+
+	var sources map[string]string
+	if err := json.Unmarshal(data, &sources); err != nil {
+		return nil, fmt.Errorf("parsing prompt templates %s: %w", file, err)
+	}
+
+	return New(sources)
+}
+
+// New parses each named template source.
+func New(sources map[string]string) (*Set, error) {
+	set := &Set{templates: make(map[string]*template.Template, len(sources))}
+	for name, source := range sources {
+		if err := set.Add(name, source); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// Add parses source and registers it under name, replacing any template
+// already registered with that name.
+func (s *Set) Add(name, source string) error {
+	tmpl, err := template.New(name).Parse(source)
+	if err != nil {
+		return fmt.Errorf("parsing prompt template %q: %w", name, err)
+	}
+	s.templates[name] = tmpl
+	return nil
+}
+
+// Lookup returns the template registered under name. A nil Set has no
+// templates.
+func (s *Set) Lookup(name string) (*template.Template, bool) {
+	if s == nil {
+		return nil, false
+	}
+	tmpl, ok := s.templates[name]
+	return tmpl, ok
+}
+
+// Names returns the registered template names in sorted order.
+func (s *Set) Names() []string {
+	if s == nil {
+		return nil
+	}
+	names := make([]string, 0, len(s.templates))
+	for name := range s.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,102 @@
+// Package tokenizer splits text into model tokens so prompt budgets and
+// truncation can be expressed in the unit models are limited by.
+package tokenizer
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Tokenizer splits text into tokens. Joined, the tokens give back the
+// original text, so a prefix or suffix of them is a valid truncation.
+type Tokenizer interface {
+	Split(text string) []string
+}
+
+// Count returns the number of tokens in text.
+func Count(t Tokenizer, text string) int {
+	return len(t.Split(text))
+}
+
+// Head returns the longest start of text that is at most n tokens.
+func Head(t Tokenizer, text string, n int) string {
+	tokens := t.Split(text)
+	if len(tokens) <= n {
+		return text
+	}
+	return strings.Join(tokens[:max(n, 0)], "")
+}
+
+// Tail returns the longest end of text that is at most n tokens.
+func Tail(t Tokenizer, text string, n int) string {
+	tokens := t.Split(text)
+	if len(tokens) <= n {
+		return text
+	}
+	return strings.Join(tokens[len(tokens)-max(n, 0):], "")
+}
+
+// Estimate approximates tokens as runs of CharsPerToken characters. It is
+// the fallback for models without a loaded vocabulary.
+type Estimate struct {
+	CharsPerToken int
+}
+
+// Split implements Tokenizer.
+func (e Estimate) Split(text string) []string {
+	size := e.CharsPerToken
+	if size <= 0 {
+		size = 4
+	}
+
+	tokens := make([]string, 0, utf8.RuneCountInString(text)/size+1)
+	for len(text) > 0 {
+		end, n := 0, 0
+		for end < len(text) && n < size {
+			_, width := utf8.DecodeRuneInString(text[end:])
+			end += width
+			n++
+		}
+		tokens = append(tokens, text[:end])
+		text = text[end:]
+	}
+	return tokens
+}
+
+// Default is used for model families without a registered tokenizer.
+var Default Tokenizer = Estimate{CharsPerToken: 4}
+
+var (
+	mu       sync.RWMutex
+	registry = map[string]Tokenizer{}
+)
+
+// Register makes t the tokenizer for a model family, replacing any
+// tokenizer registered before.
+func Register(family string, t Tokenizer) {
+	mu.Lock()
+	defer mu.Unlock()
+	registry[family] = t
+}
+
+// For returns the tokenizer registered for family, or Default.
+func For(family string) Tokenizer {
+	mu.RLock()
+	defer mu.RUnlock()
+	if t, ok := registry[family]; ok {
+		return t
+	}
+	return Default
+}
+
+// RegisterVocab loads a vocabulary file and registers it for family.
+func RegisterVocab(family, file string) error {
+	v, err := LoadVocab(file)
+	if err != nil {
+		return fmt.Errorf("tokenizer for %s: %w", family, err)
+	}
+	Register(family, v)
+	return nil
+}
@@ -0,0 +1,63 @@
+package tokenizer_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/tokenizer"
+)
+
+func TestEstimate(t *testing.T) {
+	e := tokenizer.Estimate{CharsPerToken: 4}
+	if got := tokenizer.Count(e, "func main() {}"); got != 4 {
+		t.Errorf("expected 4 tokens, got %d", got)
+	}
+	if got := tokenizer.Head(e, "héllo world", 2); got != "héllo wo" {
+		t.Errorf("expected the first 8 characters, got %q", got)
+	}
+	if got := tokenizer.Tail(e, "hello world", 1); got != "rld" {
+		t.Errorf("expected the last token, got %q", got)
+	}
+}
+
+func TestVocab_ByteLevel(t *testing.T) {
+	v := tokenizer.NewVocab([]string{"func", "Ġmain", "()", "Ġ{", "Ġ}", "f", "u", "n", "c", "Ġ"})
+	got := v.Split("func main() { }")
+	if want := []string{"func", " main", "()", " {", " }"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if joined := strings.Join(v.Split("func ünknown"), ""); joined != "func ünknown" {
+		t.Errorf("expected the tokens to join back to the text, got %q", joined)
+	}
+}
+
+func TestVocab_SentencePiece(t *testing.T) {
+	v := tokenizer.NewVocab([]string{"▁def", "▁main", "():", "▁", "d"})
+	got := v.Split(" def main():")
+	if want := []string{" def", " main", "():"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if got := tokenizer.Count(v, "é"); got != 2 {
+		t.Errorf("expected unknown runes to count one token per byte, got %d", got)
+	}
+}
+
+func TestRegisterVocab(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokenizer.json")
+	if err := os.WriteFile(file, []byte(`{"model":{"type":"BPE","vocab":{"hello":0,"Ġworld":1}}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokenizer.RegisterVocab("test-family", file); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := tokenizer.Count(tokenizer.For("test-family"), "hello world"); got != 2 {
+		t.Errorf("expected 2 tokens, got %d", got)
+	}
+	if tokenizer.For("other-family") != tokenizer.Default {
+		t.Error("expected the default tokenizer for an unregistered family")
+	}
+}
@@ -0,0 +1,151 @@
+package tokenizer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// Vocab tokenizes by greedy longest match against a model's vocabulary, as
+// found in a Hugging Face tokenizer.json. It does not apply BPE merges, so
+// counts can differ slightly from the model's, but they are far closer than
+// a fixed number of characters per token, especially for code.
+type Vocab struct {
+	tokens map[string]bool
+	// byteLevel vocabularies (GPT-2 style) spell each byte as a printable
+	// rune; the others (SentencePiece style) spell spaces as "▁".
+	byteLevel bool
+	maxRunes  int
+}
+
+// LoadVocab reads the vocabulary of a Hugging Face tokenizer.json file.
+func LoadVocab(file string) (*Vocab, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading vocabulary: %w", err)
+	}
+
+	var doc struct {
+		Model struct {
+			Vocab json.RawMessage `json:"vocab"`
+		} `json:"model"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parsing vocabulary %s: %w", file, err)
+	}
+
+	var tokens []string
+	// BPE models map tokens to ids, Unigram models list [token, score].
+	var bpe map[string]int
+	var unigram [][]any
+	switch {
+	case json.Unmarshal(doc.Model.Vocab, &bpe) == nil && len(bpe) > 0:
+		for token := range bpe {
+			tokens = append(tokens, token)
+		}
+	case json.Unmarshal(doc.Model.Vocab, &unigram) == nil && len(unigram) > 0:
+		for _, entry := range unigram {
+			if len(entry) > 0 {
+				if token, ok := entry[0].(string); ok {
+					tokens = append(tokens, token)
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("vocabulary %s: no model.vocab found", file)
+	}
+
+	return NewVocab(tokens), nil
+}
+
+// NewVocab builds a Vocab from the token spellings of a vocabulary.
+func NewVocab(tokens []string) *Vocab {
+	v := &Vocab{tokens: make(map[string]bool, len(tokens))}
+	spaces, pieces := 0, 0
+	for _, token := range tokens {
+		v.tokens[token] = true
+		v.maxRunes = max(v.maxRunes, utf8.RuneCountInString(token))
+		if strings.HasPrefix(token, "Ġ") {
+			spaces++
+		}
+		if strings.HasPrefix(token, "▁") {
+			pieces++
+		}
+	}
+	v.byteLevel = spaces >= pieces
+	return v
+}
+
+// unit is the smallest piece of text the vocabulary spells: a byte for
+// byte-level vocabularies and a rune otherwise.
+type unit struct {
+	start, end int // in the original text
+	mapped     int // end in the mapped text
+}
+
+// Split implements Tokenizer.
+func (v *Vocab) Split(text string) []string {
+	var mapped strings.Builder
+	units := make([]unit, 0, len(text))
+	if v.byteLevel {
+		for i := 0; i < len(text); i++ {
+			mapped.WriteRune(byteRunes[text[i]])
+			units = append(units, unit{start: i, end: i + 1, mapped: mapped.Len()})
+		}
+	} else {
+		for i, r := range text {
+			end := i + utf8.RuneLen(r)
+			if r == ' ' {
+				r = '▁'
+			}
+			mapped.WriteRune(r)
+			units = append(units, unit{start: i, end: end, mapped: mapped.Len()})
+		}
+	}
+	spelled := mapped.String()
+
+	var tokens []string
+	for i := 0; i < len(units); {
+		mappedStart := 0
+		if i > 0 {
+			mappedStart = units[i-1].mapped
+		}
+
+		j := min(i+v.maxRunes, len(units))
+		for ; j > i; j-- {
+			if v.tokens[spelled[mappedStart:units[j-1].mapped]] {
+				break
+			}
+		}
+		if j == i {
+			// Unknown: byte-level vocabularies know every byte, the others
+			// fall back to one token per byte.
+			for b := units[i].start; b < units[i].end; b++ {
+				tokens = append(tokens, text[b:b+1])
+			}
+			i++
+			continue
+		}
+		tokens = append(tokens, text[units[i].start:units[j-1].end])
+		i = j
+	}
+	return tokens
+}
+
+// byteRunes is the GPT-2 byte to rune table: printable bytes stand for
+// themselves and the rest are shifted past 255.
+var byteRunes = func() [256]rune {
+	var table [256]rune
+	n := rune(0)
+	for b := 0; b < 256; b++ {
+		if (b >= '!' && b <= '~') || (b >= 0xA1 && b <= 0xAC) || (b >= 0xAE && b <= 0xFF) {
+			table[b] = rune(b)
+		} else {
+			table[b] = 256 + n
+			n++
+		}
+	}
+	return table
+}()
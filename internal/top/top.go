@@ -0,0 +1,114 @@
+// Package top implements "ollama-copilot top", a terminal monitor for a
+// running server's stats API.
+package top
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/handlers"
+)
+
+// clearScreen moves the cursor home and clears the terminal.
+const clearScreen = "\033[H\033[2J"
+
+// Run polls the stats API at baseURL every interval and redraws the screen
+// until interrupted. key is one of the admin keys of the server, which only
+// serves its stats with --admin-key.
+func Run(baseURL, key string, interval time.Duration, out io.Writer) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	client := &http.Client{Timeout: interval}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		stats, err := fetch(ctx, client, baseURL, key)
+		fmt.Fprint(out, clearScreen)
+		if err != nil {
+			fmt.Fprintf(out, "ollama-copilot top — %s\n\n%s\n", baseURL, err)
+		} else {
+			Render(out, baseURL, stats)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func fetch(ctx context.Context, client *http.Client, baseURL, key string) (handlers.StatsResponse, error) {
+	var stats handlers.StatsResponse
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(baseURL, "/")+"/admin/stats", nil)
+	if err != nil {
+		return stats, err
+	}
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return stats, fmt.Errorf("fetching stats: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return stats, errors.New("fetching stats: the server has no --admin-key, so it serves no stats")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return stats, fmt.Errorf("fetching stats: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return stats, fmt.Errorf("decoding stats: %w", err)
+	}
+	return stats, nil
+}
+
+// Render writes one screen of stats to out.
+func Render(out io.Writer, baseURL string, stats handlers.StatsResponse) {
+	fmt.Fprintf(out, "ollama-copilot top — %s — %s\n\n", baseURL, time.Now().Format(time.TimeOnly))
+
+	if c := stats.Concurrency; c != nil {
+		fmt.Fprintf(out, "Concurrency  %d/%d active, %d queued\n", c.Active, c.Limit, c.Queued)
+	} else {
+		fmt.Fprintln(out, "Concurrency  unlimited")
+	}
+	if c := stats.Cache; c != nil {
+		fmt.Fprintf(out, "Cache        %.0f%% hit rate (%.0f hits, %.0f misses)\n", c.HitRate*100, c.Hits, c.Misses)
+	} else {
+		fmt.Fprintln(out, "Cache        disabled")
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "\nIN FLIGHT (%d)\tMODEL\tELAPSED\n", len(stats.InFlight))
+	for _, r := range stats.InFlight {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Path, r.Model, r.Elapsed.Round(100*time.Millisecond))
+	}
+
+	fmt.Fprint(tw, "\nMODEL\tPROMPT TOK\tGEN TOK\tPROMPT TOK/S\tGEN TOK/S\n")
+	for _, m := range stats.Models {
+		fmt.Fprintf(tw, "%s\t%.0f\t%.0f\t%.1f\t%.1f\n", m.Model, m.PromptTokens, m.GeneratedTokens, m.PromptTokensPerS, m.TokensPerS)
+	}
+
+	fmt.Fprint(tw, "\nRECENT ERRORS\tCLASS\tMODEL\n")
+	for _, e := range stats.RecentErrors {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", e.Time.Local().Format(time.TimeOnly), e.Class, e.Model)
+	}
+
+	tw.Flush()
+}
@@ -0,0 +1,130 @@
+package tracing
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// IDAttribute is the span attribute naming the request a trace belongs to,
+// such as a completion id, which Recorder.Lookup finds the trace by.
+const IDAttribute = "request.id"
+
+// RecentTraces is how many traces Recent keeps.
+const RecentTraces = 1000
+
+// Recent keeps the spans of the last RecentTraces traces of the server,
+// whether or not they are exported, once Setup is called.
+var Recent = NewRecorder(RecentTraces)
+
+// Span is an ended span, as a Recorder keeps it.
+type Span struct {
+	Name       string         `json:"name"`
+	ID         string         `json:"id"`
+	ParentID   string         `json:"parent_id,omitempty"`
+	Start      time.Time      `json:"start"`
+	End        time.Time      `json:"end"`
+	Events     []Event        `json:"events,omitempty"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+}
+
+// Event is something that happened during a span, such as the first token
+// of a generation.
+type Event struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+}
+
+// Recorder is a span processor keeping the spans of the last traces in
+// memory, so that the timings of a request can be looked up without an
+// OpenTelemetry collector. It is safe for concurrent use.
+type Recorder struct {
+	mu     sync.Mutex
+	size   int
+	traces map[trace.TraceID]*recorded
+	// order holds the trace ids from the oldest to the newest.
+	order []trace.TraceID
+	ids   map[string]trace.TraceID
+}
+
+type recorded struct {
+	spans []Span
+	ids   []string
+}
+
+// NewRecorder returns a Recorder keeping the last size traces.
+func NewRecorder(size int) *Recorder {
+	return &Recorder{size: size, traces: map[trace.TraceID]*recorded{}, ids: map[string]trace.TraceID{}}
+}
+
+// Lookup returns the spans of the trace of the request id, by start time.
+func (r *Recorder) Lookup(id string) ([]Span, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	traceID, ok := r.ids[id]
+	if !ok {
+		return nil, false
+	}
+	spans := slices.Clone(r.traces[traceID].spans)
+	slices.SortStableFunc(spans, func(a, b Span) int { return a.Start.Compare(b.Start) })
+	return spans, true
+}
+
+// OnEnd implements sdktrace.SpanProcessor.
+func (r *Recorder) OnEnd(s sdktrace.ReadOnlySpan) {
+	span := Span{Name: s.Name(), ID: s.SpanContext().SpanID().String(), Start: s.StartTime(), End: s.EndTime()}
+	if parent := s.Parent(); parent.IsValid() {
+		span.ParentID = parent.SpanID().String()
+	}
+	for _, e := range s.Events() {
+		span.Events = append(span.Events, Event{Name: e.Name, Time: e.Time})
+	}
+	var id string
+	for _, kv := range s.Attributes() {
+		if span.Attributes == nil {
+			span.Attributes = map[string]any{}
+		}
+		span.Attributes[string(kv.Key)] = kv.Value.AsInterface()
+		if kv.Key == IDAttribute {
+			id = kv.Value.AsString()
+		}
+	}
+
+	traceID := s.SpanContext().TraceID()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.traces[traceID]
+	if !ok {
+		if len(r.order) >= r.size {
+			oldest := r.order[0]
+			r.order = r.order[1:]
+			for _, id := range r.traces[oldest].ids {
+				if r.ids[id] == oldest {
+					delete(r.ids, id)
+				}
+			}
+			delete(r.traces, oldest)
+		}
+		t = &recorded{}
+		r.traces[traceID] = t
+		r.order = append(r.order, traceID)
+	}
+	t.spans = append(t.spans, span)
+	if id != "" {
+		t.ids = append(t.ids, id)
+		r.ids[id] = traceID
+	}
+}
+
+// OnStart implements sdktrace.SpanProcessor.
+func (r *Recorder) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+
+// Shutdown implements sdktrace.SpanProcessor.
+func (r *Recorder) Shutdown(context.Context) error { return nil }
+
+// ForceFlush implements sdktrace.SpanProcessor.
+func (r *Recorder) ForceFlush(context.Context) error { return nil }
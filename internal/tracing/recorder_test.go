@@ -0,0 +1,46 @@
+package tracing_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/josuemontano/ollama-copilot/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestRecorder(t *testing.T) {
+	rec := tracing.NewRecorder(2)
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)).Tracer("test")
+
+	request := func(id string) {
+		ctx, root := tracer.Start(context.Background(), "POST /v1/engines/{engine}/completions")
+		root.SetAttributes(attribute.String(tracing.IDAttribute, id))
+		_, child := tracer.Start(ctx, "ollama generate")
+		child.AddEvent("first token")
+		child.End()
+		root.End()
+	}
+	for i := range 3 {
+		request(fmt.Sprintf("completion-%d", i))
+	}
+
+	if _, ok := rec.Lookup("completion-0"); ok {
+		t.Error("expected the oldest trace to be evicted")
+	}
+	spans, ok := rec.Lookup("completion-2")
+	if !ok || len(spans) != 2 {
+		t.Fatalf("expected both spans of the last trace, got %+v", spans)
+	}
+	root, child := spans[0], spans[1]
+	if root.Name != "POST /v1/engines/{engine}/completions" || child.ParentID != root.ID {
+		t.Errorf("expected the spans by start time, got %+v", spans)
+	}
+	if len(child.Events) != 1 || child.Events[0].Name != "first token" {
+		t.Errorf("expected the event of the span, got %+v", child.Events)
+	}
+	if root.Attributes[tracing.IDAttribute] != "completion-2" {
+		t.Errorf("expected the attributes of the span, got %v", root.Attributes)
+	}
+}
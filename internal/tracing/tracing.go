@@ -0,0 +1,51 @@
+// Package tracing sets up OpenTelemetry tracing. Spans cover a request from
+// the middleware through decoding, prompt building and generation to the
+// stream written back, so the latency an editor sees can be split into time
+// spent in the proxy and time spent in the model. Recent keeps the last
+// traces in memory, for the timings of a request to be looked up without a
+// collector.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName is the service.name spans are reported under.
+const ServiceName = "ollama-copilot"
+
+// Tracer returns the tracer the server's spans are started with. Until
+// Setup is called it starts spans that are not recorded.
+func Tracer() trace.Tracer {
+	return otel.Tracer("github.com/josuemontano/ollama-copilot")
+}
+
+// Setup records spans in Recent, exports them over OTLP/HTTP to endpoint,
+// such as http://localhost:4318, and accepts W3C trace context from
+// clients. The returned function flushes the spans not yet exported; call
+// it before exiting. With an empty endpoint nothing is exported.
+func Setup(ctx context.Context, endpoint string) (shutdown func(context.Context) error, err error) {
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithSpanProcessor(Recent),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", ServiceName))),
+	}
+	if endpoint != "" {
+		exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+		if err != nil {
+			return nil, fmt.Errorf("creating the OTLP exporter: %w", err)
+		}
+		options = append(options, sdktrace.WithBatcher(exporter))
+	}
+	provider := sdktrace.NewTracerProvider(options...)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
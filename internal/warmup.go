@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/josuemontano/ollama-copilot/internal/backends"
+	"github.com/ollama/ollama/api"
+	"go.uber.org/zap"
+)
+
+// pullLogInterval is how often the progress of a pull is logged while it
+// stays in the same step.
+const pullLogInterval = 10 * time.Second
+
+// PrepareModels checks that every Ollama backend has the models of the
+// server, pulling the missing ones with AutoPull. With Warmup, it then loads
+// Model into memory so the first completion does not pay a cold start.
+// Problems are logged rather than returned, since the server can serve
+// other models meanwhile. It blocks and is meant to run in its own
+// goroutine.
+func (s *Server) PrepareModels() {
+	if name, _ := s.remote(); name != "" {
+		return
+	}
+
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		s.logger().Error("Error initializing the Ollama client", zap.Error(err))
+		return
+	}
+	pool, err := s.backendPool()
+	if err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, b := range pool.Backends() {
+		wg.Go(func() {
+			ctx := backends.WithBackend(context.Background(), b)
+			logger := s.logger().With(zap.String("backend", b.Name))
+
+			// Model comes first, so that it is warm before the other models
+			// are pulled, which may take a while.
+			if s.ensureModel(ctx, client, logger, s.Model) && s.Warmup {
+				start := time.Now()
+				if err := loadModel(ctx, client, s.Model); err != nil {
+					logger.Warn("Error warming up the model", zap.String("model", s.Model), zap.Error(err))
+				} else {
+					logger.Info("Model warmed up", zap.String("model", s.Model), zap.Duration("duration", time.Since(start)))
+				}
+			}
+			for _, model := range s.otherModels() {
+				s.ensureModel(ctx, client, logger, model)
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// otherModels returns the models the server may use besides Model: the
+// fallback, chat and burst models and those of ModelMap.
+func (s *Server) otherModels() []string {
+	models := append([]string{s.FallbackModel, s.ChatModel, s.BurstModel}, slices.Sorted(maps.Values(s.ModelMap))...)
+	var others []string
+	for _, model := range models {
+		if model != "" && model != s.Model && !slices.Contains(others, model) {
+			others = append(others, model)
+		}
+	}
+	return others
+}
+
+// ensureModel reports whether the backend of ctx has model, pulling it first
+// with AutoPull.
+func (s *Server) ensureModel(ctx context.Context, client *api.Client, logger *zap.Logger, model string) bool {
+	showCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	_, err := client.Show(showCtx, &api.ShowRequest{Model: model})
+	cancel()
+
+	var statusErr api.StatusError
+	switch {
+	case err == nil:
+		return true
+	case !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound:
+		logger.Warn("Error checking the model", zap.String("model", model), zap.Error(err))
+		return false
+	case !s.AutoPull:
+		logger.Warn("Model not found, pull it with `ollama pull` or start with --auto-pull", zap.String("model", model))
+		return false
+	}
+
+	logger.Info("Pulling the model", zap.String("model", model))
+	start := time.Now()
+	if err := pullModel(ctx, client, logger, model); err != nil {
+		logger.Error("Error pulling the model", zap.String("model", model), zap.Error(err))
+		return false
+	}
+	logger.Info("Model pulled", zap.String("model", model), zap.Duration("duration", time.Since(start)))
+	return true
+}
+
+// pullModel pulls model, logging each step of the pull and, every
+// pullLogInterval, how far along the download of a layer is.
+func pullModel(ctx context.Context, client *api.Client, logger *zap.Logger, model string) error {
+	var status string
+	var logged time.Time
+	return client.Pull(ctx, &api.PullRequest{Model: model}, func(p api.ProgressResponse) error {
+		if p.Status == status && time.Since(logged) < pullLogInterval {
+			return nil
+		}
+		status, logged = p.Status, time.Now()
+
+		fields := []zap.Field{zap.String("model", model), zap.String("status", p.Status)}
+		if p.Total > 0 {
+			fields = append(fields, zap.String("progress", fmt.Sprintf("%.1f%%", 100*float64(p.Completed)/float64(p.Total))))
+		}
+		logger.Info("Pull progress", fields...)
+		return nil
+	})
+}
@@ -1,52 +1,727 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/josuemontano/ollama-copilot/internal"
+	"github.com/josuemontano/ollama-copilot/internal/certs"
+	"github.com/josuemontano/ollama-copilot/internal/config"
+	"github.com/josuemontano/ollama-copilot/internal/handlers"
+	"github.com/josuemontano/ollama-copilot/internal/mdns"
+	"github.com/josuemontano/ollama-copilot/internal/middleware"
+	"github.com/josuemontano/ollama-copilot/internal/secrets"
+	"github.com/josuemontano/ollama-copilot/internal/storage"
+	"github.com/josuemontano/ollama-copilot/internal/templates"
+	"github.com/josuemontano/ollama-copilot/internal/tokenizer"
+	"github.com/josuemontano/ollama-copilot/internal/top"
+	"github.com/josuemontano/ollama-copilot/internal/tracing"
 	"go.uber.org/zap"
 )
 
-var logger *zap.Logger
-
 var (
-	port              = flag.String("port", ":11437", "Port to listen on")
-	proxyPort         = flag.String("proxy-port", ":11438", "Proxy port to listen on")
-	portSSL           = flag.String("port-ssl", ":11436", "Port to listen on")
-	proxyPortSSL      = flag.String("proxy-port-ssl", ":11435", "Proxy port to listen on")
+	configFile        = flag.String("config", "", "YAML or TOML config file, defaults to ~/.config/ollama-copilot/config.yaml")
+	port              = flag.String("port", "127.0.0.1:"+internal.DefaultPort, "Address the HTTP server listens on, as host:port, :port or host; empty disables it")
+	proxyPort         = flag.String("proxy-port", "127.0.0.1:"+internal.DefaultProxyPort, "Address the HTTP proxy listens on; empty disables it")
+	portSSL           = flag.String("port-ssl", "127.0.0.1:"+internal.DefaultPortSSL, "Address the HTTPS server listens on; empty disables it")
+	proxyPortSSL      = flag.String("proxy-port-ssl", "127.0.0.1:"+internal.DefaultProxyPortSSL, "Address the HTTPS proxy listens on; empty disables it")
+	listeners         = flag.String("listeners", "", "JSON file of named listeners, each with its address, TLS, proxy and API keys, replacing the port flags")
+	advertise         = flag.Bool("mdns", false, "Advertise the server on the local network with mDNS so editor plugins and other machines can find it")
+	shutdownGrace     = flag.Duration("shutdown-grace", 10*time.Second, "How long completions in flight may finish on SIGINT or SIGTERM before their connections are closed")
 	cert              = flag.String("cert", "", "Certificate file path *.crt")
 	key               = flag.String("key", "", "Key file path *.key")
+	acmeCacheDir      = flag.String("acme-cache-dir", "", "Directory the Let's Encrypt certificates of --acme-domain are kept in, defaults to ~/.config/ollama-copilot/certs/acme")
+	secretsDir        = flag.String("secrets-dir", "", "Directory secrets are kept in where the OS has no keychain, defaults to ~/.config/ollama-copilot/secrets")
+	certDir           = flag.String("cert-dir", "", "Directory of the local certificate authority and the certificate served without --cert, defaults to ~/.config/ollama-copilot/certs")
 	model             = flag.String("model", "qwen3-coder:30b", "LLM model to use")
+	fallbackModel     = flag.String("fallback-model", "", "Smaller model kept loaded and used when the primary model is slow or fails")
+	fallbackAfter     = flag.Duration("fallback-after", 3*time.Second, "Time to wait for the primary model's first token before using the fallback model")
+	autoPull          = flag.Bool("auto-pull", false, "Pull the configured models Ollama does not have on startup")
+	warmup            = flag.Bool("warmup", false, "Load the model into memory on startup, so the first completion is not a cold start")
+	burstModel        = flag.String("burst-model", "", "Larger model answering the completions of users who asked for burst mode at /v1/burst; empty disables burst mode")
+	burstNumPredict   = flag.Int("burst-num-predict", 400, "Least number of tokens to predict in burst mode")
+	burstDuration     = flag.Duration("burst-duration", handlers.DefaultBurstDuration, "How long burst mode lasts unless asked otherwise")
+	chatModel         = flag.String("chat-model", "", "LLM model answering Copilot Chat, defaults to --model")
+	minConcurrent     = flag.Int("min-concurrent", 1, "Minimum number of concurrent generations")
+	maxConcurrent     = flag.Int("max-concurrent", 8, "Maximum number of concurrent generations, 0 for unlimited")
+	maxQueue          = flag.Int("max-queue", 0, "Maximum number of requests waiting for a generation slot, beyond which they are answered 429; 0 for unlimited")
+	rateLimit         = flag.Float64("rate-limit", 0, "Generation requests per second each client, by API key or IP address, may make on average; 0 disables rate limits")
+	rateBurst         = flag.Int("rate-burst", 10, "Generation requests each client may make at once under --rate-limit")
+	ttftTarget        = flag.Duration("ttft-target", 2*time.Second, "Time to first token the concurrency limit adapts to, 0 disables adaptation")
+	defaultLanguage   = flag.String("default-language", "", "Language assumed when a request names none and it cannot be inferred")
+	pathRules         = flag.String("path-rules", "", "JSON file with per-path overrides for model, template, context lines and blocking")
+	languageParams    = flag.String("language-params", "", "JSON file with per-language num_predict, stop, temperature and single-line settings")
 	numPredict        = flag.Int("num-predict", 200, "Maximum number of tokens to predict")
-	promptTemplateStr = flag.String("prompt-template", "<|fim_prefix|> {{.Prefix}} <|fim_suffix|>{{.Suffix}} <|fim_middle|>", "Fill-in-middle template to apply in prompt")
+	functionPredict   = flag.Int("function-num-predict", 500, "Maximum number of tokens to predict for a whole function body")
+	prefixLines       = flag.Int("prefix-lines", handlers.DefaultContextLines, "Lines before the cursor put in completion prompts")
+	suffixLines       = flag.Int("suffix-lines", handlers.DefaultContextLines, "Lines after the cursor put in completion prompts")
+	numCtx            = flag.Int("num-ctx", 0, "Context window of the model in tokens that completion prompts are cut to fit, defaults to the model's num_ctx")
+	cacheSize         = flag.Int("cache-size", 256, "Number of completions kept to answer repeated requests, 0 disables the cache")
+	cacheTTL          = flag.Duration("cache-ttl", 5*time.Minute, "How long cached completions are served")
+	idempotencyTTL    = flag.Duration("idempotency-ttl", time.Minute, "How long responses to requests with an Idempotency-Key are replayed to retries, 0 disables replays")
+	storageSpec       = flag.String("storage", "memory", "Where the cache, usage stats, feedback, recorded events and completions are kept: memory, sqlite:FILE to keep them across restarts, or redis://HOST:PORT to share them and the rate limits between instances")
+	recordEvents      = flag.Bool("record-events", false, "Record every daemon event in the storage")
+	recordCompletions = flag.Bool("record-completions", false, "Record the prompt and text of every completion in the storage, for offline analysis")
+	cancelSuperseded  = flag.Bool("cancel-superseded", true, "Cancel a client's running completion when it asks again for the same document position")
+	suppressRejected  = flag.Bool("suppress-rejected", true, "Keep a suggestion the user rejected from being shown again at the same document position")
+	commentLanguage   = flag.String("comment-language", "", "Natural language the model is asked to write comments and documentation in, such as Spanish")
+	resumeWindow      = flag.Duration("resume-window", 0, "How long a client whose connection dropped may resume a streamed completion with Last-Event-ID, 0 disables resumption")
+	requestTimeout    = flag.Duration("request-timeout", handlers.DefaultRequestTimeout, "How long a completion request may take before it is canceled")
+	firstTokenTimeout = flag.Duration("first-token-timeout", 0, "Answer a completion empty when the model produces no token for this long, 0 waits for the request timeout")
+	retryBudget       = flag.Duration("retry-budget", 2*time.Second, "How long completions failing with transient Ollama errors are retried for, 0 disables retries")
+	completionMode    = flag.String("completion-mode", "auto", "Cut completions to the cursor line, block or function: auto, line, block, function or full")
+	postProcess       = flag.String("post-process", handlers.DefaultPostProcess, "Comma-separated post-processors completions stream through: fences, indent, trim_blank, suffix_overlap, max_lines=N, or none")
+	promptTemplateStr = flag.String("prompt-template", "", "Fill-in-middle template to apply in prompt, defaults to the model family's")
+	modelFamily       = flag.String("model-family", "", "FIM template preset: "+strings.Join(templates.Families(), ", ")+"; inferred from --model when empty")
+	systemTemplate    = flag.String("system-template", "", "Template of the system prompt sent with completions, defaults to the built-in one")
+	noSystem          = flag.Bool("no-system", false, "Send completions without a system prompt")
+	rawPrompt         = flag.Bool("raw", false, "Send the prompt template to the model verbatim, bypassing the model's own template and the system prompt")
+	promptTemplates   = flag.String("prompt-templates", "", "JSON file of named prompt templates selectable with the X-Prompt-Template header")
+	tokenTTL          = flag.Duration("token-ttl", 2*time.Hour, "How long issued Copilot tokens are valid")
+	publicHost        = flag.String("public-host", "localhost", "Host name advertised to clients in token endpoints, empty to disable")
+	noGithubHeaders   = flag.Bool("no-github-headers", false, "Do not inject GitHub headers into responses or forward request headers")
+	verifyEntitlement = flag.Bool("verify-entitlement", false, "Only issue tokens to users with a GitHub Copilot license")
+	entitlementURL    = flag.String("entitlement-url", "https://api.github.com/copilot_internal/v2/token", "GitHub endpoint used to verify Copilot licenses")
+	entitlementTTL    = flag.Duration("entitlement-cache", 10*time.Minute, "How long verified Copilot licenses are cached")
+	projectDir        = flag.String("project-dir", "", "Project directory to summarize and describe to the model in every prompt")
+	projectInterval   = flag.Duration("project-summary-interval", 30*time.Minute, "How often the project summary is regenerated")
+	projectTokens     = flag.Int("project-summary-tokens", 200, "Maximum length of the project summary in tokens")
+	userHeader        = flag.String("user-header", "", "Request header identifying the user in the usage export, defaults to the client IP")
+	gpuWatts          = flag.Float64("gpu-watts", 0, "Average GPU power draw in watts, used to estimate energy in the usage export")
+	gpuCostPerHour    = flag.Float64("gpu-cost-per-hour", 0, "Cost of one hour of GPU time, used to estimate cost in the usage export")
+	idleUnload        = flag.Duration("idle-unload", 30*time.Minute, "Unload the model once editor plugins have sent no heartbeat for this long, 0 keeps it loaded")
+	pinBackend        = flag.String("pin-backend", "", "Name of the --backend to send every completion to, whatever its latency")
+	openaiURL         = flag.String("openai-url", "", "Base URL of an OpenAI-compatible server, such as http://127.0.0.1:8080/v1, to generate completions and chats with in place of Ollama")
+	openaiKey         = flag.String("openai-key", "", "API key sent to the --openai-url server")
+	llamaCppURL       = flag.String("llama-cpp-url", "", "URL of a llama.cpp llama-server, such as http://127.0.0.1:8080, to fill in completions with natively through /infill in place of Ollama")
+	llamaCppKey       = flag.String("llama-cpp-key", "", "API key sent to the --llama-cpp-url server")
+	ollamaHosts       = flag.String("ollama-hosts", "", "Comma-separated Ollama servers completions are routed between as [scheme://]host[:port], each named by its address")
+	balance           = flag.String("balance", "latency", "How completions are spread over the backends: latency, round-robin or least-loaded")
+	stickyRouting     = flag.Bool("sticky-routing", true, "Send completions whose prompts start the same way to the backend that served the last one, to reuse its KV cache")
 	verbose           = flag.Bool("verbose", false, "Enable verbose mode")
+	otlpEndpoint      = flag.String("otlp-endpoint", "", "OTLP/HTTP endpoint completion traces are exported to, such as http://localhost:4318")
+	watchConfig       = flag.Duration("watch-config", 0, "How often the config file, the files it names and the certificate are checked for changes, which reloads them as SIGHUP does; 0 disables watching")
+)
+
+// reloadable are the flags a reload sets again from the config file. The
+// others take a restart.
+var reloadable = []string{
+	"model", "fallback-model", "fallback-after", "model-map", "model-options",
+	"prompt-template", "model-family", "system-template", "no-system", "raw",
+	"num-predict", "function-num-predict", "prefix-lines", "suffix-lines", "num-ctx",
+	"default-language", "path-rules", "language-params", "prompt-templates",
+	"completion-mode", "post-process",
+}
+
+var (
+	headers        = middleware.DefaultGithubHeaderPolicy()
+	forwardHeaders listFlag
+	tokenizers     = headerFlag{}
+	modelMap       = headerFlag{}
+	modelOptions   = headerFlag{}
+	backendHosts   = headerFlag{}
+	eventWebhooks  listFlag
+	listen         listFlag
+	acmeDomains    listFlag
+	adminKeys      listFlag
 )
 
+func init() {
+	flag.Var(headerFlag(headers.Headers), "response-header", "Header injected into every response as name=value, repeatable; name= removes a default")
+	flag.Var(&forwardHeaders, "forward-header", "Request header forwarded to Ollama, repeatable")
+	flag.Var(modelMap, "model-map", "Ollama model answering a requested Copilot model as name=model, e.g. gpt-4o-copilot=qwen2.5-coder:7b, repeatable")
+	flag.Var(modelOptions, "model-options", "Ollama option of a requested Copilot model as name.option=value, e.g. copilot-codex.num_predict=60, repeatable")
+	flag.Var(backendHosts, "backend", "Ollama server completions are routed between by latency as name=[scheme://]host[:port], repeatable; defaults to OLLAMA_HOST")
+	flag.Var(&listen, "listen", "Further HTTP listener as host:port or unix:///path for a unix socket, repeatable")
+	flag.Var(&acmeDomains, "acme-domain", "Host name HTTPS certificates are obtained for from Let's Encrypt instead of the local authority, repeatable")
+	flag.Var(&adminKeys, "admin-key", "Key required by the /admin endpoints and /debug/trace, repeatable; without one, completions cannot be changed at runtime")
+	flag.Var(&eventWebhooks, "event-webhook", "URL every daemon event is posted to as JSON, repeatable")
+	flag.Var(tokenizers, "tokenizer", "Hugging Face tokenizer.json counting tokens for a model family as family=file, repeatable")
+}
+
+// headerFlag collects repeated name=value flags into a map.
+type headerFlag map[string]string
+
+func (h headerFlag) String() string {
+	pairs := make([]string, 0, len(h))
+	for name, value := range h {
+		pairs = append(pairs, name+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (h headerFlag) Repeatable() bool { return true }
+
+func (h headerFlag) Reset() { clear(h) }
+
+func (h headerFlag) Set(v string) error {
+	name, value, ok := strings.Cut(v, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected name=value, got %q", v)
+	}
+	if value == "" {
+		delete(h, name)
+		return nil
+	}
+	h[name] = value
+	return nil
+}
+
+// listFlag collects repeated flag values.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Repeatable() bool { return true }
+
+func (l *listFlag) Reset() { *l = nil }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// hostList splits a comma-separated list of hosts, skipping empty entries.
+func hostList(s string) []string {
+	var hosts []string
+	for _, host := range strings.Split(s, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
 // main is the entrypoint for the program.
 func main() {
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "top" {
+		runTop(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "trust" {
+		runTrust(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "discover" {
+		runDiscover(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "secret" {
+		runSecret(os.Args[2:])
+		return
+	}
+
+	// "config validate" takes the server's flags and checks them instead
+	// of serving.
+	args, validate := os.Args[1:], false
+	if len(args) > 0 && args[0] == "config" {
+		if len(args) < 2 || args[1] != "validate" {
+			fmt.Fprintln(os.Stderr, "usage: ollama-copilot config validate [flags]")
+			os.Exit(2)
+		}
+		args, validate = args[2:], true
+	}
+
+	_ = flag.CommandLine.Parse(args)
+	if err := loadConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	keychain, err := secretStore(*secretsDir)
+	if err == nil {
+		err = resolveSecrets(keychain)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	for family, file := range tokenizers {
+		if err := tokenizer.RegisterVocab(family, file); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	headers.Forward = forwardHeaders
+	headers.Bypass = *noGithubHeaders
+
+	logger, err := newLogger(validate, *verbose)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "creating the logger:", err)
+		os.Exit(2)
+	}
+	defer func() { _ = logger.Sync() }()
+
+	if !*verifyEntitlement {
+		*entitlementURL = ""
+	}
+
+	// The transport is replaced before anything starts using it.
+	internal.InstallTransport()
+	server := newServer(logger, keychain)
+
+	if validate {
+		runValidate(server)
+		return
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), *otlpEndpoint)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	defer func() { _ = shutdownTracing(context.Background()) }()
+
+	store, err := storage.Open(*storageSpec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	defer func() { _ = store.Close() }()
+	server.Storage = store
+
+	server.SubscribeEvents()
+	go server.PrepareModels()
+	go server.KeepStandbyWarm()
+	go server.SummarizeProject()
+	go server.WatchPresence()
+	go server.ProbeBackends()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go watchReloads(ctx, server, logger, keychain)
+	if err := server.Run(ctx); err != nil {
+		logger.Error("Server stopped", zap.Error(err))
+		stop()
+		_ = shutdownTracing(context.Background())
+		_ = store.Close()
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+}
+
+// newServer returns the server the flags configure. Its maps are copies,
+// so that a reload can reset the flags while it serves.
+func newServer(logger *zap.Logger, keychain secrets.Store) *internal.Server {
+	return &internal.Server{
+		PortSSL:                *portSSL,
+		Port:                   *port,
+		ProxyPort:              *proxyPort,
+		ProxyPortSSL:           *proxyPortSSL,
+		Listeners:              *listeners,
+		Listen:                 listen,
+		Advertise:              *advertise,
+		ShutdownGrace:          *shutdownGrace,
+		Certificate:            *cert,
+		Key:                    *key,
+		CertDir:                *certDir,
+		ACMEDomains:            acmeDomains,
+		ACMECacheDir:           *acmeCacheDir,
+		Template:               *promptTemplateStr,
+		SystemTemplate:         *systemTemplate,
+		NoSystem:               *noSystem,
+		Raw:                    *rawPrompt,
+		ModelFamily:            *modelFamily,
+		Secrets:                keychain,
+		Model:                  *model,
+		FallbackModel:          *fallbackModel,
+		FallbackAfter:          *fallbackAfter,
+		AutoPull:               *autoPull,
+		Warmup:                 *warmup,
+		ChatModel:              *chatModel,
+		ModelMap:               handlers.ModelMap(maps.Clone(modelMap)),
+		ModelOptions:           maps.Clone(modelOptions),
+		NumPredict:             *numPredict,
+		FunctionNumPredict:     *functionPredict,
+		PrefixLines:            *prefixLines,
+		SuffixLines:            *suffixLines,
+		NumCtx:                 *numCtx,
+		CacheSize:              *cacheSize,
+		CacheTTL:               *cacheTTL,
+		IdempotencyTTL:         *idempotencyTTL,
+		EventWebhooks:          eventWebhooks,
+		RecordEvents:           *recordEvents,
+		RecordCompletions:      *recordCompletions,
+		CancelSuperseded:       *cancelSuperseded,
+		SuppressRejected:       *suppressRejected,
+		CommentLanguage:        *commentLanguage,
+		ResumeWindow:           *resumeWindow,
+		RequestTimeout:         *requestTimeout,
+		FirstTokenTimeout:      *firstTokenTimeout,
+		RetryBudget:            *retryBudget,
+		BurstModel:             *burstModel,
+		BurstNumPredict:        *burstNumPredict,
+		BurstDuration:          *burstDuration,
+		CompletionMode:         *completionMode,
+		PostProcess:            *postProcess,
+		MinConcurrent:          *minConcurrent,
+		MaxConcurrent:          *maxConcurrent,
+		TTFTTarget:             *ttftTarget,
+		MaxQueue:               *maxQueue,
+		RateLimit:              *rateLimit,
+		RateBurst:              *rateBurst,
+		DefaultLanguage:        *defaultLanguage,
+		PathRules:              *pathRules,
+		LanguageParams:         *languageParams,
+		PromptTemplates:        *promptTemplates,
+		TokenTTL:               *tokenTTL,
+		PublicHost:             *publicHost,
+		Headers:                headers,
+		EntitlementURL:         *entitlementURL,
+		EntitlementTTL:         *entitlementTTL,
+		ProjectDir:             *projectDir,
+		ProjectSummaryInterval: *projectInterval,
+		ProjectSummaryTokens:   *projectTokens,
+		UserHeader:             *userHeader,
+		AdminKeys:              adminKeys,
+		Backends:               backendHosts,
+		OpenAIURL:              *openaiURL,
+		OpenAIKey:              *openaiKey,
+		LlamaCppURL:            *llamaCppURL,
+		LlamaCppKey:            *llamaCppKey,
+		OllamaHosts:            hostList(*ollamaHosts),
+		Balance:                *balance,
+		PinBackend:             *pinBackend,
+		StickyRouting:          *stickyRouting,
+		Pricing:                handlers.Pricing{Watts: *gpuWatts, CostPerHour: *gpuCostPerHour},
+		IdleUnload:             *idleUnload,
+		Logger:                 logger,
+	}
+}
 
-	if *verbose {
-		logger, _ = zap.NewDevelopment()
+// newLogger returns the logger every component of the server is given: a
+// discarding one for the validate subcommand, a development logger with
+// --verbose and a production logger otherwise.
+func newLogger(validate, verbose bool) (*zap.Logger, error) {
+	switch {
+	case validate:
+		return zap.NewNop(), nil
+	case verbose:
+		return zap.NewDevelopment()
+	default:
+		return zap.NewProduction()
+	}
+}
+
+// loadConfig fills the flags not given on the command line from the config
+// file, then overrides them from OLLAMA_COPILOT_* environment variables. A
+// missing default config file is not an error.
+func loadConfig() error {
+	values, err := configValues()
+	if err != nil {
+		return err
+	}
+	return config.Apply(flag.CommandLine, values)
+}
+
+// configPath returns the config file given with --config or its
+// environment variable, or else the first default one that exists, and
+// whether it was given.
+func configPath() (path string, explicit bool) {
+	path, explicit = *configFile, true
+	if env, ok := os.LookupEnv(config.EnvName("config")); ok {
+		path = env
+	}
+	if path == "" {
+		explicit = false
+		for _, p := range config.DefaultPaths() {
+			if _, err := os.Stat(p); err == nil {
+				path = p
+				break
+			}
+		}
+	}
+	return path, explicit
+}
+
+// configValues reads the settings of the config file, if there is one.
+func configValues() (map[string][]string, error) {
+	path, explicit := configPath()
+	if path == "" {
+		return nil, nil
+	}
+	values, err := config.Load(path)
+	if err != nil && (explicit || !errors.Is(err, fs.ErrNotExist)) {
+		return nil, err
+	}
+	return values, nil
+}
+
+// watchReloads reloads server on SIGHUP and, with --watch-config, when one
+// of the files of watchedFiles changes, until ctx is done.
+func watchReloads(ctx context.Context, server *internal.Server, logger *zap.Logger, keychain secrets.Store) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if *watchConfig > 0 {
+		ticker := time.NewTicker(*watchConfig)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	modified := modTimes(watchedFiles())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+			if maps.Equal(modTimes(watchedFiles()), modified) {
+				continue
+			}
+		}
+		if err := reload(server, logger, keychain); err != nil {
+			logger.Error("Error reloading the config, keeping the current one", zap.Error(err))
+		} else {
+			logger.Info("Reloaded the config")
+		}
+		// The files are those of the reloaded flags, which may name others.
+		modified = modTimes(watchedFiles())
+	}
+}
+
+// reload sets the reloadable flags again from the config file and applies
+// them to server.
+func reload(server *internal.Server, logger *zap.Logger, keychain secrets.Store) error {
+	values, err := configValues()
+	if err != nil {
+		return err
+	}
+	if err := config.Reload(flag.CommandLine, values, reloadable...); err != nil {
+		return err
+	}
+	return server.Reload(newServer(logger, keychain))
+}
+
+// watchedFiles are the files a reload reads: the config file, the files of
+// path rules, language parameters and named templates, and the
+// certificate.
+func watchedFiles() []string {
+	path, _ := configPath()
+	var files []string
+	for _, file := range []string{path, *pathRules, *languageParams, *promptTemplates, *cert, *key} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// modTimes returns when each of files was last modified, and the zero time
+// for those that cannot be read.
+func modTimes(files []string) map[string]time.Time {
+	times := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		var modified time.Time
+		if info, err := os.Stat(file); err == nil {
+			modified = info.ModTime()
+		}
+		times[file] = modified
+	}
+	return times
+}
+
+// secretStore opens the store of secrets, in dir where the OS has no
+// keychain, by default secrets.DefaultDir.
+func secretStore(dir string) (secrets.Store, error) {
+	if dir == "" {
+		var err error
+		if dir, err = secrets.DefaultDir(); err != nil {
+			return nil, err
+		}
+	}
+	return secrets.Open(dir), nil
+}
+
+// resolveSecrets replaces the keys and URLs given as keychain:NAME with the
+// secrets they name, so that they need not be in flags or config files.
+func resolveSecrets(store secrets.Store) error {
+	for _, value := range []*string{openaiKey, llamaCppKey, storageSpec} {
+		resolved, err := secrets.Resolve(store, *value)
+		if err != nil {
+			return err
+		}
+		*value = resolved
+	}
+	for i, key := range adminKeys {
+		resolved, err := secrets.Resolve(store, key)
+		if err != nil {
+			return err
+		}
+		adminKeys[i] = resolved
+	}
+	return nil
+}
+
+// runSecret implements the "secret" subcommand, which stores a secret read
+// from stdin in the keychain, or deletes one, for flags to name as
+// keychain:NAME.
+func runSecret(args []string) {
+	flags := flag.NewFlagSet("secret", flag.ExitOnError)
+	dir := flags.String("secrets-dir", "", "Directory secrets are kept in where the OS has no keychain, defaults to ~/.config/ollama-copilot/secrets")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: ollama-copilot secret [--secrets-dir DIR] set|delete NAME")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() != 2 || flags.Arg(0) != "set" && flags.Arg(0) != "delete" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	store, err := secretStore(*dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	name := flags.Arg(1)
+	if flags.Arg(0) == "delete" {
+		err = store.Delete(name)
 	} else {
-		logger, _ = zap.NewProduction()
+		var value []byte
+		if value, err = io.ReadAll(os.Stdin); err == nil {
+			value = bytes.TrimRight(value, "\r\n")
+			if len(value) == 0 {
+				err = errors.New("no secret on stdin")
+			} else {
+				err = store.Set(name, string(value))
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s secret %q: %v\n", flags.Arg(0), name, err)
+		os.Exit(1)
+	}
+	if flags.Arg(0) == "set" {
+		fmt.Fprintf(os.Stderr, "stored, give %s%s in place of the secret\n", secrets.Prefix, name)
+	}
+}
+
+// runValidate implements the "config validate" subcommand. It exits with
+// status 1 if the configuration does not load or has problems.
+func runValidate(server *internal.Server) {
+	problems, err := server.Validate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	defer logger.Sync()
+	for _, problem := range problems {
+		fmt.Fprintln(os.Stderr, "warning:", problem)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	fmt.Println("configuration OK")
+}
+
+// runTop implements the "top" subcommand.
+func runTop(args []string) {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	url := flags.String("url", "http://localhost:11437", "Base URL of the ollama-copilot server")
+	interval := flags.Duration("interval", time.Second, "Refresh interval")
+	key := flags.String("key", "", "Admin key of the server, one of its --admin-key values, or keychain:NAME")
+	_ = flags.Parse(args)
 
-	server := &internal.Server{
-		PortSSL:     *portSSL,
-		Port:        *port,
-		Certificate: *cert,
-		Key:         *key,
-		Template:    *promptTemplateStr,
-		Model:       *model,
-		NumPredict:  *numPredict,
-		Logger:      logger,
+	adminKey := *key
+	if strings.HasPrefix(adminKey, secrets.Prefix) {
+		store, err := secretStore("")
+		if err == nil {
+			adminKey, err = secrets.Resolve(store, adminKey)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
 	}
+	if err := top.Run(*url, adminKey, *interval, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
 
-	go internal.Proxy(*proxyPortSSL, *portSSL)
-	go internal.Proxy(*proxyPort, *port)
+// runDiscover implements the "discover" subcommand, which lists the servers
+// advertised with mDNS on the local network.
+func runDiscover(args []string) {
+	flags := flag.NewFlagSet("discover", flag.ExitOnError)
+	timeout := flags.Duration("timeout", 2*time.Second, "How long to wait for servers to answer")
+	_ = flags.Parse(args)
 
-	go server.Serve()
-	server.ServeTLS()
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	instances, err := mdns.Browse(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(instances) == 0 {
+		fmt.Fprintln(os.Stderr, "no server found, is one running with --mdns?")
+		os.Exit(1)
+	}
+	for _, inst := range instances {
+		addr := inst.Host + ".local"
+		if len(inst.IPs) > 0 {
+			addr = inst.IPs[0].String()
+		}
+		scheme := "http"
+		if inst.Text["tls"] == "true" {
+			scheme = "https"
+		}
+		var text []string
+		for key, value := range inst.Text {
+			text = append(text, key+"="+value)
+		}
+		slices.Sort(text)
+		fmt.Printf("%s\t%s://%s\t%s\n", inst.Name, scheme, net.JoinHostPort(addr, strconv.Itoa(inst.Port)), strings.Join(text, " "))
+	}
+}
+
+// runTrust implements the "trust" subcommand, which prints the local
+// certificate authority or adds it to the system trust store.
+func runTrust(args []string) {
+	flags := flag.NewFlagSet("trust", flag.ExitOnError)
+	dir := flags.String("cert-dir", "", "Directory of the local certificate authority, defaults to ~/.config/ollama-copilot/certs")
+	printCA := flags.Bool("print", false, "Print the certificate authority as PEM instead of installing it")
+	_ = flags.Parse(args)
+
+	if *dir == "" {
+		var err error
+		if *dir, err = certs.DefaultDir(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *printCA {
+		ca, err := certs.CA(*dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(ca)
+		return
+	}
+	if err := certs.Install(*dir); err != nil {
+		fmt.Fprintln(os.Stderr, "installing the certificate authority:", err)
+		os.Exit(1)
+	}
+	fmt.Println("certificate authority", filepath.Join(*dir, certs.CAFile), "is trusted")
 }